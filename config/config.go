@@ -1,14 +1,21 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"stp/auth"
+	"stp/routing"
 )
 
 type Duration struct {
@@ -57,28 +64,215 @@ type TunnelConfig struct {
 	Routes       []string `json:"routes,omitempty"`       // Additional routes to add
 }
 
+const (
+	HandshakeLegacy  = "legacy"
+	HandshakeNoiseIK = "noise-ik"
+	HandshakeNoiseXX = "noise-xx"
+)
+
+const (
+	SecurityProfileLegacy   = "legacy"
+	SecurityProfileBalanced = "balanced"
+	SecurityProfileStrict   = "strict"
+	SecurityProfileParanoid = "paranoid"
+)
+
+const (
+	ObfuscationNone   = "none"
+	ObfuscationXOR    = "xor"
+	ObfuscationOBFS4  = "obfs4"
+	ObfuscationTLS    = "tls"
+	ObfuscationRandom = "random"
+)
+
+// Cipher suite names accepted in cipherSuites, matching crypto.CipherSuiteInfo.
+var knownCipherSuites = map[string]bool{
+	"chacha20-poly1305":  true,
+	"aes-256-gcm":        true,
+	"xchacha20-poly1305": true,
+}
+
 type Config struct {
-	Mode            string           `json:"mode"`
-	Listen          string           `json:"listen,omitempty"`
-	Endpoint        string           `json:"endpoint,omitempty"`
-	PSK             string           `json:"psk"`
-	Keepalive       Duration         `json:"keepalive"`
-	MaxPadding      uint8            `json:"maxPadding"`
-	Peers           []PeerConfig     `json:"peers"`
-	Management      ManagementConfig `json:"management"`
-	Logging         LoggingConfig    `json:"logging"`
-	RekeyInterval   Duration         `json:"rekeyInterval,omitempty"`
-	RekeyBudget     uint64           `json:"rekeyBudget,omitempty"`
-	MaxConnections  int              `json:"maxConnections,omitempty"`
-	ConnectionRate  int              `json:"connectionRate,omitempty"`
-	ConnectionBurst int              `json:"connectionBurst,omitempty"`
-	Tunnel          TunnelConfig     `json:"tunnel"`
+	Mode            string            `json:"mode"`
+	Listen          string            `json:"listen,omitempty"`
+	Endpoint        string            `json:"endpoint,omitempty"`
+	PSK             string            `json:"psk"`
+	PSKs            []PSKEntry        `json:"psks,omitempty"` // rotating keys, alternative to psk
+	Keepalive       Duration          `json:"keepalive"`
+	MaxPadding      uint8             `json:"maxPadding"`
+	Peers           []PeerConfig      `json:"peers"`
+	Management      ManagementConfig  `json:"management"`
+	Logging         LoggingConfig     `json:"logging"`
+	RekeyInterval   Duration          `json:"rekeyInterval,omitempty"`
+	RekeyBudget     uint64            `json:"rekeyBudget,omitempty"`  // data messages, both directions
+	RekeyBytes      uint64            `json:"rekeyBytes,omitempty"`   // payload bytes, both directions
+	ReplayWindow    uint64            `json:"replayWindow,omitempty"` // packets accepted out of order
+	MaxConnections  int               `json:"maxConnections,omitempty"`
+	ConnectionRate  int               `json:"connectionRate,omitempty"`
+	ConnectionBurst int               `json:"connectionBurst,omitempty"`
+	Tunnel          TunnelConfig      `json:"tunnel"`
+	Handshake       string            `json:"handshake,omitempty"`
+	PrivateKey      string            `json:"privateKey,omitempty"`     // base64 Curve25519 static key
+	PrivateKeyFile  string            `json:"privateKeyFile,omitempty"` // created on first start if missing
+	SecurityProfile string            `json:"securityProfile,omitempty"`
+	CipherSuites    []string          `json:"cipherSuites,omitempty"` // preference order, overrides the profile
+	Obfuscation     ObfuscationConfig `json:"obfuscation,omitempty"`
+	Listeners       []ListenerConfig  `json:"listeners,omitempty"` // extra server listeners
+	ZeroRTT         ZeroRTTConfig     `json:"zeroRTT,omitempty"`
+	WebSocket       WebSocketConfig   `json:"websocket,omitempty"`
+	PortHopping     PortHoppingConfig `json:"portHopping,omitempty"`
+	Fallback        FallbackConfig    `json:"fallback,omitempty"`
+	Reconnect       ReconnectConfig   `json:"reconnect,omitempty"`
+	Proxy           ProxyConfig       `json:"proxy,omitempty"`
+	Forwards        []ForwardConfig   `json:"forwards,omitempty"`      // client: published by the server
+	LocalForwards   []ForwardConfig   `json:"localForwards,omitempty"` // client: reached through the server
+	ForwardACL      []ACLRuleConfig   `json:"forwardAcl,omitempty"`    // server: who may publish and connect, default none
 }
 
 type PeerConfig struct {
 	Name       string   `json:"name"`
 	Endpoint   string   `json:"endpoint"`
 	AllowedIPs []string `json:"allowedIPs"`
+	PublicKey  string   `json:"publicKey,omitempty"` // base64 Curve25519 static key
+	PSK        string   `json:"psk,omitempty"`       // overrides the global psk for this peer
+}
+
+// PSKEntry is one generation of a rotating pre-shared key. Windows of
+// successive generations should overlap so clients can switch to the new key
+// while servers still accept the old one.
+type PSKEntry struct {
+	Key        string    `json:"key"`
+	Generation int       `json:"generation,omitempty"` // defaults to the 1-based list position
+	NotBefore  time.Time `json:"notBefore,omitempty"`
+	NotAfter   time.Time `json:"notAfter,omitempty"`
+}
+
+// ValidAt reports whether the key may be used at t. Zero bounds are open.
+func (e PSKEntry) ValidAt(t time.Time) bool {
+	if !e.NotBefore.IsZero() && t.Before(e.NotBefore) {
+		return false
+	}
+	if !e.NotAfter.IsZero() && !t.Before(e.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// ObfuscationConfig selects how transport frames are disguised on the wire.
+// Both ends of a session must use the same mode.
+type ObfuscationConfig struct {
+	Mode         string   `json:"mode,omitempty"`    // none, xor, obfs4, tls, random
+	IATMode      int      `json:"iatMode,omitempty"` // 0=off, 1=enabled, 2=paranoid
+	IATMeanDelay Duration `json:"iatMeanDelay,omitempty"`
+	MinPadding   uint16   `json:"minPadding,omitempty"`
+	MaxPadding   uint16   `json:"maxPadding,omitempty"`
+}
+
+// ListenerConfig declares an additional server listener. Obfuscation
+// overrides the global section for sessions accepted on this listener.
+type ListenerConfig struct {
+	Listen      string             `json:"listen"`
+	Obfuscation *ObfuscationConfig `json:"obfuscation,omitempty"`
+}
+
+// ZeroRTTConfig enables session resumption. The server hands out tickets
+// after each handshake; the client presents one on its next connection and
+// may send data before the server has answered. TicketFile is only read by
+// clients and keeps tickets across restarts; without it they live in memory.
+type ZeroRTTConfig struct {
+	Enabled        bool     `json:"enabled,omitempty"`
+	TicketFile     string   `json:"ticketFile,omitempty"`
+	TicketLifetime Duration `json:"ticketLifetime,omitempty"` // server only, default 24h
+}
+
+// WebSocketConfig applies to ws:// and wss:// endpoints and listeners. A path
+// in the endpoint URL takes precedence over Path. Host is sent as the Host
+// header and TLS server name, so a client can dial a CDN edge while naming
+// the origin's domain.
+type WebSocketConfig struct {
+	Path               string `json:"path,omitempty"` // default "/"
+	Host               string `json:"host,omitempty"`
+	TLSCert            string `json:"tlsCert,omitempty"`            // server: PEM certificate for wss
+	TLSKey             string `json:"tlsKey,omitempty"`             // server: PEM private key for wss
+	TLSCA              string `json:"tlsCA,omitempty"`              // client: PEM roots instead of the system pool
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"` // client: testing only
+}
+
+// PortHoppingConfig moves the server port through [portMin, portMax] on a
+// schedule both sides derive from Secret, or from the global psk when Secret
+// is empty. The port of the endpoint and of the primary listen address is
+// ignored; extra listeners keep their fixed ports. Clocks may disagree by up
+// to one interval.
+type PortHoppingConfig struct {
+	Enabled  bool     `json:"enabled,omitempty"`
+	PortMin  int      `json:"portMin,omitempty"`  // default 10000
+	PortMax  int      `json:"portMax,omitempty"`  // default 60000
+	Interval Duration `json:"interval,omitempty"` // default 60s
+	Secret   string   `json:"secret,omitempty"`
+}
+
+// FallbackConfig fronts tcp server listeners with a decoy site. Connections
+// that do not open with a handshake record, or whose handshake fails before
+// the server has answered, are relayed byte for byte to Address, so probes
+// and browsers get the decoy's real HTTP or HTTPS responses. A port hopping
+// primary listener is not fronted.
+type FallbackConfig struct {
+	Enabled          bool     `json:"enabled,omitempty"`
+	Address          string   `json:"address,omitempty"`          // decoy host:port
+	DetectionTimeout Duration `json:"detectionTimeout,omitempty"` // default 1s
+}
+
+// ReconnectConfig controls how a client recovers a lost session. The server
+// is declared dead once nothing arrived from it for DeadPeerTimeout, or when
+// a handshake is not answered within HandshakeTimeout on every try. The
+// client then redials with a delay doubling from InitialDelay up to
+// MaxDelay, while the tunnel interface stays up.
+type ReconnectConfig struct {
+	Disabled         bool     `json:"disabled,omitempty"`         // exit when the session ends
+	InitialDelay     Duration `json:"initialDelay,omitempty"`     // default 1s
+	MaxDelay         Duration `json:"maxDelay,omitempty"`         // default 60s
+	DeadPeerTimeout  Duration `json:"deadPeerTimeout,omitempty"`  // default 4 keepalive intervals
+	HandshakeTimeout Duration `json:"handshakeTimeout,omitempty"` // per try, default 5s
+}
+
+// ProxyConfig runs a local SOCKS5 and HTTP CONNECT proxy on a client. Every
+// request is matched against Routing and then relayed through the server,
+// dialed directly or refused. The server only dials destinations for its
+// clients when Outbound is set, and never loopback, private, link-local or
+// unspecified addresses outside OutboundAllow.
+//
+// Each relayed request gets a session of its own unless Mux is set: then
+// requests become streams of the client's tunnel session.
+type ProxyConfig struct {
+	Listen   string                `json:"listen,omitempty"`   // client: host:port for SOCKS5 and HTTP CONNECT
+	Routing  routing.RoutingConfig `json:"routing,omitempty"`  // client: default action proxy
+	Mux      bool                  `json:"mux,omitempty"`      // client: relay requests as streams of the tunnel session
+	Outbound bool                  `json:"outbound,omitempty"` // server: dial destinations of proxied requests
+	// server: internal CIDRs outbound may still dial, default none
+	OutboundAllow []string `json:"outboundAllow,omitempty"`
+}
+
+// ForwardConfig relays the connections accepted on Listen over the tunnel
+// to Target. In forwards, a service the client reaches is published by the
+// server (reverse forwarding): the server listens and the client dials. In
+// localForwards, a service the server reaches is exposed on the client
+// (ssh -L style): the client listens and the server dials, which requires
+// proxy outbound on the server.
+type ForwardConfig struct {
+	Name   string `json:"name"`
+	Listen string `json:"listen"` // host:port
+	Target string `json:"target"` // host:port
+}
+
+// ACLRuleConfig is one auth.ACLManager rule. In forwardAcl, read lets
+// addresses in CIDR connect to published ports and write lets clients
+// connecting from CIDR publish them. A rule with Roles only lets the named
+// peers publish.
+type ACLRuleConfig struct {
+	Name       string   `json:"name"`
+	CIDR       string   `json:"cidr"`
+	Permission string   `json:"permission"`      // none, read, write or admin
+	Roles      []string `json:"roles,omitempty"` // peer names
 }
 
 type ManagementConfig struct {
@@ -126,14 +320,36 @@ func (c *Config) validate() error {
 		return fmt.Errorf("unsupported mode %q", c.Mode)
 	}
 
-	if len(c.PSK) == 0 {
+	if len(c.PSK) > 0 && len(c.PSKs) > 0 {
+		return errors.New("psk and psks are mutually exclusive")
+	}
+	if !c.hasGlobalPSK() && !c.hasPeerPSKs() {
 		return errors.New("psk must be provided")
 	}
-	if len(c.PSK) < 16 {
-		return errors.New("psk must be at least 16 characters for security")
+	if len(c.PSK) > 0 {
+		if err := validatePSK(c.PSK); err != nil {
+			return err
+		}
 	}
-	if c.PSK == "0123456789abcdef0123456789abcdef" {
-		return errors.New("default PSK detected - please use a secure random PSK")
+	generations := make(map[int]bool, len(c.PSKs))
+	for i := range c.PSKs {
+		entry := &c.PSKs[i]
+		if entry.Generation == 0 {
+			entry.Generation = i + 1
+		}
+		if entry.Generation < 0 {
+			return fmt.Errorf("psks[%d]: generation must be positive", i)
+		}
+		if generations[entry.Generation] {
+			return fmt.Errorf("psks[%d]: duplicate generation %d", i, entry.Generation)
+		}
+		generations[entry.Generation] = true
+		if err := validatePSK(entry.Key); err != nil {
+			return fmt.Errorf("psks[%d]: %w", i, err)
+		}
+		if !entry.NotBefore.IsZero() && !entry.NotAfter.IsZero() && !entry.NotAfter.After(entry.NotBefore) {
+			return fmt.Errorf("psks[%d]: notAfter must be after notBefore", i)
+		}
 	}
 
 	if c.Mode == "client" {
@@ -160,6 +376,46 @@ func (c *Config) validate() error {
 		if c.ConnectionBurst <= 0 {
 			c.ConnectionBurst = 10
 		}
+		for i := range c.Listeners {
+			listener := &c.Listeners[i]
+			if err := validateEndpoint(listener.Listen); err != nil {
+				return fmt.Errorf("invalid listeners[%d] address: %w", i, err)
+			}
+			if listener.Obfuscation != nil {
+				if err := listener.Obfuscation.validate(); err != nil {
+					return fmt.Errorf("listeners[%d]: %w", i, err)
+				}
+			}
+		}
+	} else if len(c.Listeners) > 0 {
+		return errors.New("listeners are only supported in server mode")
+	}
+	if err := c.Obfuscation.validate(); err != nil {
+		return err
+	}
+	if err := c.validateWebSocket(); err != nil {
+		return err
+	}
+	if err := c.validatePortHopping(); err != nil {
+		return err
+	}
+	if err := c.validateFallback(); err != nil {
+		return err
+	}
+	if err := c.validateProxy(); err != nil {
+		return err
+	}
+	if err := c.validateForwards(); err != nil {
+		return err
+	}
+	if err := c.validateReconnect(); err != nil {
+		return err
+	}
+	if c.ZeroRTT.TicketLifetime.Duration < 0 {
+		return errors.New("zeroRTT ticketLifetime cannot be negative")
+	}
+	if c.ZeroRTT.TicketLifetime.Duration > 7*24*time.Hour {
+		return errors.New("zeroRTT ticketLifetime cannot exceed 7 days")
 	}
 
 	if len(c.Peers) == 0 {
@@ -189,6 +445,62 @@ func (c *Config) validate() error {
 				return fmt.Errorf("peer %q has invalid allowed IP %q: %w", name, cidr, err)
 			}
 		}
+
+		if peer.PublicKey != "" {
+			if _, err := DecodeKey(peer.PublicKey); err != nil {
+				return fmt.Errorf("peer %q has invalid public key: %w", name, err)
+			}
+		}
+
+		if peer.PSK != "" {
+			if err := validatePSK(peer.PSK); err != nil {
+				return fmt.Errorf("peer %q: %w", name, err)
+			}
+		} else if !c.hasGlobalPSK() && c.Mode == "server" {
+			return fmt.Errorf("peer %q requires a psk when no global psk is set", name)
+		}
+	}
+
+	c.Handshake = c.EffectiveHandshake()
+	switch c.Handshake {
+	case HandshakeLegacy, HandshakeNoiseIK, HandshakeNoiseXX:
+	default:
+		return fmt.Errorf("unsupported handshake %q", c.Handshake)
+	}
+	if c.Mode == "client" && c.Handshake == HandshakeNoiseIK && c.ServerPublicKey() == nil {
+		return errors.New("noise-ik handshake requires a peer with publicKey set to the server's static key")
+	}
+	if c.Handshake == HandshakeLegacy && c.hasPinnedKeys() {
+		return errors.New("peer public keys require a noise handshake")
+	}
+
+	c.SecurityProfile = strings.ToLower(strings.TrimSpace(c.SecurityProfile))
+	if c.SecurityProfile == "" {
+		c.SecurityProfile = SecurityProfileLegacy
+	}
+	switch c.SecurityProfile {
+	case SecurityProfileLegacy:
+	case SecurityProfileBalanced, SecurityProfileStrict, SecurityProfileParanoid:
+		if c.Handshake == HandshakeLegacy {
+			return fmt.Errorf("securityProfile %q requires a noise handshake", c.SecurityProfile)
+		}
+	default:
+		return fmt.Errorf("unsupported securityProfile %q", c.SecurityProfile)
+	}
+	for i, suite := range c.CipherSuites {
+		c.CipherSuites[i] = strings.ToLower(strings.TrimSpace(suite))
+		if !knownCipherSuites[c.CipherSuites[i]] {
+			return fmt.Errorf("unsupported cipher suite %q", suite)
+		}
+	}
+
+	if c.PrivateKey != "" && c.PrivateKeyFile != "" {
+		return errors.New("privateKey and privateKeyFile are mutually exclusive")
+	}
+	if c.PrivateKey != "" {
+		if _, err := DecodeKey(c.PrivateKey); err != nil {
+			return fmt.Errorf("invalid private key: %w", err)
+		}
 	}
 
 	if c.Keepalive.Duration < 0 {
@@ -207,6 +519,12 @@ func (c *Config) validate() error {
 	if c.RekeyBudget > 0 && c.RekeyBudget < 1000 {
 		return errors.New("rekey budget must be at least 1000 messages if specified")
 	}
+	if c.RekeyBytes > 0 && c.RekeyBytes < 1<<20 {
+		return errors.New("rekey bytes must be at least 1 MiB if specified")
+	}
+	if c.ReplayWindow > 0 && (c.ReplayWindow < 32 || c.ReplayWindow > 65536) {
+		return errors.New("replay window must be between 32 and 65536 packets if specified")
+	}
 
 	if c.Management.Bind == "" {
 		c.Management.Bind = "127.0.0.1:7777"
@@ -266,6 +584,255 @@ func (c *Config) validate() error {
 	return nil
 }
 
+func (o *ObfuscationConfig) validate() error {
+	o.Mode = strings.ToLower(strings.TrimSpace(o.Mode))
+	if o.Mode == "" {
+		o.Mode = ObfuscationNone
+	}
+	switch o.Mode {
+	case ObfuscationNone, ObfuscationXOR, ObfuscationOBFS4, ObfuscationTLS, ObfuscationRandom:
+	default:
+		return fmt.Errorf("unsupported obfuscation mode %q", o.Mode)
+	}
+	if o.IATMode < 0 || o.IATMode > 2 {
+		return fmt.Errorf("obfuscation iatMode %d out of range (0-2)", o.IATMode)
+	}
+	if o.IATMeanDelay.Duration < 0 {
+		return errors.New("obfuscation iatMeanDelay cannot be negative")
+	}
+	if o.MinPadding > o.MaxPadding {
+		return errors.New("obfuscation minPadding cannot exceed maxPadding")
+	}
+	return nil
+}
+
+func (c *Config) validateWebSocket() error {
+	ws := c.WebSocket
+	if ws.Path != "" && !strings.HasPrefix(ws.Path, "/") {
+		return fmt.Errorf("websocket path %q must start with /", ws.Path)
+	}
+	if (ws.TLSCert == "") != (ws.TLSKey == "") {
+		return errors.New("websocket tlsCert and tlsKey must be set together")
+	}
+	if c.Mode != "server" {
+		return nil
+	}
+	for _, listener := range c.ServerListeners() {
+		if strings.HasPrefix(listener.Listen, "wss://") && ws.TLSCert == "" {
+			return fmt.Errorf("wss listener %s requires websocket tlsCert and tlsKey", listener.Listen)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validatePortHopping() error {
+	hop := c.PortHopping
+	if !hop.Enabled {
+		return nil
+	}
+	portMin, portMax := c.EffectivePortRange()
+	if portMin < 1 || portMax > 65535 || portMin > portMax {
+		return fmt.Errorf("portHopping range %d-%d is invalid", portMin, portMax)
+	}
+	if hop.Interval.Duration < 0 || (hop.Interval.Duration > 0 && hop.Interval.Duration < time.Second) {
+		return errors.New("portHopping interval must be at least 1s")
+	}
+	if hop.Secret == "" && c.EffectivePSK() == "" {
+		return errors.New("portHopping secret is required without a global psk")
+	}
+	address := c.Endpoint
+	if c.Mode == "server" {
+		address = c.Listen
+	}
+	if strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://") {
+		return errors.New("portHopping requires a udp or tcp address")
+	}
+	return nil
+}
+
+func (c *Config) validateFallback() error {
+	fallback := c.Fallback
+	if !fallback.Enabled {
+		return nil
+	}
+	if c.Mode != "server" {
+		return errors.New("fallback is only supported in server mode")
+	}
+	if _, port, err := splitHostPort(fallback.Address); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("fallback address %q must be host:port", fallback.Address)
+	}
+	if fallback.DetectionTimeout.Duration < 0 {
+		return errors.New("fallback detectionTimeout cannot be negative")
+	}
+	for _, listener := range c.ServerListeners() {
+		if c.FallbackFronts(listener.Listen) {
+			return nil
+		}
+	}
+	return errors.New("fallback requires a tcp listener")
+}
+
+func (c *Config) validateReconnect() error {
+	reconnect := c.Reconnect
+	if reconnect.InitialDelay.Duration < 0 || reconnect.MaxDelay.Duration < 0 ||
+		reconnect.DeadPeerTimeout.Duration < 0 || reconnect.HandshakeTimeout.Duration < 0 {
+		return errors.New("reconnect durations cannot be negative")
+	}
+	if c.EffectiveReconnectMaxDelay() < c.EffectiveReconnectDelay() {
+		return errors.New("reconnect maxDelay cannot be less than initialDelay")
+	}
+	if c.EffectiveDeadPeerTimeout() <= c.EffectiveKeepalive() {
+		return errors.New("reconnect deadPeerTimeout must exceed the keepalive interval")
+	}
+	return nil
+}
+
+func (c *Config) validateProxy() error {
+	proxy := c.Proxy
+	if proxy.Outbound && c.Mode != "server" {
+		return errors.New("proxy outbound is only supported in server mode")
+	}
+	for _, cidr := range proxy.OutboundAllow {
+		if !proxy.Outbound {
+			return errors.New("proxy outboundAllow requires proxy outbound")
+		}
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid proxy outboundAllow %q: %w", cidr, err)
+		}
+	}
+	if proxy.Listen == "" {
+		if proxy.Mux {
+			return errors.New("proxy mux requires proxy listen")
+		}
+		return nil
+	}
+	if c.Mode != "client" {
+		return errors.New("proxy listen is only supported in client mode")
+	}
+	if !c.streamEndpoint() {
+		return errors.New("proxy requires a tcp, ws or wss endpoint")
+	}
+	if _, port, err := splitHostPort(proxy.Listen); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("proxy listen %q must be host:port", proxy.Listen)
+	}
+	validAction := func(action routing.Action) bool {
+		switch action {
+		case routing.ActionProxy, routing.ActionDirect, routing.ActionBlock:
+			return true
+		}
+		return false
+	}
+	if proxy.Routing.DefaultAction != "" && !validAction(proxy.Routing.DefaultAction) {
+		return fmt.Errorf("unsupported proxy default action %q", proxy.Routing.DefaultAction)
+	}
+	for i, rule := range proxy.Routing.Rules {
+		if rule.Type == "" || rule.Pattern == "" {
+			return fmt.Errorf("proxy rule %d requires a type and a pattern", i)
+		}
+		if !validAction(rule.Action) {
+			return fmt.Errorf("proxy rule %d: unsupported action %q", i, rule.Action)
+		}
+	}
+	return nil
+}
+
+// streamEndpoint reports whether the endpoint delivers every byte, as
+// relayed connections need.
+func (c *Config) streamEndpoint() bool {
+	scheme, _, ok := strings.Cut(c.Endpoint, "://")
+	return ok && !strings.HasPrefix(scheme, "udp")
+}
+
+func (c *Config) validateForwards() error {
+	lists := []struct {
+		field    string
+		forwards []ForwardConfig
+	}{{"forwards", c.Forwards}, {"localForwards", c.LocalForwards}}
+	for _, list := range lists {
+		field, forwards := list.field, list.forwards
+		if len(forwards) == 0 {
+			continue
+		}
+		if c.Mode != "client" {
+			return fmt.Errorf("%s are only supported in client mode", field)
+		}
+		if !c.streamEndpoint() {
+			return fmt.Errorf("%s require a tcp, ws or wss endpoint", field)
+		}
+		names := make(map[string]bool, len(forwards))
+		for i, fwd := range forwards {
+			if fwd.Name == "" || strings.ContainsAny(fwd.Name, " \t") {
+				return fmt.Errorf("%s[%d] requires a name without spaces", field, i)
+			}
+			if names[fwd.Name] {
+				return fmt.Errorf("duplicate %s name %q", field, fwd.Name)
+			}
+			names[fwd.Name] = true
+			if _, port, err := splitHostPort(fwd.Listen); err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("forward %q listen %q must be host:port", fwd.Name, fwd.Listen)
+			}
+			if host, port, err := splitHostPort(fwd.Target); err != nil || host == "" || port < 1 || port > 65535 {
+				return fmt.Errorf("forward %q target %q must be host:port", fwd.Name, fwd.Target)
+			}
+		}
+	}
+
+	if len(c.ForwardACL) > 0 && c.Mode != "server" {
+		return errors.New("forwardAcl is only supported in server mode")
+	}
+	for i, rule := range c.ForwardACL {
+		if _, err := netip.ParsePrefix(rule.CIDR); err != nil {
+			return fmt.Errorf("forwardAcl[%d]: invalid cidr %q", i, rule.CIDR)
+		}
+		if _, err := auth.ParsePermission(rule.Permission); err != nil {
+			return fmt.Errorf("forwardAcl[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// FallbackFronts reports whether the decoy site fronts the listener.
+func (c *Config) FallbackFronts(listen string) bool {
+	if !c.Fallback.Enabled {
+		return false
+	}
+	if c.PortHopping.Enabled && listen == c.Listen {
+		return false
+	}
+	return strings.HasPrefix(listen, "tcp://") || strings.HasPrefix(listen, "tcp4://") || strings.HasPrefix(listen, "tcp6://")
+}
+
+// Enabled reports whether frames are obfuscated.
+func (o ObfuscationConfig) Enabled() bool {
+	return o.Mode != "" && o.Mode != ObfuscationNone
+}
+
+// EffectiveIATMeanDelay returns the mean inter-frame delay used when iatMode
+// is enabled.
+func (o ObfuscationConfig) EffectiveIATMeanDelay() time.Duration {
+	if o.IATMeanDelay.Duration > 0 {
+		return o.IATMeanDelay.Duration
+	}
+	return 10 * time.Millisecond
+}
+
+// ServerListeners returns every listener the server accepts sessions on: the
+// primary listen address followed by the extra listeners, each with its
+// effective obfuscation settings.
+func (c *Config) ServerListeners() []ListenerConfig {
+	listeners := make([]ListenerConfig, 0, 1+len(c.Listeners))
+	global := c.Obfuscation
+	listeners = append(listeners, ListenerConfig{Listen: c.Listen, Obfuscation: &global})
+	for _, listener := range c.Listeners {
+		obfs := c.Obfuscation
+		if listener.Obfuscation != nil {
+			obfs = *listener.Obfuscation
+		}
+		listeners = append(listeners, ListenerConfig{Listen: listener.Listen, Obfuscation: &obfs})
+	}
+	return listeners
+}
+
 func (c *Config) EffectiveKeepalive() time.Duration {
 	if c.Keepalive.Duration <= 0 {
 		return 15 * time.Second
@@ -298,6 +865,95 @@ func (c *Config) EffectiveRekeyBudget() uint64 {
 	return c.RekeyBudget
 }
 
+func (c *Config) EffectiveRekeyBytes() uint64 {
+	if c.RekeyBytes == 0 {
+		return 1 << 30
+	}
+	return c.RekeyBytes
+}
+
+func (c *Config) EffectiveReplayWindow() uint64 {
+	if c.ReplayWindow == 0 {
+		return 1024
+	}
+	return c.ReplayWindow
+}
+
+func (c *Config) EffectiveTicketLifetime() time.Duration {
+	if c.ZeroRTT.TicketLifetime.Duration <= 0 {
+		return 24 * time.Hour
+	}
+	return c.ZeroRTT.TicketLifetime.Duration
+}
+
+// EffectivePortRange returns the ports the server hops between.
+func (c *Config) EffectivePortRange() (int, int) {
+	portMin, portMax := c.PortHopping.PortMin, c.PortHopping.PortMax
+	if portMin == 0 {
+		portMin = 10000
+	}
+	if portMax == 0 {
+		portMax = 60000
+	}
+	return portMin, portMax
+}
+
+func (c *Config) EffectiveHopInterval() time.Duration {
+	if c.PortHopping.Interval.Duration <= 0 {
+		return 60 * time.Second
+	}
+	return c.PortHopping.Interval.Duration
+}
+
+// PortHoppingSecret returns the key the port schedule is derived from. The
+// psk itself never doubles as the schedule key.
+func (c *Config) PortHoppingSecret() []byte {
+	secret := c.PortHopping.Secret
+	if secret == "" {
+		secret = c.EffectivePSK()
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("stp port hopping"))
+	return mac.Sum(nil)
+}
+
+func (c *Config) EffectiveFallbackDetectionTimeout() time.Duration {
+	if c.Fallback.DetectionTimeout.Duration <= 0 {
+		return time.Second
+	}
+	return c.Fallback.DetectionTimeout.Duration
+}
+
+func (c *Config) EffectiveReconnectDelay() time.Duration {
+	if c.Reconnect.InitialDelay.Duration <= 0 {
+		return time.Second
+	}
+	return c.Reconnect.InitialDelay.Duration
+}
+
+func (c *Config) EffectiveReconnectMaxDelay() time.Duration {
+	if c.Reconnect.MaxDelay.Duration <= 0 {
+		return 60 * time.Second
+	}
+	return c.Reconnect.MaxDelay.Duration
+}
+
+// EffectiveDeadPeerTimeout allows several keepalives from the server to go
+// missing before the session is given up.
+func (c *Config) EffectiveDeadPeerTimeout() time.Duration {
+	if c.Reconnect.DeadPeerTimeout.Duration <= 0 {
+		return 4 * c.EffectiveKeepalive()
+	}
+	return c.Reconnect.DeadPeerTimeout.Duration
+}
+
+func (c *Config) EffectiveHandshakeTimeout() time.Duration {
+	if c.Reconnect.HandshakeTimeout.Duration <= 0 {
+		return 5 * time.Second
+	}
+	return c.Reconnect.HandshakeTimeout.Duration
+}
+
 func (c *Config) EffectiveMaxConnections() int {
 	if c.MaxConnections <= 0 {
 		return 1000
@@ -319,6 +975,155 @@ func (c *Config) EffectiveConnectionBurst() int {
 	return c.ConnectionBurst
 }
 
+// EffectiveHandshake returns the normalised handshake mode, legacy when none
+// is set. validate stores it back, so it is the one place the default lives.
+func (c *Config) EffectiveHandshake() string {
+	mode := strings.ToLower(strings.TrimSpace(c.Handshake))
+	if mode == "" {
+		return HandshakeLegacy
+	}
+	return mode
+}
+
+// EffectiveSecurityProfile returns the configured security profile name.
+func (c *Config) EffectiveSecurityProfile() string {
+	if c.SecurityProfile == "" {
+		return SecurityProfileLegacy
+	}
+	return c.SecurityProfile
+}
+
+// ServerPublicKey returns the first pinned peer static key, which a client
+// uses as the responder key for the IK pattern.
+func (c *Config) ServerPublicKey() []byte {
+	for _, peer := range c.Peers {
+		if peer.PublicKey == "" {
+			continue
+		}
+		if key, err := DecodeKey(peer.PublicKey); err == nil {
+			return key
+		}
+	}
+	return nil
+}
+
+func (c *Config) hasPeerPSKs() bool {
+	for _, peer := range c.Peers {
+		if peer.PSK != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) hasGlobalPSK() bool {
+	return c.EffectivePSK() != "" || len(c.PSKs) > 0
+}
+
+// EffectivePSK returns the global psk, which the STP_PSK environment
+// variable overrides.
+func (c *Config) EffectivePSK() string {
+	if value := os.Getenv("STP_PSK"); value != "" {
+		return value
+	}
+	return c.PSK
+}
+
+// ClientPSK returns the pre-shared key a client presents to its server at
+// now: the first peer-specific key, otherwise the newest generation of psks
+// that is currently valid, otherwise the global psk.
+func (c *Config) ClientPSK(now time.Time) (PSKEntry, error) {
+	for _, peer := range c.Peers {
+		if peer.PSK != "" {
+			return PSKEntry{Key: peer.PSK}, nil
+		}
+	}
+	if len(c.PSKs) == 0 {
+		return PSKEntry{Key: c.PSK}, nil
+	}
+
+	var newest *PSKEntry
+	for i := range c.PSKs {
+		entry := &c.PSKs[i]
+		if !entry.ValidAt(now) {
+			continue
+		}
+		if newest == nil || entry.NotBefore.After(newest.NotBefore) ||
+			(entry.NotBefore.Equal(newest.NotBefore) && entry.Generation > newest.Generation) {
+			newest = entry
+		}
+	}
+	if newest == nil {
+		return PSKEntry{}, fmt.Errorf("no pre-shared key is valid at %s", now.UTC().Format(time.RFC3339))
+	}
+	return *newest, nil
+}
+
+func (c *Config) hasPinnedKeys() bool {
+	for _, peer := range c.Peers {
+		if peer.PublicKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// StaticPrivateKey returns the configured static identity key. When
+// privateKeyFile names a file that does not exist yet, a new key is generated
+// with generate and persisted there so the identity survives restarts. A nil
+// key without error means no identity is configured.
+func (c *Config) StaticPrivateKey(generate func() ([]byte, error)) ([]byte, error) {
+	if c.PrivateKey != "" {
+		return DecodeKey(c.PrivateKey)
+	}
+	path := strings.TrimSpace(c.PrivateKeyFile)
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := DecodeKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("private key file %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) || generate == nil {
+		return nil, err
+	}
+	key, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(path, key); err != nil {
+		return nil, fmt.Errorf("persist private key: %w", err)
+	}
+	return key, nil
+}
+
+// writeKeyFile replaces path with the encoded key in one rename, so a
+// reader never sees a partly written key. The temporary file is created
+// exclusively with mode 0600.
+func writeKeyFile(path string, key []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 func (c *Config) EffectiveTunnelType() string {
 	if c.Tunnel.Type == "" {
 		return "loopback"
@@ -354,6 +1159,28 @@ func (c *Config) ManagementPrefixes() []netip.Prefix {
 	return out
 }
 
+func validatePSK(psk string) error {
+	if len(psk) < 16 {
+		return errors.New("psk must be at least 16 characters for security")
+	}
+	if psk == "0123456789abcdef0123456789abcdef" {
+		return errors.New("default PSK detected - please use a secure random PSK")
+	}
+	return nil
+}
+
+// DecodeKey parses a base64 encoded 32-byte Curve25519 key.
+func DecodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
 func validateEndpoint(endpoint string) error {
 	addr := endpoint
 	if strings.Contains(endpoint, "://") {
@@ -368,6 +1195,12 @@ func validateEndpoint(endpoint string) error {
 		if !validProtocols[protocol] {
 			return fmt.Errorf("unsupported protocol %q", protocol)
 		}
+		// A WebSocket endpoint may carry the request path
+		if protocol == "ws" || protocol == "wss" {
+			if i := strings.Index(addr, "/"); i >= 0 {
+				addr = addr[:i]
+			}
+		}
 	}
 
 	host, port, err := splitHostPort(addr)
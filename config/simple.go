@@ -184,6 +184,10 @@ func (sc *SimpleConfig) ToFullConfig() (*Config, error) {
 	} else {
 		config.Tunnel.MTU = 1420
 	}
+	if sc.Advanced != nil {
+		config.ZeroRTT.Enabled = sc.Advanced.ZeroRTT
+		config.PortHopping.Enabled = sc.Advanced.PortHopping
+	}
 
 	return config, nil
 }
@@ -30,7 +30,9 @@ type AntiReplayConfig struct {
 	// Window size for sliding window mode (default: 64)
 	WindowSize uint64
 
-	// Maximum age for replay detection (default: 60s)
+	// Maximum age for replay detection (default: 60s). In window mode a
+	// negative value disables per-sequence timestamps and relies on the
+	// window alone, which keeps memory bounded on busy sessions.
 	MaxAge time.Duration
 
 	// Bloom filter size (for AntiReplayBloom mode)
@@ -58,7 +60,7 @@ type AntiReplay struct {
 
 	// For window mode
 	windowBase uint64
-	windowBits uint64 // Bitmap for window
+	windowBits []uint64 // Bitmap for window, bit i marks windowBase-i
 
 	// For bloom filter mode
 	bloom *bloomFilter
@@ -66,6 +68,10 @@ type AntiReplay struct {
 	// Timestamp tracking
 	timestamps map[uint64]time.Time
 	lastCleanup time.Time
+
+	// Counters
+	accepted uint64
+	rejected uint64
 }
 
 // NewAntiReplay creates a new anti-replay filter
@@ -95,7 +101,10 @@ func NewAntiReplay(config AntiReplayConfig) *AntiReplay {
 		ar.bloom = newBloomFilter(size, hashCount)
 
 	case AntiReplayWindow:
-		ar.timestamps = make(map[uint64]time.Time)
+		ar.windowBits = make([]uint64, (ar.config.WindowSize+63)/64)
+		if ar.config.MaxAge > 0 {
+			ar.timestamps = make(map[uint64]time.Time)
+		}
 	}
 
 	return ar
@@ -118,19 +127,21 @@ func (ar *AntiReplay) Check(seq uint64) error {
 		ar.lastCleanup = now
 	}
 
+	var err error
 	switch ar.mode {
 	case AntiReplaySimple:
-		return ar.checkSimple(seq)
+		err = ar.checkSimple(seq)
 
 	case AntiReplayWindow:
-		return ar.checkWindow(seq, now)
+		err = ar.checkWindow(seq, now)
 
 	case AntiReplayBloom:
-		return ar.checkBloom(seq)
-
-	default:
-		return nil
+		err = ar.checkBloom(seq)
 	}
+	if err != nil {
+		ar.rejected++
+	}
+	return err
 }
 
 // Accept marks a sequence number as seen
@@ -142,6 +153,7 @@ func (ar *AntiReplay) Accept(seq uint64) {
 	ar.mu.Lock()
 	defer ar.mu.Unlock()
 
+	ar.accepted++
 	switch ar.mode {
 	case AntiReplaySimple:
 		if seq > ar.lastSeq {
@@ -175,7 +187,7 @@ func (ar *AntiReplay) checkWindow(seq uint64, now time.Time) error {
 	}
 
 	// Too old - outside window
-	if seq+ar.config.WindowSize < ar.windowBase {
+	if seq+ar.config.WindowSize <= ar.windowBase {
 		return errors.New("replay detected: sequence number too old")
 	}
 
@@ -186,11 +198,8 @@ func (ar *AntiReplay) checkWindow(seq uint64, now time.Time) error {
 
 	// Within window - check bitmap
 	diff := ar.windowBase - seq
-	if diff < ar.config.WindowSize {
-		bit := uint64(1) << diff
-		if (ar.windowBits & bit) != 0 {
-			return errors.New("replay detected: duplicate in window")
-		}
+	if ar.windowBits[diff/64]&(uint64(1)<<(diff%64)) != 0 {
+		return errors.New("replay detected: duplicate in window")
 	}
 
 	return nil
@@ -205,19 +214,39 @@ func (ar *AntiReplay) acceptWindow(seq uint64) {
 	// Sequence number is newer than window base
 	if seq > ar.windowBase {
 		// Shift window forward
-		diff := seq - ar.windowBase
-		if diff < ar.config.WindowSize {
-			ar.windowBits = ar.windowBits << diff
-		} else {
-			ar.windowBits = 0
-		}
+		ar.shiftWindow(seq - ar.windowBase)
 		ar.windowBase = seq
-		ar.windowBits |= 1 // Mark current seq as seen
+		ar.windowBits[0] |= 1 // Mark current seq as seen
 	} else {
 		// Set bit in window
 		diff := ar.windowBase - seq
 		if diff < ar.config.WindowSize {
-			ar.windowBits |= (uint64(1) << diff)
+			ar.windowBits[diff/64] |= uint64(1) << (diff % 64)
+		}
+	}
+}
+
+// shiftWindow moves every bit of the window bitmap n positions older
+func (ar *AntiReplay) shiftWindow(n uint64) {
+	words := uint64(len(ar.windowBits))
+	if n >= words*64 {
+		for i := range ar.windowBits {
+			ar.windowBits[i] = 0
+		}
+		return
+	}
+	wordShift, bitShift := n/64, n%64
+	for i := words - 1; ; i-- {
+		var word uint64
+		if i >= wordShift {
+			word = ar.windowBits[i-wordShift] << bitShift
+			if bitShift > 0 && i > wordShift {
+				word |= ar.windowBits[i-wordShift-1] >> (64 - bitShift)
+			}
+		}
+		ar.windowBits[i] = word
+		if i == 0 {
+			break
 		}
 	}
 }
@@ -249,7 +278,9 @@ func (ar *AntiReplay) Reset() {
 
 	ar.lastSeq = 0
 	ar.windowBase = 0
-	ar.windowBits = 0
+	for i := range ar.windowBits {
+		ar.windowBits[i] = 0
+	}
 
 	if ar.bloom != nil {
 		ar.bloom.reset()
@@ -268,6 +299,9 @@ func (ar *AntiReplay) Stats() AntiReplayStats {
 	stats := AntiReplayStats{
 		Mode:       ar.mode,
 		WindowBase: ar.windowBase,
+		WindowSize: ar.config.WindowSize,
+		Accepted:   ar.accepted,
+		Rejected:   ar.rejected,
 	}
 
 	if ar.bloom != nil {
@@ -281,6 +315,9 @@ func (ar *AntiReplay) Stats() AntiReplayStats {
 type AntiReplayStats struct {
 	Mode          AntiReplayMode
 	WindowBase    uint64
+	WindowSize    uint64
+	Accepted      uint64
+	Rejected      uint64
 	BloomFillRate float64
 }
 
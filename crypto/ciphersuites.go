@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"errors"
 	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -69,6 +70,16 @@ func GetCipherSuiteInfo(suite CipherSuite) (CipherSuiteInfo, error) {
 	return info, nil
 }
 
+// ParseCipherSuite looks up a cipher suite by its name, ignoring case
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	for id, info := range supportedCipherSuites {
+		if strings.EqualFold(info.Name, strings.TrimSpace(name)) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
 // ListSupportedCipherSuites returns all supported cipher suites
 func ListSupportedCipherSuites() []CipherSuiteInfo {
 	suites := make([]CipherSuiteInfo, 0, len(supportedCipherSuites))
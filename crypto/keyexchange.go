@@ -20,9 +20,34 @@ type HandshakeRole int
 
 type HandshakeOptions struct {
 	PreSharedKey []byte
-	KeepAlive    time.Duration
-	MaxPadding   uint8
-	CookieTTL    time.Duration
+	// PSKCandidates lets a responder accept several pre-shared keys; the
+	// one that authenticates the initiator is reported in the result.
+	PSKCandidates []PSKCandidate
+	KeepAlive     time.Duration
+	MaxPadding    uint8
+	CookieTTL     time.Duration
+}
+
+// PSKCandidate is a pre-shared key a responder is willing to accept, tagged
+// with the identity it authenticates. A zero NotBefore or NotAfter leaves
+// that side of the validity window open.
+type PSKCandidate struct {
+	ID         string
+	Key        []byte
+	Generation int
+	NotBefore  time.Time
+	NotAfter   time.Time
+}
+
+// ValidAt reports whether the key may be used at t.
+func (c PSKCandidate) ValidAt(t time.Time) bool {
+	if !c.NotBefore.IsZero() && t.Before(c.NotBefore) {
+		return false
+	}
+	if !c.NotAfter.IsZero() && !t.Before(c.NotAfter) {
+		return false
+	}
+	return true
 }
 
 type TransportParameters struct {
@@ -41,8 +66,10 @@ type SessionSecrets struct {
 }
 
 type HandshakeResult struct {
-	Secrets    SessionSecrets
-	Parameters TransportParameters
+	Secrets       SessionSecrets
+	Parameters    TransportParameters
+	PSKID         string // ID of the accepted PSK candidate (responder only)
+	PSKGeneration int    // Generation of the accepted PSK candidate (responder only)
 }
 
 const (
@@ -55,6 +82,7 @@ const (
 	msgTypeClientHello = 1
 	msgTypeServerHello = 2
 	msgTypeCookie      = 3
+	msgTypeResumeOffer = 4
 
 	clientFlagHasCookie = 0x01
 
@@ -75,11 +103,16 @@ func GeneratePrivateKey() ([]byte, error) {
 	return key, nil
 }
 
+// PublicKey derives the Curve25519 public key for a static private key.
+func PublicKey(privateKey []byte) ([32]byte, error) {
+	return derivePublicKey(privateKey)
+}
+
 func PerformHandshake(privateKey []byte, conn net.Conn, role HandshakeRole, opts HandshakeOptions) (*HandshakeResult, error) {
 	if len(privateKey) != curve25519.ScalarSize {
 		return nil, errors.New("invalid private key length")
 	}
-	if len(opts.PreSharedKey) == 0 {
+	if len(opts.PreSharedKey) == 0 && (role == RoleClient || len(opts.PSKCandidates) == 0) {
 		return nil, errors.New("pre-shared key required")
 	}
 
@@ -197,7 +230,10 @@ func serverHandshake(privateKey []byte, conn net.Conn, opts HandshakeOptions) (*
 
 	remote := conn.RemoteAddr().String()
 
+	candidates := pskCandidates(opts.PreSharedKey, opts.PSKCandidates, time.Now())
+
 	var clientMsg *clientHelloMessage
+	var selected PSKCandidate
 	attempts := 0
 	for {
 		payload, err := readRecord(conn)
@@ -209,13 +245,23 @@ func serverHandshake(privateKey []byte, conn net.Conn, opts HandshakeOptions) (*
 			return nil, err
 		}
 
-		mac := computeMAC(opts.PreSharedKey, msg.SessionID[:], msg.PublicKey[:])
-		if !hmac.Equal(msg.MAC[:], mac[:]) {
+		// The client MAC identifies which pre-shared key the client holds.
+		found := false
+		for _, candidate := range candidates {
+			mac := computeMAC(candidate.Key, msg.SessionID[:], msg.PublicKey[:])
+			if hmac.Equal(msg.MAC[:], mac[:]) {
+				selected = candidate
+				found = true
+				break
+			}
+		}
+		if !found {
 			return nil, errors.New("client MAC verification failed")
 		}
+		psk := selected.Key
 
-		if len(msg.Cookie) == 0 || !verifyCookie(opts.PreSharedKey, remote, msg.SessionID, msg.PublicKey, msg.Cookie, opts.CookieTTL) {
-			cookiePayload := encodeCookieMessage(msg.SessionID, issueCookieNow(opts.PreSharedKey, remote, msg.SessionID, msg.PublicKey))
+		if len(msg.Cookie) == 0 || !verifyCookie(candidates, remote, msg.SessionID, msg.PublicKey, msg.Cookie, opts.CookieTTL) {
+			cookiePayload := encodeCookieMessage(msg.SessionID, issueCookieNow(psk, remote, msg.SessionID, msg.PublicKey))
 			if err := writeRecord(conn, cookiePayload); err != nil {
 				return nil, err
 			}
@@ -242,7 +288,7 @@ func serverHandshake(privateKey []byte, conn net.Conn, opts HandshakeOptions) (*
 
 	keepAlive := opts.KeepAlive
 	keepAliveMillis := uint16(keepAlive / time.Millisecond)
-	serverMac := computeMAC(opts.PreSharedKey, clientMsg.SessionID[:], clientMsg.PublicKey[:], serverPub[:])
+	serverMac := computeMAC(selected.Key, clientMsg.SessionID[:], clientMsg.PublicKey[:], serverPub[:])
 	serverHello := encodeServerHello(clientMsg.SessionID, serverPub, keepAliveMillis, opts.MaxPadding, padding, serverMac)
 
 	if err := writeRecord(conn, serverHello); err != nil {
@@ -258,7 +304,7 @@ func serverHandshake(privateKey []byte, conn net.Conn, opts HandshakeOptions) (*
 		return nil, err
 	}
 
-	secrets, err := deriveSessionSecrets(sharedSecret, transcript.Bytes(), opts.PreSharedKey, RoleServer, clientMsg.SessionID, clientMsg.PublicKey)
+	secrets, err := deriveSessionSecrets(sharedSecret, transcript.Bytes(), selected.Key, RoleServer, clientMsg.SessionID, clientMsg.PublicKey)
 	if err != nil {
 		return nil, err
 	}
@@ -268,7 +314,23 @@ func serverHandshake(privateKey []byte, conn net.Conn, opts HandshakeOptions) (*
 		MaxPadding: opts.MaxPadding,
 	}
 
-	return &HandshakeResult{Secrets: *secrets, Parameters: params}, nil
+	return &HandshakeResult{Secrets: *secrets, Parameters: params, PSKID: selected.ID, PSKGeneration: selected.Generation}, nil
+}
+
+// pskCandidates returns the keys a responder should try at now, falling back
+// to the single configured pre-shared key. Keys outside their validity
+// window are dropped so a retired key stops authenticating immediately.
+func pskCandidates(psk []byte, candidates []PSKCandidate, now time.Time) []PSKCandidate {
+	if len(candidates) == 0 {
+		return []PSKCandidate{{Key: psk}}
+	}
+	valid := make([]PSKCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.ValidAt(now) {
+			valid = append(valid, candidate)
+		}
+	}
+	return valid
 }
 
 func randomSessionID() ([16]byte, error) {
@@ -391,23 +453,36 @@ func expandKey(sharedSecret, salt, info []byte) ([]byte, error) {
 	return key, nil
 }
 
+// writeRecord sends a handshake record with a single write, so that on
+// datagram connections each record travels in exactly one packet.
 func writeRecord(conn net.Conn, payload []byte) error {
 	if len(payload) > 0xFFFF {
 		return errors.New("handshake payload too large")
 	}
-	header := make([]byte, recordHeaderSize)
-	header[0] = 0x17
-	header[1] = 0x03
-	header[2] = 0x03
-	binary.BigEndian.PutUint16(header[3:], uint16(len(payload)))
-	if _, err := conn.Write(header); err != nil {
-		return err
-	}
-	_, err := conn.Write(payload)
+	record := make([]byte, recordHeaderSize+len(payload))
+	record[0] = 0x17
+	record[1] = 0x03
+	record[2] = 0x03
+	binary.BigEndian.PutUint16(record[3:], uint16(len(payload)))
+	copy(record[recordHeaderSize:], payload)
+	_, err := conn.Write(record)
 	return err
 }
 
+// IsHandshakeRecord reports whether data starts with a handshake record
+// header. It is a cheap way to tell tunnel clients from other traffic on a
+// shared port; it says nothing about whether the handshake will succeed.
+func IsHandshakeRecord(data []byte) bool {
+	if len(data) < recordHeaderSize {
+		return false
+	}
+	return data[0] == 0x17 && data[1] == 0x03 && data[2] == 0x03 && binary.BigEndian.Uint16(data[3:]) > 0
+}
+
 func readRecord(conn net.Conn) ([]byte, error) {
+	if isDatagram(conn) {
+		return readDatagramRecord(conn)
+	}
 	header := make([]byte, recordHeaderSize)
 	if _, err := io.ReadFull(conn, header); err != nil {
 		return nil, err
@@ -420,6 +495,30 @@ func readRecord(conn net.Conn) ([]byte, error) {
 	return payload, nil
 }
 
+// readDatagramRecord reads one packet holding one complete record.
+func readDatagramRecord(conn net.Conn) ([]byte, error) {
+	packet := make([]byte, recordHeaderSize+0xFFFF)
+	n, err := conn.Read(packet)
+	if err != nil {
+		return nil, err
+	}
+	if n < recordHeaderSize {
+		return nil, errors.New("handshake datagram too short")
+	}
+	length := int(binary.BigEndian.Uint16(packet[3:recordHeaderSize]))
+	if n != recordHeaderSize+length {
+		return nil, errors.New("handshake datagram length mismatch")
+	}
+	return append([]byte(nil), packet[recordHeaderSize:n]...), nil
+}
+
+// isDatagram reports whether conn preserves packet boundaries, as the UDP
+// connections of the transport package do.
+func isDatagram(conn net.Conn) bool {
+	dc, ok := conn.(interface{ Datagram() bool })
+	return ok && dc.Datagram()
+}
+
 type clientHelloMessage struct {
 	Flags     uint8
 	SessionID [16]byte
@@ -622,7 +721,10 @@ func issueCookieNow(psk []byte, remote string, sessionID [16]byte, clientPub [32
 	return issueCookie(psk, remote, sessionID, clientPub, time.Now())
 }
 
-func verifyCookie(psk []byte, remote string, sessionID [16]byte, clientPub [32]byte, cookie []byte, ttl time.Duration) bool {
+// verifyCookie accepts a cookie minted under any of the currently valid
+// pre-shared keys, so a rotation between the cookie round trip and the retry
+// does not bounce the client.
+func verifyCookie(candidates []PSKCandidate, remote string, sessionID [16]byte, clientPub [32]byte, cookie []byte, ttl time.Duration) bool {
 	if len(cookie) < 4+cookieMacSize {
 		return false
 	}
@@ -631,6 +733,11 @@ func verifyCookie(psk []byte, remote string, sessionID [16]byte, clientPub [32]b
 	if time.Since(issued) > ttl {
 		return false
 	}
-	expected := issueCookie(psk, remote, sessionID, clientPub, issued)
-	return hmac.Equal(cookie, expected)
+	for _, candidate := range candidates {
+		expected := issueCookie(candidate.Key, remote, sessionID, clientPub, issued)
+		if hmac.Equal(cookie, expected) {
+			return true
+		}
+	}
+	return false
 }
@@ -168,3 +168,157 @@ func performHandshake(t *testing.T) (SessionSecrets, SessionSecrets) {
 	}
 	return clientRes.Secrets, serverRes.Secrets
 }
+
+func TestHandshakePSKRotation(t *testing.T) {
+	now := time.Now()
+	candidates := []PSKCandidate{
+		{Key: []byte("generation-one-key-0123456789abc"), Generation: 1, NotAfter: now.Add(-time.Minute)},
+		{Key: []byte("generation-two-key-0123456789abc"), Generation: 2, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)},
+		{Key: []byte("generation-three-key-0123456789a"), Generation: 3, NotBefore: now.Add(-time.Minute)},
+	}
+
+	handshake := func(clientPSK []byte) (*HandshakeResult, error) {
+		clientPriv, _ := GeneratePrivateKey()
+		serverPriv, _ := GeneratePrivateKey()
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		serverCh := make(chan *HandshakeResult, 1)
+		errCh := make(chan error, 1)
+		go func() {
+			res, err := PerformHandshake(serverPriv, serverConn, RoleServer, HandshakeOptions{PSKCandidates: candidates})
+			if err != nil {
+				serverConn.Close()
+				errCh <- err
+				return
+			}
+			serverCh <- res
+		}()
+
+		if _, err := PerformHandshake(clientPriv, clientConn, RoleClient, HandshakeOptions{PreSharedKey: clientPSK}); err != nil {
+			return nil, <-errCh
+		}
+		select {
+		case err := <-errCh:
+			return nil, err
+		case res := <-serverCh:
+			return res, nil
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for server handshake")
+			return nil, nil
+		}
+	}
+
+	for _, candidate := range candidates[1:] {
+		res, err := handshake(candidate.Key)
+		if err != nil {
+			t.Fatalf("generation %d rejected: %v", candidate.Generation, err)
+		}
+		if res.PSKGeneration != candidate.Generation {
+			t.Fatalf("expected generation %d, got %d", candidate.Generation, res.PSKGeneration)
+		}
+	}
+
+	if _, err := handshake(candidates[0].Key); err == nil {
+		t.Fatal("expired generation was accepted")
+	}
+}
+
+func TestVerifyCookieAcrossGenerations(t *testing.T) {
+	var sessionID [16]byte
+	var clientPub [32]byte
+	oldKey := PSKCandidate{Key: []byte("generation-one-key-0123456789abc"), Generation: 1}
+	newKey := PSKCandidate{Key: []byte("generation-two-key-0123456789abc"), Generation: 2}
+
+	cookie := issueCookieNow(oldKey.Key, "198.51.100.7:4000", sessionID, clientPub)
+	if !verifyCookie([]PSKCandidate{oldKey, newKey}, "198.51.100.7:4000", sessionID, clientPub, cookie, time.Minute) {
+		t.Fatal("cookie minted under a valid generation was rejected")
+	}
+	if verifyCookie([]PSKCandidate{newKey}, "198.51.100.7:4000", sessionID, clientPub, cookie, time.Minute) {
+		t.Fatal("cookie minted under a retired generation was accepted")
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	clientSecrets, serverSecrets := performHandshake(t)
+	clientSecret, err := ResumptionSecret(clientSecrets, RoleClient)
+	if err != nil {
+		t.Fatalf("client resumption secret: %v", err)
+	}
+	serverSecret, err := ResumptionSecret(serverSecrets, RoleServer)
+	if err != nil {
+		t.Fatalf("server resumption secret: %v", err)
+	}
+	if !bytes.Equal(clientSecret, serverSecret) {
+		t.Fatal("resumption secrets differ")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	ticketID := [16]byte{1, 2, 3}
+	offerCh := make(chan *ResumeOffer, 1)
+	go func() {
+		offer, err := SendResumeOffer(clientConn, ticketID, clientSecret)
+		if err != nil {
+			t.Errorf("send offer: %v", err)
+		}
+		offerCh <- offer
+	}()
+
+	record, replay, err := PeekRecord(serverConn)
+	if err != nil {
+		t.Fatalf("peek record: %v", err)
+	}
+	if replay == nil {
+		t.Fatal("no replay connection")
+	}
+	serverOffer, ok := ParseResumeOffer(record)
+	if !ok || serverOffer.TicketID != ticketID {
+		t.Fatal("resumption offer not recognised")
+	}
+	if err := serverOffer.Verify(serverSecret); err != nil {
+		t.Fatalf("verify offer: %v", err)
+	}
+	if err := serverOffer.Verify(make([]byte, KeySize)); err == nil {
+		t.Fatal("offer verified under the wrong secret")
+	}
+	clientOffer := <-offerCh
+
+	clientEarly, err := clientOffer.EarlySecrets(clientSecret, RoleClient)
+	if err != nil {
+		t.Fatalf("client early secrets: %v", err)
+	}
+	serverEarly, err := serverOffer.EarlySecrets(serverSecret, RoleServer)
+	if err != nil {
+		t.Fatalf("server early secrets: %v", err)
+	}
+	if !bytes.Equal(clientEarly.SendKey, serverEarly.ReceiveKey) || clientEarly.Epoch != 0 {
+		t.Fatal("early keys do not match")
+	}
+
+	params := TransportParameters{KeepAlive: 20 * time.Second, MaxPadding: 32}
+	serverFinal, accept, err := AcceptResume(serverSecret, serverOffer, params)
+	if err != nil {
+		t.Fatalf("accept resume: %v", err)
+	}
+	clientFinal, gotParams, err := FinishResume(clientSecret, clientOffer, accept)
+	if err != nil {
+		t.Fatalf("finish resume: %v", err)
+	}
+	if gotParams != params {
+		t.Fatalf("parameters mismatch: %+v", gotParams)
+	}
+	if !bytes.Equal(clientFinal.SendKey, serverFinal.ReceiveKey) || !bytes.Equal(clientFinal.ReceiveKey, serverFinal.SendKey) {
+		t.Fatal("final keys do not match")
+	}
+	if bytes.Equal(clientFinal.SendKey, clientEarly.SendKey) || clientFinal.SessionID != serverFinal.SessionID {
+		t.Fatal("final keys not distinct from early keys")
+	}
+
+	accept[0] ^= 0xFF
+	if _, _, err := FinishResume(clientSecret, clientOffer, accept); err == nil {
+		t.Fatal("tampered accept accepted")
+	}
+}
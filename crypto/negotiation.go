@@ -4,8 +4,13 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 // ProtocolVersion represents the protocol version
@@ -115,6 +120,38 @@ func GetSecurityProfile(profile SecurityProfile) NegotiationConfig {
 	}
 }
 
+// String returns the configuration name of the profile
+func (p SecurityProfile) String() string {
+	switch p {
+	case SecurityProfileLegacy:
+		return "legacy"
+	case SecurityProfileBalanced:
+		return "balanced"
+	case SecurityProfileStrict:
+		return "strict"
+	case SecurityProfileParanoid:
+		return "paranoid"
+	default:
+		return fmt.Sprintf("profile(%d)", int(p))
+	}
+}
+
+// ParseSecurityProfile maps a configuration name to a security profile
+func ParseSecurityProfile(name string) (SecurityProfile, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "legacy":
+		return SecurityProfileLegacy, nil
+	case "balanced":
+		return SecurityProfileBalanced, nil
+	case "strict":
+		return SecurityProfileStrict, nil
+	case "paranoid":
+		return SecurityProfileParanoid, nil
+	default:
+		return SecurityProfileLegacy, fmt.Errorf("unknown security profile %q", name)
+	}
+}
+
 // NegotiationState tracks the state of protocol negotiation
 type NegotiationState struct {
 	config NegotiationConfig
@@ -236,7 +273,9 @@ func (ns *NegotiationState) ProcessOffer(offerData []byte) ([]byte, error) {
 
 // ProcessResponse processes a negotiation response
 func (ns *NegotiationState) ProcessResponse(responseData []byte) error {
-	ns.transcript = append(ns.transcript, responseData...)
+	// The responder signs the transcript up to its response, so the response
+	// is only appended once the downgrade proof has been checked.
+	defer func() { ns.transcript = append(ns.transcript, responseData...) }()
 
 	response, err := decodeResponse(responseData)
 	if err != nil {
@@ -364,6 +403,23 @@ type NegotiatedParams struct {
 	Features    FeatureFlags
 }
 
+// MarshalJSON renders the parameters in a human-readable form for status output
+func (np NegotiatedParams) MarshalJSON() ([]byte, error) {
+	suite := fmt.Sprintf("0x%04x", uint16(np.CipherSuite))
+	if info, err := GetCipherSuiteInfo(np.CipherSuite); err == nil {
+		suite = info.Name
+	}
+	return json.Marshal(struct {
+		Version     uint8  `json:"version"`
+		CipherSuite string `json:"cipherSuite"`
+		Features    string `json:"features"`
+	}{
+		Version:     uint8(np.Version),
+		CipherSuite: suite,
+		Features:    np.Features.String(),
+	})
+}
+
 // HasFeature checks if a feature was negotiated
 func (np NegotiatedParams) HasFeature(feature FeatureFlags) bool {
 	return (np.Features & feature) != 0
@@ -527,3 +583,104 @@ func (f FeatureFlags) String() string {
 	}
 	return result
 }
+
+// NegotiationChannel carries the negotiation offer and response. Callers send
+// them as session frames under keys from NegotiationSecrets, so they are
+// encrypted and obfuscated like the traffic that follows.
+type NegotiationChannel interface {
+	Send(message []byte) error
+	Receive() ([]byte, error)
+}
+
+// NegotiateSession exchanges a negotiation offer and response over channel
+// once the handshake has authenticated both sides. The downgrade proof is
+// keyed from the session secrets, so only the authenticated responder can
+// produce it and a tampered offer is detected by the initiator.
+func NegotiateSession(channel NegotiationChannel, role HandshakeRole, config NegotiationConfig, secrets SessionSecrets) (NegotiatedParams, error) {
+	key, err := negotiationKey(secrets, role)
+	if err != nil {
+		return NegotiatedParams{}, err
+	}
+	config.SigningKey = key
+	ns := NewNegotiationState(config, role)
+
+	if role == RoleClient {
+		offer, err := ns.CreateOffer()
+		if err != nil {
+			return NegotiatedParams{}, err
+		}
+		if err := channel.Send(offer); err != nil {
+			return NegotiatedParams{}, err
+		}
+		response, err := channel.Receive()
+		if err != nil {
+			return NegotiatedParams{}, fmt.Errorf("negotiation rejected by server: %w", err)
+		}
+		if err := ns.ProcessResponse(response); err != nil {
+			return NegotiatedParams{}, err
+		}
+		return ns.GetNegotiatedParams(), nil
+	}
+
+	offer, err := channel.Receive()
+	if err != nil {
+		return NegotiatedParams{}, err
+	}
+	response, err := ns.ProcessOffer(offer)
+	if err != nil {
+		return NegotiatedParams{}, err
+	}
+	if err := channel.Send(response); err != nil {
+		return NegotiatedParams{}, err
+	}
+	return ns.GetNegotiatedParams(), nil
+}
+
+// NegotiationSecrets derives the keys negotiation frames travel under. They
+// are independent of the traffic keys, so the session installed afterwards
+// starts its counters afresh without reusing a nonce.
+func NegotiationSecrets(secrets SessionSecrets) (SessionSecrets, error) {
+	derived := secrets
+	for _, key := range []struct {
+		dst   *[]byte
+		src   []byte
+		label string
+	}{
+		{&derived.SendKey, secrets.SendKey, "stp negotiation traffic"},
+		{&derived.ReceiveKey, secrets.ReceiveKey, "stp negotiation traffic"},
+		{&derived.ObfuscationKey, secrets.ObfuscationKey, "stp negotiation obfuscation"},
+	} {
+		if len(key.src) == 0 {
+			return SessionSecrets{}, errors.New("session secrets required for negotiation")
+		}
+		out := make([]byte, len(key.src))
+		reader := hkdf.New(sha256.New, key.src, secrets.SessionID[:], []byte(key.label))
+		if _, err := io.ReadFull(reader, out); err != nil {
+			return SessionSecrets{}, err
+		}
+		*key.dst = out
+	}
+	return derived, nil
+}
+
+// negotiationKey derives the downgrade-proof key from the traffic keys, ordered
+// by direction so both roles arrive at the same value.
+func negotiationKey(secrets SessionSecrets, role HandshakeRole) ([]byte, error) {
+	if len(secrets.SendKey) == 0 || len(secrets.ReceiveKey) == 0 {
+		return nil, errors.New("session secrets required for negotiation")
+	}
+	clientToServer, serverToClient := secrets.SendKey, secrets.ReceiveKey
+	if role == RoleServer {
+		clientToServer, serverToClient = secrets.ReceiveKey, secrets.SendKey
+	}
+	ikm := make([]byte, 0, len(clientToServer)+len(serverToClient))
+	ikm = append(ikm, clientToServer...)
+	ikm = append(ikm, serverToClient...)
+
+	key := make([]byte, KeySize)
+	reader := hkdf.New(sha256.New, ikm, secrets.SessionID[:], []byte("stp negotiation"))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -54,6 +54,7 @@ type NoiseHandshakeState struct {
 type NoiseHandshakeOptions struct {
 	Pattern        NoisePattern
 	PreSharedKey   []byte
+	PSKCandidates  []PSKCandidate  // Responder-side alternatives to PreSharedKey
 	StaticKey      []byte          // Static long-term key
 	RemoteStatic   []byte          // Known remote static key (for IK pattern)
 	KeepAlive      time.Duration
@@ -71,16 +72,19 @@ type NoiseHandshakeResult struct {
 	Pattern        NoisePattern
 	CipherSuite    CipherSuite
 	Version        uint8
+	PSKID          string          // ID of the accepted PSK candidate (responder only)
+	PSKGeneration  int             // Generation of the accepted PSK candidate (responder only)
 }
 
 const (
-	noiseProtocolName = "Noise_IKpsk2_25519_ChaChaPoly_SHA256"
-	noiseHeaderSize   = 5
+	noiseProtocolName   = "Noise_IKpsk2_25519_ChaChaPoly_SHA256"
+	noiseProtocolNameXX = "Noise_XXpsk3_25519_ChaChaPoly_SHA256"
+	noiseHeaderSize     = 5
 )
 
 // PerformNoiseHandshake executes a Noise protocol handshake
 func PerformNoiseHandshake(conn net.Conn, role HandshakeRole, opts NoiseHandshakeOptions) (*NoiseHandshakeResult, error) {
-	if len(opts.PreSharedKey) == 0 {
+	if len(opts.PreSharedKey) == 0 && (role == RoleClient || len(opts.PSKCandidates) == 0) {
 		return nil, errors.New("pre-shared key required")
 	}
 
@@ -112,24 +116,8 @@ func performNoiseIKpsk2(conn net.Conn, role HandshakeRole, opts NoiseHandshakeOp
 	}
 
 	// Initialize static keypair
-	if len(opts.StaticKey) == 32 {
-		copy(hs.staticPrivate[:], opts.StaticKey)
-		pub, err := derivePublicKey(hs.staticPrivate[:])
-		if err != nil {
-			return nil, err
-		}
-		hs.staticPublic = pub
-	} else {
-		priv, err := GeneratePrivateKey()
-		if err != nil {
-			return nil, err
-		}
-		copy(hs.staticPrivate[:], priv)
-		pub, err := derivePublicKey(priv)
-		if err != nil {
-			return nil, err
-		}
-		hs.staticPublic = pub
+	if err := initStaticKeypair(hs, opts.StaticKey); err != nil {
+		return nil, err
 	}
 
 	// Initialize chaining key and hash
@@ -467,9 +455,6 @@ func noiseIKpsk2Responder(conn net.Conn, hs *NoiseHandshakeState, opts NoiseHand
 	}
 	mixKey(hs, dhResult)
 
-	// Mix PSK
-	mixKeyAndHash(hs, hs.psk)
-
 	// s (encrypted)
 	encStaticLen := 32 + 16 // public key + poly1305 tag
 	if len(msg1) < offset+encStaticLen {
@@ -478,7 +463,8 @@ func noiseIKpsk2Responder(conn net.Conn, hs *NoiseHandshakeState, opts NoiseHand
 	encStatic := msg1[offset : offset+encStaticLen]
 	offset += encStaticLen
 
-	remoteStaticBytes, err := decryptAndHash(hs, encStatic)
+	// Mix PSK; only the initiator's key decrypts its static key
+	selected, remoteStaticBytes, err := mixCandidatePSK(hs, opts, encStatic)
 	if err != nil {
 		return nil, errors.New("failed to decrypt remote static key")
 	}
@@ -574,6 +560,8 @@ func noiseIKpsk2Responder(conn net.Conn, hs *NoiseHandshakeState, opts NoiseHand
 		Pattern:      NoiseIKpsk2,
 		CipherSuite:  selectedSuite,
 		Version:      hs.agreedVersion,
+		PSKID:        selected.ID,
+		PSKGeneration: selected.Generation,
 	}, nil
 }
 
@@ -620,8 +608,407 @@ func decodeTransportParams(data []byte) (TransportParameters, error) {
 
 // performNoiseXXpsk3 implements Noise_XXpsk3 for mutual identity hiding
 func performNoiseXXpsk3(conn net.Conn, role HandshakeRole, opts NoiseHandshakeOptions) (*NoiseHandshakeResult, error) {
-	// TODO: Implement XX pattern for cases where both parties don't know each other's static keys
-	return nil, errors.New("Noise_XXpsk3 not yet implemented")
+	hs := &NoiseHandshakeState{
+		pattern:    NoiseXXpsk3,
+		role:       role,
+		psk:        opts.PreSharedKey,
+		minVersion: opts.MinVersion,
+		maxVersion: noiseVersion,
+	}
+
+	if err := initStaticKeypair(hs, opts.StaticKey); err != nil {
+		return nil, err
+	}
+
+	initializeSymmetric(hs, noiseProtocolNameXX)
+
+	if role == RoleClient {
+		return noiseXXpsk3Initiator(conn, hs, opts)
+	}
+	return noiseXXpsk3Responder(conn, hs, opts)
+}
+
+// initStaticKeypair loads the long-term static key, generating a throwaway
+// one when the caller did not supply a key.
+func initStaticKeypair(hs *NoiseHandshakeState, staticKey []byte) error {
+	if len(staticKey) == 32 {
+		copy(hs.staticPrivate[:], staticKey)
+	} else {
+		priv, err := GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		copy(hs.staticPrivate[:], priv)
+	}
+	pub, err := derivePublicKey(hs.staticPrivate[:])
+	if err != nil {
+		return err
+	}
+	hs.staticPublic = pub
+	return nil
+}
+
+// noiseXXpsk3Initiator performs the initiator side of Noise_XXpsk3
+func noiseXXpsk3Initiator(conn net.Conn, hs *NoiseHandshakeState, opts NoiseHandshakeOptions) (*NoiseHandshakeResult, error) {
+	ephemPriv, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	copy(hs.ephemeralPriv[:], ephemPriv)
+	ephemPub, err := derivePublicKey(ephemPriv)
+	if err != nil {
+		return nil, err
+	}
+	hs.ephemeralPub = ephemPub
+
+	sessionID, err := randomSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Message 1: -> e
+	msg1 := bytes.NewBuffer(nil)
+	msg1.WriteByte(noiseVersion)
+	msg1.WriteByte(uint8(opts.MinVersion))
+	msg1.WriteByte(uint8(len(opts.CipherSuites)))
+	for _, suite := range opts.CipherSuites {
+		binary.Write(msg1, binary.BigEndian, uint16(suite))
+	}
+	msg1.Write(sessionID[:])
+
+	msg1.Write(hs.ephemeralPub[:])
+	mixHash(hs, hs.ephemeralPub[:])
+
+	padding, err := randomPadding(opts.MaxPadding)
+	if err != nil {
+		return nil, err
+	}
+	msg1.WriteByte(uint8(len(padding)))
+	msg1.Write(padding)
+
+	if err := writeRecord(conn, msg1.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Message 2: <- e, ee, s, es
+	msg2, err := readRecord(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg2) < 1+1+2+32+48+2 {
+		return nil, errors.New("message 2 too short")
+	}
+
+	offset := 0
+	version := msg2[offset]
+	offset++
+	if version < opts.MinVersion || version > noiseVersion {
+		return nil, fmt.Errorf("unsupported protocol version: %d", version)
+	}
+	hs.agreedVersion = version
+
+	suiteCount := int(msg2[offset])
+	offset++
+	if suiteCount != 1 || len(msg2) < offset+2+32+48+2 {
+		return nil, errors.New("invalid cipher suite selection")
+	}
+	selectedSuite := CipherSuite(binary.BigEndian.Uint16(msg2[offset : offset+2]))
+	offset += 2
+	if !containsSuite(opts.CipherSuites, selectedSuite) {
+		return nil, fmt.Errorf("responder selected unsupported cipher suite: 0x%04x", uint16(selectedSuite))
+	}
+
+	// e
+	copy(hs.remoteEphemeral[:], msg2[offset:offset+32])
+	offset += 32
+	mixHash(hs, hs.remoteEphemeral[:])
+
+	// ee
+	dhResult, err := curve25519.X25519(hs.ephemeralPriv[:], hs.remoteEphemeral[:])
+	if err != nil {
+		return nil, err
+	}
+	mixKey(hs, dhResult)
+
+	// s (encrypted)
+	remoteStaticBytes, err := decryptAndHash(hs, msg2[offset:offset+48])
+	if err != nil {
+		return nil, errors.New("failed to decrypt remote static key")
+	}
+	offset += 48
+	copy(hs.remoteStatic[:], remoteStaticBytes)
+
+	// es
+	dhResult, err = curve25519.X25519(hs.ephemeralPriv[:], hs.remoteStatic[:])
+	if err != nil {
+		return nil, err
+	}
+	mixKey(hs, dhResult)
+
+	paramsLen := int(binary.BigEndian.Uint16(msg2[offset : offset+2]))
+	offset += 2
+	if len(msg2) < offset+paramsLen {
+		return nil, errors.New("message 2 truncated")
+	}
+	paramsData, err := decryptAndHash(hs, msg2[offset:offset+paramsLen])
+	if err != nil {
+		return nil, errors.New("failed to decrypt transport parameters")
+	}
+	params, err := decodeTransportParams(paramsData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Message 3: -> s, se, psk
+	msg3 := bytes.NewBuffer(nil)
+	encStatic, err := encryptAndHash(hs, hs.staticPublic[:])
+	if err != nil {
+		return nil, err
+	}
+	msg3.Write(encStatic)
+
+	// se
+	dhResult, err = curve25519.X25519(hs.staticPrivate[:], hs.remoteEphemeral[:])
+	if err != nil {
+		return nil, err
+	}
+	mixKey(hs, dhResult)
+
+	// psk
+	mixKeyAndHash(hs, hs.psk)
+
+	// Empty payload authenticates the PSK to the responder
+	confirm, err := encryptAndHash(hs, nil)
+	if err != nil {
+		return nil, err
+	}
+	msg3.Write(confirm)
+
+	if err := writeRecord(conn, msg3.Bytes()); err != nil {
+		return nil, err
+	}
+
+	sendKey, recvKey := splitKeys(hs, RoleClient)
+
+	secrets := SessionSecrets{
+		SessionID:      sessionID,
+		SendKey:        sendKey,
+		ReceiveKey:     recvKey,
+		ObfuscationKey: deriveObfuscationKey(hs.chainingKey[:]),
+		PeerPublicKey:  hs.remoteStatic,
+		Epoch:          1,
+		Established:    time.Now().UTC(),
+	}
+
+	return &NoiseHandshakeResult{
+		Secrets:      secrets,
+		Parameters:   params,
+		RemoteStatic: hs.remoteStatic,
+		Pattern:      NoiseXXpsk3,
+		CipherSuite:  selectedSuite,
+		Version:      hs.agreedVersion,
+	}, nil
+}
+
+// noiseXXpsk3Responder performs the responder side of Noise_XXpsk3
+func noiseXXpsk3Responder(conn net.Conn, hs *NoiseHandshakeState, opts NoiseHandshakeOptions) (*NoiseHandshakeResult, error) {
+	// Message 1: -> e
+	msg1, err := readRecord(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg1) < 1+1+1 {
+		return nil, errors.New("message 1 too short")
+	}
+
+	offset := 0
+	version := msg1[offset]
+	offset++
+	minVersion := msg1[offset]
+	offset++
+	if noiseVersion < minVersion {
+		return nil, fmt.Errorf("version too old: need >= %d", minVersion)
+	}
+	hs.agreedVersion = min(noiseVersion, version)
+	if hs.agreedVersion < opts.MinVersion {
+		return nil, fmt.Errorf("unsupported protocol version: %d", hs.agreedVersion)
+	}
+
+	suiteCount := int(msg1[offset])
+	offset++
+	if len(msg1) < offset+suiteCount*2+16+32 {
+		return nil, errors.New("message 1 truncated")
+	}
+	clientSuites := make([]CipherSuite, suiteCount)
+	for i := 0; i < suiteCount; i++ {
+		clientSuites[i] = CipherSuite(binary.BigEndian.Uint16(msg1[offset : offset+2]))
+		offset += 2
+	}
+
+	selectedSuite, found := selectCipherSuite(clientSuites, opts.CipherSuites)
+	if !found {
+		return nil, errors.New("no mutually supported cipher suites")
+	}
+
+	var sessionID [16]byte
+	copy(sessionID[:], msg1[offset:offset+16])
+	offset += 16
+
+	// e
+	copy(hs.remoteEphemeral[:], msg1[offset:offset+32])
+	mixHash(hs, hs.remoteEphemeral[:])
+
+	// Message 2: <- e, ee, s, es
+	ephemPriv, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	copy(hs.ephemeralPriv[:], ephemPriv)
+	ephemPub, err := derivePublicKey(ephemPriv)
+	if err != nil {
+		return nil, err
+	}
+	hs.ephemeralPub = ephemPub
+
+	msg2 := bytes.NewBuffer(nil)
+	msg2.WriteByte(hs.agreedVersion)
+	msg2.WriteByte(1) // 1 cipher suite selected
+	binary.Write(msg2, binary.BigEndian, uint16(selectedSuite))
+
+	// e
+	msg2.Write(hs.ephemeralPub[:])
+	mixHash(hs, hs.ephemeralPub[:])
+
+	// ee
+	dhResult, err := curve25519.X25519(hs.ephemeralPriv[:], hs.remoteEphemeral[:])
+	if err != nil {
+		return nil, err
+	}
+	mixKey(hs, dhResult)
+
+	// s (encrypted)
+	encStatic, err := encryptAndHash(hs, hs.staticPublic[:])
+	if err != nil {
+		return nil, err
+	}
+	msg2.Write(encStatic)
+
+	// es
+	dhResult, err = curve25519.X25519(hs.staticPrivate[:], hs.remoteEphemeral[:])
+	if err != nil {
+		return nil, err
+	}
+	mixKey(hs, dhResult)
+
+	params := TransportParameters{
+		KeepAlive:  opts.KeepAlive,
+		MaxPadding: opts.MaxPadding,
+	}
+	if params.KeepAlive == 0 {
+		params.KeepAlive = 15 * time.Second
+	}
+	if params.MaxPadding == 0 {
+		params.MaxPadding = 96
+	}
+
+	encParams, err := encryptAndHash(hs, encodeTransportParams(params))
+	if err != nil {
+		return nil, err
+	}
+	binary.Write(msg2, binary.BigEndian, uint16(len(encParams)))
+	msg2.Write(encParams)
+
+	if err := writeRecord(conn, msg2.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Message 3: -> s, se, psk
+	msg3, err := readRecord(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg3) < 48+16 {
+		return nil, errors.New("message 3 too short")
+	}
+
+	remoteStaticBytes, err := decryptAndHash(hs, msg3[:48])
+	if err != nil {
+		return nil, errors.New("failed to decrypt remote static key")
+	}
+	copy(hs.remoteStatic[:], remoteStaticBytes)
+
+	// se
+	dhResult, err = curve25519.X25519(hs.ephemeralPriv[:], hs.remoteStatic[:])
+	if err != nil {
+		return nil, err
+	}
+	mixKey(hs, dhResult)
+
+	// psk
+	selected, _, err := mixCandidatePSK(hs, opts, msg3[48:64])
+	if err != nil {
+		return nil, errors.New("pre-shared key verification failed")
+	}
+
+	sendKey, recvKey := splitKeys(hs, RoleServer)
+
+	secrets := SessionSecrets{
+		SessionID:      sessionID,
+		SendKey:        sendKey,
+		ReceiveKey:     recvKey,
+		ObfuscationKey: deriveObfuscationKey(hs.chainingKey[:]),
+		PeerPublicKey:  hs.remoteStatic,
+		Epoch:          1,
+		Established:    time.Now().UTC(),
+	}
+
+	return &NoiseHandshakeResult{
+		Secrets:      secrets,
+		Parameters:   params,
+		RemoteStatic: hs.remoteStatic,
+		Pattern:      NoiseXXpsk3,
+		CipherSuite:  selectedSuite,
+		Version:      hs.agreedVersion,
+		PSKID:        selected.ID,
+		PSKGeneration: selected.Generation,
+	}, nil
+}
+
+// mixCandidatePSK mixes each acceptable pre-shared key into a copy of the
+// handshake state and keeps the first one whose ciphertext authenticates.
+func mixCandidatePSK(hs *NoiseHandshakeState, opts NoiseHandshakeOptions, ciphertext []byte) (PSKCandidate, []byte, error) {
+	base := *hs
+	for _, candidate := range pskCandidates(opts.PreSharedKey, opts.PSKCandidates, time.Now()) {
+		trial := base
+		trial.psk = candidate.Key
+		mixKeyAndHash(&trial, trial.psk)
+		plaintext, err := decryptAndHash(&trial, ciphertext)
+		if err != nil {
+			continue
+		}
+		*hs = trial
+		return candidate, plaintext, nil
+	}
+	return PSKCandidate{}, nil, errors.New("no pre-shared key candidate matched")
+}
+
+// selectCipherSuite picks the first offered suite that we also support
+func selectCipherSuite(offered, supported []CipherSuite) (CipherSuite, bool) {
+	for _, suite := range offered {
+		if containsSuite(supported, suite) {
+			return suite, true
+		}
+	}
+	return CipherSuiteChaCha20Poly1305, false
+}
+
+func containsSuite(suites []CipherSuite, suite CipherSuite) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
 }
 
 func min(a, b uint8) uint8 {
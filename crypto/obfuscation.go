@@ -8,9 +8,12 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	mrand "math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/hkdf"
@@ -54,6 +57,49 @@ type ObfsConfig struct {
 
 	// Protocol mimicry
 	MimicProtocol string // "tls", "http", "ssh", etc.
+
+	// Role selects the key direction so both ends derive mirrored ciphers
+	Role HandshakeRole
+
+	// Datagram makes every frame independently decodable, for transports
+	// that may lose or reorder packets
+	Datagram bool
+}
+
+// String returns the configuration name of the mode
+func (m ObfsMode) String() string {
+	switch m {
+	case ObfsModeNone:
+		return "none"
+	case ObfsModeXOR:
+		return "xor"
+	case ObfsModeOBFS4:
+		return "obfs4"
+	case ObfsModeTLS:
+		return "tls"
+	case ObfsModeRandom:
+		return "random"
+	default:
+		return fmt.Sprintf("mode(%d)", int(m))
+	}
+}
+
+// ParseObfsMode maps a configuration name to an obfuscation mode
+func ParseObfsMode(name string) (ObfsMode, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return ObfsModeNone, nil
+	case "xor":
+		return ObfsModeXOR, nil
+	case "obfs4":
+		return ObfsModeOBFS4, nil
+	case "tls":
+		return ObfsModeTLS, nil
+	case "random":
+		return ObfsModeRandom, nil
+	default:
+		return ObfsModeNone, fmt.Errorf("unknown obfuscation mode %q", name)
+	}
 }
 
 // DefaultObfsConfig returns a secure default obfuscation config
@@ -77,6 +123,10 @@ type Obfuscator struct {
 	sendCipher cipher.Stream
 	recvCipher cipher.Stream
 
+	// Keys for per-frame streams in datagram mode
+	sendKey []byte
+	recvKey []byte
+
 	// Frame state
 	sendNonce uint64
 	recvNonce uint64
@@ -100,11 +150,21 @@ func NewObfuscator(secrets SessionSecrets, config ObfsConfig) (*Obfuscator, erro
 		return o, nil
 	}
 
-	// Derive obfuscation keys
+	// Derive obfuscation keys; the responder uses the initiator's directions reversed
 	sendKey, recvKey := deriveObfuscationKeys(secrets.ObfuscationKey, secrets.SessionID[:])
+	if config.Role == RoleServer {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	if len(o.config.Seed) == 0 {
+		o.config.Seed = deriveFrameMACKey(secrets.ObfuscationKey, secrets.SessionID[:])
+	}
 
 	var err error
 
+	if config.Datagram {
+		o.sendKey, o.recvKey = sendKey, recvKey
+	}
+
 	// Initialize stream ciphers based on mode
 	switch config.Mode {
 	case ObfsModeXOR:
@@ -152,33 +212,78 @@ func NewObfuscator(secrets SessionSecrets, config ObfsConfig) (*Obfuscator, erro
 
 // ObfuscateFrame obfuscates an outgoing frame
 func (o *Obfuscator) ObfuscateFrame(plaintext []byte) ([]byte, error) {
+	return o.obfuscate(plaintext, nil)
+}
+
+// ObfuscateDatagram obfuscates a datagram frame under the caller's per-frame
+// nonce instead of a random one. The nonce must never repeat for a session.
+func (o *Obfuscator) ObfuscateDatagram(plaintext, nonce []byte) ([]byte, error) {
+	if !o.config.Datagram || len(nonce) != datagramNonceSize {
+		return nil, errors.New("invalid datagram nonce")
+	}
+	return o.obfuscate(plaintext, nonce)
+}
+
+// DatagramNonceOffset returns where the per-frame nonce starts in an
+// obfuscated datagram.
+func (o *Obfuscator) DatagramNonceOffset() int {
+	switch o.mode {
+	case ObfsModeTLS:
+		return 5
+	case ObfsModeOBFS4:
+		return 3
+	default:
+		return 2
+	}
+}
+
+func (o *Obfuscator) obfuscate(plaintext, nonce []byte) ([]byte, error) {
 	if o.mode == ObfsModeNone {
 		return plaintext, nil
 	}
 
-	// Add length obfuscation padding
+	// Add length obfuscation padding. The length prefix is always present
+	// when padding is enabled so the receiver can strip a zero-length pad.
 	padded := plaintext
 	if o.config.MaxPadding > 0 {
 		padLen := o.samplePaddingLength()
-		if padLen > 0 {
-			padding := make([]byte, padLen)
-			rand.Read(padding)
-
-			// Encode with length prefix
-			buf := make([]byte, 2+len(plaintext)+len(padding))
-			binary.BigEndian.PutUint16(buf[0:2], uint16(len(plaintext)))
-			copy(buf[2:], plaintext)
-			copy(buf[2+len(plaintext):], padding)
-			padded = buf
-		}
+		padding := make([]byte, padLen)
+		rand.Read(padding)
+
+		// Encode with length prefix
+		buf := make([]byte, 2+len(plaintext)+len(padding))
+		binary.BigEndian.PutUint16(buf[0:2], uint16(len(plaintext)))
+		copy(buf[2:], plaintext)
+		copy(buf[2+len(plaintext):], padding)
+		padded = buf
+	}
+	if len(padded) > maxObfsFrameData {
+		return nil, errors.New("obfuscated frame exceeds maximum size")
 	}
 
 	// Apply stream cipher obfuscation
-	obfuscated := make([]byte, len(padded))
-	if o.sendCipher != nil {
-		o.sendCipher.XORKeyStream(obfuscated, padded)
+	var obfuscated []byte
+	if o.config.Datagram {
+		// A fresh nonce keys each frame's stream, so frames can be decoded
+		// after loss or reordering
+		obfuscated = make([]byte, datagramNonceSize+len(padded))
+		if nonce != nil {
+			copy(obfuscated, nonce)
+		} else {
+			rand.Read(obfuscated[:datagramNonceSize])
+		}
+		stream, err := o.frameStream(o.sendKey, obfuscated[:datagramNonceSize])
+		if err != nil {
+			return nil, err
+		}
+		stream.XORKeyStream(obfuscated[datagramNonceSize:], padded)
 	} else {
-		copy(obfuscated, padded)
+		obfuscated = make([]byte, len(padded))
+		if o.sendCipher != nil {
+			o.sendCipher.XORKeyStream(obfuscated, padded)
+		} else {
+			copy(obfuscated, padded)
+		}
 	}
 
 	// Add protocol-specific framing
@@ -188,7 +293,7 @@ func (o *Obfuscator) ObfuscateFrame(plaintext []byte) ([]byte, error) {
 	case ObfsModeOBFS4:
 		return o.wrapOBFS4Frame(obfuscated)
 	default:
-		return obfuscated, nil
+		return wrapLengthFrame(obfuscated), nil
 	}
 }
 
@@ -208,7 +313,7 @@ func (o *Obfuscator) DeobfuscateFrame(ciphertext []byte) ([]byte, error) {
 	case ObfsModeOBFS4:
 		payload, err = o.unwrapOBFS4Frame(ciphertext)
 	default:
-		payload = ciphertext
+		payload, err = unwrapLengthFrame(ciphertext)
 	}
 
 	if err != nil {
@@ -216,11 +321,24 @@ func (o *Obfuscator) DeobfuscateFrame(ciphertext []byte) ([]byte, error) {
 	}
 
 	// Deobfuscate
-	plaintext := make([]byte, len(payload))
-	if o.recvCipher != nil {
-		o.recvCipher.XORKeyStream(plaintext, payload)
+	var plaintext []byte
+	if o.config.Datagram {
+		if len(payload) < datagramNonceSize {
+			return nil, errors.New("obfuscated datagram too short")
+		}
+		stream, err := o.frameStream(o.recvKey, payload[:datagramNonceSize])
+		if err != nil {
+			return nil, err
+		}
+		plaintext = make([]byte, len(payload)-datagramNonceSize)
+		stream.XORKeyStream(plaintext, payload[datagramNonceSize:])
 	} else {
-		copy(plaintext, payload)
+		plaintext = make([]byte, len(payload))
+		if o.recvCipher != nil {
+			o.recvCipher.XORKeyStream(plaintext, payload)
+		} else {
+			copy(plaintext, payload)
+		}
 	}
 
 	// Remove padding if present
@@ -234,6 +352,40 @@ func (o *Obfuscator) DeobfuscateFrame(ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// ReadFrame reads exactly one obfuscated frame, as produced by ObfuscateFrame,
+// from a byte stream. The result is passed to DeobfuscateFrame.
+func (o *Obfuscator) ReadFrame(r io.Reader) ([]byte, error) {
+	var headerLen, trailerLen int
+	switch o.mode {
+	case ObfsModeNone:
+		return nil, errors.New("obfuscation disabled")
+	case ObfsModeTLS:
+		headerLen = 5
+	case ObfsModeOBFS4:
+		headerLen, trailerLen = 3, 16
+	default:
+		headerLen = 2
+	}
+
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var dataLen int
+	if o.mode == ObfsModeTLS {
+		dataLen = int(binary.BigEndian.Uint16(header[3:5]))
+	} else {
+		dataLen = int(binary.BigEndian.Uint16(header[0:2]))
+	}
+
+	frame := make([]byte, headerLen+dataLen+trailerLen)
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[headerLen:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
 // GetIATDelay returns the Inter-Arrival Time delay for timing obfuscation
 func (o *Obfuscator) GetIATDelay() time.Duration {
 	if o.config.IATMode == 0 || o.iatDist == nil {
@@ -298,15 +450,18 @@ func (o *Obfuscator) wrapOBFS4Frame(data []byte) ([]byte, error) {
 	frame[2] = 0x00 // Data frame type
 	copy(frame[3:], data)
 
-	// Compute MAC
+	// Compute MAC. Datagram frames carry their own nonce inside the MAC'd
+	// data, so the implicit counter stays at zero.
 	mac := hmac.New(sha256.New, o.config.Seed)
 	nonceBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(nonceBuf, o.sendNonce)
+	if !o.config.Datagram {
+		binary.BigEndian.PutUint64(nonceBuf, o.sendNonce)
+		o.sendNonce++
+	}
 	mac.Write(nonceBuf)
 	mac.Write(frame[0 : frameLen-16])
 	copy(frame[frameLen-16:], mac.Sum(nil)[:16])
 
-	o.sendNonce++
 	return frame, nil
 }
 
@@ -324,7 +479,9 @@ func (o *Obfuscator) unwrapOBFS4Frame(frame []byte) ([]byte, error) {
 	expectedMac := frame[len(frame)-16:]
 	mac := hmac.New(sha256.New, o.config.Seed)
 	nonceBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(nonceBuf, o.recvNonce)
+	if !o.config.Datagram {
+		binary.BigEndian.PutUint64(nonceBuf, o.recvNonce)
+	}
 	mac.Write(nonceBuf)
 	mac.Write(frame[0 : len(frame)-16])
 	computedMac := mac.Sum(nil)[:16]
@@ -333,10 +490,57 @@ func (o *Obfuscator) unwrapOBFS4Frame(frame []byte) ([]byte, error) {
 		return nil, errors.New("obfs4 MAC verification failed")
 	}
 
-	o.recvNonce++
+	if !o.config.Datagram {
+		o.recvNonce++
+	}
 	return frame[3 : 3+dataLen], nil
 }
 
+// datagramNonceSize is the per-frame nonce prepended in datagram mode
+const datagramNonceSize = 8
+
+// frameStream returns the keystream for a single datagram frame
+func (o *Obfuscator) frameStream(key, nonce []byte) (cipher.Stream, error) {
+	frameKey := hmac.New(sha256.New, key)
+	frameKey.Write(nonce)
+	derived := frameKey.Sum(nil)
+	if o.mode == ObfsModeXOR {
+		return newXORCipher(derived), nil
+	}
+	return newCTRCipher(derived)
+}
+
+// maxObfsFrameData is the largest payload the 16-bit frame length fields can carry
+const maxObfsFrameData = 0xFFFF
+
+// wrapLengthFrame prefixes unframed modes with a length so frames can be
+// recovered from a byte stream
+func wrapLengthFrame(data []byte) []byte {
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame[0:2], uint16(len(data)))
+	copy(frame[2:], data)
+	return frame
+}
+
+func unwrapLengthFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 2 {
+		return nil, errors.New("obfuscated frame too short")
+	}
+	dataLen := binary.BigEndian.Uint16(frame[0:2])
+	if len(frame) < 2+int(dataLen) {
+		return nil, errors.New("obfuscated frame truncated")
+	}
+	return frame[2 : 2+dataLen], nil
+}
+
+// deriveFrameMACKey derives the obfs4 frame MAC key when no seed is configured
+func deriveFrameMACKey(masterKey, sessionID []byte) []byte {
+	reader := hkdf.New(sha256.New, masterKey, sessionID, []byte("obfuscation mac"))
+	key := make([]byte, 32)
+	io.ReadFull(reader, key)
+	return key
+}
+
 func deriveObfuscationKeys(masterKey, sessionID []byte) (send, recv []byte) {
 	// Derive independent send/recv keys
 	reader := hkdf.New(sha256.New, masterKey, sessionID, []byte("obfuscation"))
@@ -425,6 +629,7 @@ type TrafficShaper struct {
 	obfs      *Obfuscator
 	sendQueue chan []byte
 	iatMode   int
+	mu        sync.Mutex // serializes IAT sampling for Delay
 }
 
 // NewTrafficShaper creates a traffic shaper
@@ -461,6 +666,18 @@ func (ts *TrafficShaper) Shape(data []byte) <-chan []byte {
 	return out
 }
 
+// Delay samples the inter-arrival delay to wait before the next frame. It
+// lets a caller sleep without holding its write lock and obfuscate the frame
+// itself afterwards.
+func (ts *TrafficShaper) Delay() time.Duration {
+	if ts.iatMode == 0 {
+		return 0
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.obfs.GetIATDelay()
+}
+
 // BatchShape processes multiple frames with traffic shaping
 func (ts *TrafficShaper) BatchShape(frames [][]byte) <-chan []byte {
 	out := make(chan []byte, len(frames))
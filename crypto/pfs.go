@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
@@ -26,8 +27,25 @@ type PFSConfig struct {
 
 	// MaxEpochAge is the maximum age of a key epoch before forced rekey
 	MaxEpochAge time.Duration
+
+	// RekeyTimeout is how long a rekey request waits for its response before
+	// it is sent again, doubling with every try (0 for the default)
+	RekeyTimeout time.Duration
+
+	// RekeyAttempts bounds how often a rekey request is sent before it is
+	// abandoned (0 for the default)
+	RekeyAttempts int
 }
 
+const (
+	defaultRekeyTimeout  = time.Second
+	defaultRekeyAttempts = 5
+)
+
+// ErrRekeyTimeout reports a rekey request abandoned after its last try went
+// unanswered
+var ErrRekeyTimeout = errors.New("rekey request unanswered")
+
 // DefaultPFSConfig returns a secure default configuration
 func DefaultPFSConfig() PFSConfig {
 	return PFSConfig{
@@ -58,8 +76,15 @@ type PFSManager struct {
 	// Configuration
 	config PFSConfig
 
-	// Pending rekey
-	pendingRekey *RekeyContext
+	// Pending rekey, when it was last sent and how often
+	pendingRekey    *RekeyContext
+	pendingSent     time.Time
+	pendingAttempts int
+
+	// The last rekey request answered and its response, sent again when
+	// the request is repeated because the response was lost
+	answeredRequest  []byte
+	answeredResponse []byte
 
 	// Role
 	role HandshakeRole
@@ -165,9 +190,76 @@ func (p *PFSManager) InitiateRekey() (*RekeyContext, error) {
 	}
 
 	p.pendingRekey = ctx
+	p.pendingSent = time.Now()
+	p.pendingAttempts = 1
 	return ctx, nil
 }
 
+// RekeyTimeout returns how long a new rekey request waits for its response
+// before RetryRekey is due.
+func (p *PFSManager) RekeyTimeout() time.Duration {
+	if p.config.RekeyTimeout > 0 {
+		return p.config.RekeyTimeout
+	}
+	return defaultRekeyTimeout
+}
+
+// RetryRekey handles the pending rekey request ctx once it may have gone
+// unanswered. When its timeout has passed it returns the payload to send
+// again; either way it returns how long to wait before the next call. After
+// RekeyAttempts tries the request is abandoned with ErrRekeyTimeout, so that
+// a later rekey can start afresh. Nothing is returned once ctx has been
+// answered or cancelled.
+func (p *PFSManager) RetryRekey(ctx *RekeyContext) ([]byte, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ctx == nil || p.pendingRekey != ctx {
+		return nil, 0, nil
+	}
+	timeout := p.RekeyTimeout() << (p.pendingAttempts - 1)
+	if wait := timeout - time.Since(p.pendingSent); wait > 0 {
+		return nil, wait, nil
+	}
+	attempts := p.config.RekeyAttempts
+	if attempts <= 0 {
+		attempts = defaultRekeyAttempts
+	}
+	if p.pendingAttempts >= attempts {
+		p.pendingRekey = nil
+		return nil, 0, ErrRekeyTimeout
+	}
+	p.pendingAttempts++
+	p.pendingSent = time.Now()
+	return ctx.Payload, timeout * 2, nil
+}
+
+// AnsweredRekey returns the response already sent for a rekey request
+// that arrives again, nil for any other payload.
+func (p *PFSManager) AnsweredRekey(payload []byte) []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.answeredRequest == nil || !bytes.Equal(payload, p.answeredRequest) {
+		return nil
+	}
+	return p.answeredResponse
+}
+
+// RekeyPending reports whether a rekey request awaits its response
+func (p *PFSManager) RekeyPending() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pendingRekey != nil
+}
+
+// CancelRekey abandons the pending rekey request, e.g. when the peer's
+// concurrent request takes precedence
+func (p *PFSManager) CancelRekey() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pendingRekey = nil
+}
+
 // ProcessRekeyMessage processes an incoming rekey message
 func (p *PFSManager) ProcessRekeyMessage(payload []byte) (*SessionSecrets, []byte, error) {
 	p.mu.Lock()
@@ -181,6 +273,10 @@ func (p *PFSManager) ProcessRekeyMessage(payload []byte) (*SessionSecrets, []byt
 	if newSecrets != nil {
 		p.commitRekey(newSecrets)
 		p.pendingRekey = nil
+		if len(response) > 0 {
+			p.answeredRequest = append([]byte(nil), payload...)
+			p.answeredResponse = response
+		}
 	}
 
 	return newSecrets, response, err
@@ -248,13 +344,13 @@ func (p *PFSManager) timeUntilRekey() time.Duration {
 
 // PFSStats contains PFS statistics
 type PFSStats struct {
-	CurrentEpoch     uint32
-	LastRekey        time.Time
-	MessagesSent     uint64
-	MessagesReceived uint64
-	BytesSent        uint64
-	BytesReceived    uint64
-	TimeUntilRekey   time.Duration
+	CurrentEpoch     uint32        `json:"currentEpoch"`
+	LastRekey        time.Time     `json:"lastRekey"`
+	MessagesSent     uint64        `json:"messagesSent"`
+	MessagesReceived uint64        `json:"messagesReceived"`
+	BytesSent        uint64        `json:"bytesSent"`
+	BytesReceived    uint64        `json:"bytesReceived"`
+	TimeUntilRekey   time.Duration `json:"timeUntilRekey"`
 }
 
 // DoubleRatchet implements the Double Ratchet algorithm for continuous key rotation
@@ -114,6 +114,97 @@ func TestNoiseHandshake(t *testing.T) {
 		cRes.res.Version, cRes.res.CipherSuite)
 }
 
+// TestNoiseXXHandshake tests the Noise XXpsk3 handshake without pinned keys
+func TestNoiseXXHandshake(t *testing.T) {
+	psk := make([]byte, 32)
+	copy(psk, []byte("test-preshared-key-123456789012"))
+
+	clientStatic, _ := GeneratePrivateKey()
+	clientPub, _ := derivePublicKey(clientStatic)
+	serverStatic, _ := GeneratePrivateKey()
+	serverPub, _ := derivePublicKey(serverStatic)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	type result struct {
+		res *NoiseHandshakeResult
+		err error
+	}
+	serverResult := make(chan result, 1)
+
+	go func() {
+		res, err := PerformNoiseHandshake(serverConn, RoleServer, NoiseHandshakeOptions{
+			Pattern:      NoiseXXpsk3,
+			PreSharedKey: psk,
+			StaticKey:    serverStatic,
+			KeepAlive:    20 * time.Second,
+		})
+		serverResult <- result{res, err}
+	}()
+
+	cRes, err := PerformNoiseHandshake(clientConn, RoleClient, NoiseHandshakeOptions{
+		Pattern:      NoiseXXpsk3,
+		PreSharedKey: psk,
+		StaticKey:    clientStatic,
+		MaxPadding:   32,
+	})
+	if err != nil {
+		t.Fatalf("Client handshake failed: %v", err)
+	}
+	sRes := <-serverResult
+	if sRes.err != nil {
+		t.Fatalf("Server handshake failed: %v", sRes.err)
+	}
+
+	if cRes.Secrets.SessionID != sRes.res.Secrets.SessionID {
+		t.Error("Session IDs don't match")
+	}
+	if !bytes.Equal(cRes.Secrets.SendKey, sRes.res.Secrets.ReceiveKey) {
+		t.Error("Client send key != server receive key")
+	}
+	if !bytes.Equal(cRes.Secrets.ReceiveKey, sRes.res.Secrets.SendKey) {
+		t.Error("Client receive key != server send key")
+	}
+	if cRes.RemoteStatic != serverPub {
+		t.Error("Client doesn't have correct server static key")
+	}
+	if sRes.res.RemoteStatic != clientPub {
+		t.Error("Server doesn't have correct client static key")
+	}
+	if cRes.Parameters.KeepAlive != 20*time.Second {
+		t.Errorf("Unexpected keepalive %v", cRes.Parameters.KeepAlive)
+	}
+}
+
+// TestNoiseXXHandshakePSKMismatch ensures the responder rejects a wrong PSK
+func TestNoiseXXHandshakePSKMismatch(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := PerformNoiseHandshake(serverConn, RoleServer, NoiseHandshakeOptions{
+			Pattern:      NoiseXXpsk3,
+			PreSharedKey: []byte("server-preshared-key-0123456789"),
+		})
+		serverErr <- err
+	}()
+
+	_, err := PerformNoiseHandshake(clientConn, RoleClient, NoiseHandshakeOptions{
+		Pattern:      NoiseXXpsk3,
+		PreSharedKey: []byte("client-preshared-key-0123456789"),
+	})
+	if err != nil {
+		t.Fatalf("Client handshake failed early: %v", err)
+	}
+	if err := <-serverErr; err == nil {
+		t.Fatal("Server accepted mismatched PSK")
+	}
+}
+
 // TestPFSManager tests the PFS manager
 func TestPFSManager(t *testing.T) {
 	secrets := SessionSecrets{
@@ -162,6 +253,43 @@ func TestPFSManager(t *testing.T) {
 		stats.MessagesSent+stats.MessagesReceived)
 }
 
+// TestPFSManagerRekeyRetry tests retransmission of an unanswered rekey
+func TestPFSManagerRekeyRetry(t *testing.T) {
+	secrets := SessionSecrets{
+		SendKey:        make([]byte, 32),
+		ReceiveKey:     make([]byte, 32),
+		ObfuscationKey: make([]byte, 32),
+		Epoch:          1,
+		Established:    time.Now(),
+	}
+	mgr := NewPFSManager(secrets, RoleClient, PFSConfig{RekeyTimeout: 20 * time.Millisecond, RekeyAttempts: 2})
+
+	ctx, err := mgr.InitiateRekey()
+	if err != nil {
+		t.Fatalf("InitiateRekey failed: %v", err)
+	}
+	if payload, wait, err := mgr.RetryRekey(ctx); payload != nil || wait <= 0 || err != nil {
+		t.Fatalf("Retry before the timeout: payload=%v wait=%v err=%v", payload != nil, wait, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	payload, wait, err := mgr.RetryRekey(ctx)
+	if err != nil || !bytes.Equal(payload, ctx.Payload) || wait != 40*time.Millisecond {
+		t.Fatalf("Expected the request again with a doubled timeout: wait=%v err=%v", wait, err)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, _, err := mgr.RetryRekey(ctx); err != ErrRekeyTimeout {
+		t.Fatalf("Expected ErrRekeyTimeout after the last try, got %v", err)
+	}
+	if mgr.RekeyPending() {
+		t.Fatal("Abandoned rekey still pending")
+	}
+	if _, err := mgr.InitiateRekey(); err != nil {
+		t.Fatalf("New rekey after abandoning failed: %v", err)
+	}
+}
+
 // TestAntiReplay tests anti-replay protection
 func TestAntiReplay(t *testing.T) {
 	config := AntiReplayConfig{
@@ -354,6 +482,78 @@ func TestDowngradeProtection(t *testing.T) {
 	}
 }
 
+// pipeChannel carries negotiation messages between two goroutines
+type pipeChannel struct {
+	out chan<- []byte
+	in  <-chan []byte
+}
+
+func (c pipeChannel) Send(message []byte) error {
+	c.out <- message
+	return nil
+}
+
+func (c pipeChannel) Receive() ([]byte, error) {
+	return <-c.in, nil
+}
+
+// TestNegotiateSession tests the negotiation exchange over a channel and the
+// keys its frames travel under
+func TestNegotiateSession(t *testing.T) {
+	c2s := bytes.Repeat([]byte{0x11}, KeySize)
+	s2c := bytes.Repeat([]byte{0x22}, KeySize)
+	clientSecrets := SessionSecrets{SendKey: c2s, ReceiveKey: s2c, ObfuscationKey: bytes.Repeat([]byte{0x33}, KeySize)}
+	clientSecrets.SessionID[0] = 1
+	serverSecrets := clientSecrets
+	serverSecrets.SendKey, serverSecrets.ReceiveKey = s2c, c2s
+
+	clientKeys, err := NegotiationSecrets(clientSecrets)
+	if err != nil {
+		t.Fatalf("Failed to derive negotiation secrets: %v", err)
+	}
+	serverKeys, err := NegotiationSecrets(serverSecrets)
+	if err != nil {
+		t.Fatalf("Failed to derive negotiation secrets: %v", err)
+	}
+	if !bytes.Equal(clientKeys.SendKey, serverKeys.ReceiveKey) || !bytes.Equal(clientKeys.ObfuscationKey, serverKeys.ObfuscationKey) {
+		t.Error("Negotiation keys do not mirror between roles")
+	}
+	if bytes.Equal(clientKeys.SendKey, c2s) || bytes.Equal(clientKeys.ReceiveKey, s2c) || bytes.Equal(clientKeys.ObfuscationKey, clientSecrets.ObfuscationKey) {
+		t.Error("Negotiation keys reuse the traffic keys")
+	}
+
+	config := NegotiationConfig{
+		MinVersion:          ProtocolVersionNoise,
+		MaxVersion:          ProtocolVersionCurrent,
+		CipherSuites:        []CipherSuite{CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305},
+		DowngradeProtection: true,
+	}
+	toServer := make(chan []byte, 1)
+	toClient := make(chan []byte, 1)
+
+	type outcome struct {
+		params NegotiatedParams
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		params, err := NegotiateSession(pipeChannel{out: toClient, in: toServer}, RoleServer, config, serverSecrets)
+		done <- outcome{params, err}
+	}()
+
+	clientParams, err := NegotiateSession(pipeChannel{out: toServer, in: toClient}, RoleClient, config, clientSecrets)
+	if err != nil {
+		t.Fatalf("Client negotiation failed: %v", err)
+	}
+	server := <-done
+	if server.err != nil {
+		t.Fatalf("Server negotiation failed: %v", server.err)
+	}
+	if clientParams.CipherSuite != server.params.CipherSuite || clientParams.Version != server.params.Version {
+		t.Errorf("Negotiation disagreement: client %+v, server %+v", clientParams, server.params)
+	}
+}
+
 // TestCipherSuites tests all cipher suites
 func TestCipherSuites(t *testing.T) {
 	testData := []byte("The quick brown fox jumps over the lazy dog")
@@ -485,3 +685,38 @@ func (cs CipherSuite) String() string {
 	info, _ := GetCipherSuiteInfo(cs)
 	return info.Name
 }
+
+// TestAntiReplayLargeWindow tests a window wider than one bitmap word
+func TestAntiReplayLargeWindow(t *testing.T) {
+	ar := NewAntiReplay(AntiReplayConfig{Mode: AntiReplayWindow, WindowSize: 256, MaxAge: -1})
+
+	for _, seq := range []uint64{300, 100, 299, 45, 200} {
+		if err := ar.Check(seq); err != nil {
+			t.Fatalf("sequence %d rejected: %v", seq, err)
+		}
+		ar.Accept(seq)
+	}
+	for _, seq := range []uint64{100, 200, 299, 44} {
+		if err := ar.Check(seq); err == nil {
+			t.Errorf("sequence %d accepted twice or outside window", seq)
+		}
+	}
+
+	// Advancing past a word boundary keeps older bits
+	ar.Check(370)
+	ar.Accept(370)
+	if err := ar.Check(200); err == nil {
+		t.Error("replay detected before shift but not after")
+	}
+	if err := ar.Check(201); err != nil {
+		t.Errorf("unseen sequence 201 rejected: %v", err)
+	}
+
+	stats := ar.Stats()
+	if stats.WindowBase != 370 || stats.WindowSize != 256 {
+		t.Errorf("unexpected window position %d/%d", stats.WindowBase, stats.WindowSize)
+	}
+	if stats.Accepted != 6 || stats.Rejected != 5 {
+		t.Errorf("expected 6 accepted and 5 rejected, got %d/%d", stats.Accepted, stats.Rejected)
+	}
+}
@@ -60,6 +60,13 @@ func NewRekeyRequest(secrets SessionSecrets, role HandshakeRole) (*RekeyContext,
 	return &ctx, nil
 }
 
+// IsRekeyResponse reports whether payload answers a rekey request, as
+// opposed to starting one.
+func IsRekeyResponse(payload []byte) bool {
+	msg, err := decodeRekeyMessage(payload)
+	return err == nil && (msg.Flags&rekeyFlagResponse) != 0
+}
+
 func ProcessRekey(current SessionSecrets, payload []byte, pending *RekeyContext, role HandshakeRole) (*SessionSecrets, []byte, error) {
 	msg, err := decodeRekeyMessage(payload)
 	if err != nil {
@@ -0,0 +1,270 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Session resumption lets a client skip the full handshake by presenting a
+// ticket issued in an earlier session. The client sends a single offer record
+// and may send data straight away under early keys derived from the ticket's
+// resumption secret alone. The server answers inside the tunnel with a fresh
+// ephemeral key, and both sides move on to forward-secret keys for epoch 1.
+
+const (
+	resumeNonceSize  = 16
+	resumeOfferSize  = 2 + 16 + resumeNonceSize + 32 + handshakeMacSize
+	resumeAcceptSize = resumeNonceSize + 32 + 2 + 1 + handshakeMacSize
+)
+
+var errResumeMAC = errors.New("resumption MAC mismatch")
+
+// ResumeOffer is the client's first and only handshake record when resuming.
+type ResumeOffer struct {
+	TicketID [16]byte
+	Nonce    [resumeNonceSize]byte
+	Public   [32]byte
+	MAC      [handshakeMacSize]byte
+
+	private []byte // client only
+}
+
+// ResumptionSecret derives the secret a ticket carries from the session
+// secrets. Both sides derive the same value.
+func ResumptionSecret(secrets SessionSecrets, role HandshakeRole) ([]byte, error) {
+	if len(secrets.SendKey) == 0 || len(secrets.ReceiveKey) == 0 {
+		return nil, errors.New("session secrets required for resumption")
+	}
+	clientToServer, serverToClient := secrets.SendKey, secrets.ReceiveKey
+	if role == RoleServer {
+		clientToServer, serverToClient = secrets.ReceiveKey, secrets.SendKey
+	}
+	ikm := make([]byte, 0, len(clientToServer)+len(serverToClient))
+	ikm = append(ikm, clientToServer...)
+	ikm = append(ikm, serverToClient...)
+
+	key := make([]byte, KeySize)
+	reader := hkdf.New(sha256.New, ikm, secrets.SessionID[:], []byte("stp resumption"))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SendResumeOffer writes a resumption offer for the given ticket.
+func SendResumeOffer(conn net.Conn, ticketID [16]byte, secret []byte) (*ResumeOffer, error) {
+	private, public, err := ephemeralKeypair()
+	if err != nil {
+		return nil, err
+	}
+	offer := &ResumeOffer{TicketID: ticketID, Public: public, private: private}
+	if _, err := rand.Read(offer.Nonce[:]); err != nil {
+		return nil, err
+	}
+	copy(offer.MAC[:], resumeMAC(secret, []byte("stp resume offer"), offer.signed()))
+	if err := writeRecord(conn, offer.encode()); err != nil {
+		return nil, err
+	}
+	return offer, nil
+}
+
+// ParseResumeOffer decodes a record that may be a resumption offer. It only
+// checks the shape; the caller looks the ticket up and calls Verify.
+func ParseResumeOffer(payload []byte) (*ResumeOffer, bool) {
+	if len(payload) != resumeOfferSize || payload[0] != msgTypeResumeOffer || payload[1] != handshakeVersion {
+		return nil, false
+	}
+	offer := &ResumeOffer{}
+	offset := 2
+	offset += copy(offer.TicketID[:], payload[offset:])
+	offset += copy(offer.Nonce[:], payload[offset:])
+	offset += copy(offer.Public[:], payload[offset:])
+	copy(offer.MAC[:], payload[offset:])
+	return offer, true
+}
+
+// Verify checks that the offer was made by a holder of the ticket secret.
+func (o *ResumeOffer) Verify(secret []byte) error {
+	expected := resumeMAC(secret, []byte("stp resume offer"), o.signed())
+	if !hmac.Equal(expected, o.MAC[:]) {
+		return errResumeMAC
+	}
+	return nil
+}
+
+// EarlySecrets returns the epoch 0 keys both sides use until the server's
+// accept has been processed. They depend only on the ticket, so data sent
+// under them is not forward secret and may be replayed unless the server
+// refuses to redeem a ticket twice.
+func (o *ResumeOffer) EarlySecrets(secret []byte, role HandshakeRole) (SessionSecrets, error) {
+	salt := append(append([]byte(nil), o.TicketID[:]...), o.Nonce[:]...)
+	return resumeSecrets(secret, salt, "stp resume early", role, o.Public, 0)
+}
+
+// AcceptResume derives the forward-secret epoch 1 keys on the server and
+// returns the accept message to send to the client under the early keys.
+func AcceptResume(secret []byte, offer *ResumeOffer, params TransportParameters) (SessionSecrets, []byte, error) {
+	private, public, err := ephemeralKeypair()
+	if err != nil {
+		return SessionSecrets{}, nil, err
+	}
+	var nonce [resumeNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return SessionSecrets{}, nil, err
+	}
+	shared, err := deriveSharedSecret(private, offer.Public[:])
+	if err != nil {
+		return SessionSecrets{}, nil, err
+	}
+	secrets, err := finalResumeSecrets(secret, shared, offer, nonce, RoleServer, offer.Public)
+	if err != nil {
+		return SessionSecrets{}, nil, err
+	}
+
+	accept := make([]byte, 0, resumeAcceptSize)
+	accept = append(accept, nonce[:]...)
+	accept = append(accept, public[:]...)
+	accept = binary.BigEndian.AppendUint16(accept, uint16(params.KeepAlive/time.Millisecond))
+	accept = append(accept, params.MaxPadding)
+	accept = append(accept, resumeMAC(secret, []byte("stp resume accept"), offer.signed(), accept)...)
+	return secrets, accept, nil
+}
+
+// FinishResume processes the server's accept on the client and returns the
+// epoch 1 keys and the server's transport parameters.
+func FinishResume(secret []byte, offer *ResumeOffer, accept []byte) (SessionSecrets, TransportParameters, error) {
+	if len(accept) != resumeAcceptSize {
+		return SessionSecrets{}, TransportParameters{}, errors.New("invalid resumption accept length")
+	}
+	body := accept[:len(accept)-handshakeMacSize]
+	expected := resumeMAC(secret, []byte("stp resume accept"), offer.signed(), body)
+	if !hmac.Equal(expected, accept[len(body):]) {
+		return SessionSecrets{}, TransportParameters{}, errResumeMAC
+	}
+	var nonce [resumeNonceSize]byte
+	var serverPublic [32]byte
+	offset := copy(nonce[:], body)
+	offset += copy(serverPublic[:], body[offset:])
+	params := TransportParameters{
+		KeepAlive:  time.Duration(binary.BigEndian.Uint16(body[offset:])) * time.Millisecond,
+		MaxPadding: body[offset+2],
+	}
+
+	shared, err := deriveSharedSecret(offer.private, serverPublic[:])
+	if err != nil {
+		return SessionSecrets{}, TransportParameters{}, err
+	}
+	secrets, err := finalResumeSecrets(secret, shared, offer, nonce, RoleClient, serverPublic)
+	if err != nil {
+		return SessionSecrets{}, TransportParameters{}, err
+	}
+	return secrets, params, nil
+}
+
+// PeekRecord reads the first handshake record from conn and returns it along
+// with a connection that delivers the same record again, so a full handshake
+// can still run when the record is not a resumption offer.
+func PeekRecord(conn net.Conn) ([]byte, net.Conn, error) {
+	payload, err := readRecord(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	record[0] = 0x17
+	record[1] = 0x03
+	record[2] = 0x03
+	binary.BigEndian.PutUint16(record[3:], uint16(len(payload)))
+	copy(record[recordHeaderSize:], payload)
+	return payload, &peekedConn{Conn: conn, pending: record}, nil
+}
+
+// peekedConn replays one already-read record before reading from the
+// underlying connection.
+type peekedConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *peekedConn) Write(p []byte) (int, error) { return c.Conn.Write(p) }
+
+// Datagram keeps the packet framing of the underlying connection visible
+func (c *peekedConn) Datagram() bool { return isDatagram(c.Conn) }
+
+func (o *ResumeOffer) signed() []byte {
+	buf := make([]byte, 0, resumeOfferSize-handshakeMacSize)
+	buf = append(buf, msgTypeResumeOffer, handshakeVersion)
+	buf = append(buf, o.TicketID[:]...)
+	buf = append(buf, o.Nonce[:]...)
+	buf = append(buf, o.Public[:]...)
+	return buf
+}
+
+func (o *ResumeOffer) encode() []byte {
+	return append(o.signed(), o.MAC[:]...)
+}
+
+func resumeMAC(secret []byte, label []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(label)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)[:handshakeMacSize]
+}
+
+func finalResumeSecrets(secret, shared []byte, offer *ResumeOffer, serverNonce [resumeNonceSize]byte, role HandshakeRole, peerPublic [32]byte) (SessionSecrets, error) {
+	ikm := append(append([]byte(nil), shared...), secret...)
+	salt := bytes.Join([][]byte{offer.TicketID[:], offer.Nonce[:], serverNonce[:]}, nil)
+	return resumeSecrets(ikm, salt, "stp resume", role, peerPublic, 1)
+}
+
+func resumeSecrets(ikm, salt []byte, label string, role HandshakeRole, peerPublic [32]byte, epoch uint32) (SessionSecrets, error) {
+	clientToServer, err := expandKey(ikm, salt, []byte(label+" c2s"))
+	if err != nil {
+		return SessionSecrets{}, err
+	}
+	serverToClient, err := expandKey(ikm, salt, []byte(label+" s2c"))
+	if err != nil {
+		return SessionSecrets{}, err
+	}
+	obfuscation, err := expandKey(ikm, salt, []byte(label+" obfuscation"))
+	if err != nil {
+		return SessionSecrets{}, err
+	}
+	sessionKey, err := expandKey(ikm, salt, []byte(label+" session id"))
+	if err != nil {
+		return SessionSecrets{}, err
+	}
+
+	secrets := SessionSecrets{
+		SendKey:        clientToServer,
+		ReceiveKey:     serverToClient,
+		ObfuscationKey: obfuscation,
+		PeerPublicKey:  peerPublic,
+		Epoch:          epoch,
+		Established:    time.Now().UTC(),
+	}
+	if role == RoleServer {
+		secrets.SendKey, secrets.ReceiveKey = serverToClient, clientToServer
+	}
+	copy(secrets.SessionID[:], sessionKey)
+	return secrets, nil
+}
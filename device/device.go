@@ -2,12 +2,13 @@ package device
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
-	"os"
 	"sync"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"stp/crypto"
 	"stp/internal/dataplane"
 	"stp/internal/logging"
+	"stp/internal/timers"
 	"stp/packet"
 	"stp/peer"
 	"stp/transport"
@@ -35,16 +37,25 @@ type routeEntry struct {
 type Device struct {
 	role              Role
 	privateKey        []byte
+	publicKey         [32]byte
 	transport         *transport.Transport
 	secrets           crypto.SessionSecrets
 	mu                sync.RWMutex
 	keepaliveInterval time.Duration
 	maxPadding        uint8
-	rekeyInterval     time.Duration
-	rekeyBudget       uint64
+	rekeyPolicy       crypto.PFSConfig
+	pfs               *crypto.PFSManager
 	logger            *logging.Logger
 	messageCount      uint64
-	pendingRekey      *crypto.RekeyContext
+	handshake         string
+	remotePeer        string
+	pskGeneration     int
+	securityProfile   string
+	negotiated        crypto.NegotiatedParams
+	resumed           bool
+	tickets           *transport.ZeroRTTManager
+	ticketKey         string // client: endpoint the tickets were issued by
+	ticketFile        string // client: where tickets are persisted
 
 	plane        dataplane.Interface
 	peers        map[string]*peer.Peer
@@ -53,29 +64,106 @@ type Device struct {
 	outboundStop chan struct{}
 	outboundWG   sync.WaitGroup
 	closed       bool
+	// conn is the connection of the current session. The outbound pump
+	// outlives it, so a client can reconnect without touching the dataplane.
+	conn       net.Conn
+	connTimers *timers.ConnectionTimers
+	// router is set on server sessions that share the server's dataplane
+	router *Router
+	// network holds the interface configuration of an owned TUN dataplane
+	network *tunnelNetwork
+	// relay is the connection a proxied session carries instead of
+	// dataplane traffic; outbound lets a server dial one for its client
+	relay         net.Conn
+	outbound      bool
+	outboundAllow []netip.Prefix
+	// mux carries streams inside the current session, see OpenStream
+	mux *muxSession
+	// forwards are the reverse forwards a client publishes, by name
+	forwards map[string]*forward
+	// localForwards are the forwards a client listens for, by name
+	localForwards map[string]*forward
 }
 
 type State struct {
-	Role         string          `json:"role"`
-	Keepalive    time.Duration   `json:"keepalive"`
-	MaxPadding   uint8           `json:"maxPadding"`
-	SessionID    string          `json:"sessionId"`
-	RekeyEpoch   uint32          `json:"rekeyEpoch"`
-	Messages     uint64          `json:"messages"`
-	PendingRekey bool            `json:"pendingRekey"`
-	Peers        []peer.Snapshot `json:"peers"`
-	LastSend     time.Time       `json:"lastSend"`
-	LastReceive  time.Time       `json:"lastReceive"`
+	Role          string                  `json:"role"`
+	Handshake     string                  `json:"handshake"`
+	PublicKey     string                  `json:"publicKey"`
+	RemotePeer    string                  `json:"remotePeer,omitempty"`
+	PSKGen        int                     `json:"pskGeneration,omitempty"`
+	Profile       string                  `json:"securityProfile"`
+	Negotiated    crypto.NegotiatedParams `json:"negotiated"`
+	CipherSuite   string                  `json:"cipherSuite"`
+	Obfuscation   string                  `json:"obfuscation"`
+	Keepalive     time.Duration           `json:"keepalive"`
+	MaxPadding    uint8                   `json:"maxPadding"`
+	SessionID     string                  `json:"sessionId"`
+	RekeyEpoch    uint32                  `json:"rekeyEpoch"`
+	Messages      uint64                  `json:"messages"`
+	PendingRekey  bool                    `json:"pendingRekey"`
+	Resumed       bool                    `json:"resumed"`
+	PFS           crypto.PFSStats         `json:"pfs"`
+	Peers         []peer.Snapshot         `json:"peers"`
+	Mux           *transport.MuxStats     `json:"mux,omitempty"`
+	Forwards      []ForwardState          `json:"forwards,omitempty"`
+	LocalForwards []ForwardState          `json:"localForwards,omitempty"`
+	LastSend      time.Time               `json:"lastSend"`
+	LastReceive   time.Time               `json:"lastReceive"`
 }
 
 func NewDevice(role Role, cfg *config.Config, logger *logging.Logger) (*Device, error) {
+	if cfg == nil {
+		return nil, errors.New("config is required")
+	}
+	names := make([]string, 0, len(cfg.Peers))
+	for _, peerCfg := range cfg.Peers {
+		names = append(names, peerCfg.Name)
+	}
+	plane, err := createDataplane(cfg, names)
+	if err != nil {
+		return nil, err
+	}
+	device, err := newDevice(role, cfg, logger, plane, nil)
+	if err != nil {
+		plane.Close()
+		return nil, err
+	}
+	network, err := configureTunnel(cfg, logger)
+	if err != nil {
+		plane.Close()
+		return nil, err
+	}
+	device.network = network
+	return device, nil
+}
+
+// staticKey resolves the configured static identity, generating one that
+// lasts as long as the process when none is configured.
+func staticKey(cfg *config.Config) ([]byte, error) {
+	privateKey, err := cfg.StaticPrivateKey(crypto.GeneratePrivateKey)
+	if err != nil || privateKey != nil {
+		return privateKey, err
+	}
+	return crypto.GeneratePrivateKey()
+}
+
+func newDevice(role Role, cfg *config.Config, logger *logging.Logger, plane dataplane.Interface, router *Router) (*Device, error) {
 	if cfg == nil {
 		return nil, errors.New("config is required")
 	}
 	if logger == nil {
 		return nil, errors.New("logger is required")
 	}
-	privateKey, err := crypto.GeneratePrivateKey()
+	var privateKey []byte
+	if router != nil {
+		privateKey = router.privateKey
+	} else {
+		var err error
+		if privateKey, err = staticKey(cfg); err != nil {
+			return nil, err
+		}
+	}
+	publicKey, err := crypto.PublicKey(privateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -84,12 +172,10 @@ func NewDevice(role Role, cfg *config.Config, logger *logging.Logger) (*Device,
 	maxPadding := cfg.EffectiveMaxPadding()
 
 	peerMap := make(map[string]*peer.Peer, len(cfg.Peers))
-	peerNames := make([]string, 0, len(cfg.Peers))
 	routes := make([]routeEntry, 0)
 	for _, peerCfg := range cfg.Peers {
 		p := peer.NewPeer(peerCfg.Name, nil, peerCfg.AllowedIPs)
 		peerMap[peerCfg.Name] = p
-		peerNames = append(peerNames, peerCfg.Name)
 		for _, cidr := range peerCfg.AllowedIPs {
 			if prefix, err := netip.ParsePrefix(cidr); err == nil {
 				routes = append(routes, routeEntry{prefix: prefix, peer: peerCfg.Name})
@@ -97,27 +183,55 @@ func NewDevice(role Role, cfg *config.Config, logger *logging.Logger) (*Device,
 		}
 	}
 
-	plane, err := createDataplane(cfg, peerNames)
-	if err != nil {
-		return nil, err
+	outboundAllow := make([]netip.Prefix, 0, len(cfg.Proxy.OutboundAllow))
+	for _, cidr := range cfg.Proxy.OutboundAllow {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy outboundAllow %q: %w", cidr, err)
+		}
+		outboundAllow = append(outboundAllow, prefix)
 	}
 
 	device := &Device{
 		role:              role,
 		privateKey:        privateKey,
+		publicKey:         publicKey,
 		transport:         transport.NewTransport(logger),
 		keepaliveInterval: keepalive,
 		maxPadding:        maxPadding,
-		rekeyInterval:     cfg.EffectiveRekeyInterval(),
-		rekeyBudget:       cfg.EffectiveRekeyBudget(),
+		rekeyPolicy:       rekeyPolicy(cfg),
+		ticketFile:        cfg.ZeroRTT.TicketFile,
 		logger:            logger,
 		plane:             plane,
 		peers:             peerMap,
 		routes:            routes,
+		router:            router,
+		outbound:          cfg.Proxy.Outbound,
+		outboundAllow:     outboundAllow,
 	}
+	device.transport.SetRoamHandler(device.recordRoam)
 	return device, nil
 }
 
+// rekeyPolicy maps the configured rekey budgets onto the PFS manager. The
+// interval is the only time limit, so no separate epoch age applies.
+func rekeyPolicy(cfg *config.Config) crypto.PFSConfig {
+	return crypto.PFSConfig{
+		RekeyInterval:      cfg.EffectiveRekeyInterval(),
+		RekeyAfterMessages: cfg.EffectiveRekeyBudget(),
+		RekeyAfterBytes:    cfg.EffectiveRekeyBytes(),
+	}
+}
+
+// SetTickets enables session resumption with the given ticket store. A
+// server shares one store across all sessions, so that a ticket outlives
+// the session that issued it.
+func (d *Device) SetTickets(tickets *transport.ZeroRTTManager) {
+	d.mu.Lock()
+	d.tickets = tickets
+	d.mu.Unlock()
+}
+
 func createDataplane(cfg *config.Config, peers []string) (dataplane.Interface, error) {
 	switch cfg.EffectiveTunnelType() {
 	case "loopback":
@@ -145,29 +259,106 @@ func (d *Device) Handshake(conn net.Conn, cfg *config.Config) error {
 	if cfg == nil {
 		return errors.New("config required for handshake")
 	}
+	d.detach(nil)
+
+	psk, generation, candidates, err := d.handshakePSKs(cfg)
+	if err != nil {
+		return err
+	}
+	mode := cfg.EffectiveHandshake()
+
+	// Over UDP the handshake retransmits its messages until answered
+	hsConn := conn
+	var retransmit *transport.HandshakeConn
+	if transport.IsDatagram(conn) {
+		retransmit = transport.NewHandshakeConn(conn)
+		hsConn = retransmit
+	}
+
+	d.mu.RLock()
+	tickets := d.tickets
+	d.mu.RUnlock()
+	if tickets != nil {
+		switch d.role {
+		case RoleClient:
+			d.ticketKey = cfg.Endpoint
+			if ticket := d.takeTicket(tickets); ticket != nil {
+				return d.resume(conn, hsConn, retransmit, cfg, ticket)
+			}
+		case RoleServer:
+			record, replay, err := crypto.PeekRecord(hsConn)
+			if err != nil {
+				return err
+			}
+			if offer, ok := crypto.ParseResumeOffer(record); ok {
+				return d.acceptResume(conn, hsConn, retransmit, cfg, tickets, offer)
+			}
+			hsConn = replay
+		}
+	}
 
-	psk := resolvePSK(cfg.PSK)
-	opts := crypto.HandshakeOptions{PreSharedKey: psk}
+	var result *crypto.HandshakeResult
+	switch mode {
+	case config.HandshakeNoiseIK, config.HandshakeNoiseXX:
+		result, err = d.noiseHandshake(hsConn, cfg, mode, psk, candidates)
+	default:
+		opts := crypto.HandshakeOptions{PreSharedKey: psk, PSKCandidates: candidates}
+		if d.role == RoleServer {
+			opts.KeepAlive = d.keepaliveInterval
+			opts.MaxPadding = d.maxPadding
+		}
+		result, err = crypto.PerformHandshake(d.privateKey, hsConn, crypto.HandshakeRole(d.role), opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	remotePeer := result.PSKID
 	if d.role == RoleServer {
-		opts.KeepAlive = d.keepaliveInterval
-		opts.MaxPadding = d.maxPadding
+		generation = result.PSKGeneration
+	}
+	if mode != config.HandshakeLegacy {
+		keyPeer, err := authorizeRemoteStatic(cfg, d.role, result.Secrets.PeerPublicKey)
+		if err != nil {
+			return err
+		}
+		if keyPeer != "" && remotePeer != "" && keyPeer != remotePeer {
+			return fmt.Errorf("static key of peer %q presented with psk of peer %q", keyPeer, remotePeer)
+		}
+		if keyPeer != "" {
+			remotePeer = keyPeer
+		}
 	}
 
-	result, err := crypto.PerformHandshake(d.privateKey, conn, crypto.HandshakeRole(d.role), opts)
+	profile := cfg.EffectiveSecurityProfile()
+	negotiationCfg, err := negotiationConfig(profile, mode, cfg.CipherSuites)
 	if err != nil {
 		return err
 	}
+	negotiated, err := d.negotiate(hsConn, cfg, negotiationCfg, result.Secrets, result.Parameters, retransmit != nil)
+	if err != nil {
+		return fmt.Errorf("negotiation failed: %w", err)
+	}
 
-	if err := d.transport.InstallSession(result.Secrets, result.Parameters); err != nil {
+	if err := d.installTransport(cfg, result.Secrets, result.Parameters, negotiated.CipherSuite, retransmit != nil); err != nil {
 		return err
 	}
+	if retransmit != nil {
+		d.transport.SetHandshakeReplay(retransmit)
+	}
 
 	d.mu.Lock()
 	d.secrets = result.Secrets
 	d.keepaliveInterval = result.Parameters.KeepAlive
 	d.maxPadding = result.Parameters.MaxPadding
 	d.messageCount = 0
-	d.pendingRekey = nil
+	d.pfs = crypto.NewPFSManager(result.Secrets, crypto.HandshakeRole(d.role), d.rekeyPolicy)
+	d.handshake = mode
+	d.remotePeer = remotePeer
+	d.pskGeneration = generation
+	d.securityProfile = profile
+	d.negotiated = negotiated
+	d.resumed = false
 	d.mu.Unlock()
 
 	if err := d.transport.SendBind(conn); err != nil {
@@ -178,26 +369,253 @@ func (d *Device) Handshake(conn net.Conn, cfg *config.Config) error {
 		"remote":    conn.RemoteAddr().String(),
 		"sessionId": hex.EncodeToString(result.Secrets.SessionID[:]),
 		"role":      d.role.String(),
+		"handshake": mode,
+		"peer":      remotePeer,
+		"pskGen":    generation,
+		"profile":   profile,
+		"version":   uint8(negotiated.Version),
+		"features":  negotiated.Features.String(),
 	})
 
 	d.recordHandshake(conn.RemoteAddr(), result.Secrets)
+	d.issueTicket(conn)
 	d.startOutboundPump(conn)
 	return nil
 }
 
+// installTransport configures obfuscation and anti-replay for a new session
+// and installs its keys.
+func (d *Device) installTransport(cfg *config.Config, secrets crypto.SessionSecrets, params crypto.TransportParameters, suite crypto.CipherSuite, datagram bool) error {
+	obfs, err := obfuscationConfig(cfg.Obfuscation, d.role)
+	if err != nil {
+		return err
+	}
+	obfs.Datagram = datagram
+	d.transport.SetObfuscation(obfs)
+	d.transport.SetReplayWindow(cfg.EffectiveReplayWindow())
+	return d.transport.InstallSession(secrets, params, suite)
+}
+
+// negotiate runs the negotiation exchange as session frames on a scratch
+// transport keyed for the negotiation alone, so the offer and response are
+// encrypted and obfuscated like all later traffic and the session installed
+// afterwards never reuses one of their nonces.
+func (d *Device) negotiate(conn net.Conn, cfg *config.Config, negotiationCfg crypto.NegotiationConfig, secrets crypto.SessionSecrets, params crypto.TransportParameters, datagram bool) (crypto.NegotiatedParams, error) {
+	keys, err := crypto.NegotiationSecrets(secrets)
+	if err != nil {
+		return crypto.NegotiatedParams{}, err
+	}
+	obfs, err := obfuscationConfig(cfg.Obfuscation, d.role)
+	if err != nil {
+		return crypto.NegotiatedParams{}, err
+	}
+	obfs.Datagram = datagram
+	channel := &negotiationChannel{transport: transport.NewTransport(d.logger), conn: conn}
+	channel.transport.SetObfuscation(obfs)
+	if err := channel.transport.InstallSession(keys, params, 0); err != nil {
+		return crypto.NegotiatedParams{}, err
+	}
+	return crypto.NegotiateSession(channel, crypto.HandshakeRole(d.role), negotiationCfg, secrets)
+}
+
+// negotiationChannel carries negotiation messages as data frames
+type negotiationChannel struct {
+	transport *transport.Transport
+	conn      net.Conn
+}
+
+func (c *negotiationChannel) Send(message []byte) error {
+	return c.transport.SendPayload(c.conn, message)
+}
+
+func (c *negotiationChannel) Receive() ([]byte, error) {
+	frame, err := c.transport.Receive(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Flags&transport.FlagData == 0 {
+		return nil, fmt.Errorf("unexpected frame %#x during negotiation", frame.Flags)
+	}
+	return frame.Payload, nil
+}
+
+// noiseHandshake runs the Noise IKpsk2 or XXpsk3 pattern using the device
+// static key and adapts the result to the legacy handshake result so the
+// transport session is installed the same way for every mode.
+func (d *Device) noiseHandshake(conn net.Conn, cfg *config.Config, mode string, psk []byte, candidates []crypto.PSKCandidate) (*crypto.HandshakeResult, error) {
+	opts := crypto.NoiseHandshakeOptions{
+		Pattern:       crypto.NoiseXXpsk3,
+		PreSharedKey:  psk,
+		PSKCandidates: candidates,
+		StaticKey:     d.privateKey,
+		MaxPadding:    d.maxPadding,
+	}
+	if mode == config.HandshakeNoiseIK {
+		opts.Pattern = crypto.NoiseIKpsk2
+		if d.role == RoleClient {
+			opts.RemoteStatic = cfg.ServerPublicKey()
+			if opts.RemoteStatic == nil {
+				return nil, errors.New("noise-ik requires the server public key")
+			}
+		}
+	}
+	if d.role == RoleServer {
+		opts.KeepAlive = d.keepaliveInterval
+	}
+
+	result, err := crypto.PerformNoiseHandshake(conn, crypto.HandshakeRole(d.role), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &crypto.HandshakeResult{
+		Secrets:       result.Secrets,
+		Parameters:    result.Parameters,
+		PSKID:         result.PSKID,
+		PSKGeneration: result.PSKGeneration,
+	}, nil
+}
+
+// negotiationConfig maps the configured security profile onto the parameters
+// offered after the handshake. The protocol version is capped by the handshake
+// actually performed, so a legacy handshake always negotiates version 1, and
+// an explicit cipher suite list replaces the profile's preference order.
+func negotiationConfig(profile, mode string, suites []string) (crypto.NegotiationConfig, error) {
+	p, err := crypto.ParseSecurityProfile(profile)
+	if err != nil {
+		return crypto.NegotiationConfig{}, err
+	}
+	negotiation := crypto.GetSecurityProfile(p)
+	if len(suites) > 0 {
+		negotiation.CipherSuites = make([]crypto.CipherSuite, 0, len(suites))
+		for _, name := range suites {
+			suite, err := crypto.ParseCipherSuite(name)
+			if err != nil {
+				return crypto.NegotiationConfig{}, err
+			}
+			negotiation.CipherSuites = append(negotiation.CipherSuites, suite)
+		}
+	}
+	if mode == config.HandshakeLegacy {
+		negotiation.MaxVersion = crypto.ProtocolVersionLegacy
+	}
+	if negotiation.MaxVersion < negotiation.MinVersion {
+		return crypto.NegotiationConfig{}, fmt.Errorf("security profile %s requires a noise handshake", p)
+	}
+	return negotiation, nil
+}
+
+// obfuscationConfig translates the config section into obfuscator settings
+// for this end of the session.
+func obfuscationConfig(cfg config.ObfuscationConfig, role Role) (crypto.ObfsConfig, error) {
+	mode, err := crypto.ParseObfsMode(cfg.Mode)
+	if err != nil {
+		return crypto.ObfsConfig{}, err
+	}
+	obfs := crypto.ObfsConfig{
+		Mode:       mode,
+		IATMode:    cfg.IATMode,
+		MinPadding: cfg.MinPadding,
+		MaxPadding: cfg.MaxPadding,
+		Role:       crypto.HandshakeRole(role),
+	}
+	if cfg.IATMode > 0 {
+		obfs.IATMeanDelay = cfg.EffectiveIATMeanDelay()
+	}
+	return obfs, nil
+}
+
+// handshakePSKs selects the pre-shared keys for a handshake. Clients present
+// a single key, the newest valid generation when psks rotate; servers accept
+// every peer-specific key plus each currently valid global generation, and the
+// handshake reports which key authenticated the session.
+func (d *Device) handshakePSKs(cfg *config.Config) ([]byte, int, []crypto.PSKCandidate, error) {
+	if d.role == RoleClient {
+		entry, err := cfg.ClientPSK(time.Now())
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if entry.Key == cfg.PSK {
+			return resolvePSK(cfg.EffectivePSK()), 0, nil, nil
+		}
+		return derivePSK(entry.Key), entry.Generation, nil, nil
+	}
+
+	var candidates []crypto.PSKCandidate
+	for _, peerCfg := range cfg.Peers {
+		if peerCfg.PSK != "" {
+			candidates = append(candidates, crypto.PSKCandidate{ID: peerCfg.Name, Key: derivePSK(peerCfg.PSK)})
+		}
+	}
+	for _, entry := range cfg.PSKs {
+		candidates = append(candidates, crypto.PSKCandidate{
+			Key:        derivePSK(entry.Key),
+			Generation: entry.Generation,
+			NotBefore:  entry.NotBefore,
+			NotAfter:   entry.NotAfter,
+		})
+	}
+	var global []byte
+	if len(cfg.PSKs) == 0 && cfg.EffectivePSK() != "" {
+		global = resolvePSK(cfg.EffectivePSK())
+	}
+	if len(candidates) == 0 {
+		return global, 0, nil, nil
+	}
+	if global != nil {
+		candidates = append(candidates, crypto.PSKCandidate{Key: global})
+	}
+	return nil, 0, candidates, nil
+}
+
+// authorizeRemoteStatic checks the authenticated remote static key against the
+// keys pinned in the peer configuration and returns the matching peer name.
+// When no peer pins a key the session is authenticated by the PSK alone.
+func authorizeRemoteStatic(cfg *config.Config, role Role, remote [32]byte) (string, error) {
+	pinned := false
+	for _, peerCfg := range cfg.Peers {
+		if peerCfg.PublicKey == "" {
+			continue
+		}
+		key, err := config.DecodeKey(peerCfg.PublicKey)
+		if err != nil {
+			continue
+		}
+		pinned = true
+		if subtle.ConstantTimeCompare(key, remote[:]) == 1 {
+			return peerCfg.Name, nil
+		}
+		if role == RoleClient {
+			// Clients pin the first configured key, the same one used for IK.
+			break
+		}
+	}
+	if pinned {
+		return "", fmt.Errorf("remote static key %s does not match any configured peer", base64.StdEncoding.EncodeToString(remote[:]))
+	}
+	return "", nil
+}
+
 func (d *Device) TunnelLoop(conn net.Conn) {
 	stopKeepalive := d.startKeepalive(conn)
 	defer stopKeepalive()
-
-	rekeyTicker := time.NewTicker(d.rekeyInterval)
-	defer rekeyTicker.Stop()
+	defer d.endMux(conn)
 
 	for {
 		frame, err := d.transport.Receive(conn)
 		if err != nil {
+			if d.relayStream() != nil {
+				d.logger.Debug("relay closed", nil)
+				return
+			}
 			d.logger.Error("receive failed", map[string]interface{}{"error": err.Error()})
 			return
 		}
+		d.mu.RLock()
+		connTimers := d.connTimers
+		d.mu.RUnlock()
+		if connTimers != nil {
+			connTimers.OnDataReceived()
+		}
 
 		switch frame.Flags {
 		case transport.FlagData:
@@ -213,30 +631,28 @@ func (d *Device) TunnelLoop(conn net.Conn) {
 			}
 		case transport.FlagBind:
 			d.logger.Info("transport bind acknowledged", map[string]interface{}{"remote": conn.RemoteAddr().String()})
+		case transport.FlagTicket:
+			if err := d.handleTicket(frame.Payload); err != nil {
+				d.logger.Warn("session ticket rejected", map[string]interface{}{"error": err.Error()})
+			}
+		case transport.FlagResume:
+			d.logger.Debug("duplicate resumption accept", nil)
 		default:
 			d.logger.Warn("unknown frame flag", map[string]interface{}{"flag": frame.Flags})
 		}
 
 		d.mu.Lock()
 		d.messageCount++
-		needsRekey := d.messageCount >= d.rekeyBudget
+		pfs := d.pfs
 		d.mu.Unlock()
 
-		select {
-		case <-rekeyTicker.C:
-			needsRekey = true
-		default:
-		}
-		if needsRekey {
+		// Keepalives arrive at least every keepalive interval, so the time
+		// budget is checked often enough even on an idle tunnel.
+		if pfs != nil && pfs.NeedsRekey() {
 			if err := d.initiateRekey(conn); err != nil {
 				d.logger.Error("rekey initiate failed", map[string]interface{}{"error": err.Error()})
 				return
 			}
-			d.mu.Lock()
-			d.messageCount = 0
-			d.pendingRekey = nil
-			d.mu.Unlock()
-			rekeyTicker.Reset(d.rekeyInterval)
 		}
 	}
 }
@@ -246,7 +662,13 @@ func (d *Device) handleData(payload []byte, conn net.Conn) error {
 	if err != nil {
 		return err
 	}
-	if pkt.Type != packet.TypeData {
+	switch pkt.Type {
+	case packet.TypeData:
+	case packet.TypeConnect:
+		return d.handleConnect(pkt, conn)
+	case packet.TypeMux:
+		return d.handleMux(pkt.Payload, conn)
+	default:
 		d.logger.Warn("unexpected packet type", map[string]interface{}{"type": pkt.Type})
 		return nil
 	}
@@ -255,6 +677,19 @@ func (d *Device) handleData(payload []byte, conn net.Conn) error {
 	if err != nil {
 		return err
 	}
+	if stream := d.relayStream(); stream != nil {
+		d.recordTraffic(false, len(data))
+		_, err := stream.Write(data)
+		return err
+	}
+	if d.router != nil {
+		d.recordTraffic(false, len(data))
+		name, err := d.router.receive(d, peerName, data)
+		if p := d.ensurePeer(name, conn.RemoteAddr()); p != nil {
+			p.TouchReceive()
+		}
+		return err
+	}
 	if peerName == "" {
 		if dest, derr := destinationIP(data); derr == nil {
 			peerName = d.lookupPeerByIP(dest)
@@ -268,6 +703,7 @@ func (d *Device) handleData(payload []byte, conn net.Conn) error {
 	if p != nil {
 		p.TouchReceive()
 	}
+	d.recordTraffic(false, len(data))
 
 	if err := d.plane.Deliver(peerName, data); err != nil {
 		return err
@@ -276,66 +712,130 @@ func (d *Device) handleData(payload []byte, conn net.Conn) error {
 }
 
 func (d *Device) handleRekey(payload []byte, conn net.Conn) error {
-	d.mu.Lock()
-	currentSecrets := d.secrets
-	pending := d.pendingRekey
-	d.mu.Unlock()
+	d.mu.RLock()
+	pfs := d.pfs
+	d.mu.RUnlock()
 
-	updated, response, err := crypto.ProcessRekey(currentSecrets, payload, pending, crypto.HandshakeRole(d.role))
-	if err != nil {
+	if response := pfs.AnsweredRekey(payload); response != nil {
+		// The initiator repeated a request we answered, so our response was
+		// lost. It still only reads the previous epoch.
+		d.logger.Debug("rekey response resent", nil)
+		return d.transport.SendRekeyPrevious(conn, response)
+	}
+	if crypto.IsRekeyResponse(payload) && !pfs.RekeyPending() {
+		// A repeated response to a request already answered
+		d.logger.Debug("stale rekey response ignored", nil)
+		return nil
+	}
+	if pfs.RekeyPending() && !crypto.IsRekeyResponse(payload) {
+		// Both sides started a rekey at once. The server's request wins;
+		// the client drops its own and answers.
+		if d.role == RoleServer {
+			d.logger.Debug("concurrent rekey request ignored", nil)
+			return nil
+		}
+		pfs.CancelRekey()
+	}
+
+	updated, response, err := pfs.ProcessRekeyMessage(payload)
+	if err != nil && !errors.Is(err, crypto.ErrRekeyResponseRequired) {
 		return err
 	}
 	if updated == nil {
 		return errors.New("rekey yielded no new secrets")
 	}
 
-	if err := d.transport.UpdateSessionKeys(*updated); err != nil {
+	// The response still travels under the current keys: the initiator can
+	// only read the new epoch once it has processed it.
+	if len(response) > 0 {
+		if err := d.transport.SendRekey(conn, response); err != nil {
+			return err
+		}
+	}
+	if err := d.transport.UpdateSessionKeys(*updated, d.transport.CipherSuite()); err != nil {
 		return err
 	}
 
 	epoch := updated.Epoch
 	d.mu.Lock()
 	d.secrets = *updated
-	d.pendingRekey = nil
 	d.mu.Unlock()
 
 	d.broadcastRekey(epoch)
-	d.logger.Info("rekey applied", map[string]interface{}{"epoch": epoch})
-
-	if len(response) > 0 {
-		if err := d.transport.SendRekey(conn, response); err != nil {
-			return err
-		}
-		d.logger.Info("rekey response processed", map[string]interface{}{"epoch": epoch})
-	}
+	d.logger.Info("rekey applied", map[string]interface{}{"epoch": epoch, "responder": len(response) > 0})
 	return nil
 }
 
 func (d *Device) initiateRekey(conn net.Conn) error {
-	d.mu.Lock()
-	if d.pendingRekey != nil {
-		d.mu.Unlock()
+	d.mu.RLock()
+	pfs := d.pfs
+	d.mu.RUnlock()
+	if pfs.RekeyPending() {
 		return nil
 	}
-	secrets := d.secrets
-	d.mu.Unlock()
 
-	ctx, err := crypto.NewRekeyRequest(secrets, crypto.HandshakeRole(d.role))
+	ctx, err := pfs.InitiateRekey()
 	if err != nil {
 		return err
 	}
 	if err := d.transport.SendRekey(conn, ctx.Payload); err != nil {
 		return err
 	}
+	d.retryRekey(conn, pfs, ctx, pfs.RekeyTimeout())
 
-	d.mu.Lock()
-	d.pendingRekey = ctx
-	d.mu.Unlock()
-
-	d.logger.Info("rekey request sent", map[string]interface{}{"epoch": secrets.Epoch + 1})
+	stats := pfs.Stats()
+	d.logger.Info("rekey request sent", map[string]interface{}{
+		"epoch":    stats.CurrentEpoch + 1,
+		"messages": stats.MessagesSent + stats.MessagesReceived,
+		"bytes":    stats.BytesSent + stats.BytesReceived,
+	})
 	return nil
 }
 
+// retryRekey resends the rekey request ctx after wait if it is still
+// unanswered: on a datagram transport either the request or its response
+// may be lost. The request is abandoned after the PFS manager's last try.
+func (d *Device) retryRekey(conn net.Conn, pfs *crypto.PFSManager, ctx *crypto.RekeyContext, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		payload, next, err := pfs.RetryRekey(ctx)
+		switch {
+		case err != nil:
+			d.logger.Warn("rekey abandoned", map[string]interface{}{"error": err.Error()})
+			return
+		case next == 0:
+			return
+		case payload != nil:
+			d.mu.RLock()
+			ended := d.closed || d.pfs != pfs
+			d.mu.RUnlock()
+			if ended {
+				return
+			}
+			if err := d.transport.SendRekey(conn, payload); err != nil {
+				d.logger.Warn("rekey resend failed", map[string]interface{}{"error": err.Error()})
+				return
+			}
+			d.logger.Debug("rekey request resent", nil)
+		}
+		d.retryRekey(conn, pfs, ctx, next)
+	})
+}
+
+// recordTraffic charges a data frame against the rekey budgets
+func (d *Device) recordTraffic(sent bool, bytes int) {
+	d.mu.RLock()
+	pfs := d.pfs
+	d.mu.RUnlock()
+	if pfs == nil {
+		return
+	}
+	if sent {
+		pfs.RecordSent(1, uint64(bytes))
+	} else {
+		pfs.RecordReceived(1, uint64(bytes))
+	}
+}
+
 func (d *Device) startKeepalive(conn net.Conn) func() {
 	interval := d.keepaliveInterval
 	if interval <= 0 {
@@ -364,6 +864,7 @@ func (d *Device) startKeepalive(conn net.Conn) func() {
 
 func (d *Device) Snapshot() State {
 	send, recv := d.transport.LastActivity()
+	suite := d.transport.CipherSuite()
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
@@ -372,38 +873,95 @@ func (d *Device) Snapshot() State {
 		snap := p.Snapshot()
 		peers = append(peers, snap)
 	}
+	var pfsStats crypto.PFSStats
+	if d.pfs != nil {
+		pfsStats = d.pfs.Stats()
+	}
+	var muxStats *transport.MuxStats
+	if d.mux != nil {
+		stats := d.mux.mux.Stats()
+		muxStats = &stats
+	}
 
 	state := State{
-		Role:         d.role.String(),
-		Keepalive:    d.keepaliveInterval,
-		MaxPadding:   d.maxPadding,
-		SessionID:    hex.EncodeToString(d.secrets.SessionID[:]),
-		RekeyEpoch:   d.secrets.Epoch,
-		Messages:     d.messageCount,
-		PendingRekey: d.pendingRekey != nil,
-		Peers:        peers,
-		LastSend:     send,
-		LastReceive:  recv,
+		Role:          d.role.String(),
+		Handshake:     d.handshake,
+		PublicKey:     base64.StdEncoding.EncodeToString(d.publicKey[:]),
+		RemotePeer:    d.remotePeer,
+		PSKGen:        d.pskGeneration,
+		Profile:       d.securityProfile,
+		Negotiated:    d.negotiated,
+		CipherSuite:   cipherSuiteName(suite),
+		Obfuscation:   d.transport.ObfuscationMode().String(),
+		Keepalive:     d.keepaliveInterval,
+		MaxPadding:    d.maxPadding,
+		SessionID:     hex.EncodeToString(d.secrets.SessionID[:]),
+		RekeyEpoch:    d.secrets.Epoch,
+		Messages:      d.messageCount,
+		PendingRekey:  d.pfs != nil && d.pfs.RekeyPending(),
+		Resumed:       d.resumed,
+		PFS:           pfsStats,
+		Peers:         peers,
+		Mux:           muxStats,
+		Forwards:      forwardStates(d.forwards),
+		LocalForwards: forwardStates(d.localForwards),
+		LastSend:      send,
+		LastReceive:   recv,
 	}
 	return state
 }
 
 func (d *Device) Metrics() map[string]float64 {
 	send, recv := d.transport.LastActivity()
+	suite := d.transport.CipherSuite()
+	replay := d.transport.ReplayStats()
 	d.mu.RLock()
 	messages := d.messageCount
 	epoch := d.secrets.Epoch
-	pending := d.pendingRekey != nil
+	pending := d.pfs != nil && d.pfs.RekeyPending()
 	peerCount := len(d.peers)
 	keepalive := d.keepaliveInterval
+	var muxStats transport.MuxStats
+	if d.mux != nil {
+		muxStats = d.mux.mux.Stats()
+	}
+	forwards := forwardStates(d.forwards)
+	local := forwardStates(d.localForwards)
 	d.mu.RUnlock()
+	var published, forwarded, localForwarded, sent, received float64
+	for _, f := range forwards {
+		published += boolToFloat(f.Published)
+		forwarded += float64(f.Connections)
+		sent += float64(f.BytesSent)
+		received += float64(f.BytesReceived)
+	}
+	for _, f := range local {
+		localForwarded += float64(f.Connections)
+		sent += float64(f.BytesSent)
+		received += float64(f.BytesReceived)
+	}
 
 	metrics := map[string]float64{
-		"device_messages_total":    float64(messages),
-		"device_rekey_epoch":       float64(epoch),
-		"device_pending_rekey":     boolToFloat(pending),
-		"device_peer_count":        float64(peerCount),
-		"device_keepalive_seconds": keepalive.Seconds(),
+		"device_messages_total":                  float64(messages),
+		"device_rekey_epoch":                     float64(epoch),
+		"device_pending_rekey":                   boolToFloat(pending),
+		"device_peer_count":                      float64(peerCount),
+		"device_keepalive_seconds":               keepalive.Seconds(),
+		"device_replay_accepted_total":           float64(replay.Accepted),
+		"device_replay_rejected_total":           float64(replay.Rejected),
+		"device_replay_window_base":              float64(replay.WindowBase),
+		"device_replay_window_size":              float64(replay.WindowSize),
+		"device_streams":                         float64(len(muxStats.Streams)),
+		"device_stream_buffered_bytes":           float64(muxStats.Buffered),
+		"device_forwards_published":              published,
+		"device_forward_connections_total":       forwarded,
+		"device_local_forwards":                  float64(len(local)),
+		"device_local_forward_connections_total": localForwarded,
+		"device_forward_sent_bytes_total":        sent,
+		"device_forward_received_bytes_total":    received,
+	}
+	if suite != 0 {
+		metrics[CipherSuiteMetric("device_cipher_suite", suite)] = 1
 	}
 	if !send.IsZero() {
 		metrics["device_last_send_age_seconds"] = time.Since(send).Seconds()
@@ -414,6 +972,22 @@ func (d *Device) Metrics() map[string]float64 {
 	return metrics
 }
 
+// CipherSuiteMetric returns a metric name labelled with the suite name, e.g.
+// device_cipher_suite{suite="AES-256-GCM"}.
+func CipherSuiteMetric(name string, suite crypto.CipherSuite) string {
+	return fmt.Sprintf("%s{suite=%q}", name, cipherSuiteName(suite))
+}
+
+func cipherSuiteName(suite crypto.CipherSuite) string {
+	if suite == 0 {
+		return ""
+	}
+	if info, err := crypto.GetCipherSuiteInfo(suite); err == nil {
+		return info.Name
+	}
+	return fmt.Sprintf("0x%04x", uint16(suite))
+}
+
 func (d *Device) Close() error {
 	d.mu.Lock()
 	if d.closed {
@@ -428,6 +1002,19 @@ func (d *Device) Close() error {
 		close(stop)
 	}
 	d.outboundWG.Wait()
+	d.endRelay()
+	d.endMux(nil)
+	d.endLocalForwards()
+	if d.router != nil {
+		// The dataplane belongs to the router
+		d.router.detach(d)
+		return nil
+	}
+	if d.network != nil {
+		if err := d.network.close(); err != nil {
+			d.logger.Warn("tunnel configuration not fully removed", map[string]interface{}{"error": err.Error()})
+		}
+	}
 	if d.plane != nil {
 		return d.plane.Close()
 	}
@@ -445,7 +1032,61 @@ func (d *Device) recordHandshake(remote net.Addr, secrets crypto.SessionSecrets)
 	d.mu.Unlock()
 }
 
+// recordRoam notes a client that moved to a new address, the way
+// recordHandshake notes the address it connected from.
+func (d *Device) recordRoam(old, addr net.Addr) {
+	d.mu.Lock()
+	for _, p := range d.peers {
+		p.UpdateEndpoint(addr)
+	}
+	remotePeer := d.remotePeer
+	d.mu.Unlock()
+
+	d.logger.Info("peer roamed", map[string]interface{}{
+		"peer": remotePeer,
+		"old":  old.String(),
+		"new":  addr.String(),
+	})
+}
+
+// SetTimers reports every frame TunnelLoop receives to the given timers, so
+// that their dead-peer timer notices a silent session. nil stops reporting.
+func (d *Device) SetTimers(connTimers *timers.ConnectionTimers) {
+	d.mu.Lock()
+	d.connTimers = connTimers
+	d.mu.Unlock()
+}
+
+// detach stops the outbound pump from sending on conn, or on any connection
+// when conn is nil. Payloads are dropped until the next session starts, and
+// the streams of the session are closed.
+func (d *Device) detach(conn net.Conn) {
+	d.mu.Lock()
+	if conn == nil || d.conn == conn {
+		d.conn = nil
+	}
+	d.mu.Unlock()
+	d.endMux(conn)
+	if conn == nil {
+		d.transport.SetHandshakeReplay(nil)
+	}
+}
+
 func (d *Device) startOutboundPump(conn net.Conn) {
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+
+	// Server sessions sharing a dataplane are fed by the router
+	if d.router != nil {
+		d.router.attach(d)
+		return
+	}
+	// A relay device has no dataplane to pump
+	if d.plane == nil {
+		return
+	}
+
 	d.outboundOnce.Do(func() {
 		d.mu.Lock()
 		d.outboundStop = make(chan struct{})
@@ -472,17 +1113,8 @@ func (d *Device) startOutboundPump(conn net.Conn) {
 						d.logger.Warn("drop outbound payload", map[string]interface{}{"reason": "no-route", "bytes": len(payload)})
 						continue
 					}
-					pkt, err := packet.NewDataPacket(peerName, payload)
-					if err != nil {
+					if err := d.sendData(peerName, payload); err != nil && !errors.Is(err, errNoSession) {
 						d.logger.Warn("drop outbound payload", map[string]interface{}{"reason": err.Error()})
-						continue
-					}
-					if err := d.transport.SendPayload(conn, packet.Encode(pkt)); err != nil {
-						d.logger.Error("send payload failed", map[string]interface{}{"error": err.Error()})
-						return
-					}
-					if p := d.ensurePeer(peerName, conn.RemoteAddr()); p != nil {
-						p.TouchSend()
 					}
 				case <-stop:
 					return
@@ -492,6 +1124,40 @@ func (d *Device) startOutboundPump(conn net.Conn) {
 	})
 }
 
+// errNoSession is returned by sendData between sessions
+var errNoSession = errors.New("no session")
+
+// sendData sends a dataplane payload for the peer on the current session.
+// A connection that fails is detached; payloads are dropped until the next
+// session starts.
+func (d *Device) sendData(peerName string, payload []byte) error {
+	pkt, err := packet.NewDataPacket(peerName, payload)
+	if err != nil {
+		return err
+	}
+	conn := d.sessionConn()
+	if conn == nil {
+		d.logger.Debug("drop outbound payload", map[string]interface{}{"reason": "no-session", "bytes": len(payload)})
+		return errNoSession
+	}
+	if err := d.transport.SendPayload(conn, packet.Encode(pkt)); err != nil {
+		d.logger.Error("send payload failed", map[string]interface{}{"error": err.Error()})
+		d.detach(conn)
+		return errNoSession
+	}
+	d.recordTraffic(true, len(payload))
+	if p := d.ensurePeer(peerName, conn.RemoteAddr()); p != nil {
+		p.TouchSend()
+	}
+	return nil
+}
+
+func (d *Device) sessionConn() net.Conn {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.conn
+}
+
 func (d *Device) lookupPeerByIP(addr netip.Addr) string {
 	for _, route := range d.routes {
 		if route.prefix.Contains(addr) {
@@ -536,6 +1202,31 @@ func boolToFloat(v bool) float64 {
 	return 0
 }
 
+// sourceIP returns the source address of an IPv4 or IPv6 packet
+func sourceIP(payload []byte) (netip.Addr, error) {
+	if len(payload) == 0 {
+		return netip.Addr{}, errors.New("empty payload")
+	}
+	switch payload[0] >> 4 {
+	case 4:
+		if len(payload) < 20 {
+			return netip.Addr{}, errors.New("ipv4 header truncated")
+		}
+		var src [4]byte
+		copy(src[:], payload[12:16])
+		return netip.AddrFrom4(src), nil
+	case 6:
+		if len(payload) < 40 {
+			return netip.Addr{}, errors.New("ipv6 header truncated")
+		}
+		var src [16]byte
+		copy(src[:], payload[8:24])
+		return netip.AddrFrom16(src), nil
+	default:
+		return netip.Addr{}, errors.New("unsupported ip version")
+	}
+}
+
 func destinationIP(payload []byte) (netip.Addr, error) {
 	if len(payload) == 0 {
 		return netip.Addr{}, errors.New("empty payload")
@@ -562,12 +1253,13 @@ func destinationIP(payload []byte) (netip.Addr, error) {
 }
 
 func resolvePSK(input string) []byte {
-	if value := os.Getenv("STP_PSK"); value != "" {
-		input = value
-	}
 	if input == "" {
 		panic("PSK must be explicitly configured - no default PSK available")
 	}
+	return derivePSK(input)
+}
+
+func derivePSK(input string) []byte {
 	if len(input) >= crypto.KeySize {
 		return []byte(input)[:crypto.KeySize]
 	}
@@ -575,6 +1267,21 @@ func resolvePSK(input string) []byte {
 	return sum[:]
 }
 
+// RemotePeer returns the configured peer the current session authenticated as,
+// or an empty string when the session was authenticated by the global PSK.
+func (d *Device) RemotePeer() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.remotePeer
+}
+
+// receivedWithin reports whether the session received a frame in the last
+// window.
+func (d *Device) receivedWithin(window time.Duration) bool {
+	_, recv := d.transport.LastActivity()
+	return time.Since(recv) < window
+}
+
 func (r Role) String() string {
 	switch r {
 	case RoleClient:
@@ -630,3 +1337,12 @@ func (d *Device) UpdatePeers(peerConfigs []config.PeerConfig) error {
 
 	return nil
 }
+
+// UpdateTunnelRoutes applies a reloaded tunnel.routes list to an
+// auto-configured TUN interface. It does nothing otherwise.
+func (d *Device) UpdateTunnelRoutes(routes []string) error {
+	if d.network == nil {
+		return nil
+	}
+	return d.network.updateRoutes(routes)
+}
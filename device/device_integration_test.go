@@ -2,6 +2,10 @@ package device
 
 import (
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -91,3 +95,146 @@ func TestDeviceHandleDataRouteByPeerAndCIDR(t *testing.T) {
 		t.Fatal("timeout waiting for beta payload")
 	}
 }
+
+func TestTunnelNetworkLifecycle(t *testing.T) {
+	savedDir := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = savedDir }()
+	var calls []string
+	record := func(op string) func(string, netip.Prefix) error {
+		return func(ifname string, prefix netip.Prefix) error {
+			calls = append(calls, op+" "+ifname+" "+prefix.String())
+			return nil
+		}
+	}
+	saved := []interface{}{configureTUN, setMTU, addRoute, deleteRoute, deleteAddress}
+	configureTUN = func(ifname string, addr netip.Prefix, routes []netip.Prefix) error {
+		calls = append(calls, "configure "+ifname+" "+addr.String())
+		for _, route := range routes {
+			calls = append(calls, "add "+ifname+" "+route.String())
+		}
+		return nil
+	}
+	setMTU = func(string, int) error { return nil }
+	addRoute = record("add")
+	deleteRoute = record("del")
+	deleteAddress = record("deladdr")
+	defer func() {
+		configureTUN = saved[0].(func(string, netip.Prefix, []netip.Prefix) error)
+		setMTU = saved[1].(func(string, int) error)
+		addRoute = saved[2].(func(string, netip.Prefix) error)
+		deleteRoute = saved[3].(func(string, netip.Prefix) error)
+		deleteAddress = saved[4].(func(string, netip.Prefix) error)
+	}()
+	expect := func(want ...string) {
+		t.Helper()
+		if strings.Join(calls, "; ") != strings.Join(want, "; ") {
+			t.Fatalf("unexpected calls:\n got %q\nwant %q", calls, want)
+		}
+		calls = nil
+	}
+
+	// A crashed run left its configuration behind
+	journal := filepath.Join(stateDir, "stp9.netconfig.json")
+	if err := os.WriteFile(journal, []byte(`{"address":"10.9.0.1/24","routes":["10.9.0.0/16"]}`), 0o600); err != nil {
+		t.Fatalf("write journal: %v", err)
+	}
+
+	cfg := &config.Config{Tunnel: config.TunnelConfig{
+		Type:          "tun",
+		Name:          "stp9",
+		Address:       "10.8.0.2/24",
+		AutoConfigure: true,
+		Routes:        []string{"10.8.0.0/16"},
+	}}
+	network, err := configureTunnel(cfg, logging.New(logging.LevelError, nil))
+	if err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	expect("del stp9 10.9.0.0/16", "deladdr stp9 10.9.0.1/24", "configure stp9 10.8.0.2/24", "add stp9 10.8.0.0/16")
+	if _, err := os.Stat(journal); err != nil {
+		t.Fatalf("configuration not journaled: %v", err)
+	}
+
+	if err := network.updateRoutes([]string{"10.8.0.0/16", "192.168.50.0/24"}); err != nil {
+		t.Fatalf("update routes: %v", err)
+	}
+	expect("add stp9 192.168.50.0/24")
+	if err := network.updateRoutes([]string{"192.168.50.0/24"}); err != nil {
+		t.Fatalf("update routes: %v", err)
+	}
+	expect("del stp9 10.8.0.0/16")
+
+	if err := network.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	expect("del stp9 192.168.50.0/24", "deladdr stp9 10.8.0.2/24")
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatalf("journal left after close: %v", err)
+	}
+}
+
+func TestTunnelJournalRefused(t *testing.T) {
+	savedDir := stateDir
+	stateDir = t.TempDir()
+	saved := []interface{}{configureTUN, setMTU, deleteRoute, deleteAddress}
+	var deleted []string
+	configureTUN = func(string, netip.Prefix, []netip.Prefix) error { return nil }
+	setMTU = func(string, int) error { return nil }
+	deleteRoute = func(_ string, route netip.Prefix) error {
+		deleted = append(deleted, route.String())
+		return nil
+	}
+	deleteAddress = func(_ string, addr netip.Prefix) error {
+		deleted = append(deleted, addr.String())
+		return nil
+	}
+	defer func() {
+		stateDir = savedDir
+		configureTUN = saved[0].(func(string, netip.Prefix, []netip.Prefix) error)
+		setMTU = saved[1].(func(string, int) error)
+		deleteRoute = saved[2].(func(string, netip.Prefix) error)
+		deleteAddress = saved[3].(func(string, netip.Prefix) error)
+	}()
+
+	cfg := &config.Config{Tunnel: config.TunnelConfig{
+		Type:          "tun",
+		Name:          "stp9",
+		Address:       "10.8.0.2/24",
+		AutoConfigure: true,
+	}}
+	logger := logging.New(logging.LevelError, nil)
+
+	// A journal planted as a link is neither trusted nor written through
+	target := filepath.Join(t.TempDir(), "target")
+	planted := []byte(`{"routes":["0.0.0.0/0"]}`)
+	if err := os.WriteFile(target, planted, 0o600); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	journal := filepath.Join(stateDir, "stp9.netconfig.json")
+	if err := os.Symlink(target, journal); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	network, err := configureTunnel(cfg, logger)
+	if err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("planted journal removed %v", deleted)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != string(planted) {
+		t.Fatalf("link target overwritten: %q %v", data, err)
+	}
+	if info, err := os.Lstat(journal); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("journal not replaced by a regular file: %v", err)
+	}
+	network.close()
+
+	// A state directory other users can write to is refused
+	if err := os.Chmod(stateDir, 0o777); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if _, err := configureTunnel(cfg, logger); err == nil {
+		t.Fatal("world-writable state directory accepted")
+	}
+}
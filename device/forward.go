@@ -0,0 +1,515 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stp/auth"
+	"stp/config"
+	"stp/packet"
+	"stp/transport"
+)
+
+// forwardRetryInterval spaces attempts to publish a forward the server
+// refused, e.g. while its port is still held by a session that was lost.
+const forwardRetryInterval = 5 * time.Second
+
+// errForwardDenied answers clients the forward ACL does not let publish
+var errForwardDenied = errors.New("forward denied by server ACL")
+
+// ForwardState describes a reverse or local forward. For a reverse
+// forward, a client reports whether the server publishes it and a server
+// reports the peer that published it; a local forward is published while
+// the client listens for it. Bytes are counted as sent over and received
+// from the tunnel.
+type ForwardState struct {
+	Name          string `json:"name"`
+	Listen        string `json:"listen"`
+	Target        string `json:"target,omitempty"` // client
+	Peer          string `json:"peer,omitempty"`   // server
+	Published     bool   `json:"published"`
+	Error         string `json:"error,omitempty"`
+	Connections   uint64 `json:"connections"`
+	Active        int64  `json:"active"`
+	Refused       uint64 `json:"refused,omitempty"` // server: denied by the ACL
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+}
+
+// forward is one reverse forward at either end of the tunnel, or a local
+// forward of a client
+type forward struct {
+	name   string
+	listen string
+	target string // client
+	peer   string // server
+
+	connections atomic.Uint64
+	active      atomic.Int64
+	refused     atomic.Uint64
+	sent        atomic.Uint64
+	received    atomic.Uint64
+
+	mu        sync.Mutex
+	published bool
+	err       string
+	// Server: the listener, and the stream the client published on. The
+	// forward is withdrawn when either closes. Local forwards only have
+	// the listener.
+	listener net.Listener
+	stream   net.Conn
+}
+
+func (f *forward) state() ForwardState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return ForwardState{
+		Name:          f.name,
+		Listen:        f.listen,
+		Target:        f.target,
+		Peer:          f.peer,
+		Published:     f.published,
+		Error:         f.err,
+		Connections:   f.connections.Load(),
+		Active:        f.active.Load(),
+		Refused:       f.refused.Load(),
+		BytesSent:     f.sent.Load(),
+		BytesReceived: f.received.Load(),
+	}
+}
+
+func (f *forward) setStatus(published bool, err error) {
+	f.mu.Lock()
+	f.published = published
+	f.err = ""
+	if err != nil {
+		f.err = err.Error()
+	}
+	f.mu.Unlock()
+}
+
+// relay joins a forwarded connection to its stream and counts it
+func (f *forward) relay(conn, stream net.Conn) {
+	f.connections.Add(1)
+	f.active.Add(1)
+	defer f.active.Add(-1)
+	transport.Splice(&countedConn{Conn: conn, read: &f.sent, written: &f.received}, stream)
+}
+
+// countedConn counts the bytes read from and written to a connection
+type countedConn struct {
+	net.Conn
+	read, written *atomic.Uint64
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the connection when it supports it, so Splice
+// treats it like the connection it wraps.
+func (c *countedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
+
+func (f *forward) close() {
+	f.setStatus(false, nil)
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.stream != nil {
+		f.stream.Close()
+	}
+}
+
+// PublishForwards asks the server of the session on conn to listen for
+// each forward and relay the connections it accepts back to the forward's
+// target. A forward the server refuses is retried while the session lasts;
+// call PublishForwards again for the next session.
+func (d *Device) PublishForwards(conn net.Conn, forwards []config.ForwardConfig, timeout time.Duration) {
+	d.mu.Lock()
+	current := make(map[string]*forward, len(forwards))
+	for _, fwdCfg := range forwards {
+		f := d.forwards[fwdCfg.Name]
+		if f == nil || f.listen != fwdCfg.Listen || f.target != fwdCfg.Target {
+			f = &forward{name: fwdCfg.Name, listen: fwdCfg.Listen, target: fwdCfg.Target}
+		}
+		current[fwdCfg.Name] = f
+	}
+	d.forwards = current
+	d.mu.Unlock()
+
+	for _, f := range current {
+		go d.publishForward(conn, f, timeout)
+	}
+}
+
+func (d *Device) publishForward(conn net.Conn, f *forward, timeout time.Duration) {
+	for {
+		err := d.holdForward(conn, f, timeout)
+		f.setStatus(false, err)
+		if !d.sessionLive(conn) {
+			return
+		}
+		d.logger.Warn("forward not published", map[string]interface{}{
+			"forward": f.name,
+			"listen":  f.listen,
+			"error":   err.Error(),
+		})
+		time.Sleep(forwardRetryInterval)
+		if !d.sessionLive(conn) {
+			return
+		}
+	}
+}
+
+// holdForward publishes f and returns once the server withdraws it or the
+// session ends.
+func (d *Device) holdForward(conn net.Conn, f *forward, timeout time.Duration) error {
+	request, err := packet.NewForwardPacket(f.name, f.listen)
+	if err != nil {
+		return err
+	}
+	s, err := d.sessionMux(conn)
+	if err != nil {
+		return err
+	}
+	stream, err := requestStream(s, request, timeout)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	f.setStatus(true, nil)
+	d.logger.Info("forward published", map[string]interface{}{"forward": f.name, "listen": f.listen, "target": f.target})
+	io.Copy(io.Discard, stream)
+	return errors.New("forward withdrawn")
+}
+
+// ListenLocalForwards listens for each local forward and relays the
+// connections it accepts to the forward's target, which the server dials
+// for a stream of the current session. Connections accepted while there is
+// no session are closed. The listeners stay open until the device closes.
+func (d *Device) ListenLocalForwards(forwards []config.ForwardConfig, timeout time.Duration) error {
+	local := make(map[string]*forward, len(forwards))
+	closeAll := func() {
+		for _, f := range local {
+			f.close()
+		}
+	}
+	for _, fwdCfg := range forwards {
+		ln, err := net.Listen("tcp", fwdCfg.Listen)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("local forward %q: %w", fwdCfg.Name, err)
+		}
+		local[fwdCfg.Name] = &forward{name: fwdCfg.Name, listen: ln.Addr().String(), target: fwdCfg.Target, listener: ln, published: true}
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		closeAll()
+		return errors.New("device closed")
+	}
+	old := d.localForwards
+	d.localForwards = local
+	d.mu.Unlock()
+	for _, f := range old {
+		f.close()
+	}
+
+	for _, f := range local {
+		d.logger.Info("local forward listening", map[string]interface{}{"forward": f.name, "listen": f.listen, "target": f.target})
+		go d.acceptLocal(f, timeout)
+	}
+	return nil
+}
+
+func (d *Device) acceptLocal(f *forward, timeout time.Duration) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			stream, err := d.OpenStream("tcp", f.target, timeout)
+			if err != nil {
+				f.setStatus(true, err)
+				d.logger.Warn("local forward connection failed", map[string]interface{}{"forward": f.name, "target": f.target, "error": err.Error()})
+				conn.Close()
+				return
+			}
+			f.setStatus(true, nil)
+			f.relay(conn, stream)
+		}()
+	}
+}
+
+// endLocalForwards closes the listeners of the local forwards
+func (d *Device) endLocalForwards() {
+	d.mu.Lock()
+	local := d.localForwards
+	d.localForwards = nil
+	d.mu.Unlock()
+	for _, f := range local {
+		f.close()
+	}
+}
+
+// sessionLive reports whether conn still carries the device's session
+func (d *Device) sessionLive(conn net.Conn) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return !d.closed && d.conn == conn
+}
+
+// serveForwarded dials the target of a connection the server accepted for
+// a forward of this client.
+func (d *Device) serveForwarded(stream net.Conn, request *packet.Packet) {
+	name, from, err := packet.ExtractForward(request)
+	var f *forward
+	if err == nil {
+		d.mu.RLock()
+		f = d.forwards[name]
+		d.mu.RUnlock()
+	}
+	var upstream net.Conn
+	switch {
+	case err != nil:
+	case f == nil:
+		err = fmt.Errorf("unknown forward %q", name)
+	default:
+		upstream, err = net.DialTimeout("tcp", f.target, relayDialTimeout)
+	}
+	if sendErr := writeStreamPacket(stream, packet.NewConnectReply(err)); sendErr != nil || err != nil {
+		if err != nil {
+			d.logger.Warn("forwarded connection failed", map[string]interface{}{"forward": name, "from": from, "error": err.Error()})
+		}
+		if upstream != nil {
+			upstream.Close()
+		}
+		stream.Close()
+		return
+	}
+	d.logger.Debug("forwarded connection", map[string]interface{}{"forward": name, "from": from, "target": f.target})
+	f.relay(upstream, stream)
+}
+
+// servePublish serves a client's request to publish a forward. The forward
+// stays published until the client closes the stream it asked on.
+func (d *Device) servePublish(s *muxSession, stream net.Conn, request *packet.Packet) {
+	name, listen, err := packet.ExtractForward(request)
+	var f *forward
+	if err == nil {
+		if d.router == nil {
+			err = errors.New("forwards are not supported by this session")
+		} else {
+			f, err = d.router.publish(d, name, listen, stream)
+		}
+	}
+	if sendErr := writeStreamPacket(stream, packet.NewConnectReply(err)); sendErr != nil || err != nil {
+		if err != nil {
+			d.logger.Info("forward refused", map[string]interface{}{"forward": name, "listen": listen, "peer": d.RemotePeer(), "error": err.Error()})
+		}
+		if f != nil {
+			d.router.withdraw(f)
+		}
+		stream.Close()
+		return
+	}
+	d.logger.Info("forward published", map[string]interface{}{"forward": name, "listen": listen, "peer": f.peer})
+
+	go d.acceptForward(s, f)
+	io.Copy(io.Discard, stream)
+	d.router.withdraw(f)
+	d.logger.Info("forward withdrawn", map[string]interface{}{"forward": name, "listen": listen, "peer": f.peer})
+}
+
+// acceptForward relays every connection the forward's listener accepts
+// and the ACL allows to the client, each over a stream of its own.
+func (d *Device) acceptForward(s *muxSession, f *forward) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !d.router.allowForwardConnect(conn.RemoteAddr()) {
+			f.refused.Add(1)
+			d.logger.Info("forward connection refused", map[string]interface{}{"forward": f.name, "remote": conn.RemoteAddr().String()})
+			conn.Close()
+			continue
+		}
+		go func() {
+			request, err := packet.NewForwardPacket(f.name, conn.RemoteAddr().String())
+			if err != nil {
+				conn.Close()
+				return
+			}
+			stream, err := requestStream(s, request, streamRequestTimeout)
+			if err != nil {
+				d.logger.Warn("forward connection failed", map[string]interface{}{"forward": f.name, "remote": conn.RemoteAddr().String(), "error": err.Error()})
+				conn.Close()
+				return
+			}
+			f.relay(conn, stream)
+		}()
+	}
+}
+
+// publish opens the listener of a forward a client asked for, if the
+// forward ACL lets it publish. A forward the same peer published on a
+// session that was lost is taken over.
+func (r *Router) publish(d *Device, name, listen string, stream net.Conn) (*forward, error) {
+	peer := d.RemotePeer()
+	var roles []string
+	if peer != "" {
+		roles = []string{peer}
+	}
+	var ip net.IP
+	if conn := d.sessionConn(); conn != nil {
+		ip = addrIP(conn.RemoteAddr())
+	}
+
+	r.mu.Lock()
+	if ip == nil || !r.forwardACL.CheckPermissionWithRole(ip, auth.PermissionWrite, roles) {
+		r.mu.Unlock()
+		return nil, errForwardDenied
+	}
+	old := r.forwards[listen]
+	if old != nil && (peer == "" || old.peer != peer) {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%s is already published", listen)
+	}
+	if old != nil {
+		delete(r.forwards, listen)
+	}
+	r.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	f := &forward{name: name, listen: listen, peer: peer, listener: ln, stream: stream, published: true}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.forwards[listen] != nil {
+		ln.Close()
+		return nil, fmt.Errorf("%s is already published", listen)
+	}
+	r.forwards[listen] = f
+	return f, nil
+}
+
+// withdraw closes a published forward
+func (r *Router) withdraw(f *forward) {
+	r.mu.Lock()
+	if r.forwards[f.listen] == f {
+		delete(r.forwards, f.listen)
+	}
+	r.mu.Unlock()
+	f.close()
+}
+
+// allowForwardConnect reports whether the forward ACL lets addr connect to
+// published ports. Rules limited to peers only apply to publishing.
+func (r *Router) allowForwardConnect(addr net.Addr) bool {
+	ip := addrIP(addr)
+	r.mu.RLock()
+	acl := r.forwardACL
+	r.mu.RUnlock()
+	return ip != nil && acl.CheckPermissionWithRole(ip, auth.PermissionRead, nil)
+}
+
+// UpdateForwardACL replaces the rules of the forward ACL. Published
+// forwards are kept; the rules apply to what is published or accepted
+// from now on.
+func (r *Router) UpdateForwardACL(rules []config.ACLRuleConfig) error {
+	acl, err := newForwardACL(rules)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.forwardACL = acl
+	r.mu.Unlock()
+	return nil
+}
+
+// Forwards returns the published forwards, ordered by listen address.
+func (r *Router) Forwards() []ForwardState {
+	r.mu.RLock()
+	forwards := make([]*forward, 0, len(r.forwards))
+	for _, f := range r.forwards {
+		forwards = append(forwards, f)
+	}
+	r.mu.RUnlock()
+
+	states := make([]ForwardState, 0, len(forwards))
+	for _, f := range forwards {
+		states = append(states, f.state())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Listen < states[j].Listen })
+	return states
+}
+
+// newForwardACL builds the forward ACL. Without a matching rule nothing is
+// permitted.
+func newForwardACL(rules []config.ACLRuleConfig) (*auth.ACLManager, error) {
+	acl := auth.NewACLManager(auth.PermissionNone)
+	for i, rule := range rules {
+		permission, err := auth.ParsePermission(rule.Permission)
+		if err != nil {
+			return nil, fmt.Errorf("forwardAcl[%d]: %w", i, err)
+		}
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule-%d", i)
+		}
+		if err := acl.AddRule(name, rule.CIDR, permission, rule.Roles); err != nil {
+			return nil, fmt.Errorf("forwardAcl[%d]: %w", i, err)
+		}
+	}
+	return acl, nil
+}
+
+// addrIP returns the IP of a network address, nil when it has none
+func addrIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// forwardStates returns the states of forwards, ordered by name
+func forwardStates(forwards map[string]*forward) []ForwardState {
+	states := make([]ForwardState, 0, len(forwards))
+	for _, f := range forwards {
+		states = append(states, f.state())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
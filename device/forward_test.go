@@ -0,0 +1,199 @@
+package device
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"stp/config"
+	"stp/internal/logging"
+)
+
+func TestRouterReverseForward(t *testing.T) {
+	echo := startEchoServer(t)
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	published := free.Addr().String()
+	free.Close()
+
+	// Only alice may publish; anyone on loopback may connect
+	acl := []config.ACLRuleConfig{
+		{Name: "publish", CIDR: "127.0.0.0/8", Permission: "write", Roles: []string{"alice"}},
+		{Name: "connect", CIDR: "127.0.0.1/32", Permission: "read"},
+	}
+	serverCfg := &config.Config{
+		Mode: "server",
+		Peers: []config.PeerConfig{
+			{Name: "alice", PSK: "alice-pre-shared-key-0123456789", AllowedIPs: []string{"10.0.0.2/32"}},
+			{Name: "bob", PSK: "bob-pre-shared-key-0123456789ab", AllowedIPs: []string{"10.0.0.3/32"}},
+		},
+		Tunnel:     config.TunnelConfig{Type: "loopback"},
+		ForwardACL: acl,
+	}
+	logger := logging.New(logging.LevelError, nil)
+	router, err := NewRouter(serverCfg, logger)
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	defer router.Close()
+
+	// connect runs a client session that publishes the echo server
+	connect := func(psk string) *Device {
+		t.Helper()
+		clientCfg := &config.Config{
+			Mode:     "client",
+			Peers:    []config.PeerConfig{{Name: "server", PSK: psk, AllowedIPs: []string{"10.0.0.0/24"}}},
+			Tunnel:   config.TunnelConfig{Type: "loopback"},
+			Forwards: []config.ForwardConfig{{Name: "echo", Listen: published, Target: echo}},
+		}
+		client, conn := routerSession(t, router, serverCfg, clientCfg)
+		client.PublishForwards(conn, clientCfg.Forwards, 2*time.Second)
+		return client
+	}
+	// waitForward waits for the client's view of its forward
+	waitForward := func(client *Device, check func(ForwardState) bool) ForwardState {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			var state ForwardState
+			if forwards := client.Snapshot().Forwards; len(forwards) == 1 {
+				state = forwards[0]
+				if check(state) {
+					return state
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected forward state %+v", state)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// bob is not allowed to publish
+	bob := connect("bob-pre-shared-key-0123456789ab")
+	state := waitForward(bob, func(s ForwardState) bool { return s.Error != "" })
+	if state.Published || !strings.Contains(state.Error, "denied") {
+		t.Fatalf("expected bob's forward to be denied, got %+v", state)
+	}
+	if len(router.Forwards()) != 0 {
+		t.Fatalf("denied forward was published: %+v", router.Forwards())
+	}
+
+	// alice publishes, and connections reach her echo server
+	alice := connect("alice-pre-shared-key-0123456789")
+	waitForward(alice, func(s ForwardState) bool { return s.Published })
+	if forwards := router.Forwards(); len(forwards) != 1 || forwards[0].Peer != "alice" || forwards[0].Listen != published {
+		t.Fatalf("unexpected published forwards %+v", forwards)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialTimeout("tcp", published, 2*time.Second)
+		if err != nil {
+			t.Fatalf("dial published port: %v", err)
+		}
+		msg := fmt.Sprintf("forwarded connection %d", i)
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Fatalf("echo %d: %q %v", i, buf, err)
+		}
+		conn.Close()
+	}
+
+	// Without a rule letting loopback connect, connections are refused
+	if err := router.UpdateForwardACL(acl[:1]); err != nil {
+		t.Fatalf("update acl: %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", published, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial published port: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected refused connection to be closed, got %v", err)
+	}
+	conn.Close()
+	if forwards := router.Forwards(); forwards[0].Connections != 2 || forwards[0].Refused != 1 {
+		t.Fatalf("unexpected forward counters %+v", forwards[0])
+	}
+	waitForward(alice, func(s ForwardState) bool { return s.Connections == 2 && s.Active == 0 })
+}
+
+func TestDeviceLocalForward(t *testing.T) {
+	echo := startEchoServer(t)
+
+	cfg := &config.Config{
+		PSK:    "device-local-forward-psk-0123456789",
+		Peers:  []config.PeerConfig{{Name: "peer", AllowedIPs: []string{"10.0.0.0/24"}}},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+		Proxy:  config.ProxyConfig{Outbound: true, OutboundAllow: []string{"127.0.0.0/8"}},
+	}
+	pair := connectPair(t, "tcp", cfg, cfg)
+	if pair.clientErr != nil || pair.serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", pair.clientErr, pair.serverErr)
+	}
+	go pair.server.TunnelLoop(pair.serverConn)
+	go pair.client.TunnelLoop(pair.clientConn)
+
+	forwards := []config.ForwardConfig{{Name: "echo", Listen: "127.0.0.1:0", Target: echo}}
+	if err := pair.client.ListenLocalForwards(forwards, 2*time.Second); err != nil {
+		t.Fatalf("listen local forwards: %v", err)
+	}
+	local := pair.client.Snapshot().LocalForwards
+	if len(local) != 1 || !local[0].Published {
+		t.Fatalf("unexpected local forwards %+v", local)
+	}
+	listen := local[0].Listen
+
+	// Connections to the local port reach the echo server through the server
+	msg := "through the local forward"
+	conn, err := net.DialTimeout("tcp", listen, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial local forward: %v", err)
+	}
+	conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("echo: %q %v", buf, err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		state := pair.client.Snapshot().LocalForwards[0]
+		if state.Connections == 1 && state.Active == 0 && state.BytesSent == uint64(len(msg)) && state.BytesReceived == uint64(len(msg)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected local forward counters %+v", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Without a session, connections are closed and the error is reported
+	pair.clientConn.Close()
+	conn, err = net.DialTimeout("tcp", listen, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial local forward: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("expected the connection to be closed without a session, got %v", err)
+	}
+	conn.Close()
+	if state := pair.client.Snapshot().LocalForwards[0]; state.Error == "" {
+		t.Fatalf("expected the failure to be reported, got %+v", state)
+	}
+
+	// The listeners close with the device
+	pair.client.Close()
+	if _, err := net.DialTimeout("tcp", listen, time.Second); err == nil {
+		t.Fatal("local forward still listening after close")
+	}
+}
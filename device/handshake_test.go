@@ -0,0 +1,804 @@
+package device
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"stp/config"
+	"stp/crypto"
+	"stp/internal/dataplane"
+	"stp/internal/logging"
+	"stp/packet"
+	"stp/transport"
+)
+
+// handshakePair runs a client and server device handshake over TCP loopback.
+func handshakePair(t *testing.T, serverCfg, clientCfg *config.Config) (*Device, *Device, error, error) {
+	t.Helper()
+	return handshakePairOver(t, "tcp", serverCfg, clientCfg)
+}
+
+// handshakePairOver runs the handshake over the given loopback network.
+func handshakePairOver(t *testing.T, network string, serverCfg, clientCfg *config.Config) (*Device, *Device, error, error) {
+	t.Helper()
+	pair := connectPair(t, network, serverCfg, clientCfg)
+	return pair.server, pair.client, pair.serverErr, pair.clientErr
+}
+
+// devicePair is a client and server device joined by one connection.
+type devicePair struct {
+	server, client         *Device
+	serverConn, clientConn net.Conn
+	serverErr, clientErr   error
+}
+
+// connectPair handshakes a client and server device and keeps the
+// connection open for tunnel traffic. Prepare hooks run before the handshake.
+func connectPair(t *testing.T, network string, serverCfg, clientCfg *config.Config, prepare ...func(server, client *Device)) devicePair {
+	t.Helper()
+	logger := logging.New(logging.LevelError, nil)
+
+	server, err := NewDevice(RoleServer, serverCfg, logger)
+	if err != nil {
+		t.Fatalf("new server device: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	client, err := NewDevice(RoleClient, clientCfg, logger)
+	if err != nil {
+		t.Fatalf("new client device: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	for _, fn := range prepare {
+		fn(server, client)
+	}
+
+	ln, err := transport.Listen(network, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+	serverDone := make(chan accepted, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverDone <- accepted{err: err}
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		err = server.Handshake(conn, serverCfg)
+		if err != nil {
+			conn.Close()
+		}
+		serverDone <- accepted{conn, err}
+	}()
+
+	conn, err := transport.Dial(network, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	clientErr := client.Handshake(conn, clientCfg)
+	if clientErr != nil {
+		conn.Close()
+	}
+	result := <-serverDone
+	return devicePair{
+		server:     server,
+		client:     client,
+		serverConn: result.conn,
+		clientConn: conn,
+		serverErr:  result.err,
+		clientErr:  clientErr,
+	}
+}
+
+// startEchoServer runs a TCP server on loopback that echoes what each
+// connection sends, and returns its address.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testPSK authenticates the sessions of tests that need no per-peer keys
+const testPSK = "device-handshake-test-psk-0123456789"
+
+// testConfig returns a configuration with testPSK, one peer routing
+// 10.0.0.0/24 and a loopback tunnel. Each call returns a fresh copy for the
+// test to adjust.
+func testConfig() *config.Config {
+	return &config.Config{
+		PSK:    testPSK,
+		Peers:  []config.PeerConfig{{Name: "peer", AllowedIPs: []string{"10.0.0.0/24"}}},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+	}
+}
+
+func testKeyPair(t *testing.T) (string, string) {
+	t.Helper()
+	priv, err := crypto.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pub, err := crypto.PublicKey(priv)
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(priv), base64.StdEncoding.EncodeToString(pub[:])
+}
+
+func TestDeviceNoiseHandshake(t *testing.T) {
+	for _, mode := range []string{config.HandshakeLegacy, config.HandshakeNoiseXX} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Handshake = mode
+
+			server, client, serverErr, clientErr := handshakePair(t, cfg, cfg)
+			if clientErr != nil {
+				t.Fatalf("client handshake: %v", clientErr)
+			}
+			if serverErr != nil {
+				t.Fatalf("server handshake: %v", serverErr)
+			}
+
+			clientState := client.Snapshot()
+			serverState := server.Snapshot()
+			if clientState.SessionID != serverState.SessionID {
+				t.Fatalf("session mismatch: %s != %s", clientState.SessionID, serverState.SessionID)
+			}
+			if clientState.Handshake != mode {
+				t.Fatalf("expected handshake %q, got %q", mode, clientState.Handshake)
+			}
+		})
+	}
+}
+
+func TestDeviceNoisePinnedKeys(t *testing.T) {
+	serverPriv, serverPub := testKeyPair(t)
+	clientPriv, clientPub := testKeyPair(t)
+	strangerPriv, _ := testKeyPair(t)
+
+	serverCfg := testConfig()
+	serverCfg.Handshake = config.HandshakeNoiseIK
+	serverCfg.PrivateKey = serverPriv
+	serverCfg.Peers = []config.PeerConfig{{Name: "laptop", PublicKey: clientPub, AllowedIPs: []string{"10.0.0.2/32"}}}
+	clientCfg := testConfig()
+	clientCfg.Handshake = config.HandshakeNoiseIK
+	clientCfg.PrivateKey = clientPriv
+	clientCfg.Peers = []config.PeerConfig{{Name: "server", PublicKey: serverPub, AllowedIPs: []string{"0.0.0.0/0"}}}
+
+	server, client, serverErr, clientErr := handshakePair(t, serverCfg, clientCfg)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	if got := server.Snapshot().RemotePeer; got != "laptop" {
+		t.Fatalf("server bound session to %q, want laptop", got)
+	}
+	if got := client.Snapshot().RemotePeer; got != "server" {
+		t.Fatalf("client bound session to %q, want server", got)
+	}
+	if got := server.Snapshot().PublicKey; got != serverPub {
+		t.Fatalf("server reported public key %q, want %q", got, serverPub)
+	}
+
+	strangerCfg := *clientCfg
+	strangerCfg.PrivateKey = strangerPriv
+	_, _, serverErr, _ = handshakePair(t, serverCfg, &strangerCfg)
+	if serverErr == nil {
+		t.Fatal("server accepted an unpinned client static key")
+	}
+}
+
+func TestDevicePerPeerPSK(t *testing.T) {
+	for _, mode := range []string{config.HandshakeLegacy, config.HandshakeNoiseXX} {
+		t.Run(mode, func(t *testing.T) {
+			serverCfg := &config.Config{
+				Mode:      "server",
+				Handshake: mode,
+				Peers: []config.PeerConfig{
+					{Name: "alice", PSK: "alice-pre-shared-key-0123456789", AllowedIPs: []string{"10.0.0.2/32"}},
+					{Name: "bob", PSK: "bob-pre-shared-key-0123456789ab", AllowedIPs: []string{"10.0.0.3/32"}},
+				},
+				Tunnel: config.TunnelConfig{Type: "loopback"},
+			}
+			clientCfg := &config.Config{
+				Mode:      "client",
+				Handshake: mode,
+				Peers:     []config.PeerConfig{{Name: "server", PSK: "bob-pre-shared-key-0123456789ab", AllowedIPs: []string{"0.0.0.0/0"}}},
+				Tunnel:    config.TunnelConfig{Type: "loopback"},
+			}
+
+			server, _, serverErr, clientErr := handshakePair(t, serverCfg, clientCfg)
+			if serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+			}
+			if got := server.RemotePeer(); got != "bob" {
+				t.Fatalf("server bound session to %q, want bob", got)
+			}
+
+			revokedCfg := *clientCfg
+			revokedCfg.Peers = []config.PeerConfig{{Name: "server", PSK: "carol-pre-shared-key-0123456789", AllowedIPs: []string{"0.0.0.0/0"}}}
+			_, _, serverErr, _ = handshakePair(t, serverCfg, &revokedCfg)
+			if serverErr == nil {
+				t.Fatal("server accepted a psk that belongs to no peer")
+			}
+		})
+	}
+}
+
+func TestDevicePSKGenerations(t *testing.T) {
+	now := time.Now()
+	psks := []config.PSKEntry{
+		{Key: "rotating-psk-generation-one-0123", Generation: 1, NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(time.Hour)},
+		{Key: "rotating-psk-generation-two-0123", Generation: 2, NotBefore: now.Add(-time.Hour)},
+	}
+	serverCfg := &config.Config{
+		Mode:   "server",
+		PSKs:   psks,
+		Peers:  []config.PeerConfig{{Name: "laptop", AllowedIPs: []string{"10.0.0.2/32"}}},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+	}
+
+	// A client that has not picked up generation two yet is still accepted.
+	oldClient := &config.Config{
+		Mode:   "client",
+		PSKs:   psks[:1],
+		Peers:  []config.PeerConfig{{Name: "server", AllowedIPs: []string{"0.0.0.0/0"}}},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+	}
+	server, _, serverErr, clientErr := handshakePair(t, serverCfg, oldClient)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	if got := server.Snapshot().PSKGen; got != 1 {
+		t.Fatalf("server reported generation %d, want 1", got)
+	}
+
+	newClient := *oldClient
+	newClient.PSKs = psks
+	server, client, serverErr, clientErr := handshakePair(t, serverCfg, &newClient)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	if got := client.Snapshot().PSKGen; got != 2 {
+		t.Fatalf("client used generation %d, want newest 2", got)
+	}
+	if got := server.Snapshot().PSKGen; got != 2 {
+		t.Fatalf("server reported generation %d, want 2", got)
+	}
+}
+
+func TestDeviceSecurityProfiles(t *testing.T) {
+	newCfg := func(mode, profile string) *config.Config {
+		cfg := testConfig()
+		cfg.Mode = mode
+		cfg.Handshake = config.HandshakeNoiseXX
+		cfg.SecurityProfile = profile
+		return cfg
+	}
+
+	server, client, serverErr, clientErr := handshakePair(t, newCfg("server", config.SecurityProfileStrict), newCfg("client", config.SecurityProfileStrict))
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	serverParams := server.Snapshot().Negotiated
+	clientParams := client.Snapshot().Negotiated
+	if serverParams != clientParams {
+		t.Fatalf("negotiated params differ: server=%+v client=%+v", serverParams, clientParams)
+	}
+	if serverParams.Version != crypto.ProtocolVersionNoise || !serverParams.HasFeature(crypto.FeaturePFS) {
+		t.Fatalf("unexpected negotiated params %+v", serverParams)
+	}
+
+	_, _, serverErr, clientErr = handshakePair(t, newCfg("server", config.SecurityProfileStrict), newCfg("client", config.SecurityProfileLegacy))
+	if serverErr == nil || clientErr == nil {
+		t.Fatalf("strict server accepted a legacy client: server=%v client=%v", serverErr, clientErr)
+	}
+}
+
+func TestDeviceCipherSuitePreference(t *testing.T) {
+	serverCfg := testConfig()
+	serverCfg.Mode = "server"
+	serverCfg.Handshake = config.HandshakeNoiseXX
+	serverCfg.SecurityProfile = config.SecurityProfileBalanced
+	serverCfg.CipherSuites = []string{"aes-256-gcm", "chacha20-poly1305"}
+	clientCfg := *serverCfg
+	clientCfg.Mode = "client"
+	clientCfg.CipherSuites = nil
+
+	server, client, serverErr, clientErr := handshakePair(t, serverCfg, &clientCfg)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	for _, state := range []State{server.Snapshot(), client.Snapshot()} {
+		if state.CipherSuite != "AES-256-GCM" {
+			t.Fatalf("%s using %q, want AES-256-GCM", state.Role, state.CipherSuite)
+		}
+	}
+	if got := server.Metrics()[CipherSuiteMetric("device_cipher_suite", crypto.CipherSuiteAES256GCM)]; got != 1 {
+		t.Fatalf("cipher suite metric = %v, want 1", got)
+	}
+}
+
+func TestDeviceObfuscation(t *testing.T) {
+	cfg := testConfig()
+	cfg.Obfuscation = config.ObfuscationConfig{Mode: config.ObfuscationOBFS4, MaxPadding: 64}
+	server, client, serverErr, clientErr := handshakePair(t, cfg, cfg)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	for _, state := range []State{server.Snapshot(), client.Snapshot()} {
+		if state.Obfuscation != config.ObfuscationOBFS4 {
+			t.Fatalf("%s reported obfuscation %q, want obfs4", state.Role, state.Obfuscation)
+		}
+	}
+}
+
+func TestDeviceUDPHandshake(t *testing.T) {
+	serverPriv, serverPub := testKeyPair(t)
+	clientPriv, clientPub := testKeyPair(t)
+	base := *testConfig()
+	base.Handshake = config.HandshakeNoiseXX
+	base.Obfuscation = config.ObfuscationConfig{Mode: config.ObfuscationOBFS4, MaxPadding: 64}
+	serverCfg, clientCfg := base, base
+	serverCfg.PrivateKey = serverPriv
+	serverCfg.Peers = []config.PeerConfig{{Name: "client", PublicKey: clientPub, AllowedIPs: []string{"10.0.0.2/32"}}}
+	clientCfg.PrivateKey = clientPriv
+	clientCfg.Peers = []config.PeerConfig{{Name: "server", PublicKey: serverPub, AllowedIPs: []string{"10.0.0.0/24"}}}
+
+	server, client, serverErr, clientErr := handshakePairOver(t, "udp", &serverCfg, &clientCfg)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	if server.Snapshot().Obfuscation != config.ObfuscationOBFS4 || client.Snapshot().Obfuscation != config.ObfuscationOBFS4 {
+		t.Fatal("obfuscation not active over UDP")
+	}
+}
+
+func TestDeviceRekeyUnderLoad(t *testing.T) {
+	cfg := testConfig()
+	pair := connectPair(t, "tcp", cfg, cfg)
+	if pair.serverErr != nil || pair.clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", pair.serverErr, pair.clientErr)
+	}
+	server, client := pair.server, pair.client
+	receive := func(d *Device, conn net.Conn, want transport.FrameFlag) []byte {
+		t.Helper()
+		for {
+			frame, err := d.transport.Receive(conn)
+			if err != nil {
+				t.Fatalf("%s receive: %v", d.role, err)
+			}
+			if frame.Flags == transport.FlagBind {
+				continue
+			}
+			if frame.Flags != want {
+				t.Fatalf("%s expected flag %v, got %v", d.role, want, frame.Flags)
+			}
+			return frame.Payload
+		}
+	}
+
+	startEpoch := client.Snapshot().RekeyEpoch
+	if err := client.initiateRekey(pair.clientConn); err != nil {
+		t.Fatalf("initiate rekey: %v", err)
+	}
+	// The client keeps sending under the old keys until the response arrives.
+	if err := client.transport.SendKeepAlive(pair.clientConn); err != nil {
+		t.Fatalf("client keepalive: %v", err)
+	}
+
+	request := receive(server, pair.serverConn, transport.FlagRekey)
+	if err := server.handleRekey(request, pair.serverConn); err != nil {
+		t.Fatalf("server rekey: %v", err)
+	}
+	if err := server.transport.SendKeepAlive(pair.serverConn); err != nil {
+		t.Fatalf("server keepalive: %v", err)
+	}
+	receive(server, pair.serverConn, transport.FlagKeepAlive)
+
+	response := receive(client, pair.clientConn, transport.FlagRekey)
+	if err := client.handleRekey(response, pair.clientConn); err != nil {
+		t.Fatalf("client rekey: %v", err)
+	}
+	receive(client, pair.clientConn, transport.FlagKeepAlive)
+
+	clientState, serverState := client.Snapshot(), server.Snapshot()
+	if clientState.RekeyEpoch != startEpoch+1 || serverState.RekeyEpoch != startEpoch+1 {
+		t.Fatalf("expected epoch %d, got client=%d server=%d", startEpoch+1, clientState.RekeyEpoch, serverState.RekeyEpoch)
+	}
+	if clientState.PendingRekey {
+		t.Fatal("client still has a pending rekey")
+	}
+	if clientState.SessionID != serverState.SessionID {
+		t.Fatalf("session mismatch after rekey: %s != %s", clientState.SessionID, serverState.SessionID)
+	}
+}
+
+func TestDeviceRekeyPolicy(t *testing.T) {
+	cfg := testConfig()
+	cfg.RekeyBudget = 1000
+	cfg.RekeyBytes = 1 << 20
+	for _, tc := range []struct {
+		name   string
+		charge func(d *Device)
+	}{
+		{"messages", func(d *Device) {
+			for i := 0; i < 1000; i++ {
+				d.recordTraffic(i%2 == 0, 10)
+			}
+		}},
+		{"bytes", func(d *Device) {
+			d.recordTraffic(false, 1<<20)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pair := connectPair(t, "tcp", cfg, cfg)
+			if pair.serverErr != nil || pair.clientErr != nil {
+				t.Fatalf("handshake failed: server=%v client=%v", pair.serverErr, pair.clientErr)
+			}
+			client := pair.client
+			if client.pfs.NeedsRekey() {
+				t.Fatal("fresh session already over budget")
+			}
+			tc.charge(client)
+			if !client.pfs.NeedsRekey() {
+				t.Fatalf("budget exhausted but no rekey due: %+v", client.Snapshot().PFS)
+			}
+
+			if err := client.initiateRekey(pair.clientConn); err != nil {
+				t.Fatalf("initiate rekey: %v", err)
+			}
+			state := client.Snapshot()
+			if !state.PendingRekey {
+				t.Fatal("rekey request not pending")
+			}
+			if state.PFS.CurrentEpoch != state.RekeyEpoch || state.PFS.MessagesSent+state.PFS.MessagesReceived == 0 {
+				t.Fatalf("unexpected pfs stats %+v", state.PFS)
+			}
+		})
+	}
+}
+
+// lossyConn drops the next dropWrites packets written and the next
+// dropReads packets read on a datagram connection.
+type lossyConn struct {
+	net.Conn
+	dropWrites, dropReads atomic.Int32
+	reads                 atomic.Int32 // packets passed on
+}
+
+func (c *lossyConn) Datagram() bool { return true }
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	if c.dropWrites.Add(-1) >= 0 {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *lossyConn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(p)
+		if err != nil || c.dropReads.Add(-1) < 0 {
+			c.reads.Add(1)
+			return n, err
+		}
+	}
+}
+
+func TestDeviceRekeyLoss(t *testing.T) {
+	cfg := testConfig()
+	for _, tc := range []struct {
+		name                  string
+		dropWrites, dropReads int32
+		abandoned             bool
+	}{
+		{name: "request", dropWrites: 1},
+		{name: "response", dropReads: 1},
+		{name: "abandoned", dropWrites: 2, abandoned: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pair := connectPair(t, "udp", cfg, cfg, func(server, client *Device) {
+				client.rekeyPolicy.RekeyTimeout = 50 * time.Millisecond
+				client.rekeyPolicy.RekeyAttempts = 2
+			})
+			if pair.serverErr != nil || pair.clientErr != nil {
+				t.Fatalf("handshake failed: server=%v client=%v", pair.serverErr, pair.clientErr)
+			}
+			server, client := pair.server, pair.client
+			conn := &lossyConn{Conn: pair.clientConn}
+			go server.TunnelLoop(pair.serverConn)
+			go client.TunnelLoop(conn)
+
+			// rekey runs one rekey and waits until it is answered or abandoned
+			rekey := func(epoch uint32) {
+				t.Helper()
+				if err := client.initiateRekey(conn); err != nil {
+					t.Fatalf("initiate rekey: %v", err)
+				}
+				deadline := time.Now().Add(3 * time.Second)
+				for client.Snapshot().PendingRekey {
+					if time.Now().After(deadline) {
+						t.Fatal("rekey still pending")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				for server.Snapshot().RekeyEpoch != epoch {
+					if time.Now().After(deadline) {
+						t.Fatalf("server at epoch %d, want %d", server.Snapshot().RekeyEpoch, epoch)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				if got := client.Snapshot().RekeyEpoch; got != epoch {
+					t.Fatalf("client at epoch %d, want %d", got, epoch)
+				}
+			}
+
+			// Wait for the server's bind, so the next packet read is the
+			// rekey response
+			deadline := time.Now().Add(2 * time.Second)
+			for conn.reads.Load() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("no bind from the server")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			start := client.Snapshot().RekeyEpoch
+			conn.dropWrites.Store(tc.dropWrites)
+			conn.dropReads.Store(tc.dropReads)
+			began := time.Now()
+			if tc.abandoned {
+				rekey(start)
+			} else {
+				rekey(start + 1)
+			}
+			if elapsed := time.Since(began); elapsed < 50*time.Millisecond {
+				t.Fatalf("rekey completed in %v, before any retry", elapsed)
+			}
+			// The session keeps rekeying over the new keys
+			if tc.abandoned {
+				rekey(start + 1)
+			} else {
+				rekey(start + 2)
+			}
+		})
+	}
+}
+
+func TestDeviceSessionResumption(t *testing.T) {
+	cfg := testConfig()
+	cfg.ZeroRTT = config.ZeroRTTConfig{Enabled: true}
+	serverCfg := transport.DefaultZeroRTTConfig()
+	serverCfg.MaxTicketUsage = 1
+
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			serverTickets := transport.NewZeroRTTManager(serverCfg)
+			defer serverTickets.Stop()
+			clientTickets := transport.NewZeroRTTManager(transport.DefaultZeroRTTConfig())
+			defer clientTickets.Stop()
+			withTickets := func(server, client *Device) {
+				server.SetTickets(serverTickets)
+				client.SetTickets(clientTickets)
+			}
+
+			first := connectPair(t, network, cfg, cfg, withTickets)
+			if first.serverErr != nil || first.clientErr != nil {
+				t.Fatalf("handshake failed: server=%v client=%v", first.serverErr, first.clientErr)
+			}
+			if first.client.Snapshot().Resumed {
+				t.Fatal("first session reported as resumed")
+			}
+			go first.client.TunnelLoop(first.clientConn)
+			deadline := time.Now().Add(2 * time.Second)
+			for clientTickets.GetStats().TicketsStored == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("client never stored a session ticket")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			second := connectPair(t, network, cfg, cfg, withTickets)
+			if second.serverErr != nil || second.clientErr != nil {
+				t.Fatalf("resumption failed: server=%v client=%v", second.serverErr, second.clientErr)
+			}
+			clientState, serverState := second.client.Snapshot(), second.server.Snapshot()
+			if !clientState.Resumed || !serverState.Resumed {
+				t.Fatalf("session not resumed: client=%v server=%v", clientState.Resumed, serverState.Resumed)
+			}
+			if clientState.SessionID != serverState.SessionID || clientState.SessionID == first.client.Snapshot().SessionID {
+				t.Fatalf("unexpected session ids: client=%s server=%s", clientState.SessionID, serverState.SessionID)
+			}
+			if clientState.CipherSuite != first.client.Snapshot().CipherSuite {
+				t.Fatalf("cipher suite changed on resumption: %s", clientState.CipherSuite)
+			}
+
+			// Both ends now hold forward-secret keys and can talk
+			if err := second.client.transport.SendKeepAlive(second.clientConn); err != nil {
+				t.Fatalf("client keepalive: %v", err)
+			}
+			for {
+				frame, err := second.server.transport.Receive(second.serverConn)
+				if err != nil {
+					t.Fatalf("server receive: %v", err)
+				}
+				if frame.Flags == transport.FlagKeepAlive {
+					break
+				}
+			}
+			if stats := serverTickets.GetStats(); stats.ZeroRTTSuccess != 1 {
+				t.Fatalf("expected one redeemed ticket, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestDeviceResumptionRefused(t *testing.T) {
+	cfg := testConfig()
+	cfg.ZeroRTT = config.ZeroRTTConfig{Enabled: true}
+	serverTickets := transport.NewZeroRTTManager(transport.DefaultZeroRTTConfig())
+	defer serverTickets.Stop()
+	clientTickets := transport.NewZeroRTTManager(transport.DefaultZeroRTTConfig())
+	defer clientTickets.Stop()
+
+	// A ticket the server never issued, e.g. from before a restart
+	stale := &transport.SessionTicket{
+		SessionKey: make([]byte, crypto.KeySize),
+		IssuedAt:   time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+		MaxUsage:   1,
+	}
+	clientTickets.StoreTicket("", stale)
+
+	pair := connectPair(t, "tcp", cfg, cfg, func(server, client *Device) {
+		server.SetTickets(serverTickets)
+		client.SetTickets(clientTickets)
+	})
+	if !errors.Is(pair.clientErr, ErrResumeFailed) {
+		t.Fatalf("expected ErrResumeFailed, got %v", pair.clientErr)
+	}
+	if !errors.Is(pair.serverErr, transport.ErrTicketUnknown) {
+		t.Fatalf("expected unknown ticket, got %v", pair.serverErr)
+	}
+	if clientTickets.GetStats().TicketsStored != 0 {
+		t.Fatal("refused ticket kept for reuse")
+	}
+
+	// The retry falls back to a full handshake
+	retry := connectPair(t, "tcp", cfg, cfg, func(server, client *Device) {
+		server.SetTickets(serverTickets)
+		client.SetTickets(clientTickets)
+	})
+	if retry.serverErr != nil || retry.clientErr != nil {
+		t.Fatalf("full handshake failed: server=%v client=%v", retry.serverErr, retry.clientErr)
+	}
+	if retry.client.Snapshot().Resumed {
+		t.Fatal("retry unexpectedly resumed")
+	}
+}
+
+func TestDeviceReconnect(t *testing.T) {
+	cfg := testConfig()
+	pair := connectPair(t, "tcp", cfg, cfg)
+	if pair.serverErr != nil || pair.clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", pair.serverErr, pair.clientErr)
+	}
+	client := pair.client
+	plane := client.plane.(*dataplane.Loopback)
+	expectPayload := func(server *Device, conn net.Conn, want string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			frame, err := server.transport.Receive(conn)
+			if err != nil {
+				t.Fatalf("server receive: %v", err)
+			}
+			if frame.Flags != transport.FlagData {
+				continue
+			}
+			pkt, err := packet.Decode(frame.Payload)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			_, data, err := packet.ExtractData(pkt)
+			if err != nil {
+				t.Fatalf("extract: %v", err)
+			}
+			if string(data) == "lost" {
+				continue
+			}
+			if string(data) != want {
+				t.Fatalf("expected %q, got %q", want, data)
+			}
+			return
+		}
+	}
+
+	if err := plane.Inject("peer", []byte("first")); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectPayload(pair.server, pair.serverConn, "first")
+
+	// The session dies. A failed send must not stop the outbound pump.
+	pair.clientConn.Close()
+	pair.serverConn.Close()
+	if err := plane.Inject("peer", []byte("lost")); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+
+	// The same client device handshakes with a new server on a new
+	// connection and the outbound pump follows it.
+	logger := logging.New(logging.LevelError, nil)
+	server, err := NewDevice(RoleServer, cfg, logger)
+	if err != nil {
+		t.Fatalf("new server device: %v", err)
+	}
+	defer server.Close()
+	ln, err := transport.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		if err := server.Handshake(conn, cfg); err != nil {
+			conn.Close()
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := transport.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := client.Handshake(conn, cfg); err != nil {
+		t.Fatalf("rehandshake: %v", err)
+	}
+	serverConn, ok := <-accepted
+	if !ok {
+		t.Fatal("server handshake failed")
+	}
+	defer serverConn.Close()
+
+	if err := plane.Inject("peer", []byte("second")); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectPayload(server, serverConn, "second")
+	if client.Snapshot().SessionID != server.Snapshot().SessionID {
+		t.Fatal("client did not adopt the new session")
+	}
+}
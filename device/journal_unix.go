@@ -0,0 +1,54 @@
+//go:build !windows
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// defaultStateDir is where journals live unless replaced in tests
+const defaultStateDir = "/run/stp"
+
+// checkStateDir refuses a state directory another user could write to
+func checkStateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("state directory %s is not a directory", dir)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("state directory %s is owned by uid %d", dir, st.Uid)
+	}
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("state directory %s is writable by other users", dir)
+	}
+	return nil
+}
+
+// openJournal opens a journal for reading without following a symlink, and
+// refuses one the daemon's user does not own.
+func openJournal(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, errors.New("journal is not a regular file")
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		f.Close()
+		return nil, fmt.Errorf("journal is owned by uid %d", st.Uid)
+	}
+	return f, nil
+}
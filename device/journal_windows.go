@@ -0,0 +1,39 @@
+//go:build windows
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// defaultStateDir is where journals live unless replaced in tests
+var defaultStateDir = filepath.Join(os.Getenv("ProgramData"), "stp")
+
+// checkStateDir refuses a state directory that is a link elsewhere. Access
+// is governed by the ACL ProgramData subdirectories inherit.
+func checkStateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("state directory %s is not a directory", dir)
+	}
+	return nil
+}
+
+// openJournal opens a journal for reading, refusing anything but a regular
+// file.
+func openJournal(path string) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("journal is not a regular file")
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,340 @@
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"stp/packet"
+	"stp/transport"
+)
+
+const (
+	// streamRequestTimeout bounds how long an accepted stream may take to
+	// name its destination.
+	streamRequestTimeout = 10 * time.Second
+	// maxStreamRequest is the largest connect request a stream may send
+	maxStreamRequest = 4096
+)
+
+// muxSession runs a transport.Multiplexer inside one session. The
+// multiplexer reads and writes one end of a pipe: what it writes is sent as
+// mux packets, and received mux packets are written back to it.
+type muxSession struct {
+	conn net.Conn // session connection
+	mux  *transport.Multiplexer
+	pipe net.Conn // device end of the pipe
+}
+
+func (s *muxSession) close() {
+	s.mux.Close()
+	s.pipe.Close()
+}
+
+// OpenStream connects to address through the server over a new stream of
+// the current session, so that any number of connections share one
+// handshake. The server must allow outbound connections. A "udp" stream
+// keeps datagram boundaries: every Read returns one datagram.
+func (d *Device) OpenStream(network, address string, timeout time.Duration) (net.Conn, error) {
+	request, err := packet.NewConnectPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := d.sessionConn()
+	if conn == nil {
+		return nil, errNoSession
+	}
+	if transport.IsDatagram(conn) {
+		return nil, errors.New("streams require a stream transport")
+	}
+	s, err := d.sessionMux(conn)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := requestStream(s, request, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("stream to %s: %w", address, err)
+	}
+
+	if network == "udp" {
+		return &datagramConn{Conn: stream}, nil
+	}
+	return stream, nil
+}
+
+// requestStream opens a stream, sends request on it and waits up to
+// timeout for the other end to accept it.
+func requestStream(s *muxSession, request *packet.Packet, timeout time.Duration) (*transport.Stream, error) {
+	stream, err := s.mux.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeStreamPacket(stream, request); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	if timeout > 0 {
+		stream.SetReadDeadline(time.Now().Add(timeout))
+	}
+	reply, err := readStreamPacket(stream)
+	if err == nil && reply.Type != packet.TypeConnectReply {
+		err = fmt.Errorf("unexpected packet type %d before connect reply", reply.Type)
+	}
+	if err == nil {
+		err = packet.ExtractConnectReply(reply)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+	return stream, nil
+}
+
+// sessionMux returns the multiplexer of the session on conn, starting one
+// when there is none yet. Either end may start it; the other starts its own
+// with the first mux packet it receives.
+func (d *Device) sessionMux(conn net.Conn) (*muxSession, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, errors.New("device closed")
+	}
+	if d.mux != nil && d.mux.conn == conn {
+		s := d.mux
+		d.mu.Unlock()
+		return s, nil
+	}
+	old := d.mux
+	local, remote := net.Pipe()
+	s := &muxSession{
+		conn: conn,
+		mux:  transport.NewMultiplexer(local, d.role == RoleClient),
+		pipe: remote,
+	}
+	d.mux = s
+	d.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	go d.pumpMux(s)
+	go d.acceptStreams(s)
+	return s, nil
+}
+
+// handleMux passes a received mux packet to the session's multiplexer
+func (d *Device) handleMux(payload []byte, conn net.Conn) error {
+	s, err := d.sessionMux(conn)
+	if err != nil {
+		return err
+	}
+	d.recordTraffic(false, len(payload))
+	_, err = s.pipe.Write(payload)
+	return err
+}
+
+// pumpMux sends what the multiplexer writes as mux packets until either
+// the multiplexer or the session ends.
+func (d *Device) pumpMux(s *muxSession) {
+	buf := make([]byte, relayChunkSize)
+	for {
+		n, err := s.pipe.Read(buf)
+		if n > 0 {
+			pkt := &packet.Packet{Type: packet.TypeMux, Payload: buf[:n]}
+			if sendErr := d.transport.SendPayload(s.conn, packet.Encode(pkt)); sendErr != nil {
+				break
+			}
+			d.recordTraffic(true, n)
+		}
+		if err != nil {
+			break
+		}
+	}
+	d.mu.Lock()
+	if d.mux == s {
+		d.mux = nil
+	}
+	d.mu.Unlock()
+	s.close()
+}
+
+// endMux closes the streams of the session on conn, or of any session
+// when conn is nil.
+func (d *Device) endMux(conn net.Conn) {
+	d.mu.Lock()
+	s := d.mux
+	if s == nil || (conn != nil && s.conn != conn) {
+		d.mu.Unlock()
+		return
+	}
+	d.mux = nil
+	d.mu.Unlock()
+	s.close()
+}
+
+func (d *Device) acceptStreams(s *muxSession) {
+	for {
+		stream, err := s.mux.AcceptStream()
+		if err != nil {
+			return
+		}
+		go d.serveStream(s, stream)
+	}
+}
+
+// serveStream serves a stream the other end opened according to the
+// request it starts with.
+func (d *Device) serveStream(s *muxSession, stream net.Conn) {
+	stream.SetReadDeadline(time.Now().Add(streamRequestTimeout))
+	request, err := readStreamPacket(stream)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	switch {
+	case request.Type == packet.TypeConnect:
+		d.serveConnect(stream, request)
+	case request.Type == packet.TypeForward && d.role == RoleServer:
+		d.servePublish(s, stream, request)
+	case request.Type == packet.TypeForward:
+		d.serveForwarded(stream, request)
+	default:
+		d.logger.Warn("unexpected stream request", map[string]interface{}{"type": request.Type})
+		writeStreamPacket(stream, packet.NewConnectReply(fmt.Errorf("unsupported request type %d", request.Type)))
+		stream.Close()
+	}
+}
+
+// serveConnect dials the destination of a connect request and joins it to
+// the stream.
+func (d *Device) serveConnect(stream net.Conn, request *packet.Packet) {
+	network, address, err := packet.ExtractConnect(request)
+	if err != nil {
+		d.logger.Warn("malformed stream request", map[string]interface{}{"error": err.Error()})
+		stream.Close()
+		return
+	}
+
+	upstream, err := d.dialOutbound(network, address)
+	if sendErr := writeStreamPacket(stream, packet.NewConnectReply(err)); sendErr != nil || err != nil {
+		if err != nil {
+			d.logger.Info("stream refused", map[string]interface{}{"network": network, "address": address, "error": err.Error()})
+		}
+		if upstream != nil {
+			upstream.Close()
+		}
+		stream.Close()
+		return
+	}
+	d.logger.Debug("stream connected", map[string]interface{}{"network": network, "address": address, "peer": d.RemotePeer()})
+
+	if network == "udp" {
+		stream = &datagramConn{Conn: stream}
+	}
+	transport.Splice(stream, upstream)
+}
+
+// dialOutbound dials a destination a client asked for, if the server
+// allows it. The policy is checked against the address actually dialed,
+// after name resolution.
+func (d *Device) dialOutbound(network, address string) (net.Conn, error) {
+	d.mu.RLock()
+	outbound, allow := d.outbound, d.outboundAllow
+	d.mu.RUnlock()
+
+	switch {
+	case d.role != RoleServer || !outbound:
+		return nil, errOutboundDisabled
+	case network != "tcp" && network != "udp":
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	dialer := net.Dialer{
+		Timeout: relayDialTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			return checkOutbound(address, allow)
+		},
+	}
+	return dialer.Dial(network, address)
+}
+
+// checkOutbound refuses loopback, private, link-local and unspecified
+// addresses, which would reach the server's own services and networks,
+// unless a prefix of allow covers them.
+func checkOutbound(address string, allow []netip.Prefix) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap().WithZone("")
+	for _, prefix := range allow {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w: %s", errOutboundRefused, ip)
+	}
+	return nil
+}
+
+// writeStreamPacket sends pkt on a stream, prefixed with its length
+func writeStreamPacket(stream net.Conn, pkt *packet.Packet) error {
+	_, err := (&datagramConn{Conn: stream}).Write(packet.Encode(pkt))
+	return err
+}
+
+// readStreamPacket reads a packet sent with writeStreamPacket
+func readStreamPacket(stream net.Conn) (*packet.Packet, error) {
+	buf := make([]byte, maxStreamRequest)
+	n, err := (&datagramConn{Conn: stream}).Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return packet.Decode(buf[:n])
+}
+
+// datagramConn carries datagrams over a stream, each prefixed with its
+// length. A datagram longer than the buffer passed to Read is truncated.
+type datagramConn struct {
+	net.Conn
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size <= len(p) {
+		return io.ReadFull(c.Conn, p[:size])
+	}
+	n, err := io.ReadFull(c.Conn, p)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.CopyN(io.Discard, c.Conn, int64(size-n))
+	return n, err
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > 0xFFFF {
+		return 0, errors.New("datagram too large")
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,124 @@
+package device
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"stp/config"
+	"stp/transport"
+)
+
+func TestDeviceStreams(t *testing.T) {
+	echo := startEchoServer(t)
+	udpEcho, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := udpEcho.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	for _, outbound := range []bool{true, false} {
+		cfg := &config.Config{
+			PSK:    "device-stream-test-psk-0123456789a",
+			Peers:  []config.PeerConfig{{Name: "peer", AllowedIPs: []string{"10.0.0.0/24"}}},
+			Tunnel: config.TunnelConfig{Type: "loopback"},
+			Proxy:  config.ProxyConfig{Outbound: outbound, OutboundAllow: []string{"127.0.0.0/8"}},
+		}
+		pair := connectPair(t, "tcp", cfg, cfg)
+		if pair.clientErr != nil || pair.serverErr != nil {
+			t.Fatalf("handshake: client %v, server %v", pair.clientErr, pair.serverErr)
+		}
+		go pair.server.TunnelLoop(pair.serverConn)
+		go pair.client.TunnelLoop(pair.clientConn)
+
+		if !outbound {
+			_, err := pair.client.OpenStream("tcp", echo, 2*time.Second)
+			if err == nil || !strings.Contains(err.Error(), "disabled") {
+				t.Fatalf("expected refusal without outbound, got %v", err)
+			}
+			// A refused stream leaves the session usable
+			if err := pair.client.sendData("peer", []byte("still up")); err != nil {
+				t.Fatalf("session after refusal: %v", err)
+			}
+			continue
+		}
+
+		// Several connections share the one session
+		streams := make([]net.Conn, 3)
+		for i := range streams {
+			stream, err := pair.client.OpenStream("tcp", echo, 2*time.Second)
+			if err != nil {
+				t.Fatalf("open stream %d: %v", i, err)
+			}
+			defer stream.Close()
+			streams[i] = stream
+		}
+		if got := len(pair.client.Snapshot().Mux.Streams); got != 3 {
+			t.Fatalf("expected 3 streams, got %d", got)
+		}
+		for i, stream := range streams {
+			msg := fmt.Sprintf("stream %d through the tunnel", i)
+			if _, err := stream.Write([]byte(msg)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			buf := make([]byte, len(msg))
+			stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != msg {
+				t.Fatalf("echo %d: %q %v", i, buf, err)
+			}
+		}
+
+		// A udp stream keeps datagram boundaries
+		udp, err := pair.client.OpenStream("udp", udpEcho.LocalAddr().String(), 2*time.Second)
+		if err != nil {
+			t.Fatalf("open udp stream: %v", err)
+		}
+		defer udp.Close()
+		for _, msg := range []string{"first datagram", "second"} {
+			if _, err := udp.Write([]byte(msg)); err != nil {
+				t.Fatalf("write datagram: %v", err)
+			}
+		}
+		buf := make([]byte, 64)
+		udp.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for _, msg := range []string{"first datagram", "second"} {
+			n, err := udp.Read(buf)
+			if err != nil || string(buf[:n]) != msg {
+				t.Fatalf("datagram: %q %v", buf[:n], err)
+			}
+		}
+
+		// A half-closed stream still receives the reply
+		half := streams[1].(*transport.Stream)
+		if _, err := half.Write([]byte("last words")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := half.CloseWrite(); err != nil {
+			t.Fatalf("close write: %v", err)
+		}
+		half.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if reply, err := io.ReadAll(half); err != nil || string(reply) != "last words" {
+			t.Fatalf("reply after half-close: %q %v", reply, err)
+		}
+
+		// The streams end with the session
+		pair.clientConn.Close()
+		streams[0].SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := streams[0].Read(buf); err != io.EOF {
+			t.Fatalf("expected EOF after the session ended, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"stp/config"
+	"stp/internal/logging"
+	"stp/internal/netconfig"
+)
+
+// The system calls behind interface configuration, replaced in tests.
+var (
+	configureTUN  = netconfig.ConfigureTUN
+	bringUp       = netconfig.BringUp
+	setMTU        = netconfig.SetMTU
+	addRoute      = netconfig.AddRoute
+	deleteRoute   = netconfig.DeleteRoute
+	deleteAddress = netconfig.DeleteAddress
+)
+
+// stateDir holds the journals of applied interface configuration. Only the
+// daemon's user may write to it, since a journal decides what a later start
+// removes. Replaced in tests.
+var stateDir = defaultStateDir
+
+// tunnelNetwork applies tunnel.address and tunnel.routes to the TUN
+// interface when tunnel.autoConfigure is set, and removes them on close.
+// What was applied is journaled before it is applied, so a run that crashed
+// leaves a record the next start cleans up first.
+type tunnelNetwork struct {
+	name    string
+	journal string
+	logger  *logging.Logger
+
+	mu      sync.Mutex
+	address netip.Prefix
+	routes  []netip.Prefix
+}
+
+// networkJournal is the on-disk record of an applied configuration
+type networkJournal struct {
+	Address string   `json:"address,omitempty"`
+	Routes  []string `json:"routes,omitempty"`
+}
+
+// configureTunnel configures the interface of a TUN dataplane. It returns
+// nil when there is nothing to configure.
+func configureTunnel(cfg *config.Config, logger *logging.Logger) (*tunnelNetwork, error) {
+	if cfg.EffectiveTunnelType() != "tun" || !cfg.Tunnel.AutoConfigure {
+		return nil, nil
+	}
+	var address netip.Prefix
+	if cfg.Tunnel.Address != "" {
+		prefix, err := netip.ParsePrefix(cfg.Tunnel.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tun address %q: %w", cfg.Tunnel.Address, err)
+		}
+		address = prefix
+	}
+	routes, err := parseRoutes(cfg.Tunnel.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create state directory: %w", err)
+	}
+	if err := checkStateDir(stateDir); err != nil {
+		return nil, err
+	}
+
+	name := cfg.EffectiveTunnelName()
+	n := &tunnelNetwork{
+		name:    name,
+		journal: filepath.Join(stateDir, name+".netconfig.json"),
+		logger:  logger,
+	}
+	n.cleanupStale()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.address = address
+	n.routes = routes
+	if err := n.saveLocked(); err != nil {
+		return nil, err
+	}
+	if address.IsValid() {
+		err = configureTUN(name, address, routes)
+	} else {
+		err = bringUp(name)
+		for _, route := range routes {
+			if err != nil {
+				break
+			}
+			err = addRoute(name, route)
+		}
+	}
+	if err == nil {
+		err = setMTU(name, cfg.EffectiveTunnelMTU())
+	}
+	if err != nil {
+		n.removeLocked()
+		return nil, fmt.Errorf("configure %s: %w", name, err)
+	}
+
+	logger.Info("tunnel interface configured", map[string]interface{}{
+		"interface": name,
+		"address":   cfg.Tunnel.Address,
+		"routes":    cfg.Tunnel.Routes,
+	})
+	return n, nil
+}
+
+// updateRoutes installs the routes of a reloaded configuration, adding new
+// ones before removing those that were dropped.
+func (n *tunnelNetwork) updateRoutes(routes []string) error {
+	parsed, err := parseRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	keep := make(map[netip.Prefix]bool, len(parsed))
+	for _, route := range parsed {
+		keep[route] = true
+	}
+	current := make(map[netip.Prefix]bool, len(n.routes))
+	for _, route := range n.routes {
+		current[route] = true
+	}
+
+	var added, removed []netip.Prefix
+	for _, route := range parsed {
+		if !current[route] {
+			added = append(added, route)
+		}
+	}
+	for _, route := range n.routes {
+		if !keep[route] {
+			removed = append(removed, route)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	// Journal the union first, so a crash in between leaks nothing
+	n.routes = append(append([]netip.Prefix(nil), n.routes...), added...)
+	if err := n.saveLocked(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, route := range added {
+		if err := addRoute(n.name, route); err != nil {
+			errs = append(errs, fmt.Errorf("add route %s: %w", route, err))
+		}
+	}
+	for _, route := range removed {
+		if err := deleteRoute(n.name, route); err != nil {
+			errs = append(errs, fmt.Errorf("delete route %s: %w", route, err))
+		}
+	}
+	n.routes = parsed
+	if err := n.saveLocked(); err != nil {
+		errs = append(errs, err)
+	}
+
+	n.logger.Info("tunnel routes updated", map[string]interface{}{
+		"interface": n.name,
+		"added":     len(added),
+		"removed":   len(removed),
+	})
+	return errors.Join(errs...)
+}
+
+// close removes the routes and the address from the interface
+func (n *tunnelNetwork) close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.removeLocked()
+}
+
+func (n *tunnelNetwork) removeLocked() error {
+	var errs []error
+	for _, route := range n.routes {
+		if err := deleteRoute(n.name, route); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if n.address.IsValid() {
+		if err := deleteAddress(n.name, n.address); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	n.routes = nil
+	n.address = netip.Prefix{}
+	if len(errs) == 0 {
+		if err := os.Remove(n.journal); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cleanupStale removes what a previous run journaled but never cleaned up
+func (n *tunnelNetwork) cleanupStale() {
+	f, err := openJournal(n.journal)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			n.logger.Warn("tunnel journal refused", map[string]interface{}{"path": n.journal, "error": err.Error()})
+		}
+		return
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		n.logger.Warn("tunnel journal unreadable", map[string]interface{}{"path": n.journal, "error": err.Error()})
+		return
+	}
+	var journal networkJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		n.logger.Warn("tunnel journal unreadable", map[string]interface{}{"path": n.journal, "error": err.Error()})
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.routes, _ = parseRoutes(journal.Routes)
+	n.address, _ = netip.ParsePrefix(journal.Address)
+	if err := n.removeLocked(); err != nil {
+		n.logger.Warn("stale tunnel configuration not fully removed", map[string]interface{}{"interface": n.name, "error": err.Error()})
+		return
+	}
+	n.logger.Info("stale tunnel configuration removed", map[string]interface{}{"interface": n.name, "routes": journal.Routes})
+}
+
+func (n *tunnelNetwork) saveLocked() error {
+	journal := networkJournal{}
+	if n.address.IsValid() {
+		journal.Address = n.address.String()
+	}
+	for _, route := range n.routes {
+		journal.Routes = append(journal.Routes, route.String())
+	}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	// A fresh file renamed over the journal never writes through a link
+	// planted at its path
+	tmp, err := os.CreateTemp(filepath.Dir(n.journal), "."+filepath.Base(n.journal)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), n.journal)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func parseRoutes(routes []string) ([]netip.Prefix, error) {
+	parsed := make([]netip.Prefix, 0, len(routes))
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tun route %q: %w", route, err)
+		}
+		parsed = append(parsed, prefix)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,169 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"stp/config"
+	"stp/internal/logging"
+	"stp/packet"
+	"stp/transport"
+)
+
+const (
+	// relayDialTimeout bounds how long the server tries to reach a relay
+	// destination.
+	relayDialTimeout = 10 * time.Second
+	// relayChunkSize is the most a relay sends in one data packet
+	relayChunkSize = 16 * 1024
+)
+
+// errOutboundDisabled answers connect requests the server does not serve
+var errOutboundDisabled = errors.New("outbound connections disabled on server")
+
+// errOutboundRefused answers connect requests for internal destinations
+var errOutboundRefused = errors.New("destination refused by outbound policy")
+
+// NewRelayDevice creates a client device without a dataplane. Its session
+// carries a single connection the server relays, see Connect.
+func NewRelayDevice(cfg *config.Config, logger *logging.Logger) (*Device, error) {
+	return newDevice(RoleClient, cfg, logger, nil, nil)
+}
+
+// Connect asks the server to relay the session on conn to address and
+// returns the local end of the relayed connection. It follows a completed
+// Handshake and takes the place of TunnelLoop: the session, and with it the
+// device, ends when either end of the relayed connection closes.
+//
+// Over a datagram transport only "udp" destinations can be relayed, one
+// datagram per packet; a byte stream needs a transport that delivers all of
+// it.
+func (d *Device) Connect(conn net.Conn, network, address string, timeout time.Duration) (net.Conn, error) {
+	if transport.IsDatagram(conn) && network != "udp" {
+		return nil, fmt.Errorf("relaying %s requires a stream transport", network)
+	}
+	request, err := packet.NewConnectPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.transport.SendPayload(conn, packet.Encode(request)); err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	for {
+		frame, err := d.transport.Receive(conn)
+		if err != nil {
+			return nil, err
+		}
+		if frame.Flags == transport.FlagTicket {
+			if err := d.handleTicket(frame.Payload); err != nil {
+				d.logger.Warn("session ticket rejected", map[string]interface{}{"error": err.Error()})
+			}
+			continue
+		}
+		if frame.Flags != transport.FlagData {
+			continue
+		}
+		reply, err := packet.Decode(frame.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Type != packet.TypeConnectReply {
+			return nil, fmt.Errorf("unexpected packet type %d before connect reply", reply.Type)
+		}
+		if err := packet.ExtractConnectReply(reply); err != nil {
+			return nil, fmt.Errorf("relay to %s: %w", address, err)
+		}
+		break
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	local, remote := net.Pipe()
+	d.startRelay(conn, remote)
+	go func() {
+		d.TunnelLoop(conn)
+		remote.Close()
+		d.Close()
+	}()
+	return local, nil
+}
+
+// handleConnect serves a client's connect request: it dials the destination
+// and relays the session to it from then on.
+func (d *Device) handleConnect(pkt *packet.Packet, conn net.Conn) error {
+	network, address, err := packet.ExtractConnect(pkt)
+	if err != nil {
+		return err
+	}
+
+	var upstream net.Conn
+	if d.relayStream() != nil {
+		err = errors.New("session already relayed")
+	} else {
+		upstream, err = d.dialOutbound(network, address)
+	}
+	if sendErr := d.transport.SendPayload(conn, packet.Encode(packet.NewConnectReply(err))); sendErr != nil {
+		if upstream != nil {
+			upstream.Close()
+		}
+		return sendErr
+	}
+	if err != nil {
+		d.logger.Info("relay refused", map[string]interface{}{"network": network, "address": address, "error": err.Error()})
+		return nil
+	}
+
+	// A relayed session no longer takes part in dataplane routing
+	if d.router != nil {
+		d.router.detach(d)
+	}
+	d.logger.Info("relay connected", map[string]interface{}{"network": network, "address": address, "peer": d.RemotePeer()})
+	d.startRelay(conn, upstream)
+	return nil
+}
+
+// startRelay joins the session to stream: data packets received are written
+// to it, and what is read from it is sent as data packets. The session is
+// closed once the stream ends.
+func (d *Device) startRelay(conn, stream net.Conn) {
+	d.mu.Lock()
+	d.relay = stream
+	d.mu.Unlock()
+
+	go func() {
+		buf := make([]byte, relayChunkSize)
+		for {
+			n, err := stream.Read(buf)
+			if n > 0 {
+				if sendErr := d.sendData("", buf[:n]); sendErr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		d.endRelay()
+		conn.Close()
+	}()
+}
+
+// relayStream returns the stream the session is relayed to, if any. The
+// end of a relayed session is the normal way for it to close.
+func (d *Device) relayStream() net.Conn {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.relay
+}
+
+// endRelay closes the relayed stream
+func (d *Device) endRelay() {
+	if stream := d.relayStream(); stream != nil {
+		stream.Close()
+	}
+}
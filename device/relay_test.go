@@ -0,0 +1,88 @@
+package device
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"stp/config"
+)
+
+func TestDeviceRelay(t *testing.T) {
+	echo := startEchoServer(t)
+
+	for _, outbound := range []bool{true, false} {
+		cfg := &config.Config{
+			PSK:    "device-relay-test-psk-0123456789ab",
+			Peers:  []config.PeerConfig{{Name: "peer", AllowedIPs: []string{"10.0.0.0/24"}}},
+			Tunnel: config.TunnelConfig{Type: "loopback"},
+			Proxy:  config.ProxyConfig{Outbound: outbound, OutboundAllow: []string{"127.0.0.0/8"}},
+		}
+		pair := connectPair(t, "tcp", cfg, cfg)
+		if pair.clientErr != nil || pair.serverErr != nil {
+			t.Fatalf("handshake: client %v, server %v", pair.clientErr, pair.serverErr)
+		}
+		serverDone := make(chan struct{})
+		go func() {
+			pair.server.TunnelLoop(pair.serverConn)
+			close(serverDone)
+		}()
+
+		stream, err := pair.client.Connect(pair.clientConn, "tcp", echo, 2*time.Second)
+		if !outbound {
+			if err == nil || !strings.Contains(err.Error(), "disabled") {
+				t.Fatalf("expected refusal without outbound, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		if _, err := stream.Write([]byte("ping through the relay")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, 64)
+		stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := stream.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(buf[:n]) != "ping through the relay" {
+			t.Fatalf("unexpected echo %q", buf[:n])
+		}
+
+		// Closing the local end tears the session down on both sides
+		stream.Close()
+		select {
+		case <-serverDone:
+		case <-time.After(2 * time.Second):
+			t.Fatal("server session outlived the relay")
+		}
+	}
+}
+
+func TestDeviceRelayRefusesInternal(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	cfg := &config.Config{
+		PSK:    "device-relay-test-psk-0123456789ab",
+		Peers:  []config.PeerConfig{{Name: "peer", AllowedIPs: []string{"10.0.0.0/24"}}},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+		Proxy:  config.ProxyConfig{Outbound: true},
+	}
+	// Loopback is refused by literal address and by name alike
+	for _, address := range []string{echo, net.JoinHostPort("localhost", port)} {
+		pair := connectPair(t, "tcp", cfg, cfg)
+		if pair.clientErr != nil || pair.serverErr != nil {
+			t.Fatalf("handshake: client %v, server %v", pair.clientErr, pair.serverErr)
+		}
+		go pair.server.TunnelLoop(pair.serverConn)
+
+		_, err := pair.client.Connect(pair.clientConn, "tcp", address, 2*time.Second)
+		if err == nil || !strings.Contains(err.Error(), "refused by outbound policy") {
+			t.Fatalf("connect to %s: expected refusal, got %v", address, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"stp/config"
+	"stp/crypto"
+	"stp/transport"
+)
+
+// resumeTimeout bounds the wait for the server's answer to a resumption
+// offer. The client falls back to a full handshake on a new connection.
+const resumeTimeout = 5 * time.Second
+
+// ErrResumeFailed is returned by Handshake when the server did not accept a
+// session ticket. The ticket is spent; the next Handshake on a fresh
+// connection performs a full handshake.
+var ErrResumeFailed = errors.New("session resumption failed")
+
+// resume presents a session ticket instead of running the handshake. Data
+// queued by the dataplane is sent under the early keys straight away, while
+// the server's answer moves both sides to forward-secret keys.
+func (d *Device) resume(conn, hsConn net.Conn, retransmit *transport.HandshakeConn, cfg *config.Config, ticket *transport.SessionTicket) error {
+	secret := ticket.SessionKey
+	suite := ticket.Params.CipherSuite
+	offer, err := crypto.SendResumeOffer(hsConn, ticket.ID, secret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrResumeFailed, err)
+	}
+	early, err := offer.EarlySecrets(secret, crypto.RoleClient)
+	if err != nil {
+		return err
+	}
+	params := crypto.TransportParameters{KeepAlive: d.keepaliveInterval, MaxPadding: d.maxPadding}
+	if err := d.installTransport(cfg, early, params, suite, retransmit != nil); err != nil {
+		return err
+	}
+	d.startOutboundPump(conn)
+
+	if err := hsConn.SetReadDeadline(time.Now().Add(resumeTimeout)); err != nil {
+		return err
+	}
+	var accept []byte
+	for accept == nil {
+		frame, err := d.transport.Receive(hsConn)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrResumeFailed, err)
+		}
+		if frame.Flags != transport.FlagResume {
+			d.logger.Debug("frame before resumption accept ignored", map[string]interface{}{"flag": frame.Flags})
+			continue
+		}
+		accept = frame.Payload
+	}
+	if err := hsConn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	secrets, params, err := crypto.FinishResume(secret, offer, accept)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrResumeFailed, err)
+	}
+	secrets.PeerPublicKey = ticket.RemotePublicKey
+	if err := d.transport.UpdateSessionKeys(secrets, suite); err != nil {
+		return err
+	}
+	if retransmit != nil {
+		d.transport.SetHandshakeReplay(retransmit)
+	}
+
+	d.adoptResumed(conn, cfg, secrets, params, ticket.Params, "")
+	return nil
+}
+
+// acceptResume answers a resumption offer. Each ticket is redeemed at most
+// once, so a replayed offer, and the early data behind it, is refused.
+func (d *Device) acceptResume(conn, hsConn net.Conn, retransmit *transport.HandshakeConn, cfg *config.Config, tickets *transport.ZeroRTTManager, offer *crypto.ResumeOffer) error {
+	ticket, remotePeer, err := tickets.RedeemTicket(offer.TicketID)
+	if err != nil {
+		return fmt.Errorf("resumption refused: %w", err)
+	}
+	secret := ticket.SessionKey
+	suite := ticket.Params.CipherSuite
+	if err := offer.Verify(secret); err != nil {
+		return fmt.Errorf("resumption refused: %w", err)
+	}
+	early, err := offer.EarlySecrets(secret, crypto.RoleServer)
+	if err != nil {
+		return err
+	}
+	params := crypto.TransportParameters{KeepAlive: d.keepaliveInterval, MaxPadding: d.maxPadding}
+	secrets, accept, err := crypto.AcceptResume(secret, offer, params)
+	if err != nil {
+		return err
+	}
+	secrets.PeerPublicKey = ticket.RemotePublicKey
+
+	if err := d.installTransport(cfg, early, params, suite, retransmit != nil); err != nil {
+		return err
+	}
+	// The accept travels under the early keys, the only ones the client
+	// holds until it has processed it.
+	if err := d.transport.SendResume(hsConn, accept); err != nil {
+		return err
+	}
+	if err := d.transport.UpdateSessionKeys(secrets, suite); err != nil {
+		return err
+	}
+	if retransmit != nil {
+		d.transport.SetHandshakeReplay(retransmit)
+	}
+
+	d.adoptResumed(conn, cfg, secrets, params, ticket.Params, remotePeer)
+	return nil
+}
+
+// adoptResumed records a resumed session the way Handshake records a full one
+func (d *Device) adoptResumed(conn net.Conn, cfg *config.Config, secrets crypto.SessionSecrets, params crypto.TransportParameters, negotiated crypto.NegotiatedParams, remotePeer string) {
+	mode := cfg.EffectiveHandshake()
+	profile := cfg.EffectiveSecurityProfile()
+
+	d.mu.Lock()
+	d.secrets = secrets
+	d.keepaliveInterval = params.KeepAlive
+	d.maxPadding = params.MaxPadding
+	d.messageCount = 0
+	d.pfs = crypto.NewPFSManager(secrets, crypto.HandshakeRole(d.role), d.rekeyPolicy)
+	d.handshake = mode
+	d.remotePeer = remotePeer
+	d.pskGeneration = 0
+	d.securityProfile = profile
+	d.negotiated = negotiated
+	d.resumed = true
+	d.mu.Unlock()
+
+	if err := d.transport.SendBind(conn); err != nil {
+		d.logger.Warn("bind send failed", map[string]interface{}{"error": err.Error()})
+	}
+
+	d.logger.Info("session resumed", map[string]interface{}{
+		"remote":    conn.RemoteAddr().String(),
+		"sessionId": hex.EncodeToString(secrets.SessionID[:]),
+		"role":      d.role.String(),
+		"peer":      remotePeer,
+		"profile":   profile,
+	})
+
+	d.recordHandshake(conn.RemoteAddr(), secrets)
+	d.issueTicket(conn)
+	d.startOutboundPump(conn)
+}
+
+// takeTicket removes the newest usable ticket for the endpoint. Tickets are
+// single use, so it is forgotten before it goes on the wire.
+func (d *Device) takeTicket(tickets *transport.ZeroRTTManager) *transport.SessionTicket {
+	ticket, err := tickets.UseTicket(d.ticketKey)
+	if err != nil {
+		return nil
+	}
+	tickets.RemoveTicket(d.ticketKey, ticket.ID)
+	d.saveTickets(tickets)
+	return ticket
+}
+
+// issueTicket hands the client a ticket for its next connection
+func (d *Device) issueTicket(conn net.Conn) {
+	d.mu.RLock()
+	tickets := d.tickets
+	secrets := d.secrets
+	negotiated := d.negotiated
+	remotePeer := d.remotePeer
+	d.mu.RUnlock()
+	if tickets == nil || d.role != RoleServer {
+		return
+	}
+
+	secret, err := crypto.ResumptionSecret(secrets, crypto.RoleServer)
+	if err != nil {
+		d.logger.Warn("session ticket not issued", map[string]interface{}{"error": err.Error()})
+		return
+	}
+	ticket, err := tickets.IssueResumptionTicket(remotePeer, secret, secrets.PeerPublicKey, negotiated)
+	if err != nil {
+		d.logger.Warn("session ticket not issued", map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err := d.transport.SendTicket(conn, transport.EncodeNewTicket(ticket, secrets.Epoch)); err != nil {
+		d.logger.Warn("session ticket send failed", map[string]interface{}{"error": err.Error()})
+	}
+}
+
+// handleTicket stores a ticket announced by the server. The resumption
+// secret is derived locally from the keys of the epoch it was issued in.
+func (d *Device) handleTicket(payload []byte) error {
+	d.mu.RLock()
+	tickets := d.tickets
+	secrets := d.secrets
+	negotiated := d.negotiated
+	d.mu.RUnlock()
+	if tickets == nil || d.role != RoleClient {
+		return nil
+	}
+
+	ticket, epoch, err := transport.DecodeNewTicket(payload)
+	if err != nil {
+		return err
+	}
+	if epoch != secrets.Epoch {
+		return fmt.Errorf("ticket issued in epoch %d, session is in epoch %d", epoch, secrets.Epoch)
+	}
+	secret, err := crypto.ResumptionSecret(secrets, crypto.RoleClient)
+	if err != nil {
+		return err
+	}
+	ticket.SessionKey = secret
+	ticket.RemotePublicKey = secrets.PeerPublicKey
+	ticket.Params = negotiated
+	tickets.StoreTicket(d.ticketKey, ticket)
+	d.saveTickets(tickets)
+
+	d.logger.Debug("session ticket stored", map[string]interface{}{"expires": ticket.ExpiresAt})
+	return nil
+}
+
+func (d *Device) saveTickets(tickets *transport.ZeroRTTManager) {
+	if d.ticketFile == "" {
+		return
+	}
+	if err := tickets.SaveTickets(d.ticketFile); err != nil {
+		d.logger.Warn("session tickets not saved", map[string]interface{}{"error": err.Error()})
+	}
+}
@@ -0,0 +1,412 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"stp/auth"
+	"stp/config"
+	"stp/internal/dataplane"
+	"stp/internal/logging"
+)
+
+// Router shares one dataplane among all sessions of a server. Each session
+// is bound to a configured peer, and the peers' AllowedIPs form the routing
+// table: a packet read from the dataplane goes to the session of the peer
+// that owns its destination, and a packet a client sends to another peer's
+// address is forwarded to that peer's session instead of the dataplane.
+//
+// A session is bound to the peer its handshake authenticated. A session
+// authenticated only by the global psk claims a peer from the source
+// address of the first packet it sends, or from the packet's peer name
+// when that is not an IP packet. With a single configured peer every
+// session is bound to it. Such a claim never displaces a live session of
+// the peer: only a session authenticated as the peer replaces one.
+type Router struct {
+	plane   dataplane.Interface
+	network *tunnelNetwork
+	logger  *logging.Logger
+	// privateKey is the static identity every session presents, resolved
+	// once so concurrent sessions never race to generate it
+	privateKey []byte
+
+	mu       sync.RWMutex
+	routes   []routeEntry
+	peers    map[string]bool
+	sessions map[string]*Device // peer -> live session
+	bound    map[*Device]string // session -> peer
+	// staleAfter is how long a session may receive nothing before a claim
+	// can replace it
+	staleAfter time.Duration
+
+	// Reverse forwards clients published, by listen address, and the rules
+	// for publishing and connecting to them
+	forwards   map[string]*forward
+	forwardACL *auth.ACLManager
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	stats RouterStats
+}
+
+// RouterStats counts the packets the router handled.
+type RouterStats struct {
+	Outbound  uint64 `json:"outbound"`  // dataplane to client
+	Delivered uint64 `json:"delivered"` // client to dataplane
+	Forwarded uint64 `json:"forwarded"` // client to client
+	Dropped   uint64 `json:"dropped"`
+}
+
+// RouteState describes one peer in the routing table.
+type RouteState struct {
+	Peer       string   `json:"peer"`
+	AllowedIPs []string `json:"allowedIPs"`
+	Connected  bool     `json:"connected"`
+	Remote     string   `json:"remote,omitempty"`
+}
+
+// NewRouter creates the server-wide dataplane configured in cfg.
+func NewRouter(cfg *config.Config, logger *logging.Logger) (*Router, error) {
+	if cfg == nil {
+		return nil, errors.New("config is required")
+	}
+	if logger == nil {
+		return nil, errors.New("logger is required")
+	}
+	privateKey, err := staticKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(cfg.Peers))
+	for _, peerCfg := range cfg.Peers {
+		names = append(names, peerCfg.Name)
+	}
+	plane, err := createDataplane(cfg, names)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := newForwardACL(cfg.ForwardACL)
+	if err != nil {
+		plane.Close()
+		return nil, err
+	}
+	network, err := configureTunnel(cfg, logger)
+	if err != nil {
+		plane.Close()
+		return nil, err
+	}
+	r := &Router{
+		plane:      plane,
+		network:    network,
+		logger:     logger,
+		privateKey: privateKey,
+		sessions:   make(map[string]*Device),
+		bound:      make(map[*Device]string),
+		staleAfter: 4 * cfg.EffectiveKeepalive(),
+		forwards:   make(map[string]*forward),
+		forwardACL: acl,
+		stop:       make(chan struct{}),
+	}
+	r.UpdatePeers(cfg.Peers)
+
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// NewDevice creates a server session device that exchanges traffic through
+// the router instead of a dataplane of its own.
+func (r *Router) NewDevice(cfg *config.Config, logger *logging.Logger) (*Device, error) {
+	return newDevice(RoleServer, cfg, logger, r.plane, r)
+}
+
+// UpdatePeers replaces the routing table. Sessions of peers that are no
+// longer configured are unbound and receive no more traffic.
+func (r *Router) UpdatePeers(peerConfigs []config.PeerConfig) {
+	routes := make([]routeEntry, 0)
+	peers := make(map[string]bool, len(peerConfigs))
+	for _, peerCfg := range peerConfigs {
+		peers[peerCfg.Name] = true
+		for _, cidr := range peerCfg.AllowedIPs {
+			if prefix, err := netip.ParsePrefix(cidr); err == nil {
+				routes = append(routes, routeEntry{prefix: prefix, peer: peerCfg.Name})
+			}
+		}
+	}
+	// Most specific first, so a lookup returns the longest matching prefix
+	slices.SortStableFunc(routes, func(a, b routeEntry) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+
+	r.mu.Lock()
+	r.routes = routes
+	r.peers = peers
+	for session, name := range r.bound {
+		if !peers[name] {
+			delete(r.bound, session)
+			delete(r.sessions, name)
+		}
+	}
+	r.mu.Unlock()
+
+	if loop, ok := r.plane.(*dataplane.Loopback); ok {
+		for name := range peers {
+			loop.EnsurePeer(name)
+		}
+	}
+}
+
+// UpdateTunnelRoutes applies a reloaded tunnel.routes list to an
+// auto-configured TUN interface. It does nothing otherwise.
+func (r *Router) UpdateTunnelRoutes(routes []string) error {
+	if r.network == nil {
+		return nil
+	}
+	return r.network.updateRoutes(routes)
+}
+
+// Snapshot lists the configured peers and whether a session serves them.
+func (r *Router) Snapshot() []RouteState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	states := make([]RouteState, 0, len(r.peers))
+	index := make(map[string]int, len(r.peers))
+	for _, route := range r.routes {
+		i, ok := index[route.peer]
+		if !ok {
+			i = len(states)
+			index[route.peer] = i
+			states = append(states, RouteState{Peer: route.peer})
+		}
+		states[i].AllowedIPs = append(states[i].AllowedIPs, route.prefix.String())
+	}
+	for name := range r.peers {
+		if _, ok := index[name]; !ok {
+			index[name] = len(states)
+			states = append(states, RouteState{Peer: name})
+		}
+	}
+	for i := range states {
+		if session, ok := r.sessions[states[i].Peer]; ok {
+			states[i].Connected = true
+			if conn := session.sessionConn(); conn != nil {
+				states[i].Remote = conn.RemoteAddr().String()
+			}
+		}
+	}
+	return states
+}
+
+// Stats returns the packet counters.
+func (r *Router) Stats() RouterStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.stats
+}
+
+// Close stops routing and closes the dataplane.
+func (r *Router) Close() error {
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+		r.mu.Unlock()
+		return nil
+	default:
+	}
+	close(r.stop)
+	forwards := r.forwards
+	r.forwards = make(map[string]*forward)
+	r.mu.Unlock()
+
+	for _, f := range forwards {
+		f.close()
+	}
+	if r.network != nil {
+		if err := r.network.close(); err != nil {
+			r.logger.Warn("tunnel configuration not fully removed", map[string]interface{}{"error": err.Error()})
+		}
+	}
+	err := r.plane.Close()
+	r.wg.Wait()
+	return err
+}
+
+// attach binds a session that completed its handshake. A newer session of
+// the same peer, such as a reconnecting client, replaces the older one.
+func (r *Router) attach(d *Device) {
+	name := d.RemotePeer()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name != "" && r.peers[name] {
+		r.bindLocked(name, d)
+		return
+	}
+	if name == "" && len(r.peers) == 1 {
+		for only := range r.peers {
+			r.claimLocked(only, d)
+		}
+	}
+}
+
+// detach unbinds a session that ended or was turned into a relay. Another
+// session still bound to the same peer takes over its traffic.
+func (r *Router) detach(d *Device) {
+	r.mu.Lock()
+	if name, ok := r.bound[d]; ok {
+		delete(r.bound, d)
+		if r.sessions[name] == d {
+			delete(r.sessions, name)
+			for other, otherName := range r.bound {
+				if otherName == name {
+					r.sessions[name] = other
+					break
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+}
+
+// bindLocked makes d the session of the peer. A session it replaces stays
+// bound, so what it still receives is attributed to the peer, but it no
+// longer gets the peer's traffic.
+func (r *Router) bindLocked(name string, d *Device) {
+	if old, ok := r.bound[d]; ok && old != name && r.sessions[old] == d {
+		delete(r.sessions, old)
+	}
+	r.sessions[name] = d
+	r.bound[d] = name
+}
+
+// claimLocked binds d to a peer it claimed without authenticating as it,
+// unless the peer has a session that is still live. It reports whether d
+// is bound.
+func (r *Router) claimLocked(name string, d *Device) bool {
+	if current, ok := r.sessions[name]; ok && current != d && current.receivedWithin(r.staleAfter) {
+		r.logger.Warn("peer claim refused", map[string]interface{}{"peer": name, "reason": "live session"})
+		return false
+	}
+	r.bindLocked(name, d)
+	return true
+}
+
+// receive routes a payload a session received. It returns the peer the
+// session is bound to.
+func (r *Router) receive(from *Device, packetPeer string, payload []byte) (string, error) {
+	src, srcErr := sourceIP(payload)
+	dst, dstErr := destinationIP(payload)
+
+	r.mu.Lock()
+	name, bound := r.bound[from]
+	if !bound {
+		switch {
+		case srcErr == nil:
+			name = r.lookupLocked(src)
+		case r.peers[packetPeer]:
+			name = packetPeer
+		}
+		if name == "" {
+			r.stats.Dropped++
+			r.mu.Unlock()
+			return "", errors.New("session not bound to a peer")
+		}
+		if !r.claimLocked(name, from) {
+			r.stats.Dropped++
+			r.mu.Unlock()
+			return "", fmt.Errorf("peer %q already has a live session", name)
+		}
+		r.logger.Info("session bound to peer", map[string]interface{}{"peer": name})
+	}
+	if srcErr == nil && !r.allowedLocked(name, src) {
+		r.stats.Dropped++
+		r.mu.Unlock()
+		return name, fmt.Errorf("source %s not allowed for peer %q", src, name)
+	}
+	var target *Device
+	var targetPeer string
+	if dstErr == nil {
+		targetPeer = r.lookupLocked(dst)
+		if session, ok := r.sessions[targetPeer]; ok && session != from {
+			target = session
+		}
+	}
+	if target != nil {
+		r.stats.Forwarded++
+	} else {
+		r.stats.Delivered++
+	}
+	r.mu.Unlock()
+
+	if target != nil {
+		return name, target.sendData(targetPeer, payload)
+	}
+	return name, r.plane.Deliver(name, payload)
+}
+
+// run sends packets read from the dataplane to the session of the peer they
+// are addressed to.
+func (r *Router) run() {
+	defer r.wg.Done()
+	for {
+		select {
+		case frame, ok := <-r.plane.Outbound():
+			if !ok {
+				return
+			}
+			r.route(frame)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *Router) route(frame dataplane.Frame) {
+	r.mu.Lock()
+	name := frame.Peer
+	if name == "" {
+		if dst, err := destinationIP(frame.Payload); err == nil {
+			name = r.lookupLocked(dst)
+		}
+	}
+	session, ok := r.sessions[name]
+	if ok {
+		r.stats.Outbound++
+	} else {
+		r.stats.Dropped++
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		r.logger.Debug("drop outbound payload", map[string]interface{}{"reason": "no-session", "peer": name, "bytes": len(frame.Payload)})
+		return
+	}
+	if err := session.sendData(name, frame.Payload); err != nil {
+		r.logger.Debug("drop outbound payload", map[string]interface{}{"reason": err.Error(), "peer": name})
+	}
+}
+
+func (r *Router) lookupLocked(addr netip.Addr) string {
+	for _, route := range r.routes {
+		if route.prefix.Contains(addr) {
+			return route.peer
+		}
+	}
+	return ""
+}
+
+// allowedLocked reports whether the peer may send from addr, which it may
+// when addr routes to it. A peer without AllowedIPs is not restricted.
+func (r *Router) allowedLocked(name string, addr netip.Addr) bool {
+	for _, route := range r.routes {
+		if route.peer == name {
+			return r.lookupLocked(addr) == name
+		}
+	}
+	return true
+}
@@ -0,0 +1,317 @@
+package device
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stp/config"
+	"stp/internal/dataplane"
+	"stp/internal/logging"
+	"stp/transport"
+)
+
+// routerSession runs a client session against a server device of router
+// and starts both tunnel loops. It returns the client and its connection.
+func routerSession(t *testing.T, router *Router, serverCfg, clientCfg *config.Config) (*Device, net.Conn) {
+	t.Helper()
+	logger := logging.New(logging.LevelError, nil)
+	ln, err := transport.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		server, err := router.NewDevice(serverCfg, logger)
+		if err != nil {
+			accepted <- err
+			return
+		}
+		t.Cleanup(func() { server.Close() })
+		if err := server.Handshake(conn, serverCfg); err != nil {
+			accepted <- err
+			return
+		}
+		accepted <- nil
+		server.TunnelLoop(conn)
+	}()
+
+	client, err := NewDevice(RoleClient, clientCfg, logger)
+	if err != nil {
+		t.Fatalf("new client device: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := transport.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := client.Handshake(conn, clientCfg); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+	go client.TunnelLoop(conn)
+	return client, conn
+}
+
+// testIPv4 returns an IPv4 header from 10.0.0.src to 10.0.0.dst
+func testIPv4(src, dst byte) []byte {
+	pkt := make([]byte, 20)
+	pkt[0] = 0x45
+	copy(pkt[12:16], []byte{10, 0, 0, src})
+	copy(pkt[16:20], []byte{10, 0, 0, dst})
+	return pkt
+}
+
+func expectPacket(t *testing.T, ch <-chan []byte, want []byte) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if string(got) != string(want) {
+			t.Fatalf("unexpected packet %x, want %x", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for packet")
+	}
+}
+
+func TestRouterSharedDataplane(t *testing.T) {
+	serverCfg := &config.Config{
+		Mode: "server",
+		Peers: []config.PeerConfig{
+			{Name: "alice", PSK: "alice-pre-shared-key-0123456789", AllowedIPs: []string{"10.0.0.2/32"}},
+			{Name: "bob", PSK: "bob-pre-shared-key-0123456789ab", AllowedIPs: []string{"10.0.0.3/32"}},
+		},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+	}
+	logger := logging.New(logging.LevelError, nil)
+	router, err := NewRouter(serverCfg, logger)
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	defer router.Close()
+
+	// connect runs one client session and returns its dataplane
+	connect := func(psk string) *dataplane.Loopback {
+		t.Helper()
+		client, _ := routerSession(t, router, serverCfg, &config.Config{
+			Mode:   "client",
+			Peers:  []config.PeerConfig{{Name: "server", PSK: psk, AllowedIPs: []string{"10.0.0.0/24"}}},
+			Tunnel: config.TunnelConfig{Type: "loopback"},
+		})
+		return client.plane.(*dataplane.Loopback)
+	}
+
+	alice := connect("alice-pre-shared-key-0123456789")
+	bob := connect("bob-pre-shared-key-0123456789ab")
+	bobInbox, err := bob.Subscribe("bob", 4)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	plane := router.plane.(*dataplane.Loopback)
+	serverInbox, err := plane.Subscribe("alice", 4)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// Dataplane to client, routed by destination
+	toBob := testIPv4(1, 3)
+	if err := plane.Inject("", toBob); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectPacket(t, bobInbox, toBob)
+
+	// Client to client, forwarded through the server
+	aliceToBob := testIPv4(2, 3)
+	if err := alice.Inject("server", aliceToBob); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectPacket(t, bobInbox, aliceToBob)
+
+	// Client to the server's own network
+	aliceToServer := testIPv4(2, 1)
+	if err := alice.Inject("server", aliceToServer); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectPacket(t, serverInbox, aliceToServer)
+
+	// A source address outside the peer's AllowedIPs is dropped
+	if err := alice.Inject("server", testIPv4(3, 1)); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for router.Stats().Dropped == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("spoofed packet not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := router.Stats()
+	if stats.Outbound != 1 || stats.Forwarded != 1 || stats.Delivered != 1 || stats.Dropped != 1 {
+		t.Fatalf("unexpected router stats %+v", stats)
+	}
+	for _, route := range router.Snapshot() {
+		if !route.Connected {
+			t.Fatalf("peer %s has no session", route.Peer)
+		}
+	}
+}
+
+func TestRouterClaimKeepsLiveSession(t *testing.T) {
+	const psk = "router-shared-test-psk-0123456789"
+	serverCfg := &config.Config{
+		Mode: "server",
+		PSK:  psk,
+		Peers: []config.PeerConfig{
+			{Name: "alice", AllowedIPs: []string{"10.0.0.2/32"}},
+			{Name: "bob", AllowedIPs: []string{"10.0.0.3/32"}},
+		},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+	}
+	router, err := NewRouter(serverCfg, logging.New(logging.LevelError, nil))
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	defer router.Close()
+	clientCfg := &config.Config{
+		Mode:   "client",
+		PSK:    psk,
+		Peers:  []config.PeerConfig{{Name: "server", AllowedIPs: []string{"10.0.0.0/24"}}},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+	}
+	plane := router.plane.(*dataplane.Loopback)
+	serverInbox, err := plane.Subscribe("alice", 4)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// alice claims her address with the shared psk
+	aliceDev, _ := routerSession(t, router, serverCfg, clientCfg)
+	alice := aliceDev.plane.(*dataplane.Loopback)
+	aliceInbox, err := alice.Subscribe("alice", 4)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	fromAlice := testIPv4(2, 1)
+	if err := alice.Inject("server", fromAlice); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectPacket(t, serverInbox, fromAlice)
+
+	// A second session with the same psk claims alice's address, and is
+	// refused while alice's session is live
+	malloryDev, _ := routerSession(t, router, serverCfg, clientCfg)
+	mallory := malloryDev.plane.(*dataplane.Loopback)
+	malloryInbox, err := mallory.Subscribe("alice", 4)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := mallory.Inject("server", testIPv4(2, 1)); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for router.Stats().Dropped == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("claim of a live session not refused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case pkt := <-serverInbox:
+		t.Fatalf("packet of the refused session delivered: %x", pkt)
+	default:
+	}
+
+	// alice keeps her traffic
+	toAlice := testIPv4(1, 2)
+	if err := plane.Inject("", toAlice); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectPacket(t, aliceInbox, toAlice)
+	select {
+	case pkt := <-malloryInbox:
+		t.Fatalf("alice's traffic reached the other session: %x", pkt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRouterLongestPrefix(t *testing.T) {
+	router, err := NewRouter(&config.Config{
+		Mode: "server",
+		PSK:  "router-prefix-test-psk-0123456789",
+		Peers: []config.PeerConfig{
+			{Name: "alice", AllowedIPs: []string{"10.0.0.0/24"}},
+			{Name: "bob", AllowedIPs: []string{"10.0.0.3/32"}},
+		},
+		Tunnel: config.TunnelConfig{Type: "loopback"},
+	}, logging.New(logging.LevelError, nil))
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	defer router.Close()
+
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+	for addr, want := range map[string]string{"10.0.0.3": "bob", "10.0.0.2": "alice", "10.0.1.1": ""} {
+		if got := router.lookupLocked(netip.MustParseAddr(addr)); got != want {
+			t.Fatalf("route for %s = %q, want %q", addr, got, want)
+		}
+	}
+	// The covering prefix does not let alice send from bob's address
+	if router.allowedLocked("alice", netip.MustParseAddr("10.0.0.3")) {
+		t.Fatal("alice may send from bob's address")
+	}
+	if !router.allowedLocked("bob", netip.MustParseAddr("10.0.0.3")) {
+		t.Fatal("bob may not send from its own address")
+	}
+}
+
+func TestRouterStaticKeyResolvedOnce(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "server.key")
+	cfg := &config.Config{
+		Mode:           "server",
+		PSK:            "router-static-key-test-psk-012345",
+		PrivateKeyFile: keyFile,
+		Peers:          []config.PeerConfig{{Name: "alice", AllowedIPs: []string{"10.0.0.2/32"}}},
+		Tunnel:         config.TunnelConfig{Type: "loopback"},
+	}
+	logger := logging.New(logging.LevelError, nil)
+	router, err := NewRouter(cfg, logger)
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	defer router.Close()
+
+	persisted, err := cfg.StaticPrivateKey(nil)
+	if err != nil || persisted == nil {
+		t.Fatalf("generated key not persisted: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		dev, err := router.NewDevice(cfg, logger)
+		if err != nil {
+			t.Fatalf("new device: %v", err)
+		}
+		if !bytes.Equal(dev.privateKey, persisted) {
+			t.Fatalf("session %d does not use the persisted key", i)
+		}
+		dev.Close()
+	}
+	matches, _ := filepath.Glob(keyFile + ".*")
+	if len(matches) != 0 {
+		t.Fatalf("temporary key files left behind: %v", matches)
+	}
+}
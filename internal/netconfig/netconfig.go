@@ -0,0 +1,24 @@
+package netconfig
+
+import "fmt"
+
+// Error describes a configuration request the system rejected. Err holds
+// the underlying cause, such as a syscall.Errno on Linux, so callers can
+// test it with errors.Is.
+type Error struct {
+	Op        string // "add address", "add route", "set mtu", ...
+	Interface string
+	Target    string // the address, route or value of the request
+	Err       error
+}
+
+func (e *Error) Error() string {
+	if e.Target == "" {
+		return fmt.Sprintf("%s on %s: %v", e.Op, e.Interface, e.Err)
+	}
+	return fmt.Sprintf("%s %s on %s: %v", e.Op, e.Target, e.Interface, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
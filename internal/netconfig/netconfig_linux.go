@@ -0,0 +1,208 @@
+//go:build linux
+
+package netconfig
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"syscall"
+)
+
+// ConfigureTUN configures a TUN interface with IP address and routes
+func ConfigureTUN(ifname string, localIP netip.Prefix, routes []netip.Prefix) error {
+	// Set IP address
+	if err := setIPAddress(ifname, localIP); err != nil {
+		return fmt.Errorf("failed to set IP address: %w", err)
+	}
+
+	// Bring interface up
+	if err := BringUp(ifname); err != nil {
+		return fmt.Errorf("failed to bring interface up: %w", err)
+	}
+
+	// Add routes
+	for _, route := range routes {
+		if err := AddRoute(ifname, route); err != nil {
+			return fmt.Errorf("failed to add route %s: %w", route, err)
+		}
+	}
+
+	return nil
+}
+
+// setIPAddress assigns an address to an interface. An address that is
+// already assigned is updated in place.
+func setIPAddress(ifname string, addr netip.Prefix) error {
+	addr = unmapPrefix(addr)
+	return linkRequest("add address", ifname, addr.String(), func(c *rtnl, index int32) error {
+		ip := addr.Addr().AsSlice()
+		body := ifAddrmsg(index, addr)
+		body = appendAttr(body, syscall.IFA_LOCAL, ip)
+		body = appendAttr(body, syscall.IFA_ADDRESS, ip)
+		_, err := c.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, body)
+		return err
+	})
+}
+
+// AddRoute adds a route through the interface to the main routing table. A
+// route that already exists through the interface is left as it is; one
+// through another interface is a conflict.
+func AddRoute(ifname string, prefix netip.Prefix) error {
+	prefix = unmapPrefix(prefix).Masked()
+	return linkRequest("add route", ifname, prefix.String(), func(c *rtnl, index int32) error {
+		body := rtMsg(prefix, syscall.RT_SCOPE_LINK)
+		body = appendAttr(body, syscall.RTA_DST, prefix.Addr().AsSlice())
+		body = appendUint32Attr(body, syscall.RTA_OIF, uint32(index))
+		_, err := c.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+		if !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+		oif, err := c.routeOIF(prefix)
+		if err != nil {
+			return err
+		}
+		if oif != index {
+			return fmt.Errorf("route already exists through interface index %d", oif)
+		}
+		return nil
+	})
+}
+
+// DeleteRoute removes a route through the interface. A route or interface
+// that is already gone is not an error.
+func DeleteRoute(ifname string, prefix netip.Prefix) error {
+	prefix = unmapPrefix(prefix).Masked()
+	return linkRequest("delete route", ifname, prefix.String(), func(c *rtnl, index int32) error {
+		body := rtMsg(prefix, syscall.RT_SCOPE_NOWHERE)
+		body = appendAttr(body, syscall.RTA_DST, prefix.Addr().AsSlice())
+		body = appendUint32Attr(body, syscall.RTA_OIF, uint32(index))
+		_, err := c.request(syscall.RTM_DELROUTE, 0, body)
+		return err
+	}, syscall.ESRCH, syscall.ENODEV)
+}
+
+// DeleteAddress removes an IP address from an interface. An address or
+// interface that is already gone is not an error.
+func DeleteAddress(ifname string, addr netip.Prefix) error {
+	addr = unmapPrefix(addr)
+	return linkRequest("delete address", ifname, addr.String(), func(c *rtnl, index int32) error {
+		body := ifAddrmsg(index, addr)
+		body = appendAttr(body, syscall.IFA_LOCAL, addr.Addr().AsSlice())
+		_, err := c.request(syscall.RTM_DELADDR, 0, body)
+		return err
+	}, syscall.EADDRNOTAVAIL, syscall.ENODEV)
+}
+
+// GetInterfaceIP gets the first IPv4 address of an interface
+func GetInterfaceIP(ifname string) (netip.Prefix, error) {
+	var found netip.Prefix
+	err := linkRequest("get address", ifname, "", func(c *rtnl, index int32) error {
+		rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_INET)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rib)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < sizeofIfAddrmsg {
+				continue
+			}
+			if int32(binary.NativeEndian.Uint32(m.Data[4:8])) != index {
+				continue
+			}
+			attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+			if err != nil {
+				return err
+			}
+			var local, address netip.Addr
+			for _, attr := range attrs {
+				switch attr.Attr.Type {
+				case syscall.IFA_LOCAL:
+					local, _ = netip.AddrFromSlice(attr.Value)
+				case syscall.IFA_ADDRESS:
+					address, _ = netip.AddrFromSlice(attr.Value)
+				}
+			}
+			if !local.IsValid() {
+				local = address
+			}
+			if local.IsValid() {
+				found = netip.PrefixFrom(local, int(m.Data[1]))
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if !found.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("no IP address found for interface %s", ifname)
+	}
+	return found, nil
+}
+
+// SetMTU sets the MTU of an interface
+func SetMTU(ifname string, mtu int) error {
+	return linkRequest("set mtu", ifname, strconv.Itoa(mtu), func(c *rtnl, index int32) error {
+		body := appendUint32Attr(ifInfomsg(index, 0, 0), syscall.IFLA_MTU, uint32(mtu))
+		_, err := c.request(syscall.RTM_NEWLINK, 0, body)
+		return err
+	})
+}
+
+// BringUp brings an interface up
+func BringUp(ifname string) error {
+	return linkRequest("bring up", ifname, "", func(c *rtnl, index int32) error {
+		_, err := c.request(syscall.RTM_NEWLINK, 0, ifInfomsg(index, syscall.IFF_UP, syscall.IFF_UP))
+		return err
+	})
+}
+
+// BringDown brings an interface down
+func BringDown(ifname string) error {
+	return linkRequest("bring down", ifname, "", func(c *rtnl, index int32) error {
+		_, err := c.request(syscall.RTM_NEWLINK, 0, ifInfomsg(index, 0, syscall.IFF_UP))
+		return err
+	})
+}
+
+// linkRequest runs fn against the interface over a fresh rtnetlink socket.
+// Errors listed in ignore mean the request is already in effect; anything
+// else is reported as an *Error.
+func linkRequest(op, ifname, target string, fn func(c *rtnl, index int32) error, ignore ...syscall.Errno) error {
+	c, err := openRtnl()
+	if err == nil {
+		defer c.close()
+		var index int32
+		index, err = c.linkIndex(ifname)
+		if err == nil {
+			err = fn(c, index)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	for _, errno := range ignore {
+		if errors.Is(err, errno) {
+			return nil
+		}
+	}
+	return &Error{Op: op, Interface: ifname, Target: target, Err: err}
+}
+
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() {
+		return prefix
+	}
+	bits := prefix.Bits() - 96
+	if bits < 0 {
+		bits = 0
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+}
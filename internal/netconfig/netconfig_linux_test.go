@@ -0,0 +1,197 @@
+//go:build linux
+
+package netconfig
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// inNetns runs fn on a thread moved into a new network namespace, so the
+// test only touches that namespace's loopback interface. fn runs off the
+// test goroutine and must report failures with t.Errorf.
+func inNetns(t *testing.T, fn func()) {
+	t.Helper()
+	var unshareErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The thread stays locked, so it exits with the goroutine instead
+		// of going back to the scheduler inside the namespace.
+		runtime.LockOSThread()
+		if unshareErr = syscall.Unshare(syscall.CLONE_NEWNET); unshareErr != nil {
+			return
+		}
+		fn()
+	}()
+	<-done
+	if unshareErr != nil {
+		t.Skipf("network namespace unavailable: %v", unshareErr)
+	}
+}
+
+func TestLinkConfiguration(t *testing.T) {
+	inNetns(t, func() {
+		address := netip.MustParsePrefix("10.200.0.1/24")
+		route := netip.MustParsePrefix("10.201.0.0/16")
+
+		// Applying the same configuration twice is not an error
+		for i := 0; i < 2; i++ {
+			if err := ConfigureTUN("lo", address, []netip.Prefix{route}); err != nil {
+				t.Errorf("configure #%d: %v", i+1, err)
+				return
+			}
+		}
+		if err := SetMTU("lo", 1400); err != nil {
+			t.Errorf("set mtu: %v", err)
+			return
+		}
+
+		iface, err := net.InterfaceByName("lo")
+		if err != nil {
+			t.Errorf("lookup lo: %v", err)
+			return
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			t.Errorf("lo is not up")
+		}
+		if iface.MTU != 1400 {
+			t.Errorf("mtu = %d, want 1400", iface.MTU)
+		}
+		if !hasAddress(iface, address) {
+			t.Errorf("address %s not assigned", address)
+		}
+		if !hasRoute(t, route) {
+			t.Errorf("route %s not installed", route)
+		}
+
+		// Removing what is already gone is not an error either
+		for i := 0; i < 2; i++ {
+			if err := DeleteRoute("lo", route); err != nil {
+				t.Errorf("delete route #%d: %v", i+1, err)
+			}
+			if err := DeleteAddress("lo", address); err != nil {
+				t.Errorf("delete address #%d: %v", i+1, err)
+			}
+		}
+		if hasRoute(t, route) {
+			t.Errorf("route %s still installed", route)
+		}
+		if hasAddress(iface, address) {
+			t.Errorf("address %s still assigned", address)
+		}
+
+		if err := BringDown("lo"); err != nil {
+			t.Errorf("bring down: %v", err)
+		}
+		if iface, err := net.InterfaceByName("lo"); err == nil && iface.Flags&net.FlagUp != 0 {
+			t.Errorf("lo is still up")
+		}
+	})
+}
+
+func TestLinkConfigurationErrors(t *testing.T) {
+	inNetns(t, func() {
+		route := netip.MustParsePrefix("10.202.0.0/16")
+
+		err := AddRoute("stp-missing0", route)
+		var cfgErr *Error
+		if !errors.As(err, &cfgErr) {
+			t.Errorf("add route on missing interface: got %v, want *Error", err)
+			return
+		}
+		if cfgErr.Op != "add route" || cfgErr.Interface != "stp-missing0" || cfgErr.Target != route.String() {
+			t.Errorf("unexpected error fields: %+v", cfgErr)
+		}
+		if !errors.Is(err, syscall.ENODEV) {
+			t.Errorf("error does not wrap ENODEV: %v", err)
+		}
+
+		if err := DeleteRoute("stp-missing0", route); err != nil {
+			t.Errorf("delete route on missing interface: %v", err)
+		}
+		if err := DeleteAddress("stp-missing0", netip.MustParsePrefix("10.202.0.1/24")); err != nil {
+			t.Errorf("delete address on missing interface: %v", err)
+		}
+	})
+}
+
+func TestAddRouteConflict(t *testing.T) {
+	inNetns(t, func() {
+		route := netip.MustParsePrefix("10.203.0.0/16")
+		if err := BringUp("lo"); err != nil {
+			t.Errorf("bring up: %v", err)
+			return
+		}
+
+		// A blackhole route to the prefix goes through no interface
+		c, err := openRtnl()
+		if err != nil {
+			t.Errorf("open rtnetlink: %v", err)
+			return
+		}
+		defer c.close()
+		body := rtMsg(route, syscall.RT_SCOPE_UNIVERSE)
+		body[7] = syscall.RTN_BLACKHOLE
+		body = appendAttr(body, syscall.RTA_DST, route.Addr().AsSlice())
+		if _, err := c.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body); err != nil {
+			t.Errorf("add blackhole route: %v", err)
+			return
+		}
+
+		err = AddRoute("lo", route)
+		var cfgErr *Error
+		if !errors.As(err, &cfgErr) || cfgErr.Op != "add route" || cfgErr.Target != route.String() {
+			t.Errorf("add conflicting route: got %v, want *Error", err)
+		}
+	})
+}
+
+func hasAddress(iface *net.Interface, prefix netip.Prefix) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.String() == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRoute reports whether the main table holds a route to prefix
+func hasRoute(t *testing.T, prefix netip.Prefix) bool {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+	if err != nil {
+		t.Errorf("dump routes: %v", err)
+		return false
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		t.Errorf("parse routes: %v", err)
+		return false
+	}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < sizeofRtMsg || int(m.Data[1]) != prefix.Bits() {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			continue
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type != syscall.RTA_DST {
+				continue
+			}
+			if dst, ok := netip.AddrFromSlice(attr.Value); ok && dst == prefix.Addr() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,4 +1,4 @@
-//go:build !windows
+//go:build !windows && !linux
 
 package netconfig
 
@@ -23,7 +23,7 @@ func ConfigureTUN(ifname string, localIP netip.Prefix, routes []netip.Prefix) er
 
 	// Add routes
 	for _, route := range routes {
-		if err := addRoute(ifname, route); err != nil {
+		if err := AddRoute(ifname, route); err != nil {
 			return fmt.Errorf("failed to add route %s: %w", route, err)
 		}
 	}
@@ -50,8 +50,8 @@ func setIPAddress(ifname string, addr netip.Prefix) error {
 	return nil
 }
 
-// addRoute adds a route to the Unix routing table
-func addRoute(ifname string, prefix netip.Prefix) error {
+// AddRoute adds a route to the Unix routing table
+func AddRoute(ifname string, prefix netip.Prefix) error {
 	prefixStr := prefix.String()
 
 	// ip route add PREFIX dev INTERFACE
@@ -87,6 +87,22 @@ func DeleteRoute(ifname string, prefix netip.Prefix) error {
 	return nil
 }
 
+// DeleteAddress removes an IP address from a Unix interface
+func DeleteAddress(ifname string, addr netip.Prefix) error {
+	cmd := exec.Command("ip", "addr", "del", addr.String(), "dev", ifname)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		// Ignore errors for addresses or interfaces that are already gone
+		if strings.Contains(string(output), "Cannot assign requested address") ||
+			strings.Contains(string(output), "Cannot find device") {
+			return nil
+		}
+		return fmt.Errorf("ip addr del failed: %w, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
 // GetInterfaceIP gets the current IP address of an interface
 func GetInterfaceIP(ifname string) (netip.Prefix, error) {
 	cmd := exec.Command("ip", "-o", "addr", "show", "dev", ifname)
@@ -18,7 +18,7 @@ func ConfigureTUN(ifname string, localIP netip.Prefix, routes []netip.Prefix) er
 
 	// Add routes
 	for _, route := range routes {
-		if err := addRoute(ifname, route); err != nil {
+		if err := AddRoute(ifname, route); err != nil {
 			return fmt.Errorf("failed to add route %s: %w", route, err)
 		}
 	}
@@ -46,8 +46,8 @@ func setIPAddress(ifname string, addr netip.Prefix) error {
 	return nil
 }
 
-// addRoute adds a route to the Windows routing table
-func addRoute(ifname string, prefix netip.Prefix) error {
+// AddRoute adds a route to the Windows routing table
+func AddRoute(ifname string, prefix netip.Prefix) error {
 	network := prefix.Masked().Addr().String()
 	bits := prefix.Bits()
 	netmask := prefixToNetmask(bits)
@@ -91,6 +91,24 @@ func DeleteRoute(ifname string, prefix netip.Prefix) error {
 	return nil
 }
 
+// DeleteAddress removes an IP address from a Windows interface
+func DeleteAddress(ifname string, addr netip.Prefix) error {
+	cmd := exec.Command("netsh", "interface", "ip", "delete", "address",
+		ifname, addr.Addr().String())
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		// Ignore "not found" errors
+		if strings.Contains(string(output), "not found") ||
+			strings.Contains(string(output), "Element not found") {
+			return nil
+		}
+		return fmt.Errorf("netsh delete address failed: %w, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
 // GetInterfaceIP gets the current IP address of an interface
 func GetInterfaceIP(ifname string) (netip.Prefix, error) {
 	cmd := exec.Command("netsh", "interface", "ip", "show", "addresses", ifname)
@@ -0,0 +1,204 @@
+//go:build linux
+
+package netconfig
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"os"
+	"syscall"
+)
+
+// rtnetlink message layouts, see rtnetlink(7)
+const (
+	sizeofIfInfomsg = 16
+	sizeofIfAddrmsg = 8
+	sizeofRtMsg     = 12
+)
+
+// rtnl is a NETLINK_ROUTE socket. It lives in the network namespace of the
+// thread that opened it.
+type rtnl struct {
+	fd  int
+	seq uint32
+}
+
+func openRtnl() (*rtnl, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return &rtnl{fd: fd}, nil
+}
+
+func (c *rtnl) close() {
+	syscall.Close(c.fd)
+}
+
+// request sends one message and waits for the kernel's acknowledgement.
+// It returns the replies that came before it; a rejected request returns
+// the syscall.Errno the kernel reported.
+func (c *rtnl) request(typ, flags uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	c.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], c.seq)
+	msg = append(msg, body...)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var replies []syscall.NetlinkMessage
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("short netlink error message")
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return replies, nil
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			default:
+				replies = append(replies, syscall.NetlinkMessage{Header: m.Header, Data: append([]byte(nil), m.Data...)})
+			}
+		}
+	}
+}
+
+// linkIndex resolves an interface name. A missing interface is ENODEV.
+func (c *rtnl) linkIndex(ifname string) (int32, error) {
+	body := ifInfomsg(0, 0, 0)
+	body = appendAttr(body, syscall.IFLA_IFNAME, append([]byte(ifname), 0))
+	replies, err := c.request(syscall.RTM_GETLINK, 0, body)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range replies {
+		if m.Header.Type == syscall.RTM_NEWLINK && len(m.Data) >= sizeofIfInfomsg {
+			return int32(binary.NativeEndian.Uint32(m.Data[4:8])), nil
+		}
+	}
+	return 0, syscall.ENODEV
+}
+
+// routeOIF returns the output interface of the main table route to prefix.
+// A route without one, such as a blackhole, reports 0.
+func (c *rtnl) routeOIF(prefix netip.Prefix) (int32, error) {
+	body := make([]byte, sizeofRtMsg)
+	body[0] = addrFamily(prefix.Addr())
+	replies, err := c.request(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, body)
+	if err != nil {
+		return 0, err
+	}
+	for i := range replies {
+		m := &replies[i]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < sizeofRtMsg || int(m.Data[1]) != prefix.Bits() {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return 0, err
+		}
+		table := uint32(m.Data[4])
+		var dst netip.Addr
+		var oif int32
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				dst, _ = netip.AddrFromSlice(attr.Value)
+			case syscall.RTA_OIF:
+				oif = int32(binary.NativeEndian.Uint32(attr.Value))
+			case syscall.RTA_TABLE:
+				table = binary.NativeEndian.Uint32(attr.Value)
+			}
+		}
+		if table != syscall.RT_TABLE_MAIN {
+			continue
+		}
+		if dst == prefix.Addr() || (!dst.IsValid() && prefix.Bits() == 0) {
+			return oif, nil
+		}
+	}
+	return 0, syscall.ESRCH
+}
+
+func ifInfomsg(index int32, flags, change uint32) []byte {
+	b := make([]byte, sizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+func ifAddrmsg(index int32, prefix netip.Prefix) []byte {
+	b := make([]byte, sizeofIfAddrmsg)
+	b[0] = addrFamily(prefix.Addr())
+	b[1] = uint8(prefix.Bits())
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+func rtMsg(prefix netip.Prefix, scope uint8) []byte {
+	b := make([]byte, sizeofRtMsg)
+	b[0] = addrFamily(prefix.Addr())
+	b[1] = uint8(prefix.Bits())
+	b[4] = syscall.RT_TABLE_MAIN
+	b[5] = syscall.RTPROT_BOOT
+	b[6] = scope
+	b[7] = syscall.RTN_UNICAST
+	return b
+}
+
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	var hdr [syscall.SizeofRtAttr]byte
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	b = append(b, hdr[:]...)
+	b = append(b, data...)
+	for length%syscall.RTA_ALIGNTO != 0 {
+		b = append(b, 0)
+		length++
+	}
+	return b
+}
+
+func appendUint32Attr(b []byte, typ uint16, v uint32) []byte {
+	var data [4]byte
+	binary.NativeEndian.PutUint32(data[:], v)
+	return appendAttr(b, typ, data[:])
+}
+
+func addrFamily(addr netip.Addr) uint8 {
+	if addr.Is4() {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
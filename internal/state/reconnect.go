@@ -0,0 +1,93 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// ReconnectEvent represents one attempt of a client to re-establish its session
+type ReconnectEvent struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Attempt   int           `json:"attempt"`
+	Delay     time.Duration `json:"delay"`
+	Success   bool          `json:"success"`
+	Reason    string        `json:"reason,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// ReconnectTracker tracks reconnection attempts
+type ReconnectTracker struct {
+	mu      sync.RWMutex
+	history []ReconnectEvent
+	maxSize int
+	total   int
+}
+
+// NewReconnectTracker creates a new reconnect tracker
+func NewReconnectTracker(maxSize int) *ReconnectTracker {
+	if maxSize <= 0 {
+		maxSize = 10
+	}
+	return &ReconnectTracker{
+		history: make([]ReconnectEvent, 0, maxSize),
+		maxSize: maxSize,
+	}
+}
+
+// RecordSuccess records an attempt that established a new session
+func (rt *ReconnectTracker) RecordSuccess(attempt int, delay time.Duration, reason string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.addEvent(ReconnectEvent{
+		Timestamp: time.Now(),
+		Attempt:   attempt,
+		Delay:     delay,
+		Success:   true,
+		Reason:    reason,
+	})
+}
+
+// RecordFailure records a failed attempt
+func (rt *ReconnectTracker) RecordFailure(attempt int, delay time.Duration, reason string, err error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.addEvent(ReconnectEvent{
+		Timestamp: time.Now(),
+		Attempt:   attempt,
+		Delay:     delay,
+		Success:   false,
+		Reason:    reason,
+		Error:     err.Error(),
+	})
+}
+
+func (rt *ReconnectTracker) addEvent(event ReconnectEvent) {
+	rt.total++
+	rt.history = append(rt.history, event)
+
+	// Keep only the last maxSize events
+	if len(rt.history) > rt.maxSize {
+		rt.history = rt.history[1:]
+	}
+}
+
+// GetHistory returns the most recent reconnect attempts
+func (rt *ReconnectTracker) GetHistory() []ReconnectEvent {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	// Return a copy
+	result := make([]ReconnectEvent, len(rt.history))
+	copy(result, rt.history)
+	return result
+}
+
+// Total returns the number of attempts recorded, including those that no
+// longer fit in the history
+func (rt *ReconnectTracker) Total() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.total
+}
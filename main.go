@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,21 +21,35 @@ import (
 	"time"
 
 	"stp/config"
+	"stp/crypto"
 	"stp/device"
+	"stp/internal"
 	"stp/internal/logging"
 	"stp/internal/management"
 	"stp/internal/ratelimit"
 	"stp/internal/state"
+	"stp/internal/timers"
+	"stp/proxy"
+	"stp/routing"
 	"stp/transport"
 )
 
 func main() {
 	var cfgPath string
 	var overrideMode string
+	var genKey bool
 	flag.StringVar(&cfgPath, "config", "config.json", "Path to configuration file (or '-' for stdin)")
 	flag.StringVar(&overrideMode, "mode", "", "Override mode (client/server)")
+	flag.BoolVar(&genKey, "genkey", false, "Generate a static key pair and exit")
 	flag.Parse()
 
+	if genKey {
+		if err := printKeyPair(); err != nil {
+			log.Fatalf("failed to generate key: %v", err)
+		}
+		return
+	}
+
 	cfg, err := config.Load(cfgPath)
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
@@ -70,30 +90,92 @@ func main() {
 func runClient(ctx context.Context, cfgPath string, cfg *config.Config, baseLogger *logging.Logger, reloadTracker *state.ReloadTracker) error {
 	componentLogger := baseLogger.With(map[string]interface{}{"component": "stp"})
 	logger := componentLogger.With(map[string]interface{}{"role": "client"})
+
+	var tickets *transport.ZeroRTTManager
+	if cfg.ZeroRTT.Enabled {
+		tickets = transport.NewZeroRTTManager(transport.DefaultZeroRTTConfig())
+		defer tickets.Stop()
+		if cfg.ZeroRTT.TicketFile != "" {
+			if err := tickets.LoadTickets(cfg.ZeroRTT.TicketFile); err != nil {
+				logger.Warn("session tickets not loaded", map[string]interface{}{"error": err.Error()})
+			}
+		}
+	}
+
 	dev, err := device.NewDevice(device.RoleClient, cfg, logger)
 	if err != nil {
 		return err
 	}
 	defer dev.Close()
+	if tickets != nil {
+		dev.SetTickets(tickets)
+	}
 
-	network, address := parseEndpoint(cfg.Endpoint)
-	conn, err := transport.Dial(network, address)
+	// The first connection must succeed; only a session that was up is
+	// re-established. The device, and with it the tunnel interface, is kept
+	// across reconnects.
+	session, err := connectClient(dev, cfg, logger)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	// The management server reads the session while the client reconnects
+	var sessionMu sync.Mutex
+	currentSession := func() *clientSession {
+		sessionMu.Lock()
+		defer sessionMu.Unlock()
+		return session
+	}
+	defer func() { currentSession().close() }()
+	reconnects := state.NewReconnectTracker(20)
+
+	var cfgMu sync.Mutex
+	currentConfig := func() *config.Config {
+		cfgMu.Lock()
+		defer cfgMu.Unlock()
+		return cfg
+	}
 
-	if err := dev.Handshake(conn, cfg); err != nil {
-		return err
+	var inbound *proxy.Inbound
+	if cfg.Proxy.Listen != "" {
+		inbound, err = startProxy(dev, cfg, currentConfig, logger)
+		if err != nil {
+			return err
+		}
+		defer inbound.Close()
+	}
+	if len(cfg.LocalForwards) > 0 {
+		if err := dev.ListenLocalForwards(cfg.LocalForwards, cfg.EffectiveHandshakeTimeout()); err != nil {
+			return err
+		}
 	}
 
 	mgmt, err := management.New(cfg.Management.Bind, func() interface{} {
 		snapshot := dev.Snapshot()
-		return map[string]interface{}{
-			"device":  snapshot,
-			"reloads": reloadTracker.GetHistory(),
+		out := map[string]interface{}{
+			"device":     snapshot,
+			"connection": currentSession().snapshot(),
+			"reconnects": reconnects.GetHistory(),
+			"reloads":    reloadTracker.GetHistory(),
+		}
+		if inbound != nil {
+			out["proxy"] = inbound.Stats()
 		}
-	}, logger, management.WithMetrics(dev.Metrics), management.WithACL(cfg.ManagementPrefixes()))
+		return out
+	}, logger, management.WithMetrics(func() map[string]float64 {
+		metrics := dev.Metrics()
+		metrics["client_reconnect_attempts_total"] = float64(reconnects.Total())
+		if inbound != nil {
+			stats := inbound.Stats()
+			metrics["client_proxy_connections_total"] = float64(stats.Connections)
+			metrics["client_proxy_active_connections"] = float64(stats.Active)
+			metrics["client_proxy_proxied_total"] = float64(stats.Proxied)
+			metrics["client_proxy_direct_total"] = float64(stats.Direct)
+			metrics["client_proxy_blocked_total"] = float64(stats.Blocked)
+			metrics["client_proxy_failed_total"] = float64(stats.Failed)
+			metrics["client_proxy_udp_associations_total"] = float64(stats.Associations)
+		}
+		return metrics
+	}), management.WithACL(cfg.ManagementPrefixes()))
 	if err != nil {
 		return err
 	}
@@ -111,6 +193,15 @@ func runClient(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 			changes = append(changes, "log_level")
 		}
 
+		// Update tunnel routes
+		if updated.Tunnel.AutoConfigure && !slices.Equal(cfg.Tunnel.Routes, updated.Tunnel.Routes) {
+			if err := dev.UpdateTunnelRoutes(updated.Tunnel.Routes); err != nil {
+				logger.Warn("tunnel route update failed", map[string]interface{}{"error": err.Error()})
+			} else {
+				changes = append(changes, "tunnel_routes")
+			}
+		}
+
 		// Update peers
 		if peersChanged(cfg.Peers, updated.Peers) {
 			if err := dev.UpdatePeers(updated.Peers); err != nil {
@@ -121,7 +212,9 @@ func runClient(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 		}
 
 		// Update config reference
+		cfgMu.Lock()
 		cfg = updated
+		cfgMu.Unlock()
 
 		reloadTracker.RecordSuccess(changes)
 	})
@@ -133,41 +226,264 @@ func runClient(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 		}
 	}()
 
-	done := make(chan struct{})
-	go func() {
-		dev.TunnelLoop(conn)
-		close(done)
-	}()
+	initial := currentConfig()
+	backoff := internal.NewBackoff(initial.EffectiveReconnectDelay(), initial.EffectiveReconnectMaxDelay())
+	for {
+		conn := currentSession().conn
+		done := make(chan struct{})
+		go func() {
+			dev.TunnelLoop(conn)
+			close(done)
+		}()
+		if current := currentConfig(); len(current.Forwards) > 0 {
+			dev.PublishForwards(conn, current.Forwards, current.EffectiveHandshakeTimeout())
+		}
 
-	select {
-	case <-ctx.Done():
-		logger.Info("shutdown signal received, closing client gracefully", nil)
-		conn.Close()
+		select {
+		case <-ctx.Done():
+			logger.Info("shutdown signal received, closing client gracefully", nil)
+			conn.Close()
 
-		shutdownTimeout := time.NewTimer(5 * time.Second)
-		defer shutdownTimeout.Stop()
+			shutdownTimeout := time.NewTimer(5 * time.Second)
+			defer shutdownTimeout.Stop()
 
-		select {
+			select {
+			case <-done:
+				logger.Info("client shutdown complete", nil)
+			case <-shutdownTimeout.C:
+				logger.Warn("client shutdown timeout, forcing exit", nil)
+			}
+			return nil
 		case <-done:
-			logger.Info("client shutdown complete", nil)
-		case <-shutdownTimeout.C:
-			logger.Warn("client shutdown timeout, forcing exit", nil)
 		}
-	case <-done:
-		logger.Info("tunnel loop ended", nil)
+
+		lost := currentSession()
+		lost.close()
+		dev.SetTimers(nil)
+		if currentConfig().Reconnect.Disabled {
+			logger.Info("tunnel loop ended", nil)
+			return nil
+		}
+		reason := "tunnel loop ended"
+		if lost.timers.GetState() == timers.StateDead {
+			reason = "dead peer"
+		}
+		logger.Warn("session lost, reconnecting", map[string]interface{}{"reason": reason})
+
+		next := reconnectClient(ctx, dev, currentConfig, logger, backoff, reconnects, reason)
+		if next == nil {
+			return nil
+		}
+		sessionMu.Lock()
+		session = next
+		sessionMu.Unlock()
+	}
+}
+
+// clientSession is one connection of a client device together with the
+// timers that watch it for a dead server.
+type clientSession struct {
+	conn   net.Conn
+	timers *timers.ConnectionTimers
+}
+
+// newClientSession arms the timers for a connection about to handshake. A
+// handshake left unanswered for every retry, like an established session
+// that stays silent for the dead-peer timeout, closes the connection.
+func newClientSession(conn net.Conn, cfg *config.Config, logger *logging.Logger) *clientSession {
+	timerCfg := timers.DefaultTimerConfig()
+	timerCfg.HandshakeTimeout = cfg.EffectiveHandshakeTimeout()
+	timerCfg.RekeyInterval = cfg.EffectiveRekeyInterval()
+	timerCfg.KeepaliveInterval = cfg.EffectiveKeepalive()
+	timerCfg.DeadPeerTimeout = cfg.EffectiveDeadPeerTimeout()
+
+	session := &clientSession{conn: conn, timers: timers.NewConnectionTimers(timerCfg)}
+	remote := conn.RemoteAddr().String()
+	session.timers.SetCallbacks(
+		func() {
+			logger.Debug("handshake unanswered", map[string]interface{}{"remote": remote})
+		},
+		nil,
+		nil,
+		func() {
+			logger.Warn("server unresponsive, closing session", map[string]interface{}{"remote": remote})
+			conn.Close()
+		},
+		nil,
+	)
+	session.timers.TransitionState(timers.StateInitiationSent)
+	return session
+}
+
+// established switches the timers from the handshake to the session: from
+// now on every received frame postpones the dead-peer timeout.
+func (s *clientSession) established() {
+	s.timers.TransitionState(timers.StateEstablished)
+	s.timers.OnDataReceived()
+}
+
+func (s *clientSession) close() {
+	s.timers.Stop()
+	s.conn.Close()
+}
+
+func (s *clientSession) snapshot() map[string]interface{} {
+	stats := s.timers.GetStats()
+	return map[string]interface{}{
+		"remote":        s.conn.RemoteAddr().String(),
+		"state":         stats.State.String(),
+		"lastHandshake": stats.LastHandshake,
+		"lastReceive":   stats.LastDataRecv,
 	}
-	return nil
+}
+
+// connectClient dials the endpoint and establishes a session on dev. When
+// the server refuses a session ticket the client redials and tries again;
+// the refused ticket is spent, so this ends in a full handshake.
+func connectClient(dev *device.Device, cfg *config.Config, logger *logging.Logger) (*clientSession, error) {
+	for {
+		conn, err := dialEndpoint(cfg)
+		if err != nil {
+			return nil, err
+		}
+		session := newClientSession(conn, cfg, logger)
+		err = dev.Handshake(conn, cfg)
+		if err == nil {
+			session.established()
+			dev.SetTimers(session.timers)
+			return session, nil
+		}
+		dead := session.timers.GetState() == timers.StateDead
+		session.close()
+		if dead {
+			return nil, fmt.Errorf("handshake timed out: %w", err)
+		}
+		if !errors.Is(err, device.ErrResumeFailed) {
+			return nil, err
+		}
+		logger.Warn("session resumption failed, retrying with full handshake", map[string]interface{}{"error": err.Error()})
+	}
+}
+
+// reconnectClient redials until a new session is up, waiting longer after
+// every failed attempt. It returns nil once ctx is cancelled.
+func reconnectClient(ctx context.Context, dev *device.Device, currentConfig func() *config.Config, logger *logging.Logger, backoff *internal.BackoffTimer, tracker *state.ReconnectTracker, reason string) *clientSession {
+	for attempt := 1; ; attempt++ {
+		delay := backoff.Next()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		session, err := connectClient(dev, currentConfig(), logger)
+		if err != nil {
+			tracker.RecordFailure(attempt, delay, reason, err)
+			logger.Warn("reconnect failed", map[string]interface{}{
+				"attempt": attempt,
+				"delay":   delay.String(),
+				"error":   err.Error(),
+			})
+			continue
+		}
+		backoff.Reset()
+		tracker.RecordSuccess(attempt, delay, reason)
+		logger.Info("reconnected", map[string]interface{}{
+			"attempt": attempt,
+			"remote":  session.conn.RemoteAddr().String(),
+		})
+		return session
+	}
+}
+
+// startProxy opens the local proxy of a client. Requests routed through
+// the tunnel each get a session of their own, relayed by the server, or a
+// stream of the session of dev when proxy.mux is set.
+func startProxy(dev *device.Device, cfg *config.Config, currentConfig func() *config.Config, logger *logging.Logger) (*proxy.Inbound, error) {
+	router, err := routing.NewRouterFromConfig(&cfg.Proxy.Routing)
+	if err != nil {
+		return nil, fmt.Errorf("proxy routing: %w", err)
+	}
+	inbound, err := proxy.Listen(proxy.Config{
+		Listen: cfg.Proxy.Listen,
+		Router: router,
+		Tunnel: func(network, address string) (net.Conn, error) {
+			cfg := currentConfig()
+			if cfg.Proxy.Mux {
+				return dev.OpenStream(network, address, cfg.EffectiveHandshakeTimeout())
+			}
+			return dialRelay(cfg, logger, network, address)
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := inbound.Serve(); err != nil {
+			logger.Error("proxy stopped", map[string]interface{}{"error": err.Error()})
+		}
+	}()
+	logger.Info("proxy listening", map[string]interface{}{
+		"addr":          inbound.Addr().String(),
+		"rules":         len(cfg.Proxy.Routing.Rules),
+		"mux":           cfg.Proxy.Mux,
+		"defaultAction": string(router.ExportRules().DefaultAction),
+	})
+	return inbound, nil
+}
+
+// dialRelay connects to address over a new session that the server relays
+// to it.
+func dialRelay(cfg *config.Config, logger *logging.Logger, network, address string) (net.Conn, error) {
+	dev, err := device.NewRelayDevice(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialEndpoint(cfg)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	timeout := cfg.EffectiveHandshakeTimeout()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := dev.Handshake(conn, cfg); err != nil {
+		conn.Close()
+		dev.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	stream, err := dev.Connect(conn, network, address, timeout)
+	if err != nil {
+		conn.Close()
+		dev.Close()
+		return nil, err
+	}
+	return stream, nil
 }
 
 func runServer(ctx context.Context, cfgPath string, cfg *config.Config, baseLogger *logging.Logger, reloadTracker *state.ReloadTracker) error {
 	componentLogger := baseLogger.With(map[string]interface{}{"component": "stp"})
 	logger := componentLogger.With(map[string]interface{}{"role": "server"})
-	network, address := parseEndpoint(cfg.Listen)
-	listener, err := transport.Listen(network, address)
-	if err != nil {
-		return err
+	var listeners []transport.Listener
+	var fallbacks []*transport.FallbackListener
+	listenerCfgs := cfg.ServerListeners()
+	for _, listenerCfg := range listenerCfgs {
+		listener, err := listenEndpoint(cfg, listenerCfg.Listen)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return err
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+		if fallback, ok := listener.(*transport.FallbackListener); ok {
+			fallbacks = append(fallbacks, fallback)
+		}
 	}
-	defer listener.Close()
 
 	limiter := ratelimit.NewConnectionLimiter(
 		cfg.EffectiveMaxConnections(),
@@ -175,10 +491,29 @@ func runServer(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 		cfg.EffectiveConnectionBurst(),
 	)
 
+	var tickets *transport.ZeroRTTManager
+	if cfg.ZeroRTT.Enabled {
+		ticketCfg := transport.DefaultZeroRTTConfig()
+		ticketCfg.TicketLifetime = cfg.EffectiveTicketLifetime()
+		ticketCfg.MaxTicketUsage = 1
+		tickets = transport.NewZeroRTTManager(ticketCfg)
+		defer tickets.Stop()
+	}
+
+	// All sessions share one dataplane, routed by the peers' AllowedIPs
+	router, err := device.NewRouter(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer router.Close()
+
 	var sessionID atomic.Uint64
 	registry := &sessionRegistry{
-		logger:  logger,
-		limiter: limiter,
+		logger:    logger,
+		limiter:   limiter,
+		tickets:   tickets,
+		router:    router,
+		fallbacks: fallbacks,
 	}
 
 	mgmt, err := management.New(cfg.Management.Bind, func() interface{} {
@@ -192,7 +527,36 @@ func runServer(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 		return err
 	}
 	mgmt.Start()
+
+	// cfgMu guards cfg, which reloads replace while sessions are accepted.
+	// A reload holds it throughout, so a session either sees the peers it
+	// revoked or is live by the time they are revoked.
+	var cfgMu sync.Mutex
+	currentConfig := func() *config.Config {
+		cfgMu.Lock()
+		defer cfgMu.Unlock()
+		return cfg
+	}
+	// peerRevoked reports whether a reload revoked the peer a session
+	// authenticated as after the session began its handshake under sessionCfg
+	peerRevoked := func(sessionCfg *config.Config, name string) bool {
+		cfgMu.Lock()
+		defer cfgMu.Unlock()
+		return revokedPeers(sessionCfg.Peers, cfg.Peers)[name]
+	}
+
 	startConfigWatcher(ctx, cfgPath, logger, reloadTracker, func(updated *config.Config) {
+		cfgMu.Lock()
+		defer cfgMu.Unlock()
+
+		// Listeners keep the port schedule they were started with
+		if hopScheduleChanged(cfg, updated) {
+			err := errors.New("portHopping changes require a restart")
+			logger.Warn("config reload refused", map[string]interface{}{"error": err.Error()})
+			reloadTracker.RecordFailure(err)
+			return
+		}
+
 		changes := []string{}
 
 		// Update ACL
@@ -218,8 +582,36 @@ func runServer(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 			changes = append(changes, "log_level")
 		}
 
+		// Update tunnel routes
+		if updated.Tunnel.AutoConfigure && !slices.Equal(cfg.Tunnel.Routes, updated.Tunnel.Routes) {
+			if err := router.UpdateTunnelRoutes(updated.Tunnel.Routes); err != nil {
+				logger.Warn("tunnel route update failed", map[string]interface{}{"error": err.Error()})
+			} else {
+				changes = append(changes, "tunnel_routes")
+			}
+		}
+
+		// Update forward ACL
+		if !reflect.DeepEqual(cfg.ForwardACL, updated.ForwardACL) {
+			if err := router.UpdateForwardACL(updated.ForwardACL); err != nil {
+				logger.Warn("forward ACL update failed", map[string]interface{}{"error": err.Error()})
+			} else {
+				changes = append(changes, "forward_acl")
+			}
+		}
+
 		// Update peers
 		if peersChanged(cfg.Peers, updated.Peers) {
+			if revoked := revokedPeers(cfg.Peers, updated.Peers); len(revoked) > 0 {
+				if closed := registry.revokePeers(revoked); closed > 0 {
+					changes = append(changes, "peer_revocation")
+				}
+				if tickets != nil {
+					for name := range revoked {
+						tickets.ForgetPeer(name)
+					}
+				}
+			}
 			if err := registry.updatePeers(updated.Peers); err != nil {
 				logger.Warn("peer update failed", map[string]interface{}{"error": err.Error()})
 			} else {
@@ -244,7 +636,9 @@ func runServer(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 	go func() {
 		<-ctx.Done()
 		logger.Info("shutdown signal received, stopping server gracefully", nil)
-		_ = listener.Close()
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
 
 		shutdownDeadline := time.NewTimer(30 * time.Second)
 		defer shutdownDeadline.Stop()
@@ -274,74 +668,114 @@ func runServer(ctx context.Context, cfgPath string, cfg *config.Config, baseLogg
 		close(shutdownComplete)
 	}()
 
-	logger.Info("server listening", map[string]interface{}{
-		"addr":           address,
-		"network":        network,
-		"maxConnections": cfg.EffectiveMaxConnections(),
-		"rateLimit":      cfg.EffectiveConnectionRate(),
-	})
+	serve := func(listener transport.Listener, listen string) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				logger.Warn("accept error", map[string]interface{}{"error": err.Error(), "listen": listen})
+				select {
+				case <-time.After(500 * time.Millisecond):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
-				<-shutdownComplete
-				logger.Info("server shutdown complete", nil)
-				return nil
+			if !limiter.Allow() {
+				current, max, tokens := limiter.Stats()
+				logger.Warn("connection rejected", map[string]interface{}{
+					"reason":             "rate limit or max connections",
+					"currentConnections": current,
+					"maxConnections":     max,
+					"availableTokens":    tokens,
+					"remote":             conn.RemoteAddr().String(),
+				})
+				conn.Close()
+				continue
 			}
-			logger.Warn("accept error", map[string]interface{}{"error": err.Error()})
-			select {
-			case <-time.After(500 * time.Millisecond):
-			case <-ctx.Done():
-				<-shutdownComplete
-				return nil
+
+			sessionCfg := listenerConfig(currentConfig(), listen)
+			id := sessionID.Add(1)
+			peerLogger := logger.With(map[string]interface{}{"session": id})
+			dev, err := router.NewDevice(sessionCfg, peerLogger)
+			if err != nil {
+				peerLogger.Error("device init failed", map[string]interface{}{"error": err.Error()})
+				conn.Close()
+				limiter.Release()
+				continue
+			}
+			if tickets != nil {
+				dev.SetTickets(tickets)
 			}
-			continue
-		}
 
-		if !limiter.Allow() {
-			current, max, tokens := limiter.Stats()
-			logger.Warn("connection rejected", map[string]interface{}{
-				"reason":             "rate limit or max connections",
-				"currentConnections": current,
-				"maxConnections":     max,
-				"availableTokens":    tokens,
-				"remote":             conn.RemoteAddr().String(),
-			})
-			conn.Close()
-			continue
-		}
+			registry.add(id, dev, conn)
 
-		id := sessionID.Add(1)
-		peerLogger := logger.With(map[string]interface{}{"session": id})
-		dev, err := device.NewDevice(device.RoleServer, cfg, peerLogger)
-		if err != nil {
-			peerLogger.Error("device init failed", map[string]interface{}{"error": err.Error()})
-			conn.Close()
-			limiter.Release()
-			continue
+			go func(conn net.Conn, dev *device.Device, id uint64) {
+				defer func() {
+					conn.Close()
+					if state := registry.remove(id); state != nil {
+						state.device.Close()
+						limiter.Release()
+					} else {
+						dev.Close()
+					}
+				}()
+
+				if err := dev.Handshake(conn, sessionCfg); err != nil {
+					if fallback, ok := listener.(*transport.FallbackListener); ok && fallback.Divert(conn) {
+						peerLogger.Info("failed handshake relayed to fallback", map[string]interface{}{"error": err.Error()})
+						return
+					}
+					peerLogger.Error("handshake failed", map[string]interface{}{"error": err.Error()})
+					return
+				}
+				if name := dev.RemotePeer(); name != "" && peerRevoked(sessionCfg, name) {
+					peerLogger.Info("session revoked", map[string]interface{}{"session": id, "peer": name})
+					return
+				}
+				dev.TunnelLoop(conn)
+			}(conn, dev, id)
 		}
+	}
 
-		registry.add(id, dev, conn)
+	var acceptWG sync.WaitGroup
+	current := currentConfig()
+	for i, listenerCfg := range listenerCfgs {
+		network, address := parseEndpoint(listenerCfg.Listen)
+		logger.Info("server listening", map[string]interface{}{
+			"addr":           address,
+			"network":        network,
+			"obfuscation":    listenerCfg.Obfuscation.Mode,
+			"maxConnections": current.EffectiveMaxConnections(),
+			"rateLimit":      current.EffectiveConnectionRate(),
+		})
+		acceptWG.Add(1)
+		go func(listener transport.Listener, listen string) {
+			defer acceptWG.Done()
+			serve(listener, listen)
+		}(listeners[i], listenerCfg.Listen)
+	}
+	acceptWG.Wait()
 
-		go func(conn net.Conn, dev *device.Device, id uint64) {
-			defer func() {
-				conn.Close()
-				if state := registry.remove(id); state != nil {
-					state.device.Close()
-					limiter.Release()
-				} else {
-					dev.Close()
-				}
-			}()
+	<-shutdownComplete
+	logger.Info("server shutdown complete", nil)
+	return nil
+}
 
-			if err := dev.Handshake(conn, cfg); err != nil {
-				peerLogger.Error("handshake failed", map[string]interface{}{"error": err.Error()})
-				return
-			}
-			dev.TunnelLoop(conn)
-		}(conn, dev, id)
+// listenerConfig returns the configuration for a session accepted on listen,
+// with the listener's obfuscation override applied.
+func listenerConfig(cfg *config.Config, listen string) *config.Config {
+	for _, listenerCfg := range cfg.ServerListeners() {
+		if listenerCfg.Listen == listen {
+			sessionCfg := *cfg
+			sessionCfg.Obfuscation = *listenerCfg.Obfuscation
+			return &sessionCfg
+		}
 	}
+	return cfg
 }
 
 type sessionState struct {
@@ -354,6 +788,10 @@ type sessionRegistry struct {
 	sessions map[uint64]*sessionState
 	logger   *logging.Logger
 	limiter  *ratelimit.ConnectionLimiter
+	tickets  *transport.ZeroRTTManager
+	router   *device.Router
+
+	fallbacks []*transport.FallbackListener
 }
 
 func (r *sessionRegistry) add(id uint64, dev *device.Device, conn net.Conn) {
@@ -392,16 +830,25 @@ func (r *sessionRegistry) snapshot() interface{} {
 	}
 
 	out := struct {
-		Sessions        []device.State `json:"sessions"`
-		Count           int            `json:"count"`
-		CurrentConns    int            `json:"currentConnections"`
-		MaxConns        int            `json:"maxConnections"`
-		AvailableTokens float64        `json:"availableTokens"`
+		Sessions        []device.State        `json:"sessions"`
+		Count           int                   `json:"count"`
+		CurrentConns    int                   `json:"currentConnections"`
+		MaxConns        int                   `json:"maxConnections"`
+		AvailableTokens float64               `json:"availableTokens"`
+		Routes          []device.RouteState   `json:"routes,omitempty"`
+		Routing         *device.RouterStats   `json:"routing,omitempty"`
+		Forwards        []device.ForwardState `json:"forwards,omitempty"`
 	}{
 		CurrentConns:    current,
 		MaxConns:        max,
 		AvailableTokens: tokens,
 	}
+	if r.router != nil {
+		stats := r.router.Stats()
+		out.Routes = r.router.Snapshot()
+		out.Routing = &stats
+		out.Forwards = r.router.Forwards()
+	}
 
 	for _, state := range r.sessions {
 		out.Sessions = append(out.Sessions, state.device.Snapshot())
@@ -425,6 +872,8 @@ func (r *sessionRegistry) metrics() map[string]float64 {
 	r.mu.RUnlock()
 
 	totalMessages := 0.0
+	replayRejected := 0.0
+	suites := make(map[string]float64)
 	for _, dev := range devices {
 		if dev == nil {
 			continue
@@ -433,12 +882,22 @@ func (r *sessionRegistry) metrics() map[string]float64 {
 			if value, ok := stats["device_messages_total"]; ok {
 				totalMessages += value
 			}
+			replayRejected += stats["device_replay_rejected_total"]
+			for name, value := range stats {
+				if labels, ok := strings.CutPrefix(name, "device_cipher_suite{"); ok {
+					suites["server_sessions_by_cipher_suite{"+labels] += value
+				}
+			}
 		}
 	}
 
 	metrics := map[string]float64{
-		"server_sessions":       float64(len(devices)),
-		"server_messages_total": totalMessages,
+		"server_sessions":              float64(len(devices)),
+		"server_messages_total":        totalMessages,
+		"server_replay_rejected_total": replayRejected,
+	}
+	for name, value := range suites {
+		metrics[name] = value
 	}
 	if r.limiter != nil {
 		current, max, tokens := r.limiter.Stats()
@@ -446,6 +905,41 @@ func (r *sessionRegistry) metrics() map[string]float64 {
 		metrics["server_max_connections"] = float64(max)
 		metrics["server_available_tokens"] = tokens
 	}
+	if r.tickets != nil {
+		stats := r.tickets.GetStats()
+		metrics["server_tickets_issued_total"] = float64(stats.TicketsIssued)
+		metrics["server_resumptions_total"] = float64(stats.ZeroRTTSuccess)
+		metrics["server_resumptions_failed_total"] = float64(stats.ZeroRTTFailed)
+	}
+	if len(r.fallbacks) > 0 {
+		var tunnel, relayed, diverted uint64
+		for _, fallback := range r.fallbacks {
+			stats := fallback.GetStats()
+			tunnel += stats.ValidConnections
+			relayed += stats.FallbackConnections
+			diverted += stats.DivertedConnections
+		}
+		metrics["server_fallback_tunnel_connections_total"] = float64(tunnel)
+		metrics["server_fallback_connections_total"] = float64(relayed)
+		metrics["server_fallback_diverted_total"] = float64(diverted)
+	}
+	if r.router != nil {
+		stats := r.router.Stats()
+		metrics["server_routed_outbound_total"] = float64(stats.Outbound)
+		metrics["server_routed_delivered_total"] = float64(stats.Delivered)
+		metrics["server_routed_forwarded_total"] = float64(stats.Forwarded)
+		metrics["server_routed_dropped_total"] = float64(stats.Dropped)
+
+		var published, connections, refused uint64
+		for _, f := range r.router.Forwards() {
+			published++
+			connections += f.Connections
+			refused += f.Refused
+		}
+		metrics["server_forwards_published"] = float64(published)
+		metrics["server_forward_connections_total"] = float64(connections)
+		metrics["server_forward_refused_total"] = float64(refused)
+	}
 	return metrics
 }
 
@@ -474,6 +968,10 @@ func (r *sessionRegistry) updatePeers(peerConfigs []config.PeerConfig) error {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
+	if r.router != nil {
+		r.router.UpdatePeers(peerConfigs)
+	}
+
 	for _, state := range r.sessions {
 		if err := state.device.UpdatePeers(peerConfigs); err != nil {
 			return err
@@ -482,6 +980,43 @@ func (r *sessionRegistry) updatePeers(peerConfigs []config.PeerConfig) error {
 	return nil
 }
 
+// revokePeers closes every session authenticated as one of the named peers.
+// Sessions bound to the global PSK or to other peers are left untouched.
+func (r *sessionRegistry) revokePeers(names map[string]bool) int {
+	r.mu.RLock()
+	var revoked []*sessionState
+	var ids []uint64
+	for id, state := range r.sessions {
+		if peerName := state.device.RemotePeer(); peerName != "" && names[peerName] {
+			revoked = append(revoked, state)
+			ids = append(ids, id)
+		}
+	}
+	r.mu.RUnlock()
+
+	for i, state := range revoked {
+		if state.conn != nil {
+			state.conn.Close()
+		}
+		r.logger.Info("session revoked", map[string]interface{}{"session": ids[i], "peer": state.device.RemotePeer()})
+	}
+	return len(revoked)
+}
+
+func printKeyPair() error {
+	privateKey, err := crypto.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	publicKey, err := crypto.PublicKey(privateKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("privateKey: %s\n", base64.StdEncoding.EncodeToString(privateKey))
+	fmt.Printf("publicKey:  %s\n", base64.StdEncoding.EncodeToString(publicKey[:]))
+	return nil
+}
+
 func parseEndpoint(endpoint string) (network, address string) {
 	network = "udp"
 	address = endpoint
@@ -493,6 +1028,116 @@ func parseEndpoint(endpoint string) (network, address string) {
 	return network, address
 }
 
+// dialEndpoint connects to the configured endpoint. ws:// and wss:// go
+// through the WebSocket transport, everything else through transport.Dial.
+func dialEndpoint(cfg *config.Config) (net.Conn, error) {
+	network, address := parseEndpoint(cfg.Endpoint)
+	switch network {
+	case "ws", "wss":
+		opts, err := webSocketOptions(cfg.WebSocket, false)
+		if err != nil {
+			return nil, err
+		}
+		return transport.DialWebSocket(cfg.Endpoint, opts)
+	default:
+		if cfg.PortHopping.Enabled {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			manager := transport.NewPortHoppingManager(portHoppingConfig(cfg))
+			return transport.NewPortHoppingDialer(manager, network, host).Dial()
+		}
+		return transport.Dial(network, address)
+	}
+}
+
+// listenEndpoint opens a server listener, see dialEndpoint
+func listenEndpoint(cfg *config.Config, listen string) (transport.Listener, error) {
+	network, address := parseEndpoint(listen)
+	switch network {
+	case "ws", "wss":
+		opts, err := webSocketOptions(cfg.WebSocket, true)
+		if err != nil {
+			return nil, err
+		}
+		return transport.ListenWebSocket(listen, opts)
+	default:
+		// Only the primary listen address hops
+		if cfg.PortHopping.Enabled && listen == cfg.Listen {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			manager := transport.NewPortHoppingManager(portHoppingConfig(cfg))
+			return transport.NewPortHoppingListener(manager, network, host)
+		}
+		if cfg.FallbackFronts(listen) {
+			return transport.NewFallbackListener(fallbackConfig(cfg), address)
+		}
+		return transport.Listen(network, address)
+	}
+}
+
+// fallbackConfig relays everything that is not a tunnel handshake to the
+// decoy unchanged, so TLS to an HTTPS decoy works as well as plain HTTP.
+func fallbackConfig(cfg *config.Config) transport.FallbackConfig {
+	fallback := transport.DefaultFallbackConfig(cfg.Fallback.Address)
+	fallback.Mode = transport.FallbackModeTrojan
+	fallback.UseHTTPServer = false
+	fallback.DetectionTime = cfg.EffectiveFallbackDetectionTimeout()
+	fallback.Detect = crypto.IsHandshakeRecord
+	return fallback
+}
+
+func portHoppingConfig(cfg *config.Config) transport.PortHoppingConfig {
+	portMin, portMax := cfg.EffectivePortRange()
+	hop := transport.DefaultPortHoppingConfig(cfg.PortHoppingSecret())
+	hop.PortRangeMin = portMin
+	hop.PortRangeMax = portMax
+	hop.HopInterval = cfg.EffectiveHopInterval()
+	return hop
+}
+
+// hopScheduleChanged reports whether the port schedule of a hopping primary
+// listener differs between two configurations.
+func hopScheduleChanged(old, updated *config.Config) bool {
+	if old.PortHopping.Enabled != updated.PortHopping.Enabled {
+		return true
+	}
+	if !old.PortHopping.Enabled {
+		return false
+	}
+	return !reflect.DeepEqual(portHoppingConfig(old), portHoppingConfig(updated))
+}
+
+func webSocketOptions(ws config.WebSocketConfig, server bool) (transport.WebSocketOptions, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         ws.Host,
+		InsecureSkipVerify: ws.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if server && ws.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(ws.TLSCert, ws.TLSKey)
+		if err != nil {
+			return transport.WebSocketOptions{}, fmt.Errorf("load websocket certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if !server && ws.TLSCA != "" {
+		pem, err := os.ReadFile(ws.TLSCA)
+		if err != nil {
+			return transport.WebSocketOptions{}, fmt.Errorf("read websocket tlsCA: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return transport.WebSocketOptions{}, fmt.Errorf("no certificates in websocket tlsCA %s", ws.TLSCA)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return transport.WebSocketOptions{Path: ws.Path, Host: ws.Host, TLSConfig: tlsConfig}, nil
+}
+
 const configWatchInterval = 5 * time.Second
 
 func startConfigWatcher(ctx context.Context, path string, logger *logging.Logger, tracker *state.ReloadTracker, apply func(*config.Config)) {
@@ -539,6 +1184,24 @@ func startConfigWatcher(ctx context.Context, path string, logger *logging.Logger
 	}()
 }
 
+// revokedPeers returns the peers whose credentials were removed or replaced,
+// so sessions authenticated with the old credentials can be torn down.
+func revokedPeers(old, new []config.PeerConfig) map[string]bool {
+	newMap := make(map[string]config.PeerConfig)
+	for _, p := range new {
+		newMap[p.Name] = p
+	}
+
+	revoked := make(map[string]bool)
+	for _, oldPeer := range old {
+		newPeer, exists := newMap[oldPeer.Name]
+		if !exists || oldPeer.PSK != newPeer.PSK || oldPeer.PublicKey != newPeer.PublicKey {
+			revoked[oldPeer.Name] = true
+		}
+	}
+	return revoked
+}
+
 func peersChanged(old, new []config.PeerConfig) bool {
 	if len(old) != len(new) {
 		return true
@@ -574,6 +1237,16 @@ func peersChanged(old, new []config.PeerConfig) bool {
 		if oldPeer.Endpoint != newPeer.Endpoint {
 			return true
 		}
+
+		// Check if pinned static key changed
+		if oldPeer.PublicKey != newPeer.PublicKey {
+			return true
+		}
+
+		// Check if the peer-specific PSK changed
+		if oldPeer.PSK != newPeer.PSK {
+			return true
+		}
 	}
 
 	return false
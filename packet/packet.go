@@ -1,10 +1,26 @@
 package packet
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 const (
 	TypeUnknown uint8 = iota
 	TypeData
+	// TypeConnect asks the server to relay the session to a destination.
+	// From then on data packets carry the relayed bytes and no peer name.
+	TypeConnect
+	// TypeConnectReply answers TypeConnect. A non-zero flag means the
+	// destination could not be reached; the payload holds the reason.
+	TypeConnectReply
+	// TypeMux carries bytes of the session's stream multiplexer, see
+	// transport.Multiplexer. Frames may span several packets.
+	TypeMux
+	// TypeForward opens a stream for a reverse forward: a client sends it
+	// to publish a forward, the server to relay a connection it accepted.
+	// It is answered with TypeConnectReply.
+	TypeForward
 )
 
 type Packet struct {
@@ -64,3 +80,82 @@ func ExtractData(pkt *Packet) (peer string, payload []byte, err error) {
 	payload = append([]byte(nil), pkt.Payload[peerLen:]...)
 	return peer, payload, nil
 }
+
+// NewConnectPacket builds a request to relay the session to address, dialed
+// over network ("tcp" or "udp").
+func NewConnectPacket(network, address string) (*Packet, error) {
+	if network == "" || strings.Contains(network, " ") {
+		return nil, errors.New("invalid network")
+	}
+	if address == "" {
+		return nil, errors.New("address required")
+	}
+	return &Packet{Type: TypeConnect, Payload: []byte(network + " " + address)}, nil
+}
+
+// ExtractConnect returns the destination of a connect packet.
+func ExtractConnect(pkt *Packet) (network, address string, err error) {
+	if pkt == nil {
+		return "", "", errors.New("nil packet")
+	}
+	if pkt.Type != TypeConnect {
+		return "", "", errors.New("packet is not connect")
+	}
+	network, address, ok := strings.Cut(string(pkt.Payload), " ")
+	if !ok || network == "" || address == "" {
+		return "", "", errors.New("malformed connect packet")
+	}
+	return network, address, nil
+}
+
+// NewForwardPacket builds a forward request for the named forward. The
+// address is where the server listens when publishing, and the address of
+// the accepted peer when relaying a connection.
+func NewForwardPacket(name, address string) (*Packet, error) {
+	if name == "" || strings.Contains(name, " ") {
+		return nil, errors.New("invalid forward name")
+	}
+	return &Packet{Type: TypeForward, Payload: []byte(name + " " + address)}, nil
+}
+
+// ExtractForward returns the forward name and address of a forward packet.
+func ExtractForward(pkt *Packet) (name, address string, err error) {
+	if pkt == nil {
+		return "", "", errors.New("nil packet")
+	}
+	if pkt.Type != TypeForward {
+		return "", "", errors.New("packet is not forward")
+	}
+	name, address, ok := strings.Cut(string(pkt.Payload), " ")
+	if !ok || name == "" {
+		return "", "", errors.New("malformed forward packet")
+	}
+	return name, address, nil
+}
+
+// NewConnectReply answers a connect packet; err is nil once the destination
+// is connected.
+func NewConnectReply(err error) *Packet {
+	if err == nil {
+		return &Packet{Type: TypeConnectReply}
+	}
+	return &Packet{Type: TypeConnectReply, Flags: 1, Payload: []byte(err.Error())}
+}
+
+// ExtractConnectReply returns the error a connect reply reports.
+func ExtractConnectReply(pkt *Packet) error {
+	if pkt == nil {
+		return errors.New("nil packet")
+	}
+	if pkt.Type != TypeConnectReply {
+		return errors.New("packet is not connect reply")
+	}
+	if pkt.Flags == 0 {
+		return nil
+	}
+	reason := string(pkt.Payload)
+	if reason == "" {
+		reason = "connect refused"
+	}
+	return errors.New(reason)
+}
@@ -1,6 +1,9 @@
 package packet
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestPacketEncodeDecode(t *testing.T) {
 	payload := []byte{0x01, 0x02, 0x03}
@@ -33,3 +36,50 @@ func TestNewDataPacketPeerLength(t *testing.T) {
 		t.Fatalf("expected error for long peer name")
 	}
 }
+
+func TestConnectPacket(t *testing.T) {
+	pkt, err := NewConnectPacket("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("new connect packet: %v", err)
+	}
+	decoded, err := Decode(Encode(pkt))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	network, address, err := ExtractConnect(decoded)
+	if err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	if network != "tcp" || address != "example.com:443" {
+		t.Fatalf("unexpected destination %s %s", network, address)
+	}
+
+	if err := ExtractConnectReply(NewConnectReply(nil)); err != nil {
+		t.Fatalf("expected success reply, got %v", err)
+	}
+	reply, err := Decode(Encode(NewConnectReply(errors.New("connection refused"))))
+	if err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+	if err := ExtractConnectReply(reply); err == nil || err.Error() != "connection refused" {
+		t.Fatalf("expected refusal, got %v", err)
+	}
+}
+
+func TestForwardPacket(t *testing.T) {
+	pkt, err := NewForwardPacket("ssh", ":2222")
+	if err != nil {
+		t.Fatalf("new forward packet: %v", err)
+	}
+	decoded, err := Decode(Encode(pkt))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	name, address, err := ExtractForward(decoded)
+	if err != nil || name != "ssh" || address != ":2222" {
+		t.Fatalf("unexpected forward %q %q %v", name, address, err)
+	}
+	if _, err := NewForwardPacket("two words", ":80"); err == nil {
+		t.Fatal("forward name with a space accepted")
+	}
+}
@@ -19,6 +19,8 @@ type Peer struct {
 	messagesSent  uint64
 	messagesRecv  uint64
 	rekeyEpoch    uint32
+	roams         uint64
+	lastRoam      time.Time
 }
 
 func NewPeer(name string, endpoint net.Addr, allowed []string) *Peer {
@@ -38,6 +40,16 @@ func (p *Peer) UpdateHandshake(sessionID [16]byte, endpoint net.Addr, epoch uint
 	p.rekeyEpoch = epoch
 }
 
+// UpdateEndpoint records that the peer moved to a new address within the
+// same session.
+func (p *Peer) UpdateEndpoint(endpoint net.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endpoint = endpoint
+	p.roams++
+	p.lastRoam = time.Now()
+}
+
 func (p *Peer) UpdateRekey(epoch uint32) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -79,6 +91,8 @@ func (p *Peer) Snapshot() Snapshot {
 		LastReceive:   p.lastReceive,
 		MessagesSent:  p.messagesSent,
 		MessagesRecv:  p.messagesRecv,
+		Roams:         p.roams,
+		LastRoam:      p.lastRoam,
 	}
 	if p.endpoint != nil {
 		snapshot.Endpoint = p.endpoint.String()
@@ -98,4 +112,6 @@ type Snapshot struct {
 	LastReceive   time.Time `json:"lastReceive"`
 	MessagesSent  uint64    `json:"messagesSent"`
 	MessagesRecv  uint64    `json:"messagesRecv"`
+	Roams         uint64    `json:"roams"`
+	LastRoam      time.Time `json:"lastRoam"`
 }
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"stp/transport"
+)
+
+// httpHeaderTimeout bounds how long a client may take to send its request
+const httpHeaderTimeout = 30 * time.Second
+
+// serveHTTP answers one HTTP CONNECT request. Other methods are refused;
+// plain HTTP is not proxied.
+func (in *Inbound) serveHTTP(conn *bufferedConn) {
+	conn.SetReadDeadline(time.Now().Add(httpHeaderTimeout))
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, portStr = req.Host, "443"
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || host == "" || port < 1 || port > 65535 {
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return
+	}
+
+	target, _, err := in.dial("tcp", host, port)
+	if err != nil {
+		if errors.Is(err, errBlocked) {
+			writeHTTPStatus(conn, http.StatusForbidden)
+		} else {
+			writeHTTPStatus(conn, http.StatusBadGateway)
+		}
+		return
+	}
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		target.Close()
+		return
+	}
+	transport.Splice(conn, target)
+}
+
+func writeHTTPStatus(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
@@ -0,0 +1,258 @@
+// Package proxy implements the local SOCKS5 and HTTP CONNECT proxy of a
+// client. Every request is matched against a routing.Router and then sent
+// through the tunnel, dialed directly or refused.
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stp/internal/logging"
+	"stp/routing"
+)
+
+// DialFunc connects to address over network ("tcp" or "udp")
+type DialFunc func(network, address string) (net.Conn, error)
+
+// Config configures an Inbound.
+type Config struct {
+	Listen string
+	Router *routing.Router
+	// Tunnel dials requests routed to routing.ActionProxy through the server
+	Tunnel DialFunc
+	// Direct dials requests routed to routing.ActionDirect, net.Dial with
+	// DialTimeout when nil
+	Direct      DialFunc
+	DialTimeout time.Duration // default 10s
+	Logger      *logging.Logger
+}
+
+// Stats counts the requests an Inbound handled.
+type Stats struct {
+	Connections  uint64 `json:"connections"` // accepted client connections
+	Active       int64  `json:"active"`
+	Proxied      uint64 `json:"proxied"`
+	Direct       uint64 `json:"direct"`
+	Blocked      uint64 `json:"blocked"`
+	Failed       uint64 `json:"failed"`
+	Associations uint64 `json:"udpAssociations"`
+}
+
+// errBlocked is returned for requests the routing rules refuse
+var errBlocked = errors.New("blocked by routing rules")
+
+// Inbound accepts SOCKS5 and HTTP CONNECT requests on one port. The
+// protocol is told apart by the first byte a client sends.
+type Inbound struct {
+	listener net.Listener
+	router   *routing.Router
+	tunnel   DialFunc
+	direct   DialFunc
+	logger   *logging.Logger
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+
+	connections  atomic.Uint64
+	active       atomic.Int64
+	proxied      atomic.Uint64
+	directs      atomic.Uint64
+	blocked      atomic.Uint64
+	failed       atomic.Uint64
+	associations atomic.Uint64
+}
+
+// Listen opens the inbound on cfg.Listen. Call Serve to accept requests.
+func Listen(cfg Config) (*Inbound, error) {
+	if cfg.Router == nil {
+		return nil, errors.New("router is required")
+	}
+	if cfg.Tunnel == nil {
+		return nil, errors.New("tunnel dialer is required")
+	}
+	if cfg.Logger == nil {
+		return nil, errors.New("logger is required")
+	}
+	direct := cfg.Direct
+	if direct == nil {
+		timeout := cfg.DialTimeout
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		direct = func(network, address string) (net.Conn, error) {
+			return net.DialTimeout(network, address, timeout)
+		}
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	return &Inbound{
+		listener: ln,
+		router:   cfg.Router,
+		tunnel:   cfg.Tunnel,
+		direct:   direct,
+		logger:   cfg.Logger,
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the address the inbound listens on
+func (in *Inbound) Addr() net.Addr {
+	return in.listener.Addr()
+}
+
+// Serve accepts client connections until Close is called.
+func (in *Inbound) Serve() error {
+	for {
+		conn, err := in.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !in.track(conn) {
+			conn.Close()
+			return nil
+		}
+		in.connections.Add(1)
+		in.active.Add(1)
+		in.wg.Add(1)
+		go func() {
+			defer in.wg.Done()
+			defer in.active.Add(-1)
+			defer in.untrack(conn)
+			in.handle(conn)
+		}()
+	}
+}
+
+// Close stops accepting and closes every client connection.
+func (in *Inbound) Close() error {
+	in.mu.Lock()
+	in.closed = true
+	conns := in.conns
+	in.conns = make(map[net.Conn]struct{})
+	in.mu.Unlock()
+
+	err := in.listener.Close()
+	for conn := range conns {
+		conn.Close()
+	}
+	in.wg.Wait()
+	return err
+}
+
+// Stats returns the request counters.
+func (in *Inbound) Stats() Stats {
+	return Stats{
+		Connections:  in.connections.Load(),
+		Active:       in.active.Load(),
+		Proxied:      in.proxied.Load(),
+		Direct:       in.directs.Load(),
+		Blocked:      in.blocked.Load(),
+		Failed:       in.failed.Load(),
+		Associations: in.associations.Load(),
+	}
+}
+
+func (in *Inbound) track(conn net.Conn) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return false
+	}
+	in.conns[conn] = struct{}{}
+	return true
+}
+
+func (in *Inbound) untrack(conn net.Conn) {
+	in.mu.Lock()
+	delete(in.conns, conn)
+	in.mu.Unlock()
+	conn.Close()
+}
+
+func (in *Inbound) handle(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	client := &bufferedConn{Conn: conn, r: br}
+	if first[0] == socksVersion {
+		in.serveSOCKS(client)
+		return
+	}
+	in.serveHTTP(client)
+}
+
+// dial routes one request and connects it the way the rules decide
+func (in *Inbound) dial(network, host string, port int) (net.Conn, routing.Action, error) {
+	var domain string
+	ip := net.ParseIP(host)
+	if ip == nil {
+		domain = host
+	}
+	action := in.router.Route(domain, ip, port, network)
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	var conn net.Conn
+	var err error
+	switch action {
+	case routing.ActionBlock:
+		in.blocked.Add(1)
+		in.logger.Info("proxy request blocked", map[string]interface{}{"network": network, "address": address})
+		return nil, action, errBlocked
+	case routing.ActionDirect:
+		conn, err = in.direct(network, address)
+	default:
+		action = routing.ActionProxy
+		conn, err = in.tunnel(network, address)
+	}
+	if err != nil {
+		in.failed.Add(1)
+		in.logger.Warn("proxy request failed", map[string]interface{}{
+			"network": network,
+			"address": address,
+			"action":  string(action),
+			"error":   err.Error(),
+		})
+		return nil, action, err
+	}
+	if action == routing.ActionDirect {
+		in.directs.Add(1)
+	} else {
+		in.proxied.Add(1)
+	}
+	in.logger.Debug("proxy request", map[string]interface{}{"network": network, "address": address, "action": string(action)})
+	return conn, action, nil
+}
+
+// bufferedConn reads through the reader that sniffed the protocol, so
+// nothing the client sent early is lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the client connection when it supports it, so
+// transport.Splice can pass on the destination's EOF.
+func (c *bufferedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
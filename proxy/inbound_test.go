@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stp/internal/logging"
+	"stp/routing"
+)
+
+// tunnelRecorder stands in for the tunnel: it dials a fixed address and
+// records what it was asked for. A hook runs before each dial and can hold
+// it up or fail it.
+type tunnelRecorder struct {
+	mu        sync.Mutex
+	target    map[string]string // network -> address actually dialed
+	requested []string
+	hook      func(address string) error
+}
+
+func (r *tunnelRecorder) dial(network, address string) (net.Conn, error) {
+	r.mu.Lock()
+	r.requested = append(r.requested, network+" "+address)
+	target := r.target[network]
+	r.mu.Unlock()
+	if r.hook != nil {
+		if err := r.hook(address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Dial(network, target)
+}
+
+func (r *tunnelRecorder) requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requested...)
+}
+
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startInbound(t *testing.T, tunnel *tunnelRecorder) *Inbound {
+	t.Helper()
+	router, err := routing.NewRouterFromConfig(&routing.RoutingConfig{
+		Rules: []routing.RuleConfig{
+			{Type: routing.RuleTypeDomainSuffix, Pattern: ".blocked.test", Action: routing.ActionBlock},
+		},
+	})
+	if err != nil {
+		t.Fatalf("router: %v", err)
+	}
+	in, err := Listen(Config{
+		Listen: "127.0.0.1:0",
+		Router: router,
+		Tunnel: tunnel.dial,
+		Logger: logging.New(logging.LevelError, nil),
+	})
+	if err != nil {
+		t.Fatalf("listen inbound: %v", err)
+	}
+	go in.Serve()
+	t.Cleanup(func() { in.Close() })
+	return in
+}
+
+// socksRequest negotiates no authentication and sends one request for a
+// domain destination. It returns the reply code and bound address.
+func socksRequest(t *testing.T, conn net.Conn, cmd byte, host string, port int) (byte, *net.UDPAddr) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte{socksVersion, 1, socksMethodNone}); err != nil {
+		t.Fatalf("write methods: %v", err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksMethodNone {
+		t.Fatalf("method negotiation: %v %x", err, method)
+	}
+	request := []byte{socksVersion, cmd, 0x00, socksAtypDomain, byte(len(host))}
+	request = append(request, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	bound := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+	return reply[1], bound
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	tunnel := &tunnelRecorder{target: map[string]string{"tcp": startTCPEcho(t)}}
+	in := startInbound(t, tunnel)
+
+	conn, err := net.Dial("tcp", in.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if code, _ := socksRequest(t, conn, socksCmdConnect, "example.test", 443); code != socksReplySucceeded {
+		t.Fatalf("connect reply %d", code)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo: %q %v", buf, err)
+	}
+	if got := tunnel.requests(); len(got) != 1 || got[0] != "tcp example.test:443" {
+		t.Fatalf("unexpected tunnel requests %v", got)
+	}
+
+	// A blocked destination is refused without reaching the tunnel
+	blocked, err := net.Dial("tcp", in.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer blocked.Close()
+	if code, _ := socksRequest(t, blocked, socksCmdConnect, "ads.blocked.test", 80); code != socksReplyNotAllowed {
+		t.Fatalf("expected not allowed, got %d", code)
+	}
+	if stats := in.Stats(); stats.Proxied != 1 || stats.Blocked != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// TestSOCKS5HalfClose checks that a client that half-closes after its
+// request still receives the reply.
+func TestSOCKS5HalfClose(t *testing.T) {
+	// The destination answers only once the request has ended
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("reply to "), request...))
+	}()
+	tunnel := &tunnelRecorder{target: map[string]string{"tcp": ln.Addr().String()}}
+	in := startInbound(t, tunnel)
+
+	conn, err := net.Dial("tcp", in.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if code, _ := socksRequest(t, conn, socksCmdConnect, "example.test", 80); code != socksReplySucceeded {
+		t.Fatalf("connect reply %d", code)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "reply to hello" {
+		t.Fatalf("reply: %q %v", reply, err)
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	tunnel := &tunnelRecorder{target: map[string]string{"udp": startUDPEcho(t)}}
+	in := startInbound(t, tunnel)
+
+	control, err := net.Dial("tcp", in.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer control.Close()
+	code, bound := socksRequest(t, control, socksCmdUDPAssociate, "0.0.0.0", 0)
+	if code != socksReplySucceeded {
+		t.Fatalf("associate reply %d", code)
+	}
+
+	client, err := net.DialUDP("udp", nil, bound)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer client.Close()
+	header := []byte{0, 0, 0, socksAtypDomain, byte(len("dns.test"))}
+	header = append(header, "dns.test"...)
+	header = binary.BigEndian.AppendUint16(header, 53)
+	if _, err := client.Write(append(append([]byte(nil), header...), "query"...)); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+
+	buf := make([]byte, 512)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("read datagram: %v", err)
+	}
+	if got := string(buf[:n]); got != string(header)+"query" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := tunnel.requests(); len(got) != 1 || got[0] != "udp dns.test:53" {
+		t.Fatalf("unexpected tunnel requests %v", got)
+	}
+	if stats := in.Stats(); stats.Associations != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSOCKS5UDPAssociateSlowDestination(t *testing.T) {
+	release := make(chan struct{})
+	tunnel := &tunnelRecorder{
+		target: map[string]string{"udp": startUDPEcho(t)},
+		hook: func(address string) error {
+			switch address {
+			case "slow.test:53":
+				<-release
+			case "down.test:53":
+				return errors.New("unreachable")
+			}
+			return nil
+		},
+	}
+	in := startInbound(t, tunnel)
+
+	control, err := net.Dial("tcp", in.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer control.Close()
+	code, bound := socksRequest(t, control, socksCmdUDPAssociate, "0.0.0.0", 0)
+	if code != socksReplySucceeded {
+		t.Fatalf("associate reply %d", code)
+	}
+	client, err := net.DialUDP("udp", nil, bound)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer client.Close()
+
+	header := func(host string) []byte {
+		h := []byte{0, 0, 0, socksAtypDomain, byte(len(host))}
+		h = append(h, host...)
+		return binary.BigEndian.AppendUint16(h, 53)
+	}
+	send := func(host, payload string) {
+		if _, err := client.Write(append(header(host), payload...)); err != nil {
+			t.Fatalf("write datagram: %v", err)
+		}
+	}
+	expect := func(host, payload string) {
+		t.Helper()
+		buf := make([]byte, 512)
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("read datagram: %v", err)
+		}
+		if got := string(buf[:n]); got != string(header(host))+payload {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+
+	// A destination still dialling does not hold up the others
+	send("slow.test", "queued")
+	send("dns.test", "query")
+	expect("dns.test", "query")
+
+	// A destination that failed is not dialled again for every datagram
+	for i := 0; i < 3; i++ {
+		send("down.test", "lost")
+	}
+	send("dns.test", "again")
+	expect("dns.test", "again")
+	downs := 0
+	for deadline := time.Now().Add(2 * time.Second); downs == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, request := range tunnel.requests() {
+			if request == "udp down.test:53" {
+				downs++
+			}
+		}
+	}
+	if downs != 1 {
+		t.Fatalf("failed destination dialled %d times", downs)
+	}
+
+	// The datagram queued while dialling is delivered once connected
+	close(release)
+	expect("slow.test", "queued")
+}
+
+func TestHTTPConnect(t *testing.T) {
+	tunnel := &tunnelRecorder{target: map[string]string{"tcp": startTCPEcho(t)}}
+	in := startInbound(t, tunnel)
+
+	request := func(target string) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", in.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		return conn, br, resp
+	}
+
+	conn, br, resp := request("example.test:443")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo: %q %v", buf, err)
+	}
+
+	if _, _, resp := request("ads.blocked.test:443"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %s", resp.Status)
+	}
+	if got := tunnel.requests(); len(got) != 1 || !strings.HasPrefix(got[0], "tcp example.test") {
+		t.Fatalf("unexpected tunnel requests %v", got)
+	}
+}
@@ -0,0 +1,427 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"stp/routing"
+	"stp/transport"
+)
+
+// SOCKS5 as in RFC 1928. Only the "no authentication" method is offered:
+// the inbound is meant for local clients.
+const (
+	socksVersion = 0x05
+
+	socksMethodNone         = 0x00
+	socksMethodNoAcceptable = 0xFF
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+// socksHandshakeTimeout bounds the method negotiation and the request
+const socksHandshakeTimeout = 30 * time.Second
+
+// udpFlowIdleTimeout closes a UDP ASSOCIATE destination that stayed silent
+const udpFlowIdleTimeout = 2 * time.Minute
+
+// udpFlowRetryDelay is how long a destination that could not be dialled is
+// not tried again; its datagrams are dropped meanwhile
+const udpFlowRetryDelay = 5 * time.Second
+
+// udpFlowQueue bounds the datagrams held for a destination being dialled
+const udpFlowQueue = 16
+
+// maxUDPFlows bounds the destinations of one association
+const maxUDPFlows = 256
+
+var errAddressType = errors.New("unsupported address type")
+
+func (in *Inbound) serveSOCKS(conn *bufferedConn) {
+	conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	// Method negotiation
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	offered := false
+	for _, method := range methods {
+		if method == socksMethodNone {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksMethodNone}); err != nil {
+		return
+	}
+
+	// Request
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	if request[0] != socksVersion {
+		return
+	}
+	host, port, err := readSOCKSAddr(conn)
+	if err != nil {
+		if errors.Is(err, errAddressType) {
+			writeSOCKSReply(conn, socksReplyAddressNotSupported, nil)
+		}
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch request[1] {
+	case socksCmdConnect:
+		target, _, err := in.dial("tcp", host, port)
+		if err != nil {
+			writeSOCKSReply(conn, socksReplyFor(err), nil)
+			return
+		}
+		if err := writeSOCKSReply(conn, socksReplySucceeded, nil); err != nil {
+			target.Close()
+			return
+		}
+		transport.Splice(conn, target)
+	case socksCmdUDPAssociate:
+		in.associate(conn)
+	default:
+		writeSOCKSReply(conn, socksReplyCommandNotSupported, nil)
+	}
+}
+
+func socksReplyFor(err error) byte {
+	if errors.Is(err, errBlocked) {
+		return socksReplyNotAllowed
+	}
+	return socksReplyGeneralFailure
+}
+
+// associate serves UDP ASSOCIATE. Datagrams are relayed for as long as the
+// control connection stays open. Each destination is routed once and gets
+// its own flow: a tunnel or direct connection whose replies are sent back
+// to the client with the destination in the header.
+func (in *Inbound) associate(conn *bufferedConn) {
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if local == nil || remote == nil {
+		writeSOCKSReply(conn, socksReplyGeneralFailure, nil)
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeSOCKSReply(conn, socksReplyGeneralFailure, nil)
+		return
+	}
+	defer udpConn.Close()
+	if err := writeSOCKSReply(conn, socksReplySucceeded, udpConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		return
+	}
+	in.associations.Add(1)
+
+	a := &association{
+		in:       in,
+		udp:      udpConn,
+		clientIP: remote.IP,
+		flows:    make(map[string]*udpFlow),
+	}
+	go a.serve()
+
+	// The association lasts as long as its control connection
+	io.Copy(io.Discard, conn)
+	udpConn.Close()
+	a.close()
+}
+
+type association struct {
+	in       *Inbound
+	udp      *net.UDPConn
+	clientIP net.IP
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	flows  map[string]*udpFlow
+	closed bool
+}
+
+// udpFlow is one destination of an association. It is dialled in the
+// background while its first datagrams wait in pending. A blocked or failed
+// destination keeps a flow without a connection until expires, so it is
+// routed only once in that time.
+type udpFlow struct {
+	conn    net.Conn
+	header  []byte // SOCKS header naming the destination in replies
+	ready   bool   // dialling finished
+	pending [][]byte
+	expires time.Time
+}
+
+func (a *association) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := a.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// Only the client that opened the association may use it
+		if !from.IP.Equal(a.clientIP) {
+			continue
+		}
+		header, host, port, payload, err := parseSOCKSDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		a.mu.Lock()
+		a.client = from
+		a.mu.Unlock()
+
+		conn := a.flow(header, host, port, payload)
+		if conn == nil {
+			continue
+		}
+		if _, err := conn.Write(payload); err != nil {
+			a.in.logger.Debug("udp datagram dropped", map[string]interface{}{"error": err.Error()})
+		}
+	}
+}
+
+// flow returns the connection of a destination's flow. A new destination
+// starts dialling in the background and payload is queued for it, so a
+// slow destination never holds up the others; nil means the datagram was
+// queued or is to be dropped.
+func (a *association) flow(header []byte, host string, port int, payload []byte) net.Conn {
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	flow, ok := a.flows[key]
+	if ok && flow.ready && flow.conn == nil && now.After(flow.expires) {
+		delete(a.flows, key)
+		ok = false
+	}
+	if !ok {
+		if len(a.flows) >= maxUDPFlows {
+			a.expireLocked(now)
+			if len(a.flows) >= maxUDPFlows {
+				return nil
+			}
+		}
+		flow = &udpFlow{header: append([]byte(nil), header...)}
+		a.flows[key] = flow
+		go a.dial(key, flow, host, port)
+	}
+	if !flow.ready {
+		if len(flow.pending) < udpFlowQueue {
+			flow.pending = append(flow.pending, append([]byte(nil), payload...))
+		}
+		return nil
+	}
+	return flow.conn
+}
+
+// dial connects a new flow, sends the datagrams queued meanwhile and then
+// relays the replies
+func (a *association) dial(key string, flow *udpFlow, host string, port int) {
+	conn, action, err := a.in.dial("udp", host, port)
+	for {
+		a.mu.Lock()
+		if a.closed || a.flows[key] != flow {
+			a.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		pending := flow.pending
+		flow.pending = nil
+		if err != nil || len(pending) == 0 {
+			flow.ready = true
+			flow.conn = conn
+			if err != nil {
+				flow.expires = time.Now().Add(udpFlowRetryDelay)
+				if action == routing.ActionBlock {
+					flow.expires = time.Now().Add(udpFlowIdleTimeout)
+				}
+			}
+			a.mu.Unlock()
+			break
+		}
+		a.mu.Unlock()
+		for _, payload := range pending {
+			if _, err := conn.Write(payload); err != nil {
+				a.in.logger.Debug("udp datagram dropped", map[string]interface{}{"error": err.Error()})
+			}
+		}
+	}
+	if conn != nil {
+		a.reply(key, flow)
+	}
+}
+
+// expireLocked forgets blocked and failed destinations whose time is up.
+// The caller holds a.mu.
+func (a *association) expireLocked(now time.Time) {
+	for key, flow := range a.flows {
+		if flow.ready && flow.conn == nil && now.After(flow.expires) {
+			delete(a.flows, key)
+		}
+	}
+}
+
+// reply sends what a destination answers back to the client
+func (a *association) reply(key string, flow *udpFlow) {
+	defer func() {
+		flow.conn.Close()
+		a.mu.Lock()
+		if a.flows[key] == flow {
+			delete(a.flows, key)
+		}
+		a.mu.Unlock()
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		flow.conn.SetReadDeadline(time.Now().Add(udpFlowIdleTimeout))
+		n, err := flow.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		datagram := append(append([]byte(nil), flow.header...), buf[:n]...)
+		if _, err := a.udp.WriteToUDP(datagram, client); err != nil {
+			return
+		}
+	}
+}
+
+func (a *association) close() {
+	a.mu.Lock()
+	a.closed = true
+	flows := a.flows
+	a.flows = make(map[string]*udpFlow)
+	a.mu.Unlock()
+	for _, flow := range flows {
+		if flow.conn != nil {
+			flow.conn.Close()
+		}
+	}
+}
+
+// readSOCKSAddr reads ATYP, DST.ADDR and DST.PORT of a request
+func readSOCKSAddr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var addr []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socksAtypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, length[0])
+	default:
+		return "", 0, errAddressType
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return "", 0, err
+	}
+	host := string(addr)
+	if atyp[0] != socksAtypDomain {
+		host = net.IP(addr).String()
+	}
+	return host, int(binary.BigEndian.Uint16(portBuf)), nil
+}
+
+// parseSOCKSDatagram splits a UDP request into its header, destination and
+// payload. Fragmented datagrams are not supported.
+func parseSOCKSDatagram(b []byte) (header []byte, host string, port int, payload []byte, err error) {
+	if len(b) < 4 {
+		return nil, "", 0, nil, errors.New("short datagram")
+	}
+	if b[2] != 0 {
+		return nil, "", 0, nil, errors.New("fragmented datagram")
+	}
+	r := &countingReader{b: b[3:]}
+	host, port, err = readSOCKSAddr(r)
+	if err != nil {
+		return nil, "", 0, nil, fmt.Errorf("datagram address: %w", err)
+	}
+	end := 3 + r.n
+	return b[:end], host, port, b[end:], nil
+}
+
+// writeSOCKSReply sends a reply naming bound, or 0.0.0.0:0 when nil.
+func writeSOCKSReply(w io.Writer, code byte, bound *net.UDPAddr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if bound != nil {
+		ip = bound.IP
+		port = bound.Port
+	}
+	reply := []byte{socksVersion, code, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socksAtypIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socksAtypIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
+
+// countingReader reads from a byte slice and counts what was consumed
+type countingReader struct {
+	b []byte
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.n >= len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.n:])
+	r.n += n
+	return n, nil
+}
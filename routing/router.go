@@ -176,6 +176,28 @@ func (r *Router) LoadRules(config *RoutingConfig) error {
 	return nil
 }
 
+// NewRouterFromConfig 根据配置创建路由器，默认动作为代理
+func NewRouterFromConfig(config *RoutingConfig) (*Router, error) {
+	defaultAction := config.DefaultAction
+	if defaultAction == "" {
+		defaultAction = ActionProxy
+	}
+	r := NewRouter(defaultAction)
+	if err := r.LoadRules(config); err != nil {
+		return nil, err
+	}
+
+	if config.GeoIPDatabase != "" {
+		geoip := NewGeoIP()
+		if err := geoip.LoadFromFile(config.GeoIPDatabase); err != nil {
+			return nil, err
+		}
+		r.SetGeoIP(geoip)
+	}
+
+	return r, nil
+}
+
 // RemoveRule 移除规则
 func (r *Router) RemoveRule(index int) error {
 	r.mu.Lock()
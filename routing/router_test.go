@@ -418,3 +418,34 @@ func BenchmarkRouterGeoIP(b *testing.B) {
 		router.Route("", ip, 0, "")
 	}
 }
+
+func TestNewRouterFromConfig(t *testing.T) {
+	router, err := NewRouterFromConfig(&RoutingConfig{
+		Rules: []RuleConfig{
+			{Type: RuleTypeDomainSuffix, Pattern: ".lan", Action: ActionDirect},
+			{Type: RuleTypePort, Pattern: "25", Action: ActionBlock},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	// 未设置默认动作时走代理
+	if action := router.Route("example.com", nil, 443, "tcp"); action != ActionProxy {
+		t.Errorf("Expected ActionProxy, got %s", action)
+	}
+	if action := router.Route("nas.lan", nil, 443, "tcp"); action != ActionDirect {
+		t.Errorf("Expected ActionDirect, got %s", action)
+	}
+	if action := router.Route("", net.ParseIP("1.2.3.4"), 25, "tcp"); action != ActionBlock {
+		t.Errorf("Expected ActionBlock, got %s", action)
+	}
+
+	// 无效规则
+	_, err = NewRouterFromConfig(&RoutingConfig{
+		Rules: []RuleConfig{{Type: RuleTypeIPCIDR, Pattern: "not-a-cidr", Action: ActionDirect}},
+	})
+	if err == nil {
+		t.Error("Expected error for invalid CIDR")
+	}
+}
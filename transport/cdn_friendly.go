@@ -59,6 +59,7 @@ type CDNTransport struct {
 	conn   net.Conn
 	wsConn *websocket.Conn
 	mu     sync.RWMutex
+	wmu    sync.Mutex // WebSocket只允许一个并发写者
 
 	// 读写缓冲
 	readBuf  []byte
@@ -235,19 +236,24 @@ func (ct *CDNTransport) readWebSocket(b []byte) (int, error) {
 		return 0, fmt.Errorf("websocket connection is nil")
 	}
 
-	// 读取WebSocket消息
-	messageType, message, err := wsConn.ReadMessage()
-	if err != nil {
-		return 0, err
-	}
+	// 先返回上一条消息中未读完的部分，保证按字节流语义读取
+	if len(ct.readBuf) == 0 {
+		// 读取WebSocket消息
+		messageType, message, err := wsConn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
 
-	// 只处理二进制消息
-	if messageType != websocket.BinaryMessage {
-		return 0, fmt.Errorf("unexpected message type: %d", messageType)
+		// 只处理二进制消息
+		if messageType != websocket.BinaryMessage {
+			return 0, fmt.Errorf("unexpected message type: %d", messageType)
+		}
+		ct.readBuf = append(ct.readBuf[:0], message...)
 	}
 
 	// 复制到缓冲区
-	n := copy(b, message)
+	n := copy(b, ct.readBuf)
+	ct.readBuf = ct.readBuf[:copy(ct.readBuf, ct.readBuf[n:])]
 	ct.bytesReceived += uint64(n)
 
 	return n, nil
@@ -286,7 +292,9 @@ func (ct *CDNTransport) writeWebSocket(b []byte) (int, error) {
 	}
 
 	// 发送二进制消息
+	ct.wmu.Lock()
 	err := wsConn.WriteMessage(websocket.BinaryMessage, b)
+	ct.wmu.Unlock()
 	if err != nil {
 		return 0, err
 	}
@@ -307,15 +315,11 @@ func (ct *CDNTransport) Close() error {
 	ct.closed = true
 	close(ct.stopChan)
 
-	if ct.pingTicker != nil {
-		ct.pingTicker.Stop()
-	}
-
 	var err error
 	if ct.wsConn != nil {
-		// 发送关闭消息
-		ct.wsConn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		// 发送关闭消息（控制帧可与数据写入并发）
+		ct.wsConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
 		err = ct.wsConn.Close()
 	}
 
@@ -405,14 +409,14 @@ func (ct *CDNTransport) SetWriteDeadline(t time.Time) error {
 
 // pingRoutine WebSocket ping协程
 func (ct *CDNTransport) pingRoutine() {
-	ct.pingTicker = time.NewTicker(ct.config.PingInterval)
-	defer ct.pingTicker.Stop()
+	ticker := time.NewTicker(ct.config.PingInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ct.stopChan:
 			return
-		case <-ct.pingTicker.C:
+		case <-ticker.C:
 			ct.sendPing()
 		}
 	}
@@ -428,8 +432,10 @@ func (ct *CDNTransport) sendPing() {
 		return
 	}
 
+	ct.mu.Lock()
 	ct.lastPing = time.Now()
-	err := wsConn.WriteMessage(websocket.PingMessage, nil)
+	ct.mu.Unlock()
+	err := wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(ct.config.PingInterval))
 	if err != nil {
 		// Ping失败，可能连接已断开
 	}
@@ -462,6 +468,7 @@ type CDNTransportStats struct {
 type CDNListener struct {
 	config   CDNConfig
 	listener net.Listener
+	server   *http.Server
 	upgrader websocket.Upgrader
 	connChan chan net.Conn
 	mu       sync.Mutex
@@ -493,18 +500,18 @@ func NewCDNListener(config CDNConfig, addr string) (*CDNListener, error) {
 
 	cl.listener = listener
 
-	// 启动HTTP服务器
+	// 启动HTTP服务器（升级后的连接由websocket接管，不受超时影响）
+	cl.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		TLSConfig:    config.TLSConfig,
+	}
 	go func() {
-		server := &http.Server{
-			Handler:      mux,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-		}
-
 		if config.Mode == CDNModeWebSocketTLS {
-			server.ServeTLS(listener, "", "")
+			cl.server.ServeTLS(listener, "", "")
 		} else {
-			server.Serve(listener)
+			cl.server.Serve(listener)
 		}
 	}()
 
@@ -525,6 +532,12 @@ func (cl *CDNListener) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 发送到连接通道
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		conn.Close()
+		return
+	}
 	select {
 	case cl.connChan <- conn:
 	default:
@@ -537,7 +550,7 @@ func (cl *CDNListener) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 func (cl *CDNListener) Accept() (net.Conn, error) {
 	conn, ok := <-cl.connChan
 	if !ok {
-		return nil, fmt.Errorf("listener closed")
+		return nil, net.ErrClosed
 	}
 	return conn, nil
 }
@@ -554,6 +567,9 @@ func (cl *CDNListener) Close() error {
 	cl.closed = true
 	close(cl.connChan)
 
+	if cl.server != nil {
+		return cl.server.Close()
+	}
 	if cl.listener != nil {
 		return cl.listener.Close()
 	}
@@ -0,0 +1,176 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDatagramSize bounds a single UDP packet
+	maxDatagramSize = 65535
+
+	// Handshake retransmission: the timeout doubles on every retry, up to
+	// maxHandshakeRTO, and the handshake gives up after handshakeRetries
+	handshakeRTO     = 500 * time.Millisecond
+	maxHandshakeRTO  = 4 * time.Second
+	handshakeRetries = 6
+)
+
+// IsDatagram reports whether conn preserves packet boundaries. Frames sent
+// over such a connection are self-contained: one frame per packet.
+func IsDatagram(conn net.Conn) bool {
+	dc, ok := conn.(interface{ Datagram() bool })
+	return ok && dc.Datagram()
+}
+
+// udpConn marks a dialled UDP socket as a datagram connection
+type udpConn struct {
+	*net.UDPConn
+}
+
+func (c *udpConn) Datagram() bool { return true }
+
+// HandshakeConn makes the handshake survive packet loss on a datagram
+// connection. Every message written since the last successful read forms the
+// current flight; it is retransmitted when no answer arrives within the
+// retransmission timeout, or when the peer repeats a packet it already sent
+// (meaning our flight was lost).
+type HandshakeConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	flight   [][]byte
+	answered bool
+	seen     map[[sha256.Size]byte]struct{}
+	deadline time.Time
+}
+
+// NewHandshakeConn wraps a datagram connection for the handshake
+func NewHandshakeConn(conn net.Conn) *HandshakeConn {
+	return &HandshakeConn{
+		Conn: conn,
+		seen: make(map[[sha256.Size]byte]struct{}),
+	}
+}
+
+// Datagram keeps handshake records packet-framed
+func (c *HandshakeConn) Datagram() bool { return true }
+
+func (c *HandshakeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.answered {
+		c.flight = nil
+		c.answered = false
+	}
+	c.flight = append(c.flight, append([]byte(nil), p...))
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *HandshakeConn) Read(p []byte) (int, error) {
+	buf := make([]byte, maxDatagramSize)
+	rto := handshakeRTO
+	retries := 0
+	for {
+		c.mu.Lock()
+		waiting := len(c.flight) > 0 && !c.answered
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		readDeadline := deadline
+		if waiting {
+			retry := time.Now().Add(rto)
+			if deadline.IsZero() || retry.Before(deadline) {
+				readDeadline = retry
+			}
+		}
+		if err := c.Conn.SetReadDeadline(readDeadline); err != nil {
+			return 0, err
+		}
+
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			if !waiting || !isTimeout(err) || (!deadline.IsZero() && !time.Now().Before(deadline)) {
+				return 0, err
+			}
+			if retries >= handshakeRetries {
+				return 0, fmt.Errorf("no handshake response after %d retransmits: %w", retries, os.ErrDeadlineExceeded)
+			}
+			retries++
+			if rto *= 2; rto > maxHandshakeRTO {
+				rto = maxHandshakeRTO
+			}
+			if err := c.resend(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		packet := buf[:n]
+		if c.Replay(packet) {
+			continue
+		}
+		if err := c.Conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.seen[sha256.Sum256(packet)] = struct{}{}
+		c.answered = true
+		c.mu.Unlock()
+		return copy(p, packet), nil
+	}
+}
+
+// Replay reports whether packet repeats a handshake message already received.
+// If our last flight is still unanswered, it is sent again, since the peer
+// only repeats itself when it did not get that flight.
+func (c *HandshakeConn) Replay(packet []byte) bool {
+	c.mu.Lock()
+	_, dup := c.seen[sha256.Sum256(packet)]
+	c.mu.Unlock()
+	if !dup {
+		return false
+	}
+	_ = c.resend()
+	return true
+}
+
+func (c *HandshakeConn) resend() error {
+	c.mu.Lock()
+	var flight [][]byte
+	if !c.answered {
+		flight = c.flight
+	}
+	c.mu.Unlock()
+
+	for _, packet := range flight {
+		if _, err := c.Conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *HandshakeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *HandshakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -33,6 +34,9 @@ type FallbackConfig struct {
 	BufferSize    int           // 缓冲区大小
 	UseHTTPServer bool          // 是否启用HTTP服务器伪装
 	StaticDir     string        // 静态文件目录
+
+	// Detect 判断连接开头是否为隧道流量，为空时使用内置启发式检测
+	Detect func(header []byte) bool
 }
 
 // DefaultFallbackConfig 默认回落配置
@@ -54,11 +58,13 @@ type FallbackListener struct {
 	listener     net.Listener
 	httpServer   *http.Server
 	validConns   chan net.Conn
+	done         chan struct{}
 	mu           sync.Mutex
 	closed       bool
 	statsLock    sync.RWMutex
 	validCount   uint64
 	fallbackCount uint64
+	divertCount  uint64
 }
 
 // NewFallbackListener 创建回落监听器
@@ -73,6 +79,7 @@ func NewFallbackListener(config FallbackConfig, addr string) (*FallbackListener,
 		config:     config,
 		listener:   listener,
 		validConns: make(chan net.Conn, 16),
+		done:       make(chan struct{}),
 	}
 
 	// 如果启用了HTTP服务器，设置HTTP处理器
@@ -126,9 +133,6 @@ func (fl *FallbackListener) acceptRoutine() {
 	for {
 		conn, err := fl.listener.Accept()
 		if err != nil {
-			if !fl.closed {
-				// 记录错误
-			}
 			return
 		}
 
@@ -156,9 +160,8 @@ func (fl *FallbackListener) handleConnection(conn net.Conn) {
 		fl.statsLock.Unlock()
 
 		select {
-		case fl.validConns <- bufferedConn:
-		default:
-			// 通道满了，关闭连接
+		case fl.validConns <- &probeConn{bufferedConn: bufferedConn}:
+		case <-fl.done:
 			conn.Close()
 		}
 	} else {
@@ -178,13 +181,22 @@ func (fl *FallbackListener) detectValidTraffic(conn *bufferedConn) (bool, error)
 
 	// 读取前几个字节用于检测
 	header, err := conn.Peek(32)
-	if err != nil && err != io.EOF {
-		return false, err
-	}
 
 	// 重置超时
 	conn.SetReadDeadline(time.Time{})
 
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		// 数据不足：按已读到的数据判断，客户端沉默时交给回落处理，像真实
+		// 网站一样等待请求。bufio 会保留超时错误，因此用已读到的数据重建读取器
+		head := append([]byte(nil), header...)
+		conn.reader = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(head), conn.Conn), fl.config.BufferSize)
+		return len(head) > 0 && fl.isValidProtocol(head), nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
 	if len(header) == 0 {
 		return false, fmt.Errorf("no data")
 	}
@@ -195,6 +207,10 @@ func (fl *FallbackListener) detectValidTraffic(conn *bufferedConn) (bool, error)
 
 // isValidProtocol 检测是否为有效协议
 func (fl *FallbackListener) isValidProtocol(data []byte) bool {
+	if fl.config.Detect != nil {
+		return fl.config.Detect(data)
+	}
+
 	if len(data) < 4 {
 		return false
 	}
@@ -360,11 +376,12 @@ func (fl *FallbackListener) sendErrorResponse(conn net.Conn) {
 
 // Accept 接受有效连接
 func (fl *FallbackListener) Accept() (net.Conn, error) {
-	conn, ok := <-fl.validConns
-	if !ok {
-		return nil, fmt.Errorf("listener closed")
+	select {
+	case conn := <-fl.validConns:
+		return conn, nil
+	case <-fl.done:
+		return nil, net.ErrClosed
 	}
-	return conn, nil
 }
 
 // Close 关闭监听器
@@ -377,7 +394,7 @@ func (fl *FallbackListener) Close() error {
 	}
 
 	fl.closed = true
-	close(fl.validConns)
+	close(fl.done)
 
 	return fl.listener.Close()
 }
@@ -395,6 +412,7 @@ func (fl *FallbackListener) GetStats() FallbackStats {
 	return FallbackStats{
 		ValidConnections:    fl.validCount,
 		FallbackConnections: fl.fallbackCount,
+		DivertedConnections: fl.divertCount,
 	}
 }
 
@@ -402,6 +420,78 @@ func (fl *FallbackListener) GetStats() FallbackStats {
 type FallbackStats struct {
 	ValidConnections    uint64
 	FallbackConnections uint64
+	DivertedConnections uint64 // 握手失败后转交回落的连接
+}
+
+// maxProbeRecord 限制等待服务器首次应答期间记录的数据量
+const maxProbeRecord = 64 * 1024
+
+// probeConn 记录隧道在首次写入之前读取的数据。握手在服务器应答之前失败时，
+// 连接仍可以原样转交给回落站点，探测者看不到任何差别。
+type probeConn struct {
+	*bufferedConn
+	mu       sync.Mutex
+	record   []byte
+	answered bool
+}
+
+// Read 读取数据，应答之前同时记录
+func (pc *probeConn) Read(b []byte) (int, error) {
+	n, err := pc.bufferedConn.Read(b)
+	if n > 0 {
+		pc.mu.Lock()
+		if !pc.answered {
+			if len(pc.record)+n > maxProbeRecord {
+				pc.answered = true
+				pc.record = nil
+			} else {
+				pc.record = append(pc.record, b[:n]...)
+			}
+		}
+		pc.mu.Unlock()
+	}
+	return n, err
+}
+
+// Write 写入数据，此后连接不能再转交回落
+func (pc *probeConn) Write(b []byte) (int, error) {
+	pc.mu.Lock()
+	pc.answered = true
+	pc.record = nil
+	pc.mu.Unlock()
+	return pc.bufferedConn.Write(b)
+}
+
+// Divert 把握手失败的连接转交给回落站点，先重放隧道已读取的数据。
+// 服务器已经应答过的连接无法转交，返回 false。转交成功时阻塞到回落结束，
+// 并关闭连接。
+func (fl *FallbackListener) Divert(conn net.Conn) bool {
+	pc, ok := conn.(*probeConn)
+	if !ok {
+		return false
+	}
+	pc.mu.Lock()
+	if pc.answered {
+		pc.mu.Unlock()
+		return false
+	}
+	pc.answered = true
+	consumed := pc.record
+	pc.record = nil
+	pc.mu.Unlock()
+
+	fl.statsLock.Lock()
+	fl.divertCount++
+	fl.statsLock.Unlock()
+
+	// 握手可能设置过超时
+	pc.SetDeadline(time.Time{})
+	replay := &bufferedConn{
+		Conn:   pc.bufferedConn.Conn,
+		reader: bufio.NewReaderSize(io.MultiReader(bytes.NewReader(consumed), pc.bufferedConn.reader), fl.config.BufferSize),
+	}
+	fl.handleFallback(replay)
+	return true
 }
 
 // bufferedConn 带缓冲的连接
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,17 +16,59 @@ import (
 // StreamID identifies a multiplexed stream
 type StreamID uint32
 
+// Priority orders the frames of streams waiting to be written: frames of a
+// more urgent stream go first, streams of equal priority take turns.
+type Priority uint8
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	// priorityControl is used for frames other than stream data
+	priorityControl
+)
+
 // Stream represents a multiplexed connection stream
 type Stream struct {
 	id        StreamID
 	mux       *Multiplexer
-	readBuf   chan []byte
-	writeCh   chan []byte
 	closed    uint32
 	closeCh   chan struct{}
+	readable  chan struct{} // signalled when data or a half-close arrives
+	priority  uint32
 	readDeadline  time.Time
 	writeDeadline time.Time
 	mu        sync.RWMutex
+
+	// Receive side, guarded by mu
+	recvBuf     []byte
+	recvWindow  int // bytes the peer may still send
+	consumed    int // bytes read since the last window update
+	readClosed  bool
+
+	// Send side, guarded by mux.flowMu
+	sendWindow  int
+	writeClosed bool
+}
+
+// StreamStats describes the buffers and windows of a stream
+type StreamStats struct {
+	ID          StreamID `json:"id"`
+	Priority    Priority `json:"priority"`
+	Buffered    int      `json:"buffered"`   // received, not yet read
+	RecvWindow  int      `json:"recvWindow"` // the peer may still send
+	SendWindow  int      `json:"sendWindow"` // this end may still send
+	ReadClosed  bool     `json:"readClosed,omitempty"`
+	WriteClosed bool     `json:"writeClosed,omitempty"`
+}
+
+// MuxStats describes the connection windows and every open stream
+type MuxStats struct {
+	SendWindow int           `json:"sendWindow"`
+	RecvWindow int           `json:"recvWindow"`
+	Buffered   int           `json:"buffered"`
+	Streams    []StreamStats `json:"streams"`
 }
 
 // Multiplexer multiplexes multiple streams over a single connection
@@ -39,15 +83,27 @@ type Multiplexer struct {
 	acceptCh      chan *Stream
 	maxStreams    int
 	streamTimeout time.Duration
+	writer        writeScheduler
+
+	// Connection-level flow control. flowCond wakes writers waiting for
+	// send credit; it is broadcast on window updates and on close.
+	flowMu       sync.Mutex
+	flowCond     *sync.Cond
+	sendWindow   int
+	recvWindow   int
+	recvConsumed int
 }
 
 const (
 	// Frame types
-	frameTypeData  = 0x01
-	frameTypeOpen  = 0x02
-	frameTypeClose = 0x03
-	frameTypePing  = 0x04
-	frameTypePong  = 0x05
+	frameTypeData         = 0x01
+	frameTypeOpen         = 0x02
+	frameTypeClose        = 0x03
+	frameTypePing         = 0x04
+	frameTypePong         = 0x05
+	frameTypeWindowUpdate = 0x06 // payload: 4-byte credit, stream 0 for the connection
+	frameTypeCloseWrite   = 0x07 // the sender writes no more on the stream
+	frameTypePriority     = 0x08 // payload: 1-byte Priority
 
 	// Frame header size: type(1) + id(4) + length(4) = 9 bytes
 	muxFrameHeaderSize = 9
@@ -55,11 +111,22 @@ const (
 	// Max frame payload size
 	maxFrameSize = 65535
 
+	// dataChunkSize is the most a data frame carries, so that a busy
+	// stream gives way to more urgent ones often
+	dataChunkSize = 16 * 1024
+
+	// Receive windows: how much a peer may send before it is granted more.
+	// Credit is returned once half a window has been read.
+	streamWindowSize     = 256 * 1024
+	connectionWindowSize = 1024 * 1024
+
 	// Default settings
 	defaultMaxStreams    = 256
 	defaultStreamTimeout = 60 * time.Second
 )
 
+var errStreamClosed = errors.New("stream closed")
+
 // NewMultiplexer creates a new multiplexer
 func NewMultiplexer(conn net.Conn, isClient bool) *Multiplexer {
 	mux := &Multiplexer{
@@ -71,7 +138,10 @@ func NewMultiplexer(conn net.Conn, isClient bool) *Multiplexer {
 		acceptCh:      make(chan *Stream, 32),
 		maxStreams:    defaultMaxStreams,
 		streamTimeout: defaultStreamTimeout,
+		sendWindow:    connectionWindowSize,
+		recvWindow:    connectionWindowSize,
 	}
+	mux.flowCond = sync.NewCond(&mux.flowMu)
 
 	// Client uses odd stream IDs, server uses even
 	if !isClient {
@@ -91,33 +161,24 @@ func (m *Multiplexer) OpenStream() (*Stream, error) {
 	}
 
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	if len(m.streams) >= m.maxStreams {
+		m.mu.Unlock()
 		return nil, errors.New("max streams reached")
 	}
 
 	id := StreamID(m.nextStreamID)
 	m.nextStreamID += 2 // Increment by 2 to maintain odd/even pattern
 
-	stream := &Stream{
-		id:      id,
-		mux:     m,
-		readBuf: make(chan []byte, 32),
-		writeCh: make(chan []byte, 32),
-		closeCh: make(chan struct{}),
-	}
-
+	stream := newStream(id, m)
 	m.streams[id] = stream
+	m.mu.Unlock()
 
 	// Send OPEN frame
-	if err := m.writeFrame(frameTypeOpen, id, nil); err != nil {
-		delete(m.streams, id)
+	if err := m.writeFrame(priorityControl, frameTypeOpen, id, nil); err != nil {
+		m.removeStream(stream)
 		return nil, err
 	}
 
-	go m.streamWriter(stream)
-
 	return stream, nil
 }
 
@@ -140,17 +201,22 @@ func (m *Multiplexer) Close() error {
 	close(m.closeCh)
 
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	// Close all streams
 	for _, stream := range m.streams {
 		stream.close()
 	}
+	m.mu.Unlock()
+
+	m.flowMu.Lock()
+	m.flowCond.Broadcast()
+	m.flowMu.Unlock()
 
 	return m.conn.Close()
 }
 
-// readLoop reads frames from the connection
+// readLoop reads frames from the connection. It never waits for a stream's
+// reader, and frames it answers are written by other goroutines, so a slow
+// stream or a full connection cannot stall the other streams.
 func (m *Multiplexer) readLoop() {
 	for {
 		if atomic.LoadUint32(&m.closed) == 1 {
@@ -168,7 +234,10 @@ func (m *Multiplexer) readLoop() {
 
 		switch frameType {
 		case frameTypeData:
-			m.handleDataFrame(streamID, payload)
+			if err := m.handleDataFrame(streamID, payload); err != nil {
+				m.Close()
+				return
+			}
 
 		case frameTypeOpen:
 			m.handleOpenFrame(streamID)
@@ -176,8 +245,26 @@ func (m *Multiplexer) readLoop() {
 		case frameTypeClose:
 			m.handleCloseFrame(streamID)
 
+		case frameTypeCloseWrite:
+			if stream := m.stream(streamID); stream != nil {
+				stream.mu.Lock()
+				stream.readClosed = true
+				stream.mu.Unlock()
+				stream.signal()
+			}
+
+		case frameTypeWindowUpdate:
+			if len(payload) == 4 {
+				m.handleWindowUpdate(streamID, int(getUint32(payload)))
+			}
+
+		case frameTypePriority:
+			if stream := m.stream(streamID); stream != nil && len(payload) == 1 && Priority(payload[0]) < priorityControl {
+				atomic.StoreUint32(&stream.priority, uint32(payload[0]))
+			}
+
 		case frameTypePing:
-			m.writeFrame(frameTypePong, streamID, payload)
+			go m.writeFrame(priorityControl, frameTypePong, streamID, payload)
 
 		case frameTypePong:
 			// Handle pong
@@ -185,60 +272,173 @@ func (m *Multiplexer) readLoop() {
 	}
 }
 
-// streamWriter writes data for a stream
-func (m *Multiplexer) streamWriter(stream *Stream) {
-	for {
-		select {
-		case data := <-stream.writeCh:
-			if err := m.writeFrame(frameTypeData, stream.id, data); err != nil {
-				stream.close()
-				return
-			}
-		case <-stream.closeCh:
-			return
-		case <-m.closeCh:
-			return
-		}
-	}
+// NumStreams returns the number of open streams
+func (m *Multiplexer) NumStreams() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.streams)
 }
 
-// handleDataFrame handles a data frame
-func (m *Multiplexer) handleDataFrame(id StreamID, payload []byte) {
+// Stats returns the connection windows and the buffers of every stream,
+// ordered by stream ID.
+func (m *Multiplexer) Stats() MuxStats {
 	m.mu.RLock()
-	stream, exists := m.streams[id]
+	streams := make([]*Stream, 0, len(m.streams))
+	for _, stream := range m.streams {
+		streams = append(streams, stream)
+	}
 	m.mu.RUnlock()
 
-	if !exists {
-		return
+	stats := MuxStats{Streams: make([]StreamStats, 0, len(streams))}
+	for _, stream := range streams {
+		st := stream.Stats()
+		stats.Buffered += st.Buffered
+		stats.Streams = append(stats.Streams, st)
 	}
+	sort.Slice(stats.Streams, func(i, j int) bool { return stats.Streams[i].ID < stats.Streams[j].ID })
 
-	select {
-	case stream.readBuf <- payload:
-	case <-stream.closeCh:
-	case <-m.closeCh:
+	m.flowMu.Lock()
+	stats.SendWindow = m.sendWindow
+	stats.RecvWindow = m.recvWindow
+	m.flowMu.Unlock()
+	return stats
+}
+
+// Done is closed once the multiplexer is closed
+func (m *Multiplexer) Done() <-chan struct{} {
+	return m.closeCh
+}
+
+func newStream(id StreamID, m *Multiplexer) *Stream {
+	return &Stream{
+		id:         id,
+		mux:        m,
+		closeCh:    make(chan struct{}),
+		readable:   make(chan struct{}, 1),
+		priority:   uint32(PriorityNormal),
+		recvWindow: streamWindowSize,
+		sendWindow: streamWindowSize,
 	}
 }
 
-// handleOpenFrame handles an open frame
-func (m *Multiplexer) handleOpenFrame(id StreamID) {
+func (m *Multiplexer) stream(id StreamID) *Stream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.streams[id]
+}
+
+func (m *Multiplexer) removeStream(stream *Stream) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	if m.streams[stream.id] == stream {
+		delete(m.streams, stream.id)
+	}
+	m.mu.Unlock()
+}
 
-	if len(m.streams) >= m.maxStreams {
-		m.writeFrame(frameTypeClose, id, nil)
+// handleDataFrame buffers a data frame for its stream. A peer that sends
+// more than the connection window allows is in error; a stream that
+// overruns its own window is closed.
+func (m *Multiplexer) handleDataFrame(id StreamID, payload []byte) error {
+	m.flowMu.Lock()
+	if len(payload) > m.recvWindow {
+		m.flowMu.Unlock()
+		return fmt.Errorf("connection window exceeded by %d bytes", len(payload)-m.recvWindow)
+	}
+	m.recvWindow -= len(payload)
+	m.flowMu.Unlock()
+
+	stream := m.stream(id)
+	if stream == nil {
+		// Data in flight for a stream closed here; return its credit
+		m.consumed(len(payload), true)
+		return nil
+	}
+
+	stream.mu.Lock()
+	if len(payload) > stream.recvWindow || stream.readClosed || atomic.LoadUint32(&stream.closed) == 1 {
+		stream.mu.Unlock()
+		m.consumed(len(payload), true)
+		if atomic.LoadUint32(&stream.closed) == 0 {
+			go stream.Close()
+		}
+		return nil
+	}
+	stream.recvWindow -= len(payload)
+	stream.recvBuf = append(stream.recvBuf, payload...)
+	stream.mu.Unlock()
+	stream.signal()
+	return nil
+}
+
+// handleWindowUpdate returns send credit for a stream, or for the
+// connection when id is 0.
+func (m *Multiplexer) handleWindowUpdate(id StreamID, credit int) {
+	var stream *Stream
+	if id != 0 {
+		if stream = m.stream(id); stream == nil {
+			return
+		}
+	}
+	m.flowMu.Lock()
+	if stream != nil {
+		stream.sendWindow += credit
+	} else {
+		m.sendWindow += credit
+	}
+	m.flowCond.Broadcast()
+	m.flowMu.Unlock()
+}
+
+// consumed returns connection credit for n bytes that left the receive
+// buffers. The update is sent once half the window is owed; async is set
+// when called from readLoop, which must not block on writing.
+func (m *Multiplexer) consumed(n int, async bool) {
+	if n == 0 {
 		return
 	}
+	m.flowMu.Lock()
+	m.recvConsumed += n
+	update := 0
+	if m.recvConsumed >= connectionWindowSize/2 {
+		update = m.recvConsumed
+		m.recvConsumed = 0
+		m.recvWindow += update
+	}
+	m.flowMu.Unlock()
+	if update > 0 {
+		if async {
+			go m.writeWindowUpdate(0, update)
+		} else {
+			m.writeWindowUpdate(0, update)
+		}
+	}
+}
+
+func (m *Multiplexer) writeWindowUpdate(id StreamID, credit int) error {
+	payload := make([]byte, 4)
+	putUint32(payload, uint32(credit))
+	return m.writeFrame(priorityControl, frameTypeWindowUpdate, id, payload)
+}
 
-	stream := &Stream{
-		id:      id,
-		mux:     m,
-		readBuf: make(chan []byte, 32),
-		writeCh: make(chan []byte, 32),
-		closeCh: make(chan struct{}),
+// handleOpenFrame handles an open frame. An ID the peer may not open, or
+// one already in use, is refused with a close frame and the stream that
+// holds it is left alone.
+func (m *Multiplexer) handleOpenFrame(id StreamID) {
+	// The peer opens even IDs on a client and odd ones on a server
+	if id == 0 || (id%2 == 1) == m.isClient {
+		go m.writeFrame(priorityControl, frameTypeClose, id, nil)
+		return
+	}
+	m.mu.Lock()
+	if _, inUse := m.streams[id]; inUse || len(m.streams) >= m.maxStreams {
+		m.mu.Unlock()
+		go m.writeFrame(priorityControl, frameTypeClose, id, nil)
+		return
 	}
 
+	stream := newStream(id, m)
 	m.streams[id] = stream
-	go m.streamWriter(stream)
+	m.mu.Unlock()
 
 	select {
 	case m.acceptCh <- stream:
@@ -246,45 +446,36 @@ func (m *Multiplexer) handleOpenFrame(id StreamID) {
 		stream.close()
 	default:
 		// Channel full, reject stream
+		m.removeStream(stream)
 		stream.close()
+		go m.writeFrame(priorityControl, frameTypeClose, id, nil)
 	}
 }
 
 // handleCloseFrame handles a close frame
 func (m *Multiplexer) handleCloseFrame(id StreamID) {
-	m.mu.Lock()
-	stream, exists := m.streams[id]
-	if exists {
-		delete(m.streams, id)
-	}
-	m.mu.Unlock()
-
-	if exists {
-		stream.close()
+	stream := m.stream(id)
+	if stream == nil {
+		return
 	}
+	m.removeStream(stream)
+	stream.close()
 }
 
-// writeFrame writes a frame to the connection
-func (m *Multiplexer) writeFrame(frameType byte, id StreamID, payload []byte) error {
-	header := make([]byte, muxFrameHeaderSize)
-	header[0] = frameType
-	putUint32(header[1:], uint32(id))
-	putUint32(header[5:], uint32(len(payload)))
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if _, err := m.conn.Write(header); err != nil {
-		return err
-	}
+// writeFrame writes a frame to the connection in a single write, once the
+// scheduler gives the connection to frames of this priority.
+func (m *Multiplexer) writeFrame(prio Priority, frameType byte, id StreamID, payload []byte) error {
+	frame := make([]byte, muxFrameHeaderSize+len(payload))
+	frame[0] = frameType
+	putUint32(frame[1:], uint32(id))
+	putUint32(frame[5:], uint32(len(payload)))
+	copy(frame[muxFrameHeaderSize:], payload)
 
-	if len(payload) > 0 {
-		if _, err := m.conn.Write(payload); err != nil {
-			return err
-		}
-	}
+	m.writer.acquire(prio)
+	defer m.writer.release()
 
-	return nil
+	_, err := m.conn.Write(frame)
+	return err
 }
 
 // readFrame reads a frame from the connection
@@ -320,7 +511,7 @@ func (m *Multiplexer) pingLoop() {
 	for {
 		select {
 		case <-ticker.C:
-			if err := m.writeFrame(frameTypePing, 0, nil); err != nil {
+			if err := m.writeFrame(priorityControl, frameTypePing, 0, nil); err != nil {
 				m.Close()
 				return
 			}
@@ -330,62 +521,262 @@ func (m *Multiplexer) pingLoop() {
 	}
 }
 
+// writeScheduler hands the connection to one frame writer at a time: the
+// most urgent waiting writer first, in arrival order within a priority.
+type writeScheduler struct {
+	mu      sync.Mutex
+	busy    bool
+	waiting [priorityControl + 1][]chan struct{}
+}
+
+func (w *writeScheduler) acquire(prio Priority) {
+	w.mu.Lock()
+	if !w.busy {
+		w.busy = true
+		w.mu.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	w.waiting[prio] = append(w.waiting[prio], turn)
+	w.mu.Unlock()
+	<-turn
+}
+
+func (w *writeScheduler) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for prio := len(w.waiting) - 1; prio >= 0; prio-- {
+		if queue := w.waiting[prio]; len(queue) > 0 {
+			w.waiting[prio] = queue[1:]
+			close(queue[0]) // the connection passes on still busy
+			return
+		}
+	}
+	w.busy = false
+}
+
 // Stream methods
 
-// Read reads data from the stream
+// ID returns the stream ID
+func (s *Stream) ID() StreamID {
+	return s.id
+}
+
+// SetPriority sets the priority of the stream's frames at both ends
+func (s *Stream) SetPriority(prio Priority) error {
+	if prio >= priorityControl {
+		return fmt.Errorf("invalid priority %d", prio)
+	}
+	atomic.StoreUint32(&s.priority, uint32(prio))
+	return s.mux.writeFrame(priorityControl, frameTypePriority, s.id, []byte{byte(prio)})
+}
+
+// Stats returns the stream's buffer occupancy and windows
+func (s *Stream) Stats() StreamStats {
+	s.mu.RLock()
+	stats := StreamStats{
+		ID:         s.id,
+		Priority:   Priority(atomic.LoadUint32(&s.priority)),
+		Buffered:   len(s.recvBuf),
+		RecvWindow: s.recvWindow,
+		ReadClosed: s.readClosed,
+	}
+	s.mu.RUnlock()
+	s.mux.flowMu.Lock()
+	stats.SendWindow = s.sendWindow
+	stats.WriteClosed = s.writeClosed
+	s.mux.flowMu.Unlock()
+	return stats
+}
+
+// Read reads data from the stream. Data that arrived before the stream
+// was closed is still returned before io.EOF. Reading returns credit to
+// the peer, so a stream that is not read stops receiving.
 func (s *Stream) Read(p []byte) (int, error) {
-	if atomic.LoadUint32(&s.closed) == 1 {
-		return 0, io.EOF
+	for {
+		s.mu.Lock()
+		if len(s.recvBuf) > 0 {
+			n := copy(p, s.recvBuf)
+			s.recvBuf = s.recvBuf[n:]
+			if len(s.recvBuf) == 0 {
+				s.recvBuf = nil
+			}
+			s.consumed += n
+			update := 0
+			if s.consumed >= streamWindowSize/2 && !s.readClosed {
+				update = s.consumed
+				s.consumed = 0
+				s.recvWindow += update
+			}
+			s.mu.Unlock()
+
+			if update > 0 && atomic.LoadUint32(&s.closed) == 0 {
+				s.mux.writeWindowUpdate(s.id, update)
+			}
+			s.mux.consumed(n, false)
+			return n, nil
+		}
+		if s.readClosed || atomic.LoadUint32(&s.closed) == 1 {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-s.readable:
+		case <-s.closeCh:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
 	}
+}
 
+// signal wakes a waiting Read
+func (s *Stream) signal() {
 	select {
-	case data := <-s.readBuf:
-		n := copy(p, data)
-		return n, nil
-	case <-s.closeCh:
-		return 0, io.EOF
+	case s.readable <- struct{}{}:
+	default:
 	}
 }
 
-// Write writes data to the stream
+// Write writes data to the stream. It blocks while the peer has granted no
+// credit for the stream or the connection, up to the write deadline.
 func (s *Stream) Write(p []byte) (int, error) {
-	if atomic.LoadUint32(&s.closed) == 1 {
-		return 0, errors.New("stream closed")
-	}
-
-	// Split large writes into frames
 	written := 0
 	for written < len(p) {
-		end := written + maxFrameSize
-		if end > len(p) {
-			end = len(p)
+		n, err := s.reserve(len(p) - written)
+		if err != nil {
+			return written, err
 		}
 
-		chunk := make([]byte, end-written)
-		copy(chunk, p[written:end])
-
-		select {
-		case s.writeCh <- chunk:
-			written += len(chunk)
-		case <-s.closeCh:
-			return written, errors.New("stream closed")
+		prio := Priority(atomic.LoadUint32(&s.priority))
+		if err := s.mux.writeFrame(prio, frameTypeData, s.id, p[written:written+n]); err != nil {
+			s.close()
+			return written, err
 		}
+		written += n
 	}
 
 	return written, nil
 }
 
-// Close closes the stream
+// reserve waits for send credit and takes up to want bytes of it. It gives
+// up with os.ErrDeadlineExceeded once the write deadline has passed.
+func (s *Stream) reserve(want int) (int, error) {
+	m := s.mux
+	m.flowMu.Lock()
+	defer m.flowMu.Unlock()
+
+	var timer *time.Timer
+	var armed time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		if atomic.LoadUint32(&s.closed) == 1 || s.writeClosed || atomic.LoadUint32(&m.closed) == 1 {
+			return 0, errStreamClosed
+		}
+		s.mu.RLock()
+		deadline := s.writeDeadline
+		s.mu.RUnlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if s.sendWindow > 0 && m.sendWindow > 0 {
+			n := min(want, s.sendWindow, m.sendWindow, dataChunkSize)
+			s.sendWindow -= n
+			m.sendWindow -= n
+			return n, nil
+		}
+
+		// Wake up to notice the deadline passing
+		if !deadline.Equal(armed) {
+			if timer != nil {
+				timer.Stop()
+				timer = nil
+			}
+			if !deadline.IsZero() {
+				timer = time.AfterFunc(time.Until(deadline), m.wakeWriters)
+			}
+			armed = deadline
+		}
+		m.flowCond.Wait()
+	}
+}
+
+// wakeWriters wakes writers waiting for credit so they recheck their
+// stream's state and deadline
+func (m *Multiplexer) wakeWriters() {
+	m.flowMu.Lock()
+	m.flowCond.Broadcast()
+	m.flowMu.Unlock()
+}
+
+// CloseWrite half-closes the stream: the peer reads io.EOF once it has read
+// everything written so far, and the stream can still be read.
+func (s *Stream) CloseWrite() error {
+	m := s.mux
+	m.flowMu.Lock()
+	if s.writeClosed || atomic.LoadUint32(&s.closed) == 1 {
+		m.flowMu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	m.flowCond.Broadcast()
+	m.flowMu.Unlock()
+
+	return m.writeFrame(priorityControl, frameTypeCloseWrite, s.id, nil)
+}
+
+// Close closes the stream. Unread data is dropped and its credit returned
+// to the connection.
 func (s *Stream) Close() error {
-	s.close()
-	s.mux.writeFrame(frameTypeClose, s.id, nil)
-	return nil
+	first := s.close()
+
+	s.mu.Lock()
+	unread := len(s.recvBuf)
+	s.recvBuf = nil
+	s.mu.Unlock()
+	if atomic.LoadUint32(&s.mux.closed) == 0 {
+		s.mux.consumed(unread, false)
+	}
+
+	if !first {
+		return nil
+	}
+	s.mux.removeStream(s)
+	return s.mux.writeFrame(priorityControl, frameTypeClose, s.id, nil)
 }
 
-func (s *Stream) close() {
-	if atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
-		close(s.closeCh)
+// close ends the stream without dropping what is left to read. It reports
+// whether the stream was open.
+func (s *Stream) close() bool {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return false
 	}
+	close(s.closeCh)
+
+	s.mux.flowMu.Lock()
+	s.mux.flowCond.Broadcast()
+	s.mux.flowMu.Unlock()
+	return true
 }
 
 // LocalAddr returns the local address
@@ -401,9 +792,10 @@ func (s *Stream) RemoteAddr() net.Addr {
 // SetDeadline sets read and write deadlines
 func (s *Stream) SetDeadline(t time.Time) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.readDeadline = t
 	s.writeDeadline = t
+	s.mu.Unlock()
+	s.mux.wakeWriters()
 	return nil
 }
 
@@ -415,11 +807,13 @@ func (s *Stream) SetReadDeadline(t time.Time) error {
 	return nil
 }
 
-// SetWriteDeadline sets the write deadline
+// SetWriteDeadline sets the write deadline. It also applies to a Write
+// already waiting for credit.
 func (s *Stream) SetWriteDeadline(t time.Time) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.writeDeadline = t
+	s.mu.Unlock()
+	s.mux.wakeWriters()
 	return nil
 }
 
@@ -444,3 +838,30 @@ func DialMux(ctx context.Context, network, address string) (*Multiplexer, error)
 	}
 	return NewMultiplexer(conn, true), nil
 }
+
+// Splice copies between a and b until both sides are done, then closes
+// both. A side that finishes sending is half-closed when the other end
+// supports it, so replies still get through; otherwise both are closed
+// right away.
+func Splice(a, b net.Conn) {
+	done := make(chan bool, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if hc, ok := dst.(interface{ CloseWrite() error }); ok {
+			done <- hc.CloseWrite() == nil
+			return
+		}
+		done <- false
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	if halfClosed := <-done; halfClosed {
+		<-done
+		a.Close()
+		b.Close()
+		return
+	}
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -267,163 +268,283 @@ type PortHoppingStats struct {
 	NextHopTime     time.Time
 }
 
+// recordFailure 记录跳跃失败
+func (phm *PortHoppingManager) recordFailure() {
+	phm.mu.Lock()
+	defer phm.mu.Unlock()
+	phm.failedHops++
+	phm.lastFailure = time.Now()
+}
+
 // PortHoppingListener 端口跳跃监听器
+//
+// 同时监听前一个、当前和下一个时间槽的端口，时钟相差不超过一个跳跃间隔的
+// 客户端都能连上。离开窗口的端口不再接受新会话，已建立的会话保持不变：
+// TCP 连接不依赖监听器，UDP 端口在最后一个会话关闭后才关闭。
 type PortHoppingListener struct {
-	manager  *PortHoppingManager
-	listener net.Listener
-	mu       sync.RWMutex
+	manager *PortHoppingManager
+	network string
+	host    string
+
+	mu       sync.Mutex
+	slot     int64
+	active   map[int]Listener // 窗口内的端口
+	draining []*udpListener   // 已退出窗口但仍有会话的UDP端口
 	closed   bool
+
+	conns chan net.Conn
+	done  chan struct{}
 }
 
-// NewPortHoppingListener 创建端口跳跃监听器
-func NewPortHoppingListener(manager *PortHoppingManager) (*PortHoppingListener, error) {
+// NewPortHoppingListener 创建端口跳跃监听器，network 为 tcp 或 udp
+func NewPortHoppingListener(manager *PortHoppingManager, network, host string) (*PortHoppingListener, error) {
 	phl := &PortHoppingListener{
 		manager: manager,
+		network: network,
+		host:    host,
+		active:  make(map[int]Listener),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
 	}
 
-	// 在当前端口上监听
-	currentPort := manager.GetCurrentPort()
-	addr := fmt.Sprintf(":%d", currentPort)
-
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
+	// 当前端口必须可用，相邻端口失败时只记录
+	slot := manager.getCurrentTimeSlot()
+	currentPort := manager.GetPortForTimeSlot(slot)
+	if err := phl.open(currentPort); err != nil {
 		return nil, fmt.Errorf("failed to listen on port %d: %w", currentPort, err)
 	}
+	phl.refresh(slot)
 
-	phl.listener = listener
-
-	// 设置端口变化回调
-	manager.SetPortChangeCallback(func(oldPort, newPort int) {
-		phl.handlePortChange(oldPort, newPort)
-	})
-
+	go phl.hopRoutine(slot)
 	return phl, nil
 }
 
-// Accept 接受连接
+// Accept 接受任一端口上的连接
 func (phl *PortHoppingListener) Accept() (net.Conn, error) {
-	phl.mu.RLock()
-	listener := phl.listener
-	phl.mu.RUnlock()
-
-	if listener == nil {
-		return nil, fmt.Errorf("listener is nil")
+	select {
+	case conn := <-phl.conns:
+		return conn, nil
+	case <-phl.done:
+		return nil, net.ErrClosed
 	}
-
-	return listener.Accept()
 }
 
-// Close 关闭监听器
+// Close 关闭所有端口
 func (phl *PortHoppingListener) Close() error {
 	phl.mu.Lock()
-	defer phl.mu.Unlock()
-
 	if phl.closed {
+		phl.mu.Unlock()
 		return nil
 	}
-
 	phl.closed = true
-
-	if phl.listener != nil {
-		return phl.listener.Close()
+	close(phl.done)
+	listeners := make([]Listener, 0, len(phl.active)+len(phl.draining))
+	for _, listener := range phl.active {
+		listeners = append(listeners, listener)
 	}
+	for _, listener := range phl.draining {
+		listeners = append(listeners, listener)
+	}
+	phl.active = make(map[int]Listener)
+	phl.draining = nil
+	phl.mu.Unlock()
 
+	for _, listener := range listeners {
+		listener.Close()
+	}
 	return nil
 }
 
-// Addr 获取监听地址
+// Addr 获取当前端口的监听地址
 func (phl *PortHoppingListener) Addr() net.Addr {
-	phl.mu.RLock()
-	defer phl.mu.RUnlock()
+	phl.mu.Lock()
+	defer phl.mu.Unlock()
 
-	if phl.listener != nil {
-		return phl.listener.Addr()
+	if listener, ok := phl.active[phl.manager.GetPortForTimeSlot(phl.slot)]; ok {
+		return listener.Addr()
+	}
+	for _, listener := range phl.active {
+		return listener.Addr()
 	}
-
 	return nil
 }
 
-// handlePortChange 处理端口变化
-func (phl *PortHoppingListener) handlePortChange(oldPort, newPort int) {
-	phl.mu.Lock()
-	defer phl.mu.Unlock()
+// hopRoutine 跟随时间槽移动监听窗口，并回收空闲的UDP端口
+func (phl *PortHoppingListener) hopRoutine(slot int64) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-phl.done:
+			return
+		case <-ticker.C:
+			if current := phl.manager.getCurrentTimeSlot(); current != slot {
+				slot = current
+				phl.refresh(slot)
+			} else {
+				phl.sweep()
+			}
+		}
+	}
+}
 
+// refresh 打开 slot-1..slot+1 的端口，退出窗口的端口停止接受新会话
+func (phl *PortHoppingListener) refresh(slot int64) {
+	wanted := make(map[int]bool, 3)
+	for s := slot - 1; s <= slot+1; s++ {
+		wanted[phl.manager.GetPortForTimeSlot(s)] = true
+	}
+
+	phl.mu.Lock()
 	if phl.closed {
+		phl.mu.Unlock()
 		return
 	}
+	phl.slot = slot
+	var retired []Listener
+	for port, listener := range phl.active {
+		if !wanted[port] {
+			delete(phl.active, port)
+			retired = append(retired, listener)
+		}
+	}
+	var missing []int
+	for port := range wanted {
+		if _, ok := phl.active[port]; !ok {
+			missing = append(missing, port)
+		}
+	}
+	phl.mu.Unlock()
 
-	// 关闭旧监听器
-	if phl.listener != nil {
-		phl.listener.Close()
+	for _, listener := range retired {
+		phl.retire(listener)
+	}
+	for _, port := range missing {
+		if err := phl.open(port); err != nil {
+			phl.manager.recordFailure()
+		}
 	}
+	phl.sweep()
+}
 
-	// 在新端口上创建监听器
-	addr := fmt.Sprintf(":%d", newPort)
-	listener, err := net.Listen("tcp", addr)
+// open 在端口上监听并把连接转交给 Accept
+func (phl *PortHoppingListener) open(port int) error {
+	listener, err := Listen(phl.network, net.JoinHostPort(phl.host, strconv.Itoa(port)))
 	if err != nil {
-		// 端口跳跃失败，记录错误
-		// 这里可以触发回退逻辑
+		return err
+	}
+
+	phl.mu.Lock()
+	if phl.closed {
+		phl.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	phl.active[port] = listener
+	phl.mu.Unlock()
+
+	go phl.serve(listener)
+	return nil
+}
+
+// retire 关闭TCP监听器；UDP端口共用一个套接字，留到会话结束
+func (phl *PortHoppingListener) retire(listener Listener) {
+	udp, ok := listener.(*udpListener)
+	if !ok {
+		listener.Close()
 		return
 	}
+	udp.drain()
+
+	phl.mu.Lock()
+	phl.draining = append(phl.draining, udp)
+	phl.mu.Unlock()
+}
 
-	phl.listener = listener
+// sweep 关闭已没有会话的UDP端口
+func (phl *PortHoppingListener) sweep() {
+	phl.mu.Lock()
+	var idle []*udpListener
+	kept := phl.draining[:0]
+	for _, listener := range phl.draining {
+		if listener.sessionCount() == 0 {
+			idle = append(idle, listener)
+		} else {
+			kept = append(kept, listener)
+		}
+	}
+	phl.draining = kept
+	phl.mu.Unlock()
+
+	for _, listener := range idle {
+		listener.Close()
+	}
+}
+
+func (phl *PortHoppingListener) serve(listener Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case phl.conns <- conn:
+		case <-phl.done:
+			conn.Close()
+			return
+		}
+	}
 }
 
 // PortHoppingDialer 端口跳跃拨号器
 type PortHoppingDialer struct {
 	manager *PortHoppingManager
+	network string
 	host    string
 }
 
-// NewPortHoppingDialer 创建端口跳跃拨号器
-func NewPortHoppingDialer(manager *PortHoppingManager, host string) *PortHoppingDialer {
+// NewPortHoppingDialer 创建端口跳跃拨号器，network 为 tcp 或 udp
+func NewPortHoppingDialer(manager *PortHoppingManager, network, host string) *PortHoppingDialer {
 	return &PortHoppingDialer{
 		manager: manager,
+		network: network,
 		host:    host,
 	}
 }
 
 // Dial 拨号连接
+//
+// TCP 依次尝试当前、前一个和下一个时间槽的端口。UDP 无法察觉对端是否在
+// 监听，只使用当前端口，时钟偏差由服务器的监听窗口吸收。
 func (phd *PortHoppingDialer) Dial() (net.Conn, error) {
-	// 获取当前端口
-	currentPort := phd.manager.GetCurrentPort()
-	addr := fmt.Sprintf("%s:%d", phd.host, currentPort)
-
-	// 尝试连接
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
-	if err != nil {
-		// 连接失败，尝试相邻时间槽
-		return phd.dialWithTolerance()
-	}
-
-	return conn, nil
-}
-
-// dialWithTolerance 使用时间容忍度拨号
-func (phd *PortHoppingDialer) dialWithTolerance() (net.Conn, error) {
 	currentSlot := phd.manager.getCurrentTimeSlot()
+	switch phd.network {
+	case "udp", "udp4", "udp6":
+		return Dial(phd.network, phd.addressForSlot(currentSlot))
+	}
 
-	// 尝试前一个时间槽
-	prevPort := phd.manager.GetPortForTimeSlot(currentSlot - 1)
-	addr := fmt.Sprintf("%s:%d", phd.host, prevPort)
-	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	conn, err := net.DialTimeout(phd.network, phd.addressForSlot(currentSlot), 5*time.Second)
 	if err == nil {
 		return conn, nil
 	}
 
-	// 尝试下一个时间槽
-	nextPort := phd.manager.GetPortForTimeSlot(currentSlot + 1)
-	addr = fmt.Sprintf("%s:%d", phd.host, nextPort)
-	conn, err = net.DialTimeout("tcp", addr, 2*time.Second)
-	if err == nil {
-		return conn, nil
+	// 连接失败，尝试相邻时间槽
+	for _, slot := range []int64{currentSlot - 1, currentSlot + 1} {
+		conn, err = net.DialTimeout(phd.network, phd.addressForSlot(slot), 2*time.Second)
+		if err == nil {
+			return conn, nil
+		}
 	}
 
-	return nil, fmt.Errorf("failed to connect to any valid port")
+	return nil, fmt.Errorf("failed to connect to any valid port: %w", err)
 }
 
 // GetCurrentAddress 获取当前地址
 func (phd *PortHoppingDialer) GetCurrentAddress() string {
-	port := phd.manager.GetCurrentPort()
-	return fmt.Sprintf("%s:%d", phd.host, port)
+	return phd.addressForSlot(phd.manager.getCurrentTimeSlot())
+}
+
+func (phd *PortHoppingDialer) addressForSlot(slot int64) string {
+	return net.JoinHostPort(phd.host, strconv.Itoa(phd.manager.GetPortForTimeSlot(slot)))
 }
@@ -1,11 +1,23 @@
 package transport
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"net"
 	"sync"
 	"time"
+
+	"stp/crypto"
 )
 
+// pathChallengeInterval 同一新地址重发路径挑战的最小间隔
+const pathChallengeInterval = time.Second
+
+// connectionIDLookahead 监听器为每个会话索引的后续帧连接ID数量
+const connectionIDLookahead = 64
+
 // RoamingConfig 漫游配置
 type RoamingConfig struct {
 	Enabled         bool          // 是否启用漫游
@@ -148,6 +160,23 @@ func (rm *RoamingManager) switchToEndpoint(candidate *EndpointCandidate) bool {
 	return true
 }
 
+// ConfirmEndpoint 切换到已通过路径验证的端点
+func (rm *RoamingManager) ConfirmEndpoint(addr net.Addr) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if addrEqual(addr, rm.currentEndpoint) {
+		return
+	}
+	candidate, exists := rm.candidates[addr.String()]
+	if !exists {
+		now := time.Now()
+		candidate = &EndpointCandidate{Addr: addr, FirstSeen: now, LastSeen: now}
+	}
+	candidate.Authenticated = true
+	rm.switchToEndpoint(candidate)
+}
+
 // pruneOldestCandidate 删除最旧的候选端点
 func (rm *RoamingManager) pruneOldestCandidate() {
 	var oldest *EndpointCandidate
@@ -275,14 +304,21 @@ func (pv *PathValidator) CreateChallenge(addr net.Addr) *PathChallenge {
 	}
 
 	// 生成随机数据
-	for i := range challenge.Data {
-		challenge.Data[i] = byte(time.Now().UnixNano() & 0xFF)
-	}
+	rand.Read(challenge.Data[:])
 
 	pv.challenges[addr.String()] = challenge
 	return challenge
 }
 
+// Pending 检查地址是否有未过期的挑战
+func (pv *PathValidator) Pending(addr net.Addr, maxAge time.Duration) bool {
+	pv.mu.RLock()
+	defer pv.mu.RUnlock()
+
+	challenge, exists := pv.challenges[addr.String()]
+	return exists && !challenge.Validated && time.Since(challenge.SentAt) <= maxAge
+}
+
 // ValidateResponse 验证响应
 func (pv *PathValidator) ValidateResponse(addr net.Addr, data [8]byte) bool {
 	pv.mu.Lock()
@@ -320,3 +356,188 @@ func (pv *PathValidator) CleanupOld(maxAge time.Duration) {
 		}
 	}
 }
+
+// roamState 服务器端UDP会话的漫游状态
+type roamState struct {
+	manager *RoamingManager
+	paths   *PathValidator
+	idEpoch uint32 // 已索引连接ID所属的密钥纪元
+	idEnd   uint64 // 已索引连接ID之后的第一个计数器，零表示尚未索引
+}
+
+// SetRoamHandler 设置客户端地址变化回调，在路径验证通过、会话迁移后调用
+func (t *Transport) SetRoamHandler(handler func(old, new net.Addr)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onRoam = handler
+}
+
+// handlePath 处理路径挑战与应答，并让服务器端会话跟随换了地址的客户端。
+// 来自新地址的认证帧照常交付，但只有新地址回显挑战后才迁移会话，重放或
+// 伪造源地址的数据包无法劫持会话。返回 true 表示帧已被消费。
+func (t *Transport) handlePath(conn net.Conn, frame *Frame) bool {
+	if frame.Flags == FlagPathChallenge {
+		if err := t.writeFrame(conn, FlagPathResponse, frame.Payload); err != nil && t.logger != nil {
+			t.logger.Debug("path response failed", map[string]interface{}{"error": err.Error()})
+		}
+		return true
+	}
+
+	session, ok := conn.(*udpSession)
+	if !ok {
+		return frame.Flags == FlagPathResponse
+	}
+	state := t.roamingState(session)
+	t.expectConnectionIDs(session)
+	source := session.packetSource()
+	current := session.RemoteAddr()
+	if source == nil || addrEqual(source, current) {
+		return frame.Flags == FlagPathResponse
+	}
+
+	if frame.Flags == FlagPathResponse {
+		var data [8]byte
+		if len(frame.Payload) == len(data) {
+			copy(data[:], frame.Payload)
+			if state.paths.ValidateResponse(source, data) {
+				t.migrate(session, state, current, source)
+			}
+		}
+		return true
+	}
+
+	// 回复仍发往旧地址，直到新地址应答挑战
+	if !state.paths.Pending(source, pathChallengeInterval) {
+		challenge := state.paths.CreateChallenge(source)
+		probe := &pathConn{udpSession: session, addr: source}
+		if err := t.writeFrame(probe, FlagPathChallenge, challenge.Data[:]); err != nil && t.logger != nil {
+			t.logger.Debug("path challenge failed", map[string]interface{}{"error": err.Error()})
+		}
+	}
+	return false
+}
+
+// migrate 把会话迁移到已验证的新地址
+func (t *Transport) migrate(session *udpSession, state *roamState, old net.Addr, addr *net.UDPAddr) {
+	session.listener.migrate(session, addr)
+	state.manager.ConfirmEndpoint(addr)
+
+	t.mu.RLock()
+	handler := t.onRoam
+	t.mu.RUnlock()
+	if handler != nil {
+		handler(old, addr)
+	}
+}
+
+// roamingState 首次收到会话帧时创建漫游状态
+func (t *Transport) roamingState(session *udpSession) *roamState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.roam == nil {
+		t.roam = &roamState{
+			manager: NewRoamingManager(DefaultRoamingConfig(), session.RemoteAddr()),
+			paths:   NewPathValidator(),
+		}
+	}
+	return t.roam
+}
+
+// expectConnectionIDs 让监听器按接下来若干帧的连接ID识别会话。连接ID逐帧
+// 变化，计数器字段也经过掩码，旁观者无法凭二者把客户端换地址前后的流量
+// 关联起来；索引在消耗过半或换密钥后才刷新
+func (t *Transport) expectConnectionIDs(session *udpSession) {
+	t.mu.Lock()
+	sess, state := t.session, t.roam
+	if sess == nil || state == nil || sess.recv.connectionKey == nil {
+		t.mu.Unlock()
+		return
+	}
+	recv := sess.recv
+	if state.idEnd != 0 && state.idEpoch == recv.epoch && recv.next+connectionIDLookahead/2 <= state.idEnd {
+		t.mu.Unlock()
+		return
+	}
+	ids := make([][connectionIDSize]byte, connectionIDLookahead)
+	for i := range ids {
+		copy(ids[i][:], frameConnectionID(recv.connectionKey, (recv.next+uint64(i))|recv.phase()))
+	}
+	state.idEpoch, state.idEnd = recv.epoch, recv.next+connectionIDLookahead
+	offset := recordHeaderSize + frameHeaderSize
+	if sess.obfuscator != nil {
+		offset = sess.obfuscator.DatagramNonceOffset()
+	}
+	t.mu.Unlock()
+
+	session.listener.expect(session, offset, ids, t.ownsPacket)
+}
+
+// ownsPacket 报告数据包是否携带本会话任一接收纪元的连接ID。只校验连接ID，
+// 不解密也不改动防重放窗口，认领后照常由 Receive 认证
+func (t *Transport) ownsPacket(packet []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session == nil || t.session.recv.connectionKey == nil {
+		return false
+	}
+	body, err := datagramBody(packet, t.session.obfuscator)
+	if err != nil {
+		return false
+	}
+	_, _, err = t.session.frameKeys(body)
+	return err == nil
+}
+
+// connectionIDKeys 从会话密钥派生本端发送与接收方向的连接ID密钥，
+// 一端的发送密钥即另一端的接收密钥
+func connectionIDKeys(secrets crypto.SessionSecrets) (send, recv []byte) {
+	return connectionIDKey(secrets.SendKey), connectionIDKey(secrets.ReceiveKey)
+}
+
+func connectionIDKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("stp connection id"))
+	return mac.Sum(nil)
+}
+
+// frameConnectionID 返回计数器字段为 counterField 的帧携带的连接ID
+func frameConnectionID(key []byte, counterField uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], counterField)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:])
+	return mac.Sum(nil)[:connectionIDSize]
+}
+
+// maskCounter 用连接密钥和连接ID派生的掩码隐藏计数器字段，否则旁观者可以
+// 沿递增的计数器把换地址前后的帧关联起来。掩码按位异或，同一调用也用于解除
+func maskCounter(key, connectionID []byte, field uint64) uint64 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("stp counter mask"))
+	mac.Write(connectionID)
+	return field ^ binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// pathConn 向尚未验证的地址发送
+type pathConn struct {
+	*udpSession
+	addr *net.UDPAddr
+}
+
+func (c *pathConn) Write(p []byte) (int, error) {
+	return c.conn.WriteToUDP(p, c.addr)
+}
+
+// packetSource 返回最近一次 Read 得到的数据包的来源地址
+func (s *udpSession) packetSource() *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.source
+}
+
+// isClosed 报告会话是否已关闭
+func (s *udpSession) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
@@ -21,6 +21,22 @@ import (
 const (
 	recordHeaderSize = 5
 	frameHeaderSize  = 1 + 1 + 8
+
+	// connectionIDSize is the length of the connection ID datagram frames
+	// carry after the counter, so a server can find the session of a packet
+	// that arrives from a new address. It is derived from the counter and
+	// differs in every frame, and it masks the counter field in front of it;
+	// obfuscated frames also use it as their nonce.
+	connectionIDSize = 8
+
+	// keyPhaseBit is the top bit of the counter field. It carries the low
+	// bit of the sender's key epoch so the receiver knows which keys to use
+	// while a rekey is in flight.
+	keyPhaseBit = uint64(1) << 63
+
+	// previousEpochGrace is how long the receive keys of the previous epoch
+	// stay valid after a rekey, for frames that were in flight.
+	previousEpochGrace = 30 * time.Second
 )
 
 type FrameFlag uint8
@@ -30,6 +46,10 @@ const (
 	FlagKeepAlive
 	FlagRekey
 	FlagBind
+	FlagResume        // server's answer to a resumption offer
+	FlagTicket        // session ticket for a later resumption
+	FlagPathChallenge // server probing a new client address
+	FlagPathResponse  // client echoing a path challenge
 )
 
 type Frame struct {
@@ -38,22 +58,84 @@ type Frame struct {
 }
 
 type Transport struct {
-	mu       sync.RWMutex
-	session  *sessionState
-	lastSend time.Time
-	lastRecv time.Time
-	logger   *logging.Logger
+	mu      sync.RWMutex
+	writeMu sync.Mutex // keeps whole frames contiguous on the wire
+	session *sessionState
+	obfs    crypto.ObfsConfig
+	window  uint64 // anti-replay window for the next session
+	// handshake answers retransmitted handshake packets on datagram
+	// connections until the peer's first frame shows it completed
+	handshake *HandshakeConn
+	lastSend  time.Time
+	lastRecv  time.Time
+	logger    *logging.Logger
+	// roaming state of a server-side UDP session and the callback run when
+	// its client moved to a validated new address
+	roam   *roamState
+	onRoam func(old, new net.Addr)
 }
 
 type sessionState struct {
-	sendCipher     *crypto.CipherState
-	recvCipher     *crypto.CipherState
+	suite          crypto.CipherSuite
+	sendCipher     *crypto.CipherSuiteState
 	obfuscationKey []byte
 	sendCounter    uint64
-	recvCounter    uint64
+	recv           *recvEpoch
+	previous       *recvEpoch             // kept for previousEpochGrace after a rekey
+	previousSend   *sendEpoch             // likewise, see SendRekeyPrevious
+	retired        crypto.AntiReplayStats // replay counters of discarded epochs
+	window         uint64
 	maxPadding     uint8
 	keepAlive      time.Duration
 	epoch          uint32
+	obfuscator     *crypto.Obfuscator
+	shaper         *crypto.TrafficShaper
+	connectionKey  []byte // keys sent connection IDs, datagram sessions only
+}
+
+// recvEpoch holds the receive keys and replay window of one key epoch.
+type recvEpoch struct {
+	epoch          uint32
+	cipher         *crypto.CipherSuiteState
+	obfuscationKey []byte
+	connectionKey  []byte // keys received connection IDs, datagram sessions only
+	next           uint64 // counter after the highest accepted one
+	replay         *crypto.AntiReplay
+	expires        time.Time
+}
+
+func newRecvEpoch(secrets crypto.SessionSecrets, cipher *crypto.CipherSuiteState, window uint64) *recvEpoch {
+	return &recvEpoch{
+		epoch:          secrets.Epoch,
+		cipher:         cipher,
+		obfuscationKey: append([]byte(nil), secrets.ObfuscationKey...),
+		// Timestamps are off: the window alone bounds what a replay can
+		// reach, and per-counter bookkeeping would grow with throughput.
+		replay: crypto.NewAntiReplay(crypto.AntiReplayConfig{
+			Mode:       crypto.AntiReplayWindow,
+			WindowSize: window,
+			MaxAge:     -1,
+		}),
+	}
+}
+
+// sendEpoch holds the send keys of the previous epoch, which a rekey
+// responder still needs when its response was lost.
+type sendEpoch struct {
+	epoch          uint32
+	cipher         *crypto.CipherSuiteState
+	obfuscationKey []byte
+	connectionKey  []byte
+	counter        uint64
+	expires        time.Time
+}
+
+// phase returns the key phase bit frames of this epoch carry
+func (e *recvEpoch) phase() uint64 {
+	if e.epoch&1 == 1 {
+		return keyPhaseBit
+	}
+	return 0
 }
 
 var ErrSessionUnset = errors.New("transport session not established")
@@ -62,12 +144,47 @@ func NewTransport(logger *logging.Logger) *Transport {
 	return &Transport{logger: logger}
 }
 
-func (t *Transport) InstallSession(secrets crypto.SessionSecrets, params crypto.TransportParameters) error {
-	sendCipher, err := crypto.NewCipherState(secrets.SendKey)
-	if err != nil {
-		return err
+// SetObfuscation selects how frames of the next installed session are
+// disguised on the wire. The obfuscator is keyed from the session secrets and
+// lives for the whole session, independent of rekeys.
+func (t *Transport) SetObfuscation(config crypto.ObfsConfig) {
+	t.mu.Lock()
+	t.obfs = config
+	t.mu.Unlock()
+}
+
+// ObfuscationMode returns the obfuscation mode of the current session.
+func (t *Transport) ObfuscationMode() crypto.ObfsMode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.session == nil || t.session.obfuscator == nil {
+		return crypto.ObfsModeNone
 	}
-	recvCipher, err := crypto.NewCipherState(secrets.ReceiveKey)
+	return t.obfs.Mode
+}
+
+// SetReplayWindow sets how far behind the newest received counter a frame may
+// arrive and still be accepted. It applies to the next installed session; zero
+// selects the crypto package default.
+func (t *Transport) SetReplayWindow(size uint64) {
+	t.mu.Lock()
+	t.window = size
+	t.mu.Unlock()
+}
+
+// SetHandshakeReplay keeps answering duplicate handshake packets on conn once
+// the session is installed, in case the peer lost our final message.
+func (t *Transport) SetHandshakeReplay(conn *HandshakeConn) {
+	t.mu.Lock()
+	t.handshake = conn
+	t.mu.Unlock()
+}
+
+// InstallSession installs freshly negotiated session keys. A zero suite
+// selects ChaCha20-Poly1305, the suite every peer supports.
+func (t *Transport) InstallSession(secrets crypto.SessionSecrets, params crypto.TransportParameters, suite crypto.CipherSuite) error {
+	suite = effectiveSuite(suite)
+	sendCipher, recvCipher, err := newSessionCiphers(secrets, suite)
 	if err != nil {
 		return err
 	}
@@ -83,10 +200,31 @@ func (t *Transport) InstallSession(secrets crypto.SessionSecrets, params crypto.
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	var obfuscator *crypto.Obfuscator
+	var shaper *crypto.TrafficShaper
+	if t.obfs.Mode != crypto.ObfsModeNone {
+		obfuscator, err = crypto.NewObfuscator(secrets, t.obfs)
+		if err != nil {
+			return err
+		}
+		shaper = crypto.NewTrafficShaper(obfuscator)
+	}
+
+	recv := newRecvEpoch(secrets, recvCipher, t.window)
+	var connectionKey []byte
+	if t.obfs.Datagram {
+		connectionKey, recv.connectionKey = connectionIDKeys(secrets)
+	}
+
 	t.session = &sessionState{
+		connectionKey:  connectionKey,
+		obfuscator:     obfuscator,
+		shaper:         shaper,
+		suite:          suite,
 		sendCipher:     sendCipher,
-		recvCipher:     recvCipher,
 		obfuscationKey: append([]byte(nil), secrets.ObfuscationKey...),
+		recv:           recv,
+		window:         t.window,
 		maxPadding:     maxPadding,
 		keepAlive:      keepalive,
 		epoch:          secrets.Epoch,
@@ -97,12 +235,12 @@ func (t *Transport) InstallSession(secrets crypto.SessionSecrets, params crypto.
 	return nil
 }
 
-func (t *Transport) UpdateSessionKeys(secrets crypto.SessionSecrets) error {
-	sendCipher, err := crypto.NewCipherState(secrets.SendKey)
-	if err != nil {
-		return err
-	}
-	recvCipher, err := crypto.NewCipherState(secrets.ReceiveKey)
+// UpdateSessionKeys switches to the keys of a new epoch. Frames are sent with
+// the new keys immediately; frames of the previous epoch are still accepted
+// for previousEpochGrace.
+func (t *Transport) UpdateSessionKeys(secrets crypto.SessionSecrets, suite crypto.CipherSuite) error {
+	suite = effectiveSuite(suite)
+	sendCipher, recvCipher, err := newSessionCiphers(secrets, suite)
 	if err != nil {
 		return err
 	}
@@ -112,15 +250,86 @@ func (t *Transport) UpdateSessionKeys(secrets crypto.SessionSecrets) error {
 	if t.session == nil {
 		return ErrSessionUnset
 	}
-	t.session.sendCipher = sendCipher
-	t.session.recvCipher = recvCipher
-	t.session.obfuscationKey = append([]byte(nil), secrets.ObfuscationKey...)
-	t.session.sendCounter = 0
-	t.session.recvCounter = 0
-	t.session.epoch = secrets.Epoch
+	sess := t.session
+	sess.retirePrevious()
+	sess.previous = sess.recv
+	sess.previous.expires = time.Now().Add(previousEpochGrace)
+	sess.recv = newRecvEpoch(secrets, recvCipher, sess.window)
+	sess.previousSend = &sendEpoch{
+		epoch:          sess.epoch,
+		cipher:         sess.sendCipher,
+		obfuscationKey: sess.obfuscationKey,
+		connectionKey:  sess.connectionKey,
+		counter:        sess.sendCounter,
+		expires:        sess.previous.expires,
+	}
+	if sess.connectionKey != nil {
+		sess.connectionKey, sess.recv.connectionKey = connectionIDKeys(secrets)
+	}
+
+	sess.suite = suite
+	sess.sendCipher = sendCipher
+	sess.obfuscationKey = append([]byte(nil), secrets.ObfuscationKey...)
+	sess.sendCounter = 0
+	sess.epoch = secrets.Epoch
 	return nil
 }
 
+// retirePrevious discards the previous epoch's keys, keeping its replay
+// counters for the session totals.
+func (s *sessionState) retirePrevious() {
+	if s.previous == nil {
+		return
+	}
+	stats := s.previous.replay.Stats()
+	s.retired.Accepted += stats.Accepted
+	s.retired.Rejected += stats.Rejected
+	s.previous = nil
+}
+
+// frameKeys selects the receive epoch of a frame body and returns it with the
+// frame's counter field. Datagram frames carry a masked counter field, so the
+// connection key of each live epoch is tried until one unmasks a counter that
+// the frame's connection ID was derived from.
+func (s *sessionState) frameKeys(body []byte) (*recvEpoch, uint64, error) {
+	field := binary.BigEndian.Uint64(body[2:10])
+	if s.recv.connectionKey == nil {
+		keys, err := s.recvKeys(field & keyPhaseBit)
+		return keys, field, err
+	}
+	if len(body) < frameHeaderSize+connectionIDSize {
+		return nil, 0, errors.New("frame too short")
+	}
+	connectionID := body[frameHeaderSize : frameHeaderSize+connectionIDSize]
+	if s.previous != nil && time.Now().After(s.previous.expires) {
+		s.retirePrevious()
+	}
+	for _, keys := range []*recvEpoch{s.recv, s.previous} {
+		if keys == nil {
+			continue
+		}
+		unmasked := maskCounter(keys.connectionKey, connectionID, field)
+		if unmasked&keyPhaseBit == keys.phase() && hmac.Equal(connectionID, frameConnectionID(keys.connectionKey, unmasked)) {
+			return keys, unmasked, nil
+		}
+	}
+	return nil, 0, errors.New("connection ID mismatch")
+}
+
+// recvKeys selects the receive epoch matching a frame's key phase
+func (s *sessionState) recvKeys(phase uint64) (*recvEpoch, error) {
+	if phase == s.recv.phase() {
+		return s.recv, nil
+	}
+	if s.previous != nil && time.Now().After(s.previous.expires) {
+		s.retirePrevious()
+	}
+	if s.previous == nil || phase != s.previous.phase() {
+		return nil, errors.New("frame from expired key epoch")
+	}
+	return s.previous, nil
+}
+
 func (t *Transport) SendPayload(conn net.Conn, payload []byte) error {
 	return t.writeFrame(conn, FlagData, payload)
 }
@@ -137,31 +346,79 @@ func (t *Transport) SendRekey(conn net.Conn, payload []byte) error {
 	return t.writeFrame(conn, FlagRekey, payload)
 }
 
+// SendRekeyPrevious sends a rekey frame with the keys of the epoch before
+// the last rekey. A responder uses it to repeat a lost response: the
+// initiator cannot read the new epoch until it has the response.
+func (t *Transport) SendRekeyPrevious(conn net.Conn, payload []byte) error {
+	return t.writeEpochFrame(conn, FlagRekey, payload, true)
+}
+
+func (t *Transport) SendResume(conn net.Conn, payload []byte) error {
+	return t.writeFrame(conn, FlagResume, payload)
+}
+
+func (t *Transport) SendTicket(conn net.Conn, payload []byte) error {
+	return t.writeFrame(conn, FlagTicket, payload)
+}
+
 func (t *Transport) writeFrame(conn net.Conn, flag FrameFlag, payload []byte) error {
+	return t.writeEpochFrame(conn, flag, payload, false)
+}
+
+// writeEpochFrame sends a frame with the keys of the current epoch, or of
+// the previous one while it is within its grace period.
+func (t *Transport) writeEpochFrame(conn net.Conn, flag FrameFlag, payload []byte, previous bool) error {
+	// The shaper's inter-arrival delay is waited out before taking writeMu
+	// so a sleeping writer does not hold up frames that are ready
+	if delay := t.shapingDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
 	t.mu.Lock()
 	if t.session == nil {
 		t.mu.Unlock()
 		return ErrSessionUnset
 	}
 	sess := t.session
+	cipher, obfuscationKey, connectionKey, counter, epoch := sess.sendCipher, sess.obfuscationKey, sess.connectionKey, &sess.sendCounter, sess.epoch
+	if previous {
+		prev := sess.previousSend
+		if prev == nil || time.Now().After(prev.expires) {
+			t.mu.Unlock()
+			return errors.New("previous key epoch expired")
+		}
+		cipher, obfuscationKey, connectionKey, counter, epoch = prev.cipher, prev.obfuscationKey, prev.connectionKey, &prev.counter, prev.epoch
+	}
+	counterField := *counter
+	if epoch&1 == 1 {
+		counterField |= keyPhaseBit
+	}
+	var connectionID []byte
+	if connectionKey != nil {
+		connectionID = frameConnectionID(connectionKey, counterField)
+	}
 
-	pad, padLen, err := derivePadding(sess.obfuscationKey, sess.sendCounter, sess.maxPadding)
+	pad, padLen, err := derivePadding(obfuscationKey, *counter, sess.maxPadding)
 	if err != nil {
 		t.mu.Unlock()
 		return err
 	}
 
-	aad := []byte{byte(flag), padLen}
+	aad := append([]byte{byte(flag), padLen}, connectionID...)
 	plaintext := buildPlaintext(payload)
-	ciphertext, err := sess.sendCipher.Seal(sess.sendCounter, aad, plaintext)
+	ciphertext, err := cipher.Seal(counterNonce(cipher, *counter), plaintext, aad)
 	if err != nil {
 		t.mu.Unlock()
 		return err
 	}
 
-	flagByte, padByte := maskHeader(sess.obfuscationKey, sess.sendCounter, byte(flag), padLen)
+	flagByte, padByte := maskHeader(obfuscationKey, *counter, byte(flag), padLen)
 
-	bodyLen := frameHeaderSize + len(ciphertext) + int(padLen)
+	headerLen := frameHeaderSize + len(connectionID)
+	bodyLen := headerLen + len(ciphertext) + int(padLen)
 	if bodyLen > 0xFFFF {
 		t.mu.Unlock()
 		return errors.New("frame exceeds maximum size")
@@ -169,66 +426,151 @@ func (t *Transport) writeFrame(conn net.Conn, flag FrameFlag, payload []byte) er
 	body := make([]byte, bodyLen)
 	body[0] = flagByte
 	body[1] = padByte
-	binary.BigEndian.PutUint64(body[2:10], sess.sendCounter)
-	copy(body[10:], ciphertext)
+	if connectionID != nil {
+		binary.BigEndian.PutUint64(body[2:10], maskCounter(connectionKey, connectionID, counterField))
+	} else {
+		binary.BigEndian.PutUint64(body[2:10], counterField)
+	}
+	copy(body[10:], connectionID)
+	copy(body[headerLen:], ciphertext)
 	if padLen > 0 {
-		copy(body[10+len(ciphertext):], pad)
+		copy(body[headerLen+len(ciphertext):], pad)
 	}
 
-	header := make([]byte, recordHeaderSize)
-	header[0] = 0x17
-	header[1] = 0x03
-	header[2] = 0x03
-	binary.BigEndian.PutUint16(header[3:], uint16(bodyLen))
-
-	sess.sendCounter++
+	*counter++
 	t.lastSend = time.Now()
 	t.mu.Unlock()
 
-	if err := writeAll(conn, header); err != nil {
-		return err
+	// Obfuscation happens under writeMu, so frames enter the obfuscation
+	// stream in wire order
+	if sess.obfuscator != nil {
+		var obfuscated []byte
+		if connectionID != nil {
+			obfuscated, err = sess.obfuscator.ObfuscateDatagram(body, connectionID)
+		} else {
+			obfuscated, err = sess.obfuscator.ObfuscateFrame(body)
+		}
+		if err != nil {
+			return err
+		}
+		return writeAll(conn, obfuscated)
 	}
-	return writeAll(conn, body)
+
+	// Header and body go out in one write so a datagram carries the whole
+	// record
+	record := make([]byte, recordHeaderSize+bodyLen)
+	record[0] = 0x17
+	record[1] = 0x03
+	record[2] = 0x03
+	binary.BigEndian.PutUint16(record[3:recordHeaderSize], uint16(bodyLen))
+	copy(record[recordHeaderSize:], body)
+	return writeAll(conn, record)
 }
 
-func (t *Transport) Receive(conn net.Conn) (*Frame, error) {
-	header := make([]byte, recordHeaderSize)
-	if _, err := io.ReadFull(conn, header); err != nil {
-		return nil, err
+// shapingDelay samples the inter-arrival delay of the session's traffic
+// shaper, zero when shaping is off.
+func (t *Transport) shapingDelay() time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.session == nil || t.session.shaper == nil {
+		return 0
 	}
-	length := binary.BigEndian.Uint16(header[3:])
-	if length < frameHeaderSize {
-		return nil, errors.New("frame too short")
+	return t.session.shaper.Delay()
+}
+
+func (t *Transport) Receive(conn net.Conn) (*Frame, error) {
+	if IsDatagram(conn) {
+		return t.receiveDatagram(conn)
 	}
-	body := make([]byte, length)
-	if _, err := io.ReadFull(conn, body); err != nil {
+
+	body, err := readBody(conn, t.obfuscator())
+	if err != nil {
 		return nil, err
 	}
+	return t.openFrame(body)
+}
+
+// receiveDatagram reads packets until one holds a valid frame. Lost packets
+// are simply absent; corrupt, stale and stray handshake packets are dropped
+// instead of tearing down the session.
+func (t *Transport) receiveDatagram(conn net.Conn) (*Frame, error) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		packet := buf[:n]
+
+		t.mu.RLock()
+		handshake := t.handshake
+		t.mu.RUnlock()
+		if handshake != nil && handshake.Replay(packet) {
+			continue
+		}
+
+		body, err := datagramBody(packet, t.obfuscator())
+		var frame *Frame
+		if err == nil {
+			frame, err = t.openFrame(body)
+		}
+		if errors.Is(err, ErrSessionUnset) {
+			return nil, err
+		}
+		if err != nil {
+			if t.logger != nil {
+				t.logger.Debug("datagram dropped", map[string]interface{}{"bytes": n, "error": err.Error()})
+			}
+			continue
+		}
+
+		if handshake != nil {
+			t.mu.Lock()
+			t.handshake = nil
+			t.mu.Unlock()
+		}
+		if t.handlePath(conn, frame) {
+			continue
+		}
+		return frame, nil
+	}
+}
 
+// openFrame authenticates and decrypts a frame body
+func (t *Transport) openFrame(body []byte) (*Frame, error) {
 	flagMasked := body[0]
 	padMasked := body[1]
-	counter := binary.BigEndian.Uint64(body[2:10])
 
 	t.mu.Lock()
 	if t.session == nil {
 		t.mu.Unlock()
 		return nil, ErrSessionUnset
 	}
-	sess := t.session
-	flagByte, padLen := unmaskHeader(sess.obfuscationKey, counter, flagMasked, padMasked)
-	if int(padLen) > len(body)-frameHeaderSize {
+	keys, counterField, err := t.session.frameKeys(body)
+	if err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+	counter := counterField &^ keyPhaseBit
+	var connectionID []byte
+	if keys.connectionKey != nil {
+		connectionID = body[frameHeaderSize : frameHeaderSize+connectionIDSize]
+	}
+	headerLen := frameHeaderSize + len(connectionID)
+	flagByte, padLen := unmaskHeader(keys.obfuscationKey, counter, flagMasked, padMasked)
+	if int(padLen) > len(body)-headerLen {
 		t.mu.Unlock()
 		return nil, errors.New("invalid padding length")
 	}
-	ciphertextLen := len(body) - frameHeaderSize - int(padLen)
+	ciphertextLen := len(body) - headerLen - int(padLen)
 	if ciphertextLen < 0 {
 		t.mu.Unlock()
 		return nil, errors.New("invalid ciphertext length")
 	}
-	ciphertext := body[frameHeaderSize : frameHeaderSize+ciphertextLen]
+	ciphertext := body[headerLen : headerLen+ciphertextLen]
 
-	aad := []byte{flagByte, padLen}
-	plaintext, err := sess.recvCipher.Open(counter, aad, ciphertext)
+	aad := append([]byte{flagByte, padLen}, connectionID...)
+	plaintext, err := keys.cipher.Open(counterNonce(keys.cipher, counter), ciphertext, aad)
 	if err != nil {
 		t.mu.Unlock()
 		return nil, err
@@ -244,11 +586,14 @@ func (t *Transport) Receive(conn net.Conn) (*Frame, error) {
 	}
 	payload := append([]byte(nil), plaintext[2:2+payloadLen]...)
 
-	if counter < sess.recvCounter {
+	if err := keys.replay.Check(counter); err != nil {
 		t.mu.Unlock()
-		return nil, errors.New("replayed frame detected")
+		return nil, err
+	}
+	keys.replay.Accept(counter)
+	if counter >= keys.next {
+		keys.next = counter + 1
 	}
-	sess.recvCounter = counter + 1
 	t.lastRecv = time.Now()
 	t.mu.Unlock()
 
@@ -259,6 +604,66 @@ func (t *Transport) Receive(conn net.Conn) (*Frame, error) {
 	return &Frame{Flags: FrameFlag(flagByte), Payload: payload}, nil
 }
 
+func (t *Transport) obfuscator() *crypto.Obfuscator {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.session == nil {
+		return nil
+	}
+	return t.session.obfuscator
+}
+
+// datagramBody extracts the frame body carried by a single packet
+func datagramBody(packet []byte, obfuscator *crypto.Obfuscator) ([]byte, error) {
+	var body []byte
+	if obfuscator != nil {
+		var err error
+		if body, err = obfuscator.DeobfuscateFrame(packet); err != nil {
+			return nil, err
+		}
+	} else {
+		if len(packet) < recordHeaderSize || packet[0] != 0x17 {
+			return nil, errors.New("malformed record")
+		}
+		if int(binary.BigEndian.Uint16(packet[3:recordHeaderSize])) != len(packet)-recordHeaderSize {
+			return nil, errors.New("record length mismatch")
+		}
+		body = packet[recordHeaderSize:]
+	}
+	if len(body) < frameHeaderSize {
+		return nil, errors.New("frame too short")
+	}
+	return body, nil
+}
+
+// readBody reads the next frame body, either from a plain record or by
+// reversing the session obfuscation.
+func readBody(conn net.Conn, obfuscator *crypto.Obfuscator) ([]byte, error) {
+	var body []byte
+	if obfuscator != nil {
+		raw, err := obfuscator.ReadFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if body, err = obfuscator.DeobfuscateFrame(raw); err != nil {
+			return nil, err
+		}
+	} else {
+		header := make([]byte, recordHeaderSize)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		body = make([]byte, binary.BigEndian.Uint16(header[3:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return nil, err
+		}
+	}
+	if len(body) < frameHeaderSize {
+		return nil, errors.New("frame too short")
+	}
+	return body, nil
+}
+
 func (t *Transport) SessionKeepAlive() time.Duration {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
@@ -268,12 +673,71 @@ func (t *Transport) SessionKeepAlive() time.Duration {
 	return t.session.keepAlive
 }
 
+// CipherSuite returns the AEAD suite protecting the current session, or zero
+// when no session is installed.
+func (t *Transport) CipherSuite() crypto.CipherSuite {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.session == nil {
+		return 0
+	}
+	return t.session.suite
+}
+
+// ReplayStats returns the anti-replay window state of the current session.
+func (t *Transport) ReplayStats() crypto.AntiReplayStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.session == nil {
+		return crypto.AntiReplayStats{}
+	}
+	stats := t.session.recv.replay.Stats()
+	stats.Accepted += t.session.retired.Accepted
+	stats.Rejected += t.session.retired.Rejected
+	if previous := t.session.previous; previous != nil {
+		prev := previous.replay.Stats()
+		stats.Accepted += prev.Accepted
+		stats.Rejected += prev.Rejected
+	}
+	return stats
+}
+
 func (t *Transport) LastActivity() (time.Time, time.Time) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	return t.lastSend, t.lastRecv
 }
 
+func effectiveSuite(suite crypto.CipherSuite) crypto.CipherSuite {
+	if suite == 0 {
+		return crypto.CipherSuiteChaCha20Poly1305
+	}
+	return suite
+}
+
+func newSessionCiphers(secrets crypto.SessionSecrets, suite crypto.CipherSuite) (*crypto.CipherSuiteState, *crypto.CipherSuiteState, error) {
+	if len(secrets.SendKey) < crypto.KeySize || len(secrets.ReceiveKey) < crypto.KeySize {
+		return nil, nil, errors.New("key too short for cipher state")
+	}
+	sendCipher, err := crypto.NewCipherSuiteState(suite, secrets.SendKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	recvCipher, err := crypto.NewCipherSuiteState(suite, secrets.ReceiveKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sendCipher, recvCipher, nil
+}
+
+// counterNonce places the frame counter in the trailing eight bytes of a
+// nonce sized for the suite, matching the layout of crypto.CipherState.
+func counterNonce(state *crypto.CipherSuiteState, counter uint64) []byte {
+	nonce := make([]byte, state.Info().NonceSize)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
 func buildPlaintext(payload []byte) []byte {
 	length := len(payload)
 	buf := make([]byte, 2+length)
@@ -389,6 +853,11 @@ type udpListener struct {
 	mu       sync.RWMutex
 	accept   chan *udpSession
 	closed   bool
+	draining bool
+	// ids indexes sessions by the connection IDs of their next frames;
+	// idOffset is where a packet carries its ID
+	ids      map[[connectionIDSize]byte]*udpSession
+	idOffset int
 }
 
 func newUDPListener(addr string) (*udpListener, error) {
@@ -405,6 +874,7 @@ func newUDPListener(addr string) (*udpListener, error) {
 		conn:     conn,
 		sessions: make(map[string]*udpSession),
 		accept:   make(chan *udpSession, 16),
+		ids:      make(map[[connectionIDSize]byte]*udpSession),
 	}
 
 	// Start background goroutine to demultiplex UDP packets
@@ -441,15 +911,25 @@ func (l *udpListener) demux() {
 		}
 
 		session, exists := l.sessions[key]
+		if !exists {
+			// A known session whose client moved to a new address
+			if session = l.claim(buf[:n]); session != nil {
+				session.pushData(buf[:n], remote)
+				l.mu.Unlock()
+				continue
+			}
+		}
+		if !exists && l.draining {
+			l.mu.Unlock()
+			continue
+		}
 		if !exists {
 			// New connection
-			session = newUDPSession(l.conn, remote, func() {
-				l.removeSession(key)
-			})
+			session = newUDPSession(l, remote)
 			l.sessions[key] = session
 
 			// Push initial data
-			session.pushData(buf[:n])
+			session.pushData(buf[:n], remote)
 
 			// Send to accept channel (non-blocking)
 			select {
@@ -461,16 +941,103 @@ func (l *udpListener) demux() {
 			}
 		} else {
 			// Existing connection, push data to session
-			session.pushData(buf[:n])
+			session.pushData(buf[:n], remote)
 		}
 		l.mu.Unlock()
 	}
 }
 
-func (l *udpListener) removeSession(key string) {
+func (l *udpListener) removeSession(session *udpSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, s := range l.sessions {
+		if s == session {
+			delete(l.sessions, key)
+		}
+	}
+	l.dropIDs(session)
+}
+
+// claim finds the session a packet from an unknown address belongs to by
+// its connection ID. Only the next frames of each session are indexed, so a
+// client that lost more frames than that before moving is found by asking
+// every session whether the packet is one of its frames. The caller holds
+// l.mu.
+func (l *udpListener) claim(packet []byte) *udpSession {
+	var id [connectionIDSize]byte
+	if len(l.ids) == 0 {
+		return nil
+	}
+	if len(packet) >= l.idOffset+len(id) {
+		copy(id[:], packet[l.idOffset:])
+		if session := l.ids[id]; session != nil {
+			return session
+		}
+	}
+	for _, session := range l.sessions {
+		if session.owns != nil && session.owns(packet) {
+			return session
+		}
+	}
+	return nil
+}
+
+// expect replaces the connection IDs a session is claimed by; owns matches
+// packets beyond them
+func (l *udpListener) expect(session *udpSession, offset int, ids [][connectionIDSize]byte, owns func([]byte) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || session.isClosed() {
+		return
+	}
+	l.dropIDs(session)
+	for _, id := range ids {
+		l.ids[id] = session
+	}
+	session.ids = ids
+	session.owns = owns
+	l.idOffset = offset
+}
+
+// dropIDs removes a session from the connection ID index. The caller holds
+// l.mu.
+func (l *udpListener) dropIDs(session *udpSession) {
+	for _, id := range session.ids {
+		if l.ids[id] == session {
+			delete(l.ids, id)
+		}
+	}
+	session.ids = nil
+	session.owns = nil
+}
+
+// migrate moves a session to a validated new address
+func (l *udpListener) migrate(session *udpSession, addr *net.UDPAddr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, s := range l.sessions {
+		if s == session {
+			delete(l.sessions, key)
+		}
+	}
+	l.sessions[addr.String()] = session
+	session.mu.Lock()
+	session.remote = addr
+	session.mu.Unlock()
+}
+
+// drain stops admitting new remotes; packets of existing sessions are still
+// delivered until the listener is closed.
+func (l *udpListener) drain() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	delete(l.sessions, key)
+	l.draining = true
+}
+
+func (l *udpListener) sessionCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.sessions)
 }
 
 func (l *udpListener) Accept() (net.Conn, error) {
@@ -495,6 +1062,7 @@ func (l *udpListener) Close() error {
 		sessions = append(sessions, session)
 	}
 	l.sessions = make(map[string]*udpSession)
+	l.ids = make(map[[connectionIDSize]byte]*udpSession)
 	l.mu.Unlock()
 
 	// Close sessions without holding lock
@@ -515,36 +1083,48 @@ func (l *udpListener) Addr() net.Addr {
 
 type udpSession struct {
 	conn          *net.UDPConn
+	listener      *udpListener
 	remote        *net.UDPAddr
+	source        *net.UDPAddr // sender of the packet last returned by Read
 	mu            sync.Mutex
-	pending       []byte
 	closed        bool
 	readDeadline  time.Time
 	writeDeadline time.Time
-	readChan      chan []byte
+	readChan      chan udpPacket
 	cleanupFunc   func()
+	ids           [][connectionIDSize]byte // indexed by the listener, guarded by its mu
+	owns          func([]byte) bool        // matches frames past ids, guarded by the listener's mu
+}
+
+type udpPacket struct {
+	data []byte
+	from *net.UDPAddr
 }
 
-func newUDPSession(conn *net.UDPConn, remote *net.UDPAddr, cleanup func()) *udpSession {
-	return &udpSession{
-		conn:        conn,
-		remote:      remote,
-		readChan:    make(chan []byte, 64),
-		cleanupFunc: cleanup,
+func newUDPSession(listener *udpListener, remote *net.UDPAddr) *udpSession {
+	s := &udpSession{
+		conn:     listener.conn,
+		listener: listener,
+		remote:   remote,
+		readChan: make(chan udpPacket, 64),
+	}
+	s.cleanupFunc = func() {
+		listener.removeSession(s)
 	}
+	return s
 }
 
-func (s *udpSession) pushData(data []byte) {
+func (s *udpSession) pushData(data []byte, from *net.UDPAddr) {
+	// Make a copy of the data
+	dataCopy := udpPacket{data: make([]byte, len(data)), from: from}
+	copy(dataCopy.data, data)
+
+	// The lock keeps Close from closing the channel mid-send
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
-		s.mu.Unlock()
 		return
 	}
-	s.mu.Unlock()
-
-	// Make a copy of the data
-	dataCopy := make([]byte, len(data))
-	copy(dataCopy, data)
 
 	// Try to send to read channel (non-blocking)
 	select {
@@ -565,23 +1145,16 @@ func (s *udpSession) Read(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
-	// Check if we have pending data from previous read
-	if len(s.pending) > 0 {
-		n := copy(p, s.pending)
-		s.pending = s.pending[n:]
-		s.mu.Unlock()
-		return n, nil
-	}
-
 	deadline := s.readDeadline
 	s.mu.Unlock()
 
 	// Wait for data from read channel
-	var data []byte
+	var packet udpPacket
+	var ok bool
 	if deadline.IsZero() {
 		// No deadline, block indefinitely
 		select {
-		case data = <-s.readChan:
+		case packet, ok = <-s.readChan:
 		case <-time.After(time.Hour): // Prevent infinite block
 			return 0, io.EOF
 		}
@@ -591,24 +1164,26 @@ func (s *udpSession) Read(p []byte) (int, error) {
 		defer timer.Stop()
 
 		select {
-		case data = <-s.readChan:
+		case packet, ok = <-s.readChan:
 		case <-timer.C:
 			return 0, os.ErrDeadlineExceeded
 		}
 	}
-
-	// Copy data to output buffer
-	n := copy(p, data)
-	if n < len(data) {
-		// Save remaining data for next read
-		s.mu.Lock()
-		s.pending = append(s.pending, data[n:]...)
-		s.mu.Unlock()
+	if !ok {
+		return 0, io.EOF
 	}
+	s.mu.Lock()
+	s.source = packet.from
+	s.mu.Unlock()
 
-	return n, nil
+	// One read returns one packet; like a UDP socket, whatever does not fit
+	// in p is discarded
+	return copy(p, packet.data), nil
 }
 
+// Datagram reports that each Read returns exactly one packet
+func (s *udpSession) Datagram() bool { return true }
+
 func (s *udpSession) Write(p []byte) (int, error) {
 	s.mu.Lock()
 	if s.closed {
@@ -616,12 +1191,13 @@ func (s *udpSession) Write(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 	deadline := s.writeDeadline
+	remote := s.remote
 	s.mu.Unlock()
 
 	if !deadline.IsZero() {
 		_ = s.conn.SetWriteDeadline(deadline)
 	}
-	return s.conn.WriteToUDP(p, s.remote)
+	return s.conn.WriteToUDP(p, remote)
 }
 
 func (s *udpSession) Close() error {
@@ -658,6 +1234,8 @@ func (s *udpSession) LocalAddr() net.Addr {
 }
 
 func (s *udpSession) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.remote
 }
 
@@ -688,5 +1266,9 @@ func dialUDP(addr string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return net.DialUDP("udp", nil, udpAddr)
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{UDPConn: conn}, nil
 }
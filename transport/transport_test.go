@@ -2,10 +2,28 @@ package transport
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"stp/crypto"
 )
 
 // TestPortHopping 测试动态端口跳跃
@@ -62,6 +80,110 @@ func TestPortHopping(t *testing.T) {
 	t.Logf("Stats: current=%d, hops=%d", stats.CurrentPort, stats.HopCount)
 }
 
+// TestPortHoppingListener 测试跳跃后已建立的会话保持可用
+func TestPortHoppingListener(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			secret := make([]byte, 32)
+			rand.Read(secret)
+			config := DefaultPortHoppingConfig(secret)
+			config.PortRangeMin = 20000
+			config.PortRangeMax = 40000
+			config.HopInterval = time.Hour // 由测试手动跳跃
+			manager := NewPortHoppingManager(config)
+
+			listener, err := NewPortHoppingListener(manager, network, "127.0.0.1")
+			if err != nil {
+				t.Skipf("listen: %v", err)
+			}
+			defer listener.Close()
+
+			// 每个会话回显两条消息后关闭
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go func(conn net.Conn) {
+						defer conn.Close()
+						buf := make([]byte, 64)
+						for i := 0; i < 2; i++ {
+							n, err := conn.Read(buf)
+							if err != nil {
+								return
+							}
+							conn.Write(buf[:n])
+						}
+					}(conn)
+				}
+			}()
+
+			echo := func(conn net.Conn, msg string) {
+				t.Helper()
+				if _, err := conn.Write([]byte(msg)); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				buf := make([]byte, 64)
+				n, err := conn.Read(buf)
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if string(buf[:n]) != msg {
+					t.Fatalf("echo mismatch: %q", buf[:n])
+				}
+			}
+
+			dialer := NewPortHoppingDialer(manager, network, "127.0.0.1")
+			conn, err := dialer.Dial()
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			echo(conn, "before hop")
+
+			// 跳到窗口之外，旧端口退出
+			slot := manager.getCurrentTimeSlot()
+			listener.refresh(slot + 3)
+			echo(conn, "after hop")
+
+			newAddr := net.JoinHostPort("127.0.0.1", fmt.Sprint(manager.GetPortForTimeSlot(slot+3)))
+			next, err := Dial(network, newAddr)
+			if err != nil {
+				t.Fatalf("dial new port: %v", err)
+			}
+			defer next.Close()
+			echo(next, "new port")
+
+			if network == "tcp" {
+				oldAddr := net.JoinHostPort("127.0.0.1", fmt.Sprint(manager.GetPortForTimeSlot(slot)))
+				if old, err := net.DialTimeout("tcp", oldAddr, time.Second); err == nil {
+					old.Close()
+					t.Fatal("retired port still accepts connections")
+				}
+				return
+			}
+
+			// 服务器关闭最后一个会话后，旧的UDP端口被回收
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				listener.sweep()
+				listener.mu.Lock()
+				draining := len(listener.draining)
+				listener.mu.Unlock()
+				if draining == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%d retired udp ports still open", draining)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+}
+
 // TestRoaming 测试无缝漫游
 func TestRoaming(t *testing.T) {
 	config := DefaultRoamingConfig()
@@ -115,6 +237,167 @@ func TestRoaming(t *testing.T) {
 	}
 }
 
+// TestUDPRoaming 测试客户端换地址后会话按连接ID迁移
+func TestUDPRoaming(t *testing.T) {
+	modes := []crypto.ObfsConfig{
+		{Datagram: true},
+		{Mode: crypto.ObfsModeXOR, Datagram: true},
+	}
+	for _, obfs := range modes {
+		t.Run(obfs.Mode.String(), func(t *testing.T) {
+			client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, obfs)
+			ln, err := Listen("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer ln.Close()
+
+			before, err := Dial("udp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer before.Close()
+			if err := client.SendPayload(before, []byte("one")); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			serverConn, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("accept: %v", err)
+			}
+			serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if frame, err := server.Receive(serverConn); err != nil || string(frame.Payload) != "one" {
+				t.Fatalf("first frame: %v %v", frame, err)
+			}
+			serverConn.SetReadDeadline(time.Time{})
+
+			roamed := make(chan net.Addr, 1)
+			server.SetRoamHandler(func(old, addr net.Addr) { roamed <- addr })
+			frames := make(chan *Frame, 8)
+			go func() {
+				for {
+					frame, err := server.Receive(serverConn)
+					if err != nil {
+						return
+					}
+					frames <- frame
+				}
+			}()
+
+			// 新的源端口模拟NAT重新绑定，客户端在新地址上应答路径挑战
+			after, err := Dial("udp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer after.Close()
+			replies := make(chan *Frame, 8)
+			go func() {
+				for {
+					frame, err := client.Receive(after)
+					if err != nil {
+						return
+					}
+					replies <- frame
+				}
+			}()
+			if err := client.SendPayload(after, []byte("two")); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			select {
+			case frame := <-frames:
+				if string(frame.Payload) != "two" {
+					t.Fatalf("unexpected frame %q", frame.Payload)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("frame from the new address not delivered")
+			}
+			select {
+			case addr := <-roamed:
+				if addr.String() != after.LocalAddr().String() {
+					t.Fatalf("roamed to %v, want %v", addr, after.LocalAddr())
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("session did not migrate")
+			}
+
+			if err := server.SendPayload(serverConn, []byte("three")); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			select {
+			case frame := <-replies:
+				if string(frame.Payload) != "three" {
+					t.Fatalf("unexpected reply %q", frame.Payload)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("reply not sent to the new address")
+			}
+
+			if count := ln.(*udpListener).sessionCount(); count != 1 {
+				t.Fatalf("expected 1 session after roaming, got %d", count)
+			}
+		})
+	}
+}
+
+// TestUDPRoamingAfterLoss 测试丢失超过连接ID索引范围的帧后换地址仍能找回会话
+func TestUDPRoamingAfterLoss(t *testing.T) {
+	modes := []crypto.ObfsConfig{
+		{Datagram: true},
+		{Mode: crypto.ObfsModeXOR, Datagram: true},
+	}
+	for _, obfs := range modes {
+		t.Run(obfs.Mode.String(), func(t *testing.T) {
+			client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, obfs)
+			ln, err := Listen("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer ln.Close()
+
+			before, err := Dial("udp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer before.Close()
+			if err := client.SendPayload(before, []byte("one")); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			serverConn, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("accept: %v", err)
+			}
+			serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if frame, err := server.Receive(serverConn); err != nil || string(frame.Payload) != "one" {
+				t.Fatalf("first frame: %v %v", frame, err)
+			}
+
+			// 超过索引范围的帧在旧地址上全部丢失
+			lost := &recordConn{Conn: before}
+			for i := 0; i < 2*connectionIDLookahead; i++ {
+				if err := client.SendPayload(lost, []byte{byte(i)}); err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+			}
+
+			after, err := Dial("udp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer after.Close()
+			if err := client.SendPayload(after, []byte("two")); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			frame, err := server.Receive(serverConn)
+			if err != nil || string(frame.Payload) != "two" {
+				t.Fatalf("frame from the new address: %v %v", frame, err)
+			}
+			if count := ln.(*udpListener).sessionCount(); count != 1 {
+				t.Fatalf("expected 1 session after roaming, got %d", count)
+			}
+		})
+	}
+}
+
 // TestPathValidator 测试路径验证
 func TestPathValidator(t *testing.T) {
 	validator := NewPathValidator()
@@ -215,6 +498,11 @@ func TestTicketSerialization(t *testing.T) {
 		ExpiresAt:       time.Now().Add(24 * time.Hour),
 		UsageCount:      0,
 		MaxUsage:        3,
+		Params: crypto.NegotiatedParams{
+			Version:     crypto.ProtocolVersion(2),
+			CipherSuite: crypto.CipherSuite(0x1303),
+			Features:    crypto.FeatureFlags(0x5),
+		},
 	}
 	rand.Read(ticket.ID[:])
 	rand.Read(ticket.SessionKey)
@@ -246,6 +534,104 @@ func TestTicketSerialization(t *testing.T) {
 	if ticket.MaxUsage != recovered.MaxUsage {
 		t.Error("Max usage mismatch")
 	}
+
+	if ticket.Params != recovered.Params {
+		t.Errorf("Params mismatch: got %+v, want %+v", recovered.Params, ticket.Params)
+	}
+}
+
+// TestTicketRedeemOnce 测试服务器端票据只能兑换一次
+func TestTicketRedeemOnce(t *testing.T) {
+	config := DefaultZeroRTTConfig()
+	config.MaxTicketUsage = 1
+	mgr := NewZeroRTTManager(config)
+	defer mgr.Stop()
+
+	ticket, err := mgr.IssueTicket("peer", make([]byte, 32), [32]byte{})
+	if err != nil {
+		t.Fatalf("Failed to issue ticket: %v", err)
+	}
+
+	redeemed, peer, err := mgr.RedeemTicket(ticket.ID)
+	if err != nil {
+		t.Fatalf("Failed to redeem ticket: %v", err)
+	}
+	if peer != "peer" || redeemed.ID != ticket.ID {
+		t.Errorf("Unexpected redemption: peer=%q id=%x", peer, redeemed.ID)
+	}
+
+	// 立即重放也必须被拒绝
+	if _, _, err := mgr.RedeemTicket(ticket.ID); err == nil {
+		t.Error("Replayed ticket accepted")
+	}
+
+	var unknown [16]byte
+	rand.Read(unknown[:])
+	if _, _, err := mgr.RedeemTicket(unknown); !errors.Is(err, ErrTicketUnknown) {
+		t.Errorf("Expected ErrTicketUnknown, got %v", err)
+	}
+
+	// 吊销对等点后其票据失效
+	revoked, _ := mgr.IssueTicket("revoked", make([]byte, 32), [32]byte{})
+	if n := mgr.ForgetPeer("revoked"); n != 1 {
+		t.Errorf("Expected 1 forgotten ticket, got %d", n)
+	}
+	if _, _, err := mgr.RedeemTicket(revoked.ID); !errors.Is(err, ErrTicketUnknown) {
+		t.Errorf("Revoked peer's ticket accepted: %v", err)
+	}
+}
+
+// TestTicketPersistence 测试票据保存到文件并重新加载
+func TestTicketPersistence(t *testing.T) {
+	mgr := NewZeroRTTManager(DefaultZeroRTTConfig())
+	defer mgr.Stop()
+
+	ticket := &SessionTicket{
+		SessionKey: make([]byte, 32),
+		IssuedAt:   time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+		MaxUsage:   1,
+		Params:     crypto.NegotiatedParams{CipherSuite: crypto.CipherSuite(0x1301)},
+	}
+	rand.Read(ticket.ID[:])
+	rand.Read(ticket.SessionKey)
+	mgr.StoreTicket("vpn.example.com:51820", ticket)
+
+	expired := &SessionTicket{SessionKey: make([]byte, 32), ExpiresAt: time.Now().Add(-time.Minute), MaxUsage: 1}
+	mgr.StoreTicket("vpn.example.com:51820", expired)
+
+	path := filepath.Join(t.TempDir(), "tickets")
+	if err := mgr.SaveTickets(path); err != nil {
+		t.Fatalf("Failed to save tickets: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Ticket file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Ticket file mode %v, want 0600", info.Mode().Perm())
+	}
+
+	loaded := NewZeroRTTManager(DefaultZeroRTTConfig())
+	defer loaded.Stop()
+	if err := loaded.LoadTickets(path); err != nil {
+		t.Fatalf("Failed to load tickets: %v", err)
+	}
+	if stored := loaded.GetStats().TicketsStored; stored != 1 {
+		t.Fatalf("Expected 1 stored ticket, got %d", stored)
+	}
+	restored, err := loaded.UseTicket("vpn.example.com:51820")
+	if err != nil {
+		t.Fatalf("Failed to use restored ticket: %v", err)
+	}
+	if restored.ID != ticket.ID || !bytes.Equal(restored.SessionKey, ticket.SessionKey) || restored.Params != ticket.Params {
+		t.Error("Restored ticket differs from saved ticket")
+	}
+
+	// 不存在的文件不是错误
+	if err := loaded.LoadTickets(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("Missing ticket file: %v", err)
+	}
 }
 
 // TestZeroRTTData 测试0-RTT数据编解码
@@ -346,6 +732,90 @@ func TestFallbackDetection(t *testing.T) {
 		stats.ValidConnections, stats.FallbackConnections)
 }
 
+// TestFallbackDivert 测试探测流量与握手失败的连接都转交给回落站点
+func TestFallbackDivert(t *testing.T) {
+	decoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "decoy")
+		io.WriteString(w, "decoy page")
+	}))
+	defer decoy.Close()
+
+	config := DefaultFallbackConfig(strings.TrimPrefix(decoy.URL, "http://"))
+	config.Mode = FallbackModeTrojan
+	config.UseHTTPServer = false
+	config.DetectionTime = 200 * time.Millisecond
+	config.Detect = crypto.IsHandshakeRecord
+	listener, err := NewFallbackListener(config, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// 浏览器得到回落站点的真实响应
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Server") != "decoy" || string(body) != "decoy page" {
+		t.Fatalf("unexpected fallback response: %q %q", resp.Header.Get("Server"), body)
+	}
+
+	// 形似握手但无法认证的记录：服务器应答前转交，回落站点收到原始数据
+	probe, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer probe.Close()
+	record := []byte{0x17, 0x03, 0x03, 0x00, 0x04, 'G', 'E', 'T', ' '}
+	if _, err := probe.Write(append(record, []byte("/ HTTP/1.1\r\nHost: x\r\n\r\n")...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(record))); err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	go listener.Divert(conn)
+
+	probe.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, _ := io.ReadAll(probe)
+	if !strings.HasPrefix(string(reply), "HTTP/1.1 400") {
+		t.Fatalf("decoy did not answer the diverted probe: %q", reply)
+	}
+
+	// 服务器应答过的连接不能再转交
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	client.Write(record)
+	answered, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer answered.Close()
+	answered.Write([]byte{0})
+	if listener.Divert(answered) {
+		t.Fatal("answered connection was diverted")
+	}
+
+	stats := listener.GetStats()
+	if stats.ValidConnections != 2 || stats.FallbackConnections != 1 || stats.DivertedConnections != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close: %v", err)
+	}
+}
+
 // TestBufferedConn 测试缓冲连接
 func TestBufferedConn(t *testing.T) {
 	// 创建管道
@@ -442,3 +912,832 @@ func BenchmarkZeroRTTDataEncoding(b *testing.B) {
 		DecodeZeroRTTData(encoded)
 	}
 }
+
+// sessionPair 创建一对共享密钥的传输端点
+func sessionPair(t *testing.T, suite crypto.CipherSuite, obfs crypto.ObfsConfig) (*Transport, *Transport) {
+	t.Helper()
+	sendKey := make([]byte, crypto.KeySize)
+	recvKey := make([]byte, crypto.KeySize)
+	obfsKey := make([]byte, 32)
+	rand.Read(sendKey)
+	rand.Read(recvKey)
+	rand.Read(obfsKey)
+
+	params := crypto.TransportParameters{KeepAlive: 15 * time.Second, MaxPadding: 32}
+	client := NewTransport(nil)
+	server := NewTransport(nil)
+	obfs.Role = crypto.RoleClient
+	client.SetObfuscation(obfs)
+	obfs.Role = crypto.RoleServer
+	server.SetObfuscation(obfs)
+	if err := client.InstallSession(crypto.SessionSecrets{SendKey: sendKey, ReceiveKey: recvKey, ObfuscationKey: obfsKey, Epoch: 1}, params, suite); err != nil {
+		t.Fatalf("install client session: %v", err)
+	}
+	if err := server.InstallSession(crypto.SessionSecrets{SendKey: recvKey, ReceiveKey: sendKey, ObfuscationKey: obfsKey, Epoch: 1}, params, suite); err != nil {
+		t.Fatalf("install server session: %v", err)
+	}
+	return client, server
+}
+
+// TestCipherSuiteFrames 测试各协商套件下的帧收发
+func TestCipherSuiteFrames(t *testing.T) {
+	suites := []crypto.CipherSuite{
+		crypto.CipherSuiteChaCha20Poly1305,
+		crypto.CipherSuiteAES256GCM,
+		crypto.CipherSuiteXChaCha20Poly1305,
+	}
+	for _, suite := range suites {
+		client, server := sessionPair(t, suite, crypto.ObfsConfig{})
+		if client.CipherSuite() != suite {
+			t.Fatalf("expected suite 0x%04x, got 0x%04x", suite, client.CipherSuite())
+		}
+
+		clientConn, serverConn := net.Pipe()
+		payload := []byte("negotiated suite payload")
+		errCh := make(chan error, 1)
+		go func() { errCh <- client.SendPayload(clientConn, payload) }()
+
+		frame, err := server.Receive(serverConn)
+		if err != nil {
+			t.Fatalf("suite 0x%04x: receive: %v", suite, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("suite 0x%04x: send: %v", suite, err)
+		}
+		if frame.Flags != FlagData || !bytes.Equal(frame.Payload, payload) {
+			t.Fatalf("suite 0x%04x: unexpected frame %+v", suite, frame)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+// TestObfuscatedFrames 测试各混淆模式下的双向帧收发
+func TestObfuscatedFrames(t *testing.T) {
+	modes := []crypto.ObfsConfig{
+		{Mode: crypto.ObfsModeXOR},
+		{Mode: crypto.ObfsModeOBFS4, MaxPadding: 64},
+		{Mode: crypto.ObfsModeTLS, MinPadding: 8, MaxPadding: 32},
+		{Mode: crypto.ObfsModeRandom, MaxPadding: 128, IATMode: 1, IATMeanDelay: time.Millisecond},
+	}
+	for _, obfs := range modes {
+		t.Run(obfs.Mode.String(), func(t *testing.T) {
+			client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, obfs)
+			if client.ObfuscationMode() != obfs.Mode {
+				t.Fatalf("expected mode %s, got %s", obfs.Mode, client.ObfuscationMode())
+			}
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			// 多帧往返以验证两端流密码状态保持同步
+			for i := 0; i < 5; i++ {
+				payload := bytes.Repeat([]byte{byte(i)}, 100+i)
+				errCh := make(chan error, 1)
+				go func() { errCh <- client.SendPayload(clientConn, payload) }()
+				frame, err := server.Receive(serverConn)
+				if err != nil {
+					t.Fatalf("server receive %d: %v", i, err)
+				}
+				if err := <-errCh; err != nil {
+					t.Fatalf("client send %d: %v", i, err)
+				}
+				if !bytes.Equal(frame.Payload, payload) {
+					t.Fatalf("frame %d payload mismatch", i)
+				}
+
+				go func() { errCh <- server.SendKeepAlive(serverConn) }()
+				frame, err = client.Receive(clientConn)
+				if err != nil {
+					t.Fatalf("client receive %d: %v", i, err)
+				}
+				if err := <-errCh; err != nil {
+					t.Fatalf("server send %d: %v", i, err)
+				}
+				if frame.Flags != FlagKeepAlive {
+					t.Fatalf("expected keepalive, got %v", frame.Flags)
+				}
+			}
+		})
+	}
+}
+
+// TestObfuscationErrorReturned 测试混淆失败时返回底层错误且不写出任何数据
+func TestObfuscationErrorReturned(t *testing.T) {
+	obfs := crypto.ObfsConfig{Mode: crypto.ObfsModeTLS, MinPadding: 256, MaxPadding: 256, IATMode: 1, IATMeanDelay: time.Millisecond}
+	client, _ := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, obfs)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// 帧本身未超过16位长度，加上混淆填充后超出
+	err := client.SendPayload(clientConn, make([]byte, 0xFFFF-200))
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum size") {
+		t.Fatalf("expected obfuscation size error, got %v", err)
+	}
+}
+
+// lossyConn 按写入序号丢弃数据报，模拟有损链路
+type lossyConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+	drop   func(i int) bool
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	i := c.writes
+	c.writes++
+	c.mu.Unlock()
+	if c.drop(i) {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *lossyConn) Datagram() bool { return true }
+
+// udpPair 建立一对 UDP 回环数据报连接
+func udpPair(t *testing.T, first []byte) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	client, err := Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if !IsDatagram(client) {
+		t.Fatal("dialled UDP conn should be a datagram conn")
+	}
+	if _, err := client.Write(first); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if !IsDatagram(server) {
+		t.Fatal("accepted UDP session should be a datagram conn")
+	}
+	buf := make([]byte, 64)
+	if n, err := server.Read(buf); err != nil || !bytes.Equal(buf[:n], first) {
+		t.Fatalf("first packet: %q, %v", buf[:n], err)
+	}
+	return client, server
+}
+
+// TestDatagramFramesSurviveLoss 测试数据报模式下丢包与垃圾包不会中断会话
+func TestDatagramFramesSurviveLoss(t *testing.T) {
+	modes := []crypto.ObfsConfig{
+		{},
+		{Mode: crypto.ObfsModeXOR, Datagram: true},
+		{Mode: crypto.ObfsModeOBFS4, MaxPadding: 64, Datagram: true},
+		{Mode: crypto.ObfsModeTLS, MaxPadding: 32, Datagram: true},
+	}
+	for _, obfs := range modes {
+		t.Run(obfs.Mode.String(), func(t *testing.T) {
+			client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, obfs)
+			clientConn, serverConn := udpPair(t, []byte("open"))
+			// 每三个数据报丢弃一个
+			lossy := &lossyConn{Conn: clientConn, drop: func(i int) bool { return i%3 == 1 }}
+
+			for i := 0; i < 9; i++ {
+				if err := client.SendPayload(lossy, []byte{byte(i)}); err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+				if i == 4 {
+					clientConn.Write([]byte("garbage datagram"))
+				}
+			}
+
+			serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for i := 0; i < 9; i++ {
+				if i%3 == 1 {
+					continue
+				}
+				frame, err := server.Receive(serverConn)
+				if err != nil {
+					t.Fatalf("receive %d: %v", i, err)
+				}
+				if !bytes.Equal(frame.Payload, []byte{byte(i)}) {
+					t.Fatalf("expected frame %d, got %v", i, frame.Payload)
+				}
+			}
+		})
+	}
+}
+
+// TestHandshakeRetransmit 测试握手消息丢失后的重传与会话建立后的应答重放
+func TestHandshakeRetransmit(t *testing.T) {
+	clientConn, serverConn := udpPair(t, []byte("open"))
+	// 双方的第一个握手消息都会丢失
+	clientHS := NewHandshakeConn(&lossyConn{Conn: clientConn, drop: func(i int) bool { return i == 0 }})
+	serverHS := NewHandshakeConn(&lossyConn{Conn: serverConn, drop: func(i int) bool { return i == 0 }})
+	client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, crypto.ObfsConfig{})
+
+	type result struct {
+		frame *Frame
+		err   error
+	}
+	serverDone := make(chan result, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := serverHS.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			serverDone <- result{err: fmt.Errorf("server read %q: %v", buf[:n], err)}
+			return
+		}
+		// 最后一条握手应答丢失，由会话阶段的重放补发
+		serverHS.Write([]byte("world"))
+		server.SetHandshakeReplay(serverHS)
+		frame, err := server.Receive(serverConn)
+		serverDone <- result{frame, err}
+	}()
+
+	clientHS.SetDeadline(time.Now().Add(10 * time.Second))
+	clientHS.Write([]byte("hello"))
+	buf := make([]byte, 64)
+	n, err := clientHS.Read(buf)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("client read %q: %v", buf[:n], err)
+	}
+	clientHS.SetDeadline(time.Time{})
+
+	if err := client.SendPayload(clientConn, []byte("tunnel")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	res := <-serverDone
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if !bytes.Equal(res.frame.Payload, []byte("tunnel")) {
+		t.Fatalf("unexpected payload %q", res.frame.Payload)
+	}
+}
+
+// recordConn 记录写入的数据报而不发送
+type recordConn struct {
+	net.Conn
+	packets [][]byte
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.packets = append(c.packets, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (c *recordConn) Datagram() bool { return true }
+
+// TestDatagramReorderWithinWindow 测试窗口内乱序帧被接受而重复帧被拒绝
+func TestDatagramReorderWithinWindow(t *testing.T) {
+	client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, crypto.ObfsConfig{})
+	clientConn, serverConn := udpPair(t, []byte("open"))
+
+	recorder := &recordConn{Conn: clientConn}
+	for i := 0; i < 6; i++ {
+		if err := client.SendPayload(recorder, []byte{byte(i)}); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	// 逆序投递，并重放第 5 帧
+	order := []int{5, 3, 4, 5, 0, 2, 1}
+	for _, i := range order {
+		clientConn.Write(recorder.packets[i])
+	}
+
+	serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []int{5, 3, 4, 0, 2, 1} {
+		frame, err := server.Receive(serverConn)
+		if err != nil {
+			t.Fatalf("receive %d: %v", want, err)
+		}
+		if !bytes.Equal(frame.Payload, []byte{byte(want)}) {
+			t.Fatalf("expected frame %d, got %v", want, frame.Payload)
+		}
+	}
+
+	stats := server.ReplayStats()
+	if stats.Rejected != 1 || stats.Accepted != 6 || stats.WindowBase != 5 {
+		t.Fatalf("unexpected replay stats %+v", stats)
+	}
+}
+
+// TestConnectionIDPerFrame 测试连接ID逐帧变化、计数器字段被掩码，二者都不能用来关联会话的流量
+func TestConnectionIDPerFrame(t *testing.T) {
+	modes := []crypto.ObfsConfig{
+		{Datagram: true},
+		{Mode: crypto.ObfsModeXOR, Datagram: true},
+	}
+	for _, obfs := range modes {
+		t.Run(obfs.Mode.String(), func(t *testing.T) {
+			client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, obfs)
+			clientConn, serverConn := udpPair(t, []byte("open"))
+
+			recorder := &recordConn{Conn: clientConn}
+			for i := 0; i < 2; i++ {
+				if err := client.SendPayload(recorder, []byte{byte(i)}); err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+			}
+			offset := recordHeaderSize + frameHeaderSize
+			if obfuscator := client.obfuscator(); obfuscator != nil {
+				offset = obfuscator.DatagramNonceOffset()
+			}
+			first := recorder.packets[0][offset : offset+connectionIDSize]
+			second := recorder.packets[1][offset : offset+connectionIDSize]
+			if bytes.Equal(first, second) {
+				t.Fatalf("consecutive frames share connection ID %x", first)
+			}
+			// 计数器字段经过掩码，不随帧递增
+			if client.obfuscator() == nil {
+				counters := recordHeaderSize + 2
+				a := binary.BigEndian.Uint64(recorder.packets[0][counters:])
+				b := binary.BigEndian.Uint64(recorder.packets[1][counters:])
+				if a == 0 && b == 1 {
+					t.Fatal("counter field sent in the clear")
+				}
+			}
+
+			serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for i, packet := range recorder.packets {
+				clientConn.Write(packet)
+				frame, err := server.Receive(serverConn)
+				if err != nil || !bytes.Equal(frame.Payload, []byte{byte(i)}) {
+					t.Fatalf("frame %d: %v %v", i, frame, err)
+				}
+			}
+		})
+	}
+}
+
+// TestRekeyKeepsPreviousEpoch 测试换钥后上一纪元的在途帧仍可解密
+func TestRekeyKeepsPreviousEpoch(t *testing.T) {
+	client, server := sessionPair(t, crypto.CipherSuiteChaCha20Poly1305, crypto.ObfsConfig{})
+	clientConn, serverConn := udpPair(t, []byte("open"))
+
+	// 换钥前发出但尚未到达的帧
+	recorder := &recordConn{Conn: clientConn}
+	for i := 0; i < 2; i++ {
+		if err := client.SendPayload(recorder, []byte{byte(i)}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	sendKey := make([]byte, crypto.KeySize)
+	recvKey := make([]byte, crypto.KeySize)
+	obfsKey := make([]byte, 32)
+	rand.Read(sendKey)
+	rand.Read(recvKey)
+	rand.Read(obfsKey)
+	if err := client.UpdateSessionKeys(crypto.SessionSecrets{SendKey: sendKey, ReceiveKey: recvKey, ObfuscationKey: obfsKey, Epoch: 2}, 0); err != nil {
+		t.Fatalf("client rekey: %v", err)
+	}
+	if err := server.UpdateSessionKeys(crypto.SessionSecrets{SendKey: recvKey, ReceiveKey: sendKey, ObfuscationKey: obfsKey, Epoch: 2}, 0); err != nil {
+		t.Fatalf("server rekey: %v", err)
+	}
+	if err := client.SendPayload(recorder, []byte{2}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// 新纪元的帧先到，旧纪元的帧随后到达
+	for _, i := range []int{2, 0, 1} {
+		clientConn.Write(recorder.packets[i])
+	}
+	serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []int{2, 0, 1} {
+		frame, err := server.Receive(serverConn)
+		if err != nil {
+			t.Fatalf("receive %d: %v", want, err)
+		}
+		if !bytes.Equal(frame.Payload, []byte{byte(want)}) {
+			t.Fatalf("expected frame %d, got %v", want, frame.Payload)
+		}
+	}
+
+	// 宽限期结束后旧纪元的帧被拒绝
+	server.session.previous.expires = time.Now().Add(-time.Second)
+	if _, err := server.openFrame(recorder.packets[0][recordHeaderSize:]); err == nil {
+		t.Fatal("frame of expired epoch accepted")
+	}
+	if stats := server.ReplayStats(); stats.Accepted != 3 {
+		t.Fatalf("expected 3 accepted frames across epochs, got %d", stats.Accepted)
+	}
+}
+
+// selfSignedTLS 生成用于wss测试的自签名证书
+func selfSignedTLS(t *testing.T, host string) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, roots
+}
+
+// TestWebSocketTransport 测试ws和wss端点上的帧收发
+func TestWebSocketTransport(t *testing.T) {
+	serverTLS, roots := selfSignedTLS(t, "cdn.example.com")
+	for _, scheme := range []string{"ws", "wss"} {
+		t.Run(scheme, func(t *testing.T) {
+			ln, err := ListenWebSocket(scheme+"://127.0.0.1:0/tunnel", WebSocketOptions{TLSConfig: serverTLS})
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer ln.Close()
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				accepted <- conn
+			}()
+
+			// 通过IP拨号，用Host指定源站域名（与CDN前置时相同）
+			opts := WebSocketOptions{Host: "cdn.example.com", TLSConfig: &tls.Config{RootCAs: roots}}
+			clientConn, err := DialWebSocket(scheme+"://"+ln.Addr().String()+"/tunnel", opts)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer clientConn.Close()
+			serverConn, ok := <-accepted
+			if !ok {
+				t.Fatal("accept failed")
+			}
+			defer serverConn.Close()
+
+			client, server := sessionPair(t, 0, crypto.ObfsConfig{})
+			payload := bytes.Repeat([]byte("cdn"), 2000)
+			for i := 0; i < 3; i++ {
+				if err := client.SendPayload(clientConn, payload); err != nil {
+					t.Fatalf("send: %v", err)
+				}
+				frame, err := server.Receive(serverConn)
+				if err != nil {
+					t.Fatalf("receive: %v", err)
+				}
+				if !bytes.Equal(frame.Payload, payload) {
+					t.Fatalf("payload mismatch in frame %d", i)
+				}
+			}
+			if err := server.SendKeepAlive(serverConn); err != nil {
+				t.Fatalf("server send: %v", err)
+			}
+			if frame, err := client.Receive(clientConn); err != nil || frame.Flags != FlagKeepAlive {
+				t.Fatalf("client receive: %v %+v", err, frame)
+			}
+		})
+	}
+
+	// 错误路径的升级请求被拒绝
+	ln, err := ListenWebSocket("ws://127.0.0.1:0/tunnel", WebSocketOptions{})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	if _, err := DialWebSocket("ws://"+ln.Addr().String()+"/other", WebSocketOptions{}); err == nil {
+		t.Fatal("dial to wrong path succeeded")
+	}
+	if _, err := ListenWebSocket("wss://127.0.0.1:0/", WebSocketOptions{}); err == nil {
+		t.Fatal("wss listener without certificate accepted")
+	}
+}
+
+func TestMultiplexerStreams(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewMultiplexer(a, true)
+	server := NewMultiplexer(b, false)
+	defer client.Close()
+	defer server.Close()
+
+	// 打开流不会因写帧重入锁而死锁
+	opened := make(chan *Stream, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Errorf("open: %v", err)
+				return
+			}
+			opened <- stream
+		}
+	}()
+	var accepted []*Stream
+	for i := 0; i < 2; i++ {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		accepted = append(accepted, stream)
+	}
+	first, second := <-opened, <-opened
+	if first.id%2 != 1 || second.id%2 != 1 {
+		t.Fatalf("client stream ids must be odd: %d %d", first.id, second.id)
+	}
+
+	// 超过单帧大小的写入被拆分，短读不会丢失剩余数据
+	payload := bytes.Repeat([]byte("mux"), maxFrameSize)
+	go func() {
+		first.Write(payload)
+		first.Close()
+	}()
+	var got []byte
+	buf := make([]byte, 1000)
+	for {
+		n, err := accepted[0].Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(payload))
+	}
+
+	// 另一条流不受影响，读超时生效
+	if _, err := second.Write([]byte("second")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(accepted[1], buf[:6]); err != nil || string(buf[:6]) != "second" {
+		t.Fatalf("second stream: %q %v", buf[:6], err)
+	}
+	accepted[1].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := accepted[1].Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if n := client.NumStreams(); n != 1 {
+		t.Fatalf("expected 1 open client stream, got %d", n)
+	}
+}
+
+func TestMultiplexerFlowControl(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewMultiplexer(a, true)
+	server := NewMultiplexer(b, false)
+	defer client.Close()
+	defer server.Close()
+
+	open := func() (*Stream, *Stream) {
+		t.Helper()
+		local, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		remote, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		return local, remote
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// 接收方不读时，发送方在流窗口用尽后阻塞，缓冲不会无限增长
+	bulk, bulkRemote := open()
+	payload := bytes.Repeat([]byte{0x5a}, 4*streamWindowSize)
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := bulk.Write(payload)
+		wrote <- err
+	}()
+	waitFor("window exhausted", func() bool { return bulk.Stats().SendWindow == 0 })
+	if got := bulkRemote.Stats().Buffered; got != streamWindowSize {
+		t.Fatalf("buffered %d bytes, want %d", got, streamWindowSize)
+	}
+	select {
+	case <-wrote:
+		t.Fatal("write finished without credit")
+	default:
+	}
+
+	// 其他流不受阻塞流影响
+	chat, chatRemote := open()
+	if err := chat.SetPriority(PriorityHigh); err != nil {
+		t.Fatalf("priority: %v", err)
+	}
+	if _, err := chat.Write([]byte("interactive")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 32*1024)
+	chatRemote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := chatRemote.Read(buf); err != nil || string(buf[:n]) != "interactive" {
+		t.Fatalf("interactive stream: %q %v", buf[:n], err)
+	}
+	waitFor("priority announced", func() bool { return chatRemote.Stats().Priority == PriorityHigh })
+
+	// 读取后归还额度，写入完成
+	received := 0
+	for received < len(payload) {
+		n, err := bulkRemote.Read(buf)
+		if err != nil {
+			t.Fatalf("read bulk: %v", err)
+		}
+		received += n
+	}
+	if err := <-wrote; err != nil {
+		t.Fatalf("bulk write: %v", err)
+	}
+
+	// 半关闭：对端读到 EOF，但仍可反向写入
+	if err := chat.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	if _, err := chatRemote.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF after CloseWrite, got %v", err)
+	}
+	if _, err := chat.Write([]byte("more")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	if _, err := chatRemote.Write([]byte("reply")); err != nil {
+		t.Fatalf("write back: %v", err)
+	}
+	chat.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := chat.Read(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("reply after half-close: %q %v", buf[:n], err)
+	}
+
+	stats := server.Stats()
+	if len(stats.Streams) != 2 || stats.Buffered != 0 {
+		t.Fatalf("unexpected server stats %+v", stats)
+	}
+}
+
+// TestStreamWriteDeadline 测试对端不读时，写入在截止时间后返回而不是一直阻塞
+func TestStreamWriteDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewMultiplexer(a, true)
+	server := NewMultiplexer(b, false)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	payload := make([]byte, 2*streamWindowSize)
+	stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	n, err := stream.Write(payload)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if n != streamWindowSize {
+		t.Fatalf("wrote %d bytes before the deadline, want %d", n, streamWindowSize)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("write returned after %v", elapsed)
+	}
+
+	// 等待中的写入也遵循随后设置的截止时间
+	wrote := make(chan error, 1)
+	stream.SetWriteDeadline(time.Time{})
+	go func() {
+		_, err := stream.Write(payload)
+		wrote <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stream.SetWriteDeadline(time.Now())
+	select {
+	case err := <-wrote:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending write ignored the new deadline")
+	}
+}
+
+// TestMultiplexerRejectsBadOpen 测试重复或奇偶性不符的打开帧被关闭帧拒绝且不覆盖已有的流
+func TestMultiplexerRejectsBadOpen(t *testing.T) {
+	peer, b := net.Pipe()
+	server := NewMultiplexer(b, false)
+	defer server.Close()
+	defer peer.Close()
+
+	frame := func(frameType byte, id StreamID) []byte {
+		f := make([]byte, muxFrameHeaderSize)
+		f[0] = frameType
+		putUint32(f[1:], uint32(id))
+		return f
+	}
+	expectClose := func(id StreamID) {
+		t.Helper()
+		header := make([]byte, muxFrameHeaderSize)
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(peer, header); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if header[0] != frameTypeClose || StreamID(getUint32(header[1:])) != id {
+			t.Fatalf("expected close of stream %d, got frame %x", id, header)
+		}
+	}
+
+	if _, err := peer.Write(frame(frameTypeOpen, 1)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	// 已在使用的ID
+	if _, err := peer.Write(frame(frameTypeOpen, 1)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectClose(1)
+	if server.stream(1) != stream {
+		t.Fatal("open of an in-use id replaced the stream")
+	}
+
+	// 服务器自己的偶数ID和保留的0
+	for _, id := range []StreamID{2, 0} {
+		if _, err := peer.Write(frame(frameTypeOpen, id)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		expectClose(id)
+	}
+	if n := server.NumStreams(); n != 1 {
+		t.Fatalf("expected 1 stream, got %d", n)
+	}
+}
+
+func TestWriteSchedulerPriority(t *testing.T) {
+	var w writeScheduler
+	w.acquire(PriorityNormal)
+
+	// 连接被占用时，排队的写入按优先级依次获得连接
+	order := make(chan Priority, 3)
+	var wg sync.WaitGroup
+	for _, prio := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		wg.Add(1)
+		go func(prio Priority) {
+			defer wg.Done()
+			w.acquire(prio)
+			order <- prio
+			w.release()
+		}(prio)
+		// 等待该写入进入队列
+		for {
+			w.mu.Lock()
+			queued := len(w.waiting[prio])
+			w.mu.Unlock()
+			if queued == 1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	w.release()
+	wg.Wait()
+	close(order)
+	var got []Priority
+	for prio := range order {
+		got = append(got, prio)
+	}
+	if len(got) != 3 || got[0] != PriorityHigh || got[1] != PriorityNormal || got[2] != PriorityLow {
+		t.Fatalf("unexpected write order %v", got)
+	}
+}
@@ -1,14 +1,80 @@
 package transport
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
+	"net/url"
 )
 
-func DialWebSocket(endpoint string) (net.Conn, error) {
-	return nil, errors.New("websocket transport not implemented")
+// WebSocketOptions configures ws:// and wss:// connections. Behind a CDN the
+// client dials an edge address and names the origin in Host, which is sent
+// as the Host header and used as the TLS server name.
+type WebSocketOptions struct {
+	Path      string      // request path when the endpoint has none, default "/"
+	Host      string      // Host header and TLS server name
+	TLSConfig *tls.Config // wss only; a listener needs a certificate
 }
 
-func ListenWebSocket(endpoint string) (Listener, error) {
-	return nil, errors.New("websocket transport not implemented")
+// DialWebSocket connects to a ws:// or wss:// endpoint through the CDN
+// transport. Each frame travels as one binary WebSocket message.
+func DialWebSocket(endpoint string, opts WebSocketOptions) (net.Conn, error) {
+	cfg, address, err := webSocketConfig(endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+	conn := NewCDNTransport(cfg)
+	if err := conn.Dial(address); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenWebSocket accepts WebSocket upgrades on the endpoint's path
+func ListenWebSocket(endpoint string, opts WebSocketOptions) (Listener, error) {
+	cfg, address, err := webSocketConfig(endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mode == CDNModeWebSocketTLS {
+		if cfg.TLSConfig == nil || (len(cfg.TLSConfig.Certificates) == 0 && cfg.TLSConfig.GetCertificate == nil) {
+			return nil, errors.New("wss listener requires a TLS certificate")
+		}
+	}
+	return NewCDNListener(cfg, address)
+}
+
+func webSocketConfig(endpoint string, opts WebSocketOptions) (CDNConfig, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return CDNConfig{}, "", fmt.Errorf("invalid websocket endpoint: %w", err)
+	}
+	var mode CDNMode
+	switch u.Scheme {
+	case "ws":
+		mode = CDNModeWebSocket
+	case "wss":
+		mode = CDNModeWebSocketTLS
+	default:
+		return CDNConfig{}, "", fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+
+	path := u.Path
+	if path == "" {
+		path = opts.Path
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	cfg := DefaultCDNConfig(opts.Host, path)
+	cfg.Mode = mode
+	if opts.TLSConfig != nil {
+		cfg.TLSConfig = opts.TLSConfig.Clone()
+		if cfg.TLSConfig.ServerName == "" {
+			cfg.TLSConfig.ServerName = opts.Host
+		}
+	}
+	return cfg, u.Host, nil
 }
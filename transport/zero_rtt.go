@@ -4,11 +4,19 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"stp/crypto"
 )
 
+// ErrTicketUnknown 票据不存在（服务器重启或票据已被清理）
+var ErrTicketUnknown = errors.New("unknown session ticket")
+
 // SessionTicket 会话票据（类似QUIC的session ticket）
 type SessionTicket struct {
 	ID              [16]byte  // 票据ID
@@ -18,6 +26,8 @@ type SessionTicket struct {
 	ExpiresAt       time.Time // 过期时间
 	UsageCount      int       // 使用次数
 	MaxUsage        int       // 最大使用次数
+
+	Params crypto.NegotiatedParams // 恢复时沿用的协商参数
 }
 
 // ZeroRTTConfig 0-RTT配置
@@ -97,6 +107,11 @@ func (zrm *ZeroRTTManager) Stop() {
 
 // IssueTicket 签发新票据（服务器端）
 func (zrm *ZeroRTTManager) IssueTicket(peerAddr string, sessionKey []byte, remotePubKey [32]byte) (*SessionTicket, error) {
+	return zrm.IssueResumptionTicket(peerAddr, sessionKey, remotePubKey, crypto.NegotiatedParams{})
+}
+
+// IssueResumptionTicket 签发携带协商参数的票据，恢复的会话沿用这些参数
+func (zrm *ZeroRTTManager) IssueResumptionTicket(peerAddr string, sessionKey []byte, remotePubKey [32]byte, params crypto.NegotiatedParams) (*SessionTicket, error) {
 	if !zrm.config.Enabled {
 		return nil, fmt.Errorf("0-RTT not enabled")
 	}
@@ -120,6 +135,7 @@ func (zrm *ZeroRTTManager) IssueTicket(peerAddr string, sessionKey []byte, remot
 		ExpiresAt:       now.Add(zrm.config.TicketLifetime),
 		UsageCount:      0,
 		MaxUsage:        zrm.config.MaxTicketUsage,
+		Params:          params,
 	}
 	copy(ticket.SessionKey, sessionKey)
 
@@ -256,6 +272,136 @@ func (zrm *ZeroRTTManager) RemoveTicket(peerAddr string, ticketID [16]byte) {
 	zrm.tickets[peerAddr] = filtered
 }
 
+// RedeemTicket 兑换票据（服务器端）
+// 只接受服务器自己签发的票据，并且每个票据只能兑换一次：0-RTT数据
+// 可以被重放，所以即使在重试窗口内重复出现的票据也会被拒绝。
+// 返回票据及其所属的对等点。
+func (zrm *ZeroRTTManager) RedeemTicket(id [16]byte) (*SessionTicket, string, error) {
+	if !zrm.config.Enabled {
+		return nil, "", fmt.Errorf("0-RTT not enabled")
+	}
+
+	zrm.mu.Lock()
+	defer zrm.mu.Unlock()
+
+	now := time.Now()
+	if _, used := zrm.usedTickets[id]; used {
+		zrm.zeroRTTFailed++
+		return nil, "", fmt.Errorf("ticket replay detected")
+	}
+
+	for peerAddr, tickets := range zrm.tickets {
+		for i, ticket := range tickets {
+			if ticket.ID != id {
+				continue
+			}
+
+			// 无论成功与否，票据都被消耗
+			zrm.tickets[peerAddr] = append(tickets[:i:i], tickets[i+1:]...)
+			zrm.usedTickets[id] = now
+
+			if ticket.ExpiresAt.Before(now) {
+				zrm.zeroRTTFailed++
+				return nil, "", fmt.Errorf("ticket expired")
+			}
+			ticket.UsageCount++
+			zrm.ticketsUsed++
+			zrm.zeroRTTSuccess++
+			return ticket, peerAddr, nil
+		}
+	}
+
+	zrm.zeroRTTFailed++
+	return nil, "", ErrTicketUnknown
+}
+
+// ForgetPeer 删除对等点的所有票据（例如对等点被吊销时）
+func (zrm *ZeroRTTManager) ForgetPeer(peerAddr string) int {
+	zrm.mu.Lock()
+	defer zrm.mu.Unlock()
+
+	count := len(zrm.tickets[peerAddr])
+	delete(zrm.tickets, peerAddr)
+	return count
+}
+
+// SaveTickets 将票据写入文件（客户端持久化）
+// 文件包含会话密钥，因此仅对所有者可读。
+func (zrm *ZeroRTTManager) SaveTickets(path string) error {
+	zrm.mu.RLock()
+	buf := make([]byte, 0, 1024)
+	now := time.Now()
+	for peerAddr, tickets := range zrm.tickets {
+		for _, ticket := range tickets {
+			if ticket.ExpiresAt.Before(now) {
+				continue
+			}
+			data := SerializeTicket(ticket)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(peerAddr)))
+			buf = append(buf, peerAddr...)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+			buf = append(buf, data...)
+		}
+	}
+	zrm.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create ticket file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write ticket file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadTickets 从文件读取票据。文件不存在时不报错。
+func (zrm *ZeroRTTManager) LoadTickets(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return fmt.Errorf("ticket file truncated")
+		}
+		peerLen := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+peerLen+2 {
+			return fmt.Errorf("ticket file truncated")
+		}
+		peerAddr := string(data[2 : 2+peerLen])
+		data = data[2+peerLen:]
+		ticketLen := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+ticketLen {
+			return fmt.Errorf("ticket file truncated")
+		}
+		ticket, err := DeserializeTicket(data[2 : 2+ticketLen])
+		if err != nil {
+			return err
+		}
+		data = data[2+ticketLen:]
+
+		if ticket.ExpiresAt.After(now) {
+			zrm.StoreTicket(peerAddr, ticket)
+		}
+	}
+	return nil
+}
+
 // GetStats 获取统计信息
 func (zrm *ZeroRTTManager) GetStats() ZeroRTTStats {
 	zrm.mu.RLock()
@@ -372,6 +518,11 @@ func SerializeTicket(ticket *SessionTicket) []byte {
 	binary.BigEndian.PutUint16(maxUsageBuf, uint16(ticket.MaxUsage))
 	buf = append(buf, maxUsageBuf...)
 
+	// 协商参数：版本(1) + 密码套件(2) + 特性(4)
+	buf = append(buf, uint8(ticket.Params.Version))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(ticket.Params.CipherSuite))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(ticket.Params.Features))
+
 	// 添加校验和
 	checksum := sha256.Sum256(buf)
 	buf = append(buf, checksum[:4]...)
@@ -381,7 +532,9 @@ func SerializeTicket(ticket *SessionTicket) []byte {
 
 // DeserializeTicket 反序列化票据
 func DeserializeTicket(data []byte) (*SessionTicket, error) {
-	if len(data) < 80 { // 最小长度检查
+	// 固定字段：公钥(32) + 时间(16) + 次数(4) + 协商参数(7) + 校验和(4)
+	const fixedTail = 32 + 16 + 4 + 7 + 4
+	if len(data) < 16+2+fixedTail { // 最小长度检查
 		return nil, fmt.Errorf("ticket data too short")
 	}
 
@@ -396,7 +549,7 @@ func DeserializeTicket(data []byte) (*SessionTicket, error) {
 	keyLen := binary.BigEndian.Uint16(data[offset : offset+2])
 	offset += 2
 
-	if len(data) < offset+int(keyLen)+4 {
+	if len(data) < offset+int(keyLen)+fixedTail {
 		return nil, fmt.Errorf("invalid ticket data")
 	}
 
@@ -426,6 +579,12 @@ func DeserializeTicket(data []byte) (*SessionTicket, error) {
 	ticket.MaxUsage = int(binary.BigEndian.Uint16(data[offset : offset+2]))
 	offset += 2
 
+	// 协商参数
+	ticket.Params.Version = crypto.ProtocolVersion(data[offset])
+	ticket.Params.CipherSuite = crypto.CipherSuite(binary.BigEndian.Uint16(data[offset+1 : offset+3]))
+	ticket.Params.Features = crypto.FeatureFlags(binary.BigEndian.Uint32(data[offset+3 : offset+7]))
+	offset += 7
+
 	// 验证校验和
 	expectedChecksum := data[offset : offset+4]
 	actualChecksum := sha256.Sum256(data[:offset])
@@ -439,6 +598,38 @@ func DeserializeTicket(data []byte) (*SessionTicket, error) {
 	return ticket, nil
 }
 
+// EncodeNewTicket 编码发送给客户端的票据通知
+// 格式：票据ID(16) + 签发时的密钥轮次(4) + 有效期秒数(4) + 最大使用次数(2)。
+// 会话密钥不在线路上传输，客户端从当前会话密钥自行派生。
+func EncodeNewTicket(ticket *SessionTicket, epoch uint32) []byte {
+	buf := make([]byte, 0, 26)
+	buf = append(buf, ticket.ID[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, epoch)
+	lifetime := time.Until(ticket.ExpiresAt) / time.Second
+	if lifetime < 0 {
+		lifetime = 0
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(lifetime))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(ticket.MaxUsage))
+	return buf
+}
+
+// DecodeNewTicket 解码票据通知，返回不含会话密钥的票据和签发轮次
+// 过期时间按本地时钟计算，避免受两端时钟偏差影响。
+func DecodeNewTicket(payload []byte) (*SessionTicket, uint32, error) {
+	if len(payload) != 26 {
+		return nil, 0, fmt.Errorf("invalid ticket announcement length %d", len(payload))
+	}
+	ticket := &SessionTicket{}
+	copy(ticket.ID[:], payload[:16])
+	epoch := binary.BigEndian.Uint32(payload[16:20])
+	lifetime := time.Duration(binary.BigEndian.Uint32(payload[20:24])) * time.Second
+	ticket.MaxUsage = int(binary.BigEndian.Uint16(payload[24:26]))
+	ticket.IssuedAt = time.Now()
+	ticket.ExpiresAt = ticket.IssuedAt.Add(lifetime)
+	return ticket, epoch, nil
+}
+
 // ZeroRTTData 0-RTT数据包
 type ZeroRTTData struct {
 	Ticket  *SessionTicket